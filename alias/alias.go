@@ -3,8 +3,10 @@ package alias
 import (
 	"bytes"
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
 
 	"github.com/BurntSushi/toml"
@@ -13,43 +15,161 @@ import (
 
 // Alias holds all attributes required to start a ssh port forwarding tunnel.
 type Alias struct {
-	Name              string   `toml:"name"`
-	TunnelType        string   `toml:"type"`
-	Verbose           bool     `toml:"verbose"`
-	Insecure          bool     `toml:"insecure"`
-	Detach            bool     `toml:"detach"`
-	Source            []string `toml:"source"`
-	Destination       []string `toml:"destination"`
-	Server            string   `toml:"server"`
-	Key               string   `toml:"key"`
-	KeepAliveInterval string   `toml:"keep-alive-interval"`
-	ConnectionRetries int      `toml:"connection-retries"`
-	WaitAndRetry      string   `toml:"wait-and-retry"`
-	SshAgent          string   `toml:"ssh-agent"`
-	Timeout           string   `toml:"timeout"`
-	SshConfig         string   `toml:"config"`
-	Rpc               bool     `toml:"rpc"`
-	RpcAddress        string   `toml:"rpc-address"`
+	Name                  string   `toml:"name"`
+	TunnelType            string   `toml:"type"`
+	Verbose               bool     `toml:"verbose"`
+	Insecure              bool     `toml:"insecure"`
+	Strict                bool     `toml:"strict"`
+	Detach                bool     `toml:"detach"`
+	SyncLog               bool     `toml:"sync-log"`
+	StickyPorts           bool     `toml:"sticky-ports"`
+	Source                []string `toml:"source"`
+	Destination           []string `toml:"destination"`
+	DestinationCommand    string   `toml:"destination-command"`
+	ManifestCommand       string   `toml:"manifest-command"`
+	QuietSource           []string `toml:"quiet-source"`
+	HTTPError             []string `toml:"http-error"`
+	AllowCidr             []string `toml:"allow-cidr"`
+	Prewarm               []string `toml:"prewarm"`
+	RemoteTLS             []string `toml:"remote-tls"`
+	LocalTLSCert          []string `toml:"local-tls-cert"`
+	LocalTLSKey           []string `toml:"local-tls-key"`
+	Via                   []string `toml:"via"`
+	DialSource            []string `toml:"dial-source"`
+	Protocol              []string `toml:"protocol"`
+	Server                string   `toml:"server"`
+	FallbackServer        []string `toml:"fallback-server"`
+	Jump                  []string `toml:"jump"`
+	User                  string   `toml:"user"`
+	Port                  string   `toml:"port"`
+	Interface             string   `toml:"interface"`
+	Key                   string   `toml:"key"`
+	KeyEnv                string   `toml:"key-env"`
+	IdentitiesOnly        bool     `toml:"identities-only"`
+	NoDefaultKey          bool     `toml:"no-default-key"`
+	Netrc                 bool     `toml:"netrc"`
+	InteractiveAuth       bool     `toml:"interactive-auth"`
+	PassphraseAttempts    int      `toml:"passphrase-attempts"`
+	UseKeychain           bool     `toml:"use-keychain"`
+	RSASigAlgorithms      []string `toml:"rsa-signature-algorithms"`
+	KnownHosts            []string `toml:"known-hosts"`
+	KeepAliveInterval     string   `toml:"keep-alive-interval"`
+	KeepAliveData         bool     `toml:"keep-alive-data"`
+	KeepAliveIdleOnly     bool     `toml:"keep-alive-idle-only"`
+	KeepAliveInitialDelay string   `toml:"keep-alive-initial-delay"`
+	ConnectionRetries     int      `toml:"connection-retries"`
+	MaxReconnects         int      `toml:"max-reconnects"`
+	MaxPendingOpens       int      `toml:"max-pending-opens"`
+	MaxChannels           int      `toml:"max-channels"`
+	WaitAndRetry          string   `toml:"wait-and-retry"`
+	StablePeriod          string   `toml:"stable-connection-period"`
+	Supervise             string   `toml:"supervise"`
+	LogRateLimit          string   `toml:"log-rate-limit"`
+	WaitForRemote         string   `toml:"wait-for-remote"`
+	NetworkCheckInterval  string   `toml:"network-check-interval"`
+	SshAgent              string   `toml:"ssh-agent"`
+	HostAlias             []string `toml:"host-alias"`
+	Timeout               string   `toml:"timeout"`
+	DnsTimeout            string   `toml:"dns-timeout"`
+	RemoteDialTimeout     string   `toml:"remote-dial-timeout"`
+	MigrationTimeout      string   `toml:"migration-timeout"`
+	InitialReadTimeout    string   `toml:"initial-read-timeout"`
+	DrainTimeout          string   `toml:"drain-timeout"`
+	HalfClose             bool     `toml:"half-close"`
+	Trace                 bool     `toml:"trace"`
+	TraceLimit            int      `toml:"trace-limit"`
+	ExposureCheck         string   `toml:"exposure-check"`
+	SensitivePorts        []string `toml:"sensitive-ports"`
+	EgressPolicy          string   `toml:"egress-policy"`
+	SshConfig             string   `toml:"config"`
+	Rpc                   bool     `toml:"rpc"`
+	RpcAddress            string   `toml:"rpc-address"`
+	ControlSocketMode     string   `toml:"control-socket-mode"`
+	EnvFile               string   `toml:"env-file"`
+	OnDisconnect          string   `toml:"on-disconnect"`
+	OnReconnect           string   `toml:"on-reconnect"`
+	ExecOnce              string   `toml:"exec-once"`
+	Pprof                 string   `toml:"pprof"`
+	LastSource            []string `toml:"last-source"`
 }
 
 // String parses a Alias object to a string representation.
 func (a Alias) String() string {
-	return fmt.Sprintf("[verbose: %t, insecure: %t, detach: %t, source: %s, destination: %s, server: %s, key: %s, keep-alive-interval: %s, connection-retries: %d, wait-and-retry: %s, ssh-agent: %s, timeout: %s, config: %s, rpc: %t, rpc-address: %s]",
+	return fmt.Sprintf("[verbose: %t, insecure: %t, strict: %t, detach: %t, sync-log: %t, sticky-ports: %t, source: %s, destination: %s, destination-command: %s, manifest-command: %s, quiet-source: %s, http-error: %s, allow-cidr: %s, prewarm: %s, remote-tls: %s, local-tls-cert: %s, local-tls-key: %s, via: %s, dial-source: %s, protocol: %s, server: %s, fallback-server: %s, jump: %s, user: %s, port: %s, interface: %s, key: %s, key-env: %s, identities-only: %t, no-default-key: %t, netrc: %t, interactive-auth: %t, passphrase-attempts: %d, use-keychain: %t, rsa-signature-algorithms: %s, known-hosts: %s, keep-alive-interval: %s, keep-alive-data: %t, keep-alive-idle-only: %t, keep-alive-initial-delay: %s, connection-retries: %d, max-reconnects: %d, max-pending-opens: %d, max-channels: %d, wait-and-retry: %s, stable-connection-period: %s, supervise: %s, log-rate-limit: %s, wait-for-remote: %s, network-check-interval: %s, ssh-agent: %s, host-alias: %s, timeout: %s, dns-timeout: %s, remote-dial-timeout: %s, migration-timeout: %s, initial-read-timeout: %s, drain-timeout: %s, half-close: %t, trace: %t, trace-limit: %d, exposure-check: %s, sensitive-ports: %s, egress-policy: %s, config: %s, rpc: %t, rpc-address: %s, control-socket-mode: %s, env-file: %s, on-disconnect: %s, on-reconnect: %s, exec-once: %s, pprof: %s, last-source: %s]",
 		a.Verbose,
 		a.Insecure,
+		a.Strict,
 		a.Detach,
+		a.SyncLog,
+		a.StickyPorts,
 		a.Source,
 		a.Destination,
+		a.DestinationCommand,
+		a.ManifestCommand,
+		a.QuietSource,
+		a.HTTPError,
+		a.AllowCidr,
+		a.Prewarm,
+		a.RemoteTLS,
+		a.LocalTLSCert,
+		a.LocalTLSKey,
+		a.Via,
+		a.DialSource,
+		a.Protocol,
 		a.Server,
+		a.FallbackServer,
+		a.Jump,
+		a.User,
+		a.Port,
+		a.Interface,
 		a.Key,
+		a.KeyEnv,
+		a.IdentitiesOnly,
+		a.NoDefaultKey,
+		a.Netrc,
+		a.InteractiveAuth,
+		a.PassphraseAttempts,
+		a.UseKeychain,
+		a.RSASigAlgorithms,
+		a.KnownHosts,
 		a.KeepAliveInterval,
+		a.KeepAliveData,
+		a.KeepAliveIdleOnly,
+		a.KeepAliveInitialDelay,
 		a.ConnectionRetries,
+		a.MaxReconnects,
+		a.MaxPendingOpens,
+		a.MaxChannels,
 		a.WaitAndRetry,
+		a.StablePeriod,
+		a.Supervise,
+		a.LogRateLimit,
+		a.WaitForRemote,
+		a.NetworkCheckInterval,
 		a.SshAgent,
+		a.HostAlias,
 		a.Timeout,
+		a.DnsTimeout,
+		a.RemoteDialTimeout,
+		a.MigrationTimeout,
+		a.InitialReadTimeout,
+		a.DrainTimeout,
+		a.HalfClose,
+		a.Trace,
+		a.TraceLimit,
+		a.ExposureCheck,
+		a.SensitivePorts,
+		a.EgressPolicy,
 		a.SshConfig,
 		a.Rpc,
 		a.RpcAddress,
+		a.ControlSocketMode,
+		a.EnvFile,
+		a.OnDisconnect,
+		a.OnReconnect,
+		a.ExecOnce,
+		a.Pprof,
+		a.LastSource,
 	)
 }
 
@@ -118,7 +238,7 @@ func Show(aliasName string) (string, error) {
 
 // ShowAll displays the configuration parameters for all persisted aliases.
 func ShowAll() (string, error) {
-	mp, err := fsutils.Dir()
+	all, err := GetAll()
 	if err != nil {
 		return "", err
 	}
@@ -126,7 +246,107 @@ func ShowAll() (string, error) {
 	aliases := aliases{}
 	aliases.Aliases = make(map[string]*Alias)
 
+	for _, al := range all {
+		aliases.Aliases[al.Name] = al
+	}
+
+	var buff bytes.Buffer
+
+	e := toml.NewEncoder(&buff)
+
+	if err = e.Encode(aliases); err != nil {
+		return "", err
+	}
+
+	return buff.String(), nil
+}
+
+// Export writes all persisted aliases to the given writer, in the same format
+// used by ShowAll, so they can be loaded back by Import (e.g. on the machine
+// of a teammate). Aliases never hold secrets, only the path of key files and
+// the name of environment variables, while the state kept for the local
+// machine (i.e. the last source addresses, see sticky ports) is left out.
+func Export(w io.Writer) error {
+	all, err := GetAll()
+	if err != nil {
+		return err
+	}
+
+	aliases := aliases{}
+	aliases.Aliases = make(map[string]*Alias)
+
+	for _, al := range all {
+		al.LastSource = nil
+		aliases.Aliases[al.Name] = al
+	}
+
+	return toml.NewEncoder(w).Encode(aliases)
+}
+
+// Import persists the aliases written by Export to the given reader, returning
+// the names of the ones imported and of the ones skipped, both sorted.
+//
+// An alias named after an existing one is only replaced if overwrite, called
+// with its name, returns true.
+func Import(r io.Reader, overwrite func(name string) (bool, error)) (imported, skipped []string, err error) {
+	aliases := aliases{}
+
+	if _, err := toml.DecodeReader(r, &aliases); err != nil {
+		return nil, nil, fmt.Errorf("invalid aliases: %v", err)
+	}
+
+	names := make([]string, 0, len(aliases.Aliases))
+	for name := range aliases.Aliases {
+		if name == "" || name != filepath.Base(name) || strings.HasPrefix(name, ".") {
+			return nil, nil, fmt.Errorf("invalid alias name %q", name)
+		}
+
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	for _, name := range names {
+		if _, err := Get(name); err == nil {
+			ok, err := overwrite(name)
+			if err != nil {
+				return imported, skipped, err
+			}
+
+			if !ok {
+				skipped = append(skipped, name)
+				continue
+			}
+		}
+
+		al := aliases.Aliases[name]
+		al.Name = name
+		al.LastSource = nil
+
+		if err := Add(al); err != nil {
+			return imported, skipped, fmt.Errorf("could not import alias %s: %v", name, err)
+		}
+
+		imported = append(imported, name)
+	}
+
+	return imported, skipped, nil
+}
+
+// GetAll returns all persisted aliases, sorted by name.
+func GetAll() ([]*Alias, error) {
+	mp, err := fsutils.Dir()
+	if err != nil {
+		return nil, err
+	}
+
+	var all []*Alias
+
 	err = filepath.Walk(mp, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
 		if !info.IsDir() {
 			ext := filepath.Ext(path)
 			if ext == ".toml" {
@@ -137,24 +357,18 @@ func ShowAll() (string, error) {
 					return err
 				}
 
-				aliases.Aliases[al.Name] = al
+				all = append(all, al)
 			}
 		}
 		return nil
 	})
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
-	var buff bytes.Buffer
-
-	e := toml.NewEncoder(&buff)
-
-	if err = e.Encode(aliases); err != nil {
-		return "", err
-	}
+	sort.Slice(all, func(i, j int) bool { return all[i].Name < all[j].Name })
 
-	return buff.String(), nil
+	return all, nil
 }
 
 // Get returns an alias previously created
@@ -1,12 +1,14 @@
 package alias_test
 
 import (
+	"bytes"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
 	"path/filepath"
 	"reflect"
+	"strings"
 	"testing"
 
 	"github.com/davrodpin/mole/alias"
@@ -97,6 +99,75 @@ func TestShowAll(t *testing.T) {
 	}
 }
 
+func TestGetAll(t *testing.T) {
+	expected := []string{"example", "test-env"}
+
+	all, err := alias.GetAll()
+	if err != nil {
+		t.Errorf("error retrieving all aliases: %v", err)
+	}
+
+	names := []string{}
+	for _, al := range all {
+		names = append(names, al.Name)
+	}
+
+	if !reflect.DeepEqual(expected, names) {
+		t.Errorf("expected: %s, actual: %s", expected, names)
+	}
+}
+
+func TestExportThenImport(t *testing.T) {
+	var exported bytes.Buffer
+
+	err := alias.Export(&exported)
+	if err != nil {
+		t.Fatalf("error exporting aliases: %v", err)
+	}
+
+	never := func(string) (bool, error) { return false, nil }
+
+	imported, skipped, err := alias.Import(&exported, never)
+	if err != nil {
+		t.Fatalf("error importing aliases: %v", err)
+	}
+
+	if len(imported) != 0 || !reflect.DeepEqual(skipped, []string{"example", "test-env"}) {
+		t.Errorf("existing aliases expected to be skipped: imported: %s, skipped: %s", imported, skipped)
+	}
+
+	input := `[aliases]
+  [aliases.shared]
+    type = "local"
+    destination = ["172.17.0.10:5432"]
+    server = "bastion"
+    last-source = ["127.0.0.1:40525"]
+`
+
+	imported, _, err = alias.Import(strings.NewReader(input), never)
+	if err != nil {
+		t.Fatalf("error importing aliases: %v", err)
+	}
+	defer alias.Delete("shared")
+
+	if !reflect.DeepEqual(imported, []string{"shared"}) {
+		t.Errorf("unexpected imported aliases: want: [shared], got: %s", imported)
+	}
+
+	al, err := alias.Get("shared")
+	if err != nil {
+		t.Fatalf("error reading imported alias: %v", err)
+	}
+
+	if al.Server != "bastion" || al.LastSource != nil {
+		t.Errorf("unexpected imported alias: %s", al)
+	}
+
+	if _, _, err := alias.Import(strings.NewReader("[aliases.\"../evil\"]\n"), never); err == nil {
+		t.Errorf("error expected importing an alias which name is a path")
+	}
+}
+
 func TestMain(m *testing.M) {
 	home, err := setup()
 	if err != nil {
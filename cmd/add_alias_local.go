@@ -49,5 +49,8 @@ func init() {
 		os.Exit(1)
 	}
 
+	addAliasLocalCmd.Flags().StringVarP(&conf.DestinationCommand, "destination-command", "", "", `command run on the ssh server to discover the destination addresses, one per line
+a channel is created for each address found, using the source addresses given in the same order`)
+
 	addAliasCmd.AddCommand(addAliasLocalCmd)
 }
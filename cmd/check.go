@@ -0,0 +1,16 @@
+package cmd
+
+import (
+	"github.com/spf13/cobra"
+)
+
+var checkCmd = &cobra.Command{
+	Use:   "check",
+	Short: "Checks ssh tunnel aliases are valid",
+	Args:  cobra.MinimumNArgs(1),
+	Run:   func(cmd *cobra.Command, arg []string) {},
+}
+
+func init() {
+	rootCmd.AddCommand(checkCmd)
+}
@@ -0,0 +1,60 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/davrodpin/mole/mole"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var checkAliasCmd = &cobra.Command{
+	Use:   "alias [name]",
+	Short: "Checks an alias is valid without starting its tunnel",
+	Long: `Checks an alias is valid without starting its tunnel
+
+The alias settings are parsed, the ssh server is resolved through the ssh config
+file and the addresses and options of every channel are validated, without
+connecting to the ssh server. Every problem found is reported and the command
+exits with a nonzero status if there is any, so it can be run on CI.
+`,
+	Args: func(cmd *cobra.Command, args []string) error {
+		if len(args) < 1 {
+			return errors.New("alias name not provided")
+		}
+
+		aliasName = args[0]
+
+		return nil
+	},
+	Run: func(cmd *cobra.Command, arg []string) {
+		// the problems are reported below, instead of through the logs of the
+		// tunnel creation.
+		log.SetOutput(ioutil.Discard)
+
+		problems, err := mole.CheckAlias(aliasName)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "could not check alias %s: %v\n", aliasName, err)
+			os.Exit(1)
+		}
+
+		if len(problems) == 0 {
+			fmt.Printf("alias %s is valid\n", aliasName)
+			return
+		}
+
+		for _, p := range problems {
+			fmt.Printf("alias %s: %v\n", aliasName, p)
+		}
+
+		os.Exit(1)
+	},
+}
+
+func init() {
+	checkCmd.AddCommand(checkAliasCmd)
+}
@@ -0,0 +1,16 @@
+package cmd
+
+import (
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	rootCmd.AddCommand(exportCmd)
+}
+
+var exportCmd = &cobra.Command{
+	Use:   "export",
+	Short: "Exports ssh tunnel aliases to be shared",
+	Args:  cobra.MinimumNArgs(1),
+	Run:   func(cmd *cobra.Command, arg []string) {},
+}
@@ -0,0 +1,33 @@
+package cmd
+
+import (
+	"os"
+
+	"github.com/davrodpin/mole/alias"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var exportAliasesCmd = &cobra.Command{
+	Use:   "aliases",
+	Short: "Exports all ssh tunnel aliases",
+	Long: `Exports all ssh tunnel aliases to the standard output, so they can be
+imported on another machine (e.g. by a teammate) with "mole import aliases".
+
+Aliases never hold secrets, only the path of key files and the name of
+environment variables, which must be valid on the machine the aliases are
+imported on.`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, arg []string) {
+		err := alias.Export(os.Stdout)
+		if err != nil {
+			log.WithError(err).Error("could not export aliases")
+			os.Exit(1)
+		}
+	},
+}
+
+func init() {
+	exportCmd.AddCommand(exportAliasesCmd)
+}
@@ -0,0 +1,48 @@
+package cmd
+
+import (
+	"errors"
+	"os"
+	"time"
+
+	"github.com/davrodpin/mole/mole"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var fingerprintCmd = &cobra.Command{
+	Use:   "fingerprint",
+	Short: "Shows the fingerprints of the ssh server host key",
+	Long: `Shows the SHA256 and MD5 fingerprints of the ssh server host key.
+
+mole connects to the ssh server just far enough to retrieve its host key,
+without verifying nor trusting it, so its fingerprints can be compared against
+the ones obtained out of band before the key is added to the known_hosts file.
+Unlike --insecure, no tunnel is ever started against an unverified server.`,
+	Args: func(cmd *cobra.Command, args []string) error {
+		if conf.Server.Host == "" {
+			return errors.New("server address not provided")
+		}
+
+		return nil
+	},
+	Run: func(cmd *cobra.Command, arg []string) {
+		err := mole.ShowFingerprint(conf)
+		if err != nil {
+			log.WithError(err).WithFields(log.Fields{
+				"server": conf.Server.String(),
+			}).Error("could not retrieve the ssh server host key")
+			os.Exit(1)
+		}
+	},
+}
+
+func init() {
+	fingerprintCmd.Flags().VarP(&conf.Server, "server", "s", "set server address: [<user>@]<host>[:<port>]")
+	fingerprintCmd.Flags().StringVarP(&conf.Port, "port", "p", "", "set server port, looked up on the ssh config file or 22 by default")
+	fingerprintCmd.Flags().StringVarP(&conf.SshConfig, "config", "c", "$HOME/.ssh/config", "set config file path")
+	fingerprintCmd.Flags().DurationVarP(&conf.Timeout, "timeout", "t", 3*time.Second, "ssh server connection timeout")
+	fingerprintCmd.Flags().BoolVarP(&conf.Strict, "strict", "", false, "only negotiate strong algorithms with the ssh server")
+	rootCmd.AddCommand(fingerprintCmd)
+}
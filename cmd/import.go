@@ -0,0 +1,16 @@
+package cmd
+
+import (
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	rootCmd.AddCommand(importCmd)
+}
+
+var importCmd = &cobra.Command{
+	Use:   "import",
+	Short: "Imports ssh tunnel aliases exported by mole",
+	Args:  cobra.MinimumNArgs(1),
+	Run:   func(cmd *cobra.Command, arg []string) {},
+}
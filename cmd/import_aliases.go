@@ -0,0 +1,116 @@
+package cmd
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/davrodpin/mole/alias"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"golang.org/x/crypto/ssh/terminal"
+)
+
+const (
+	conflictSkip      = "skip"
+	conflictOverwrite = "overwrite"
+	conflictPrompt    = "prompt"
+)
+
+var onConflict string
+
+var importAliasesCmd = &cobra.Command{
+	Use:   "aliases [file]",
+	Short: "Imports ssh tunnel aliases exported by \"mole export aliases\"",
+	Long: `Imports ssh tunnel aliases exported by "mole export aliases" from the given
+file or, if none or "-" is given, from the standard input.
+
+Aliases named after an existing one are handled according to --on-conflict:
+skipped, overwritten or, when prompting, only overwritten once confirmed.`,
+	Args: func(cmd *cobra.Command, args []string) error {
+		if len(args) > 1 {
+			return errors.New("only one file can be imported at a time")
+		}
+
+		switch onConflict {
+		case conflictSkip, conflictOverwrite, conflictPrompt:
+		default:
+			return fmt.Errorf("invalid --on-conflict %s: it must be either %s, %s or %s", onConflict, conflictSkip, conflictOverwrite, conflictPrompt)
+		}
+
+		return nil
+	},
+	Run: func(cmd *cobra.Command, arg []string) {
+		var r io.Reader = os.Stdin
+
+		if len(arg) == 1 && arg[0] != "-" {
+			f, err := os.Open(arg[0])
+			if err != nil {
+				log.WithError(err).Error("could not import aliases")
+				os.Exit(1)
+			}
+			defer f.Close()
+
+			r = f
+		} else if onConflict == conflictPrompt {
+			log.Error("could not import aliases: the standard input can't be both read and prompted")
+			os.Exit(1)
+		}
+
+		imported, skipped, err := alias.Import(r, conflictPolicy(onConflict))
+
+		for _, name := range imported {
+			fmt.Printf("alias %s imported\n", name)
+		}
+
+		for _, name := range skipped {
+			fmt.Printf("alias %s skipped: it already exists\n", name)
+		}
+
+		if err != nil {
+			log.WithError(err).Error("could not import aliases")
+			os.Exit(1)
+		}
+	},
+}
+
+// conflictPolicy returns the function telling if an existing alias is
+// overwritten by an imported one, according to the given --on-conflict value.
+func conflictPolicy(policy string) func(name string) (bool, error) {
+	switch policy {
+	case conflictOverwrite:
+		return func(string) (bool, error) { return true, nil }
+	case conflictPrompt:
+		input := bufio.NewReader(os.Stdin)
+
+		return func(name string) (bool, error) {
+			if !terminal.IsTerminal(int(os.Stdin.Fd())) {
+				return false, fmt.Errorf("alias %s already exists and the standard input is not a terminal to confirm overwriting it", name)
+			}
+
+			fmt.Printf("alias %s already exists, overwrite it? [y/N] ", name)
+
+			line, err := input.ReadString('\n')
+			if err != nil {
+				return false, err
+			}
+
+			answer := strings.ToLower(strings.TrimSpace(line))
+
+			return answer == "y" || answer == "yes", nil
+		}
+	default:
+		return func(string) (bool, error) { return false, nil }
+	}
+}
+
+func init() {
+	importAliasesCmd.Flags().StringVarP(&onConflict, "on-conflict", "", conflictSkip, `what to do with aliases named after an existing one: skip, overwrite or prompt
+prompt asks for confirmation on the terminal before overwriting each alias`)
+
+	importCmd.AddCommand(importAliasesCmd)
+}
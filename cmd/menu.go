@@ -0,0 +1,148 @@
+package cmd
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/davrodpin/mole/alias"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	flag "github.com/spf13/pflag"
+	"golang.org/x/crypto/ssh/terminal"
+)
+
+var menuCmd = &cobra.Command{
+	Use:   "menu",
+	Short: "Selects an alias from a list to start a ssh tunnel",
+	Long: `Selects an alias from a list to start a ssh tunnel.
+
+An alias can be selected either by its number or by typing part of its name:
+the list is narrowed down to the aliases matching the typed characters, in
+order, and the tunnel is started as soon as a single alias is left.
+
+If the standard output is not a terminal, the list of aliases is just printed.`,
+	Run: func(cmd *cobra.Command, arg []string) {
+		// This can't be inside init() because of https://github.com/spf13/cobra/issues/1019
+		cmd.Flags().VisitAll(func(f *flag.Flag) {
+			if f.Changed {
+				givenFlags = append(givenFlags, f.Name)
+			}
+		})
+
+		all, err := alias.GetAll()
+		if err != nil {
+			log.WithError(err).Error("could not list aliases")
+			os.Exit(1)
+		}
+
+		names := make([]string, len(all))
+		for i, al := range all {
+			names[i] = al.Name
+		}
+
+		if !terminal.IsTerminal(int(os.Stdout.Fd())) || !terminal.IsTerminal(int(os.Stdin.Fd())) {
+			for _, name := range names {
+				fmt.Println(name)
+			}
+
+			return
+		}
+
+		if len(names) == 0 {
+			fmt.Println("no aliases found. Use \"mole add alias\" to create one.")
+			return
+		}
+
+		name, err := selectAlias(names, bufio.NewReader(os.Stdin))
+		if err != nil {
+			if err != io.EOF {
+				log.WithError(err).Error("could not select alias")
+				os.Exit(1)
+			}
+
+			return
+		}
+
+		startAlias(name)
+	},
+}
+
+// selectAlias interactively narrows down the given list of alias names until
+// a single alias is selected.
+func selectAlias(names []string, input *bufio.Reader) (string, error) {
+	candidates := names
+
+	for {
+		for i, name := range candidates {
+			fmt.Printf("  %d) %s\n", i+1, name)
+		}
+
+		fmt.Printf("Select an alias by number or type to filter: ")
+
+		line, err := input.ReadString('\n')
+		if err != nil {
+			return "", err
+		}
+
+		line = strings.TrimSpace(line)
+
+		if n, err := strconv.Atoi(line); err == nil && n > 0 && n <= len(candidates) {
+			return candidates[n-1], nil
+		}
+
+		filtered := fuzzyFilter(names, line)
+
+		switch len(filtered) {
+		case 0:
+			fmt.Printf("no alias matches %q\n", line)
+		case 1:
+			return filtered[0], nil
+		default:
+			candidates = filtered
+		}
+	}
+}
+
+// fuzzyFilter returns the names containing all characters of pattern, in the
+// same order, ignoring case.
+func fuzzyFilter(names []string, pattern string) []string {
+	var filtered []string
+
+	pattern = strings.ToLower(pattern)
+
+	for _, name := range names {
+		rest := strings.ToLower(name)
+		matches := true
+
+		for _, c := range pattern {
+			i := strings.IndexRune(rest, c)
+			if i < 0 {
+				matches = false
+				break
+			}
+
+			rest = rest[i+len(string(c)):]
+		}
+
+		if matches {
+			filtered = append(filtered, name)
+		}
+	}
+
+	return filtered
+}
+
+func init() {
+	menuCmd.Flags().BoolVarP(&conf.Verbose, "verbose", "v", false, "increase log verbosity")
+	menuCmd.Flags().BoolVarP(&conf.Insecure, "insecure", "i", false, "skip host key validation when connecting to ssh server")
+	menuCmd.Flags().BoolVarP(&conf.Strict, "strict", "", false, `refuse insecure options and only negotiate strong algorithms with the ssh server
+can also be enabled by setting $MOLE_STRICT=true`)
+	menuCmd.Flags().BoolVarP(&conf.Detach, "detach", "x", false, "run process in background")
+
+	rootCmd.AddCommand(menuCmd)
+}
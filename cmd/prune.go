@@ -0,0 +1,42 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/davrodpin/mole/mole"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var (
+	pruneCmd = &cobra.Command{
+		Use:   "prune",
+		Short: "Removes files left behind by instances that are no longer running",
+		Long: `Removes files left behind by instances that are no longer running.
+
+Instances that didn't shut down properly (e.g. crashed or were killed) leave
+their pid, log and rpc files behind, which may confuse other commands.`,
+		Run: func(cmd *cobra.Command, arg []string) {
+			pruned, err := mole.Prune()
+
+			for _, id := range pruned {
+				fmt.Printf("removed files of instance %s\n", id)
+			}
+
+			if err != nil {
+				log.WithError(err).Error("error removing files of instances no longer running")
+				os.Exit(1)
+			}
+
+			if len(pruned) == 0 {
+				fmt.Println("no files to remove")
+			}
+		},
+	}
+)
+
+func init() {
+	rootCmd.AddCommand(pruneCmd)
+}
@@ -5,6 +5,7 @@ import (
 	"time"
 
 	"github.com/davrodpin/mole/mole"
+	"github.com/davrodpin/mole/tunnel"
 
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
@@ -33,24 +34,157 @@ func Execute() error {
 func bindFlags(conf *mole.Configuration, cmd *cobra.Command) error {
 	cmd.Flags().BoolVarP(&conf.Verbose, "verbose", "v", false, "increase log verbosity")
 	cmd.Flags().BoolVarP(&conf.Insecure, "insecure", "i", false, "skip host key validation when connecting to ssh server")
+	cmd.Flags().BoolVarP(&conf.Strict, "strict", "", false, `refuse insecure options and only negotiate strong algorithms with the ssh server
+can also be enabled by setting $MOLE_STRICT=true`)
 	cmd.Flags().BoolVarP(&conf.Detach, "detach", "x", false, "run process in background")
-	cmd.Flags().VarP(&conf.Source, "source", "S", `set source endpoint address: [<host>]:<port>
-multiple -source conf can be provided`)
-	cmd.Flags().VarP(&conf.Destination, "destination", "d", `set destination endpoint address: [<host>]:<port>
-multiple -destination conf can be provided`)
+	cmd.Flags().BoolVarP(&conf.StickyPorts, "sticky-ports", "", false, `remember the source addresses of channels listening on random ports when started from an alias
+the next time the alias is started, the same ports are used if still free`)
+	cmd.Flags().BoolVarP(&conf.SyncLog, "sync-log", "", false, `flush each log entry of a detached instance to disk right away
+makes "mole show logs --follow" reflect events promptly at the cost of slower logging`)
+	cmd.Flags().VarP(&conf.Source, "source", "S", `set source endpoint address: [<host>]:<port> or a unix socket path
+multiple -source conf can be provided. The port can also be a service name (e.g. postgres)`)
+	cmd.Flags().VarP(&conf.Destination, "destination", "d", `set destination endpoint address: [<host>]:<port> or a unix socket path
+multiple -destination conf can be provided. The port can also be a service name (e.g. postgres)`)
+	cmd.Flags().VarP(&conf.QuietSource, "quiet-source", "", `disable the connection logs of the channel listening on the given source address: [<host>]:<port>
+errors are still logged. Multiple -quiet-source conf can be provided`)
+	cmd.Flags().VarP(&conf.HTTPError, "http-error", "", `answer with "503 Service Unavailable" instead of closing the connection when the destination
+of the channel listening on the given source address can't be reached: [<host>]:<port>
+only meant for http forwards. Multiple -http-error conf can be provided`)
+	cmd.Flags().StringArrayVarP(&conf.AllowCidr, "allow-cidr", "", nil, `only accept connections from clients belonging to the given network: [[<host>]:<port>=]<cidr>
+the network applies to all channels unless a source address is given
+(e.g. :5432=192.168.1.0/24). Multiple -allow-cidr conf can be provided`)
+	cmd.Flags().StringArrayVarP(&conf.Prewarm, "prewarm", "", nil, `keep the given number of connections to the destination opened ahead of time: [[<host>]:<port>=]<n>
+reduces the latency of short lived connections at the cost of idle connections on the
+ssh server and destination. Only supported by local tunnels`)
+	cmd.Flags().StringArrayVarP(&conf.DialSource, "dial-source", "", nil, `dial the destination from the given local address instead of one picked by the system:
+[[<host>]:<port>=][<ip>]:<port>. Use "client" as port to reuse the port of the client connected to the
+ssh server. Applies to all channels unless a source address is given. Only supported by remote tunnels`)
+	cmd.Flags().StringArrayVarP(&conf.Protocol, "protocol", "", nil, `tag the channel with a hint of the protocol it carries, attached to its logs and stats: [<source>=]<protocol>
+(e.g. 127.0.0.1:8080=http). Applies to all channels unless a source address is given
+"http" channels also answer with a 503 response when the destination can't be reached (see -http-error)`)
+	cmd.Flags().StringArrayVarP(&conf.RemoteTLS, "remote-tls", "", nil, `connect to the destination using tls, so plaintext clients can reach tls only services:
+[[<host>]:<port>=][sni=<name>][,ca=<file>][,insecure]
+applies to all channels unless a source address is given (e.g. :8443=sni=db.internal,ca=ca.pem)
+the destination host name is verified unless sni is given. Multiple -remote-tls conf can be provided`)
+	cmd.Flags().StringArrayVarP(&conf.LocalTLSCert, "local-tls-cert", "", nil, `accept tls connections on the source address using the given certificate: [[<host>]:<port>=]<file>
+applies to all channels unless a source address is given. Requires a matching -local-tls-key`)
+	cmd.Flags().StringArrayVarP(&conf.LocalTLSKey, "local-tls-key", "", nil, `private key of the certificate given through -local-tls-cert: [[<host>]:<port>=]<file>`)
+	cmd.Flags().StringArrayVarP(&conf.Via, "via", "", nil, `reach the destination through an additional ssh server, itself reached through the tunnel server:
+[[<host>]:<port>=][<user>@]<host>[:<port>]. The hop applies to all channels unless a source address is given
+its user and key are looked up on the ssh config file. Multiple -via conf can be provided`)
+	cmd.Flags().StringVarP(&conf.ManifestCommand, "manifest-command", "", "", `command run on the ssh server once the tunnel is started to get additional forwards
+each line of its output is a "[<source>] <destination>" forward definition (e.g. cat /etc/mole/forwards)`)
 	cmd.Flags().VarP(&conf.Server, "server", "s", "set server address: [<user>@]<host>[:<port>]")
-	cmd.Flags().StringVarP(&conf.Key, "key", "k", "", "set server authentication key file path")
+	cmd.Flags().StringArrayVarP(&conf.FallbackServer, "fallback-server", "", nil, `ssh server connected to when the server can't be reached, like a secondary bastion: [<user>@]<host>[:<port>]
+servers are tried in the given order, starting from the last one connected to. Multiple -fallback-server conf can be provided`)
+	cmd.Flags().StringArrayVarP(&conf.Jump, "jump", "J", nil, `reach the ssh server through the given jump host, like a bastion: [<user>@]<host>[:<port>]
+multiple -jump conf can be provided, each jump host being reached through the previous one. Takes precedence over ProxyJump`)
+	cmd.Flags().StringVarP(&conf.User, "user", "u", "", `set server user name
+the user given as part of the server address takes precedence`)
+	cmd.Flags().StringVarP(&conf.Port, "port", "p", "", `set server port, looked up on the ssh config file or 22 by default
+the port given as part of the server address takes precedence`)
+	cmd.Flags().StringVarP(&conf.Interface, "interface", "", "", `name of the local network interface to connect to the ssh server from (e.g. wg0)
+its address is looked up again on every reconnection to the ssh server`)
+	cmd.Flags().StringVarP(&conf.Key, "key", "k", "", `set server authentication key file path
+the key is read from the standard input, without being written to disk, if "-" is given`)
+	cmd.Flags().StringVarP(&conf.KeyEnv, "key-env", "", "", `read the server authentication key from the given environment variable (e.g. MOLE_SSH_KEY)
+the key is never written to disk and takes precedence over -key`)
+	cmd.Flags().BoolVarP(&conf.IdentitiesOnly, "identities-only", "", false, `only authenticate using the given key, ignoring the keys held by the ssh agent
+avoids "too many authentication failures" errors from servers limiting the number of attempts`)
+	cmd.Flags().BoolVarP(&conf.NoDefaultKey, "no-default-key", "", false, `fail right away when no key is given nor found on the ssh config file, instead of trying ~/.ssh/id_rsa
+unless an ssh agent is available. Catches misconfigured automation early`)
+	cmd.Flags().BoolVarP(&conf.Netrc, "netrc", "", false, `read the user name and password of the ssh server from the netrc file ($NETRC or ~/.netrc)
+the password is tried once the keys are refused. A user given through the command line takes precedence`)
+	cmd.Flags().BoolVarP(&conf.InteractiveAuth, "interactive-auth", "", false, `prompt for the password and the keyboard-interactive challenges (e.g. one-time codes) of the ssh server
+once the keys are refused. No key is required then. Not allowed along with -detach`)
+	cmd.Flags().IntVarP(&conf.PassphraseAttempts, "passphrase-attempts", "", tunnel.DefaultPassphraseAttempts, "maximum number of times the passphrase of a protected key is asked for")
+	cmd.Flags().BoolVarP(&conf.UseKeychain, "use-keychain", "", false, `look the passphrase of a protected key up on the macOS Keychain or the Secret Service (e.g. GNOME Keyring)
+falls back to asking for it, saving the passphrase typed on the secret store once it decrypts the key`)
+	cmd.Flags().StringSliceVarP(&conf.RSASigAlgorithms, "rsa-signature-algorithms", "", nil, `comma separated list of signature algorithms offered when authenticating with an rsa key:
+rsa-sha2-256, rsa-sha2-512 and/or ssh-rsa. All of them are offered by default, picking the first one
+supported by the ssh server in that order. ssh-rsa (sha-1) is refused by modern ssh servers`)
+	cmd.Flags().StringSliceVarP(&conf.KnownHosts, "known-hosts", "", nil, `known_hosts file to verify the ssh server host key against; can be repeated.
+Defaults to ~/.ssh/known_hosts along with /etc/ssh/ssh_known_hosts`)
 	cmd.Flags().DurationVarP(&conf.KeepAliveInterval, "keep-alive-interval", "K", 10*time.Second, "time interval for keep alive packets to be sent")
+	cmd.Flags().BoolVarP(&conf.KeepAliveData, "keep-alive-data", "", false, `also send keep alive packets as channel data, through a "cat" session on the ssh server
+workaround for load balancers and firewalls dropping idle connections despite keep alive requests`)
+	cmd.Flags().BoolVarP(&conf.KeepAliveIdleOnly, "keep-alive-idle-only", "", false, `only send keep alive packets once no forwarded data was received from the ssh server for a whole -keep-alive-interval
+saves packets on busy tunnels, whose traffic already proves the connection is alive`)
+	cmd.Flags().DurationVarP(&conf.KeepAliveInitialDelay, "keep-alive-initial-delay", "", 0, `time to wait after (re)connecting to the ssh server before sending the first keep alive packet
+defaults to the keep alive interval`)
 	cmd.Flags().IntVarP(&conf.ConnectionRetries, "connection-retries", "R", 3, `maximum number of connection retries to the ssh server
 provide 0 to never give up or a negative number to disable`)
+	cmd.Flags().IntVarP(&conf.MaxReconnects, "max-reconnects", "", 0, `maximum number of times the tunnel reconnects to the ssh server after losing its connection,
+over the whole tunnel lifetime, before giving up. Use 0 for no limit`)
+	cmd.Flags().IntVarP(&conf.MaxPendingOpens, "max-pending-opens", "", 0, `maximum number of connections to the destination being opened through the ssh server at the same time,
+queuing the others to smooth bursts of clients against servers limiting the rate of channel opens. Use 0 for no limit`)
+	cmd.Flags().IntVarP(&conf.MaxChannels, "max-channels", "", tunnel.DefaultMaxChannels, `maximum number of channels the tunnel accepts, refusing to start with more
+as a guard against malformed forward definitions. Use a negative number for no limit`)
 	cmd.Flags().StringVarP(&conf.SshConfig, "config", "c", "$HOME/.ssh/config", "set config file path")
 	cmd.Flags().DurationVarP(&conf.WaitAndRetry, "retry-wait", "w", 3*time.Second, "time to wait before trying to reconnect to ssh server")
-	cmd.Flags().StringVarP(&conf.SshAgent, "ssh-agent", "A", "", "unix socket to communicate with a ssh agent")
+	cmd.Flags().DurationVarP(&conf.StablePeriod, "stable-connection-period", "", 0, `time a connection to the ssh server needs to stay up before the
+connection retries counter is reset. Use 0 to reset it on every connection`)
+	cmd.Flags().DurationVarP(&conf.Supervise, "supervise", "", 0, `keep running once all connection retries to the ssh server fail, starting a fresh
+cycle of retries after waiting the given interval. Use 0 to exit instead`)
+	cmd.Flags().DurationVarP(&conf.LogRateLimit, "log-rate-limit", "", tunnel.DefaultLogRateLimit, `window within which repeated reconnection and keep alive warnings are logged only once,
+followed by a summary of how many times they were repeated. Use 0 to log every warning`)
+	cmd.Flags().DurationVarP(&conf.WaitForRemote, "wait-for-remote", "", 0, `wait until the destination of every channel can be reached before signalling the tunnel
+is ready, failing if any of them is still unreachable after the given time. Use 0 to not wait`)
+	cmd.Flags().DurationVarP(&conf.NetworkCheck, "network-check-interval", "", 0, `time interval to look for changes on the local network interfaces, reconnecting
+to the ssh server right away when they change (e.g. switching wifi networks)
+provide 0 to disable`)
+	cmd.Flags().StringVarP(&conf.SshAgent, "ssh-agent", "A", "", `unix socket to communicate with a ssh agent, $SSH_AUTH_SOCK by default unless -no-default-key is given
+its keys are offered after the given key. Use none to disable the ssh agent`)
 	cmd.Flags().DurationVarP(&conf.Timeout, "timeout", "t", 3*time.Second, "ssh server connection timeout")
+	cmd.Flags().DurationVarP(&conf.DnsTimeout, "dns-timeout", "", 0, `ssh server host name resolution timeout
+provide 0 to rely only on the system resolver settings`)
+	cmd.Flags().DurationVarP(&conf.RemoteDialTimeout, "remote-dial-timeout", "", tunnel.DefaultDialTimeout, `maximum time to open a connection to a destination address
+the client connection is closed if the destination can't be reached in time`)
+	cmd.Flags().DurationVarP(&conf.MigrationTimeout, "migration-timeout", "", 0, `time a forwarded connection is held open after the ssh connection is lost, waiting
+for the tunnel to reconnect and dial its destination again. Only supported by local tunnels
+the destination sees a new connection, so only protocols tolerating it survive. Use 0 to disable`)
+	cmd.Flags().DurationVarP(&conf.InitialReadTimeout, "initial-read-timeout", "", 0, `drop client connections that send no data within the given time, before the destination is dialed,
+protecting forwards shared on non-loopback addresses from slow clients. Only supported by local tunnels
+not meant for protocols where the server talks first (e.g. ssh, smtp or mysql). Use 0 to disable`)
+	cmd.Flags().DurationVarP(&conf.DrainTimeout, "drain-timeout", "", mole.DefaultDrainTimeout, `time a detached instance asked to terminate (e.g. SIGTERM) waits for the connections being forwarded
+to be closed before stopping`)
+	cmd.Flags().BoolVarP(&conf.HalfClose, "half-close", "", false, `once either end of a forwarded connection closes it, only close the sending side of the other end
+instead of closing it right away, letting it send data back until it closes the connection too`)
+	cmd.Flags().BoolVarP(&conf.Trace, "trace", "", false, `log when data starts and stops flowing each way of a forwarded connection once it is closed
+e.g. to spot a destination stalling`)
+	cmd.Flags().IntVarP(&conf.TraceLimit, "trace-limit", "", tunnel.DefaultTraceLimit, `maximum number of bursts of data recorded for each connection by -trace`)
+	cmd.Flags().StringVarP(&conf.ExposureCheck, "exposure-check", "", mole.ExposureWarn, `what to do when a channel listens on a non-loopback address (e.g. 0.0.0.0) while forwarding
+to a sensitive port, exposing it to the whole network: warn, refuse to start or off`)
+	cmd.Flags().StringSliceVarP(&conf.SensitivePorts, "sensitive-ports", "", mole.DefaultSensitivePorts, `comma separated list of destination ports or service names looked for by -exposure-check`)
+	cmd.Flags().StringVarP(&conf.EgressPolicy, "egress-policy", "", "", `file listing the destinations channels may dial, one <host>:<port> pattern per line (e.g. *.db.internal:5432)
+forwards to any other destination are refused. Defaults to `+mole.DefaultEgressPolicyFile+`, if it exists`)
+	cmd.Flags().StringArrayVarP(&conf.HostAlias, "host-alias", "", nil, `resolve the given host name to a fixed ip address, like /etc/hosts: <name>=<ip>
+applies to the ssh server and destination host names. Multiple -host-alias conf can be provided`)
 	cmd.Flags().BoolVarP(&conf.Rpc, "rpc", "", false, "enable the rpc server")
 	cmd.Flags().StringVarP(&conf.RpcAddress, "rpc-address", "", "127.0.0.1:0", `set the network address of the rpc server.
 The default value uses a random free port to listen for requests.
-The full address is kept on $HOME/.mole/<id>.`)
+The full address is kept on $HOME/.mole/<id>.
+An address containing a slash is taken as the path of a unix socket (e.g. /run/mole/rpc.sock).`)
+	cmd.Flags().StringVarP(&conf.ControlSocketMode, "control-socket-mode", "", mole.DefaultControlSocketMode, `permissions, in octal notation, of the unix sockets the rpc and pprof servers listen on
+only the user running mole can reach them by default`)
+
+	cmd.Flags().StringVarP(&conf.EnvFile, "env-file", "", "", `write the source address of each channel to the given file, once the tunnel is ready
+each address is written as MOLE_<TYPE>_<N>=<host>:<port> (e.g. MOLE_LOCAL_1=127.0.0.1:5432)`)
+	cmd.Flags().StringVarP(&conf.OnDisconnect, "on-disconnect", "", "", `shell command run every time the tunnel loses its connection to the ssh server
+the event is described by $MOLE_EVENT, $MOLE_ID, $MOLE_SERVER, $MOLE_TIMESTAMP and $MOLE_ERROR`)
+	cmd.Flags().StringVarP(&conf.OnReconnect, "on-reconnect", "", "", `shell command run every time the tunnel is ready again after reconnecting to the ssh server
+the event is described by $MOLE_EVENT, $MOLE_ID, $MOLE_SERVER and $MOLE_TIMESTAMP`)
+	cmd.Flags().StringVarP(&conf.ExecOnce, "exec-once", "", "", `shell command run once the tunnel is ready for the first time (e.g. to warm up a cache)
+the tunnel keeps running once the command exits, which exit status is only logged
+the source address of each channel is given as $MOLE_<TYPE>_<N>, like on -env-file`)
+	cmd.Flags().StringVarP(&conf.Pprof, "pprof", "", "", `debugging tool: serve runtime profiling data (net/http/pprof) on the given address: [<host>]:<port>
+the loopback interface is used if no host is given. A unix socket path can be given instead
+Disabled by default`)
+	cmd.Flags().StringVarP(&conf.Takeover, "takeover", "", "", `take over the listeners of the running instance with the given id, which is stopped
+once the new instance holds them, so connections are not refused during an upgrade of mole`)
+	cmd.Flags().BoolVarP(&conf.Verify, "verify", "", false, `connect to the ssh server, listen on every source address and check every destination can be
+reached, then exit right away, with a non-zero status on any failure, instead of keeping the tunnel running`)
+	cmd.Flags().BoolVarP(&conf.Force, "force", "", false, `replace the running instance using the same id, stopping it first, instead of refusing to start`)
 
 	// id is a hidden flag used to carry the unique identifier of the instance to
 	// the child process when the `--detached` flag is used.
@@ -0,0 +1,40 @@
+package cmd
+
+import (
+	"os"
+
+	"github.com/davrodpin/mole/mole"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var (
+	sshConfig    string
+	namesOnly    bool
+	showHostsCmd = &cobra.Command{
+		Use:   "hosts",
+		Short: "Shows the hosts defined on the ssh config files",
+		Long: `Shows the hosts defined on the ssh config file of the user and on the
+system-wide one, which can be given as the server of a tunnel.
+
+Attributes are resolved from all matching host blocks for hosts given by name,
+while host blocks with patterns only show the attributes they set themselves.`,
+		Args: cobra.NoArgs,
+		Run: func(cmd *cobra.Command, arg []string) {
+			err := mole.ShowHosts(sshConfig, namesOnly)
+			if err != nil {
+				log.WithError(err).WithFields(log.Fields{
+					"config": sshConfig,
+				}).Error("could not read the ssh config file")
+				os.Exit(1)
+			}
+		},
+	}
+)
+
+func init() {
+	showHostsCmd.Flags().StringVarP(&sshConfig, "config", "c", "$HOME/.ssh/config", "set config file path")
+	showHostsCmd.Flags().BoolVarP(&namesOnly, "names", "", false, "only show host names, one per line (e.g. for shell completion)")
+	showCmd.AddCommand(showHostsCmd)
+}
@@ -30,8 +30,6 @@ same name stored in the alias.
 		return nil
 	},
 	Run: func(cmd *cobra.Command, arg []string) {
-		var err error
-
 		// This can't be inside init() because of https://github.com/spf13/cobra/issues/1019
 		cmd.Flags().VisitAll(func(f *flag.Flag) {
 			if f.Changed {
@@ -39,34 +37,48 @@ same name stored in the alias.
 			}
 		})
 
-		al, err := alias.Get(aliasName)
-		if err != nil {
-			log.WithError(err).Errorf("failed to start tunnel from alias %s", aliasName)
-			os.Exit(1)
-		}
+		startAlias(aliasName)
+	},
+}
 
-		err = conf.Merge(al, givenFlags)
-		if err != nil {
-			log.WithError(err).Errorf("failed to start tunnel from alias %s", aliasName)
-			os.Exit(1)
-		}
+// startAlias starts a tunnel from the given alias, exiting the process if
+// the tunnel can't be started.
+func startAlias(aliasName string) {
+	var err error
 
-		client := mole.New(conf)
+	al, err := alias.Get(aliasName)
+	if err != nil {
+		log.WithError(err).Errorf("failed to start tunnel from alias %s", aliasName)
+		os.Exit(1)
+	}
 
-		err = client.Start()
-		if err != nil {
-			log.WithError(err).WithFields(log.Fields{
-				"alias": aliasName,
-			}).Errorf("failed to start tunnel from alias %s", aliasName)
-			os.Exit(1)
-		}
-	},
+	err = conf.Merge(al, givenFlags)
+	if err != nil {
+		log.WithError(err).Errorf("failed to start tunnel from alias %s", aliasName)
+		os.Exit(1)
+	}
+
+	client := mole.New(conf)
+
+	err = client.Start()
+	if err != nil {
+		log.WithError(err).WithFields(log.Fields{
+			"alias": aliasName,
+		}).Errorf("failed to start tunnel from alias %s", aliasName)
+		os.Exit(1)
+	}
 }
 
 func init() {
 	startAliasCmd.Flags().BoolVarP(&conf.Verbose, "verbose", "v", false, "increase log verbosity")
 	startAliasCmd.Flags().BoolVarP(&conf.Insecure, "insecure", "i", false, "skip host key validation when connecting to ssh server")
+	startAliasCmd.Flags().BoolVarP(&conf.Strict, "strict", "", false, `refuse insecure options and only negotiate strong algorithms with the ssh server
+can also be enabled by setting $MOLE_STRICT=true`)
 	startAliasCmd.Flags().BoolVarP(&conf.Detach, "detach", "x", false, "run process in background")
+	startAliasCmd.Flags().StringVarP(&conf.Takeover, "takeover", "", "", `take over the listeners of the running instance with the given id, which is stopped
+once the new instance holds them, so connections are not refused during an upgrade of mole`)
+	startAliasCmd.Flags().BoolVarP(&conf.StickyPorts, "sticky-ports", "", false, "remember the source addresses of channels listening on random ports, using the same ports the next time if still free")
+	startAliasCmd.Flags().BoolVarP(&conf.Force, "force", "", false, `replace the running instance using the same id, stopping it first, instead of refusing to start`)
 
 	startCmd.AddCommand(startAliasCmd)
 }
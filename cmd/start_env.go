@@ -0,0 +1,97 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/davrodpin/mole/mole"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	flag "github.com/spf13/pflag"
+)
+
+const (
+	EnvForwardDoc = `
+The tunnel is configured entirely through environment variables, so mole can
+run declaratively (e.g. as a sidecar container) without any arguments:
+
+  MOLE_TYPE       type of the tunnel: local (default) or remote
+  MOLE_FORWARD_N  channel of the tunnel: <source>=<destination>, ordered by N
+                  (e.g. MOLE_FORWARD_1=127.0.0.1:5432=db.internal:5432)
+
+Every other flag is read from the environment variable named after it, with
+a MOLE_ prefix (e.g. MOLE_SERVER for --server, MOLE_KEEP_ALIVE_INTERVAL for
+--keep-alive-interval). Flags given on the command line take precedence.
+Flags accepting multiple values take a single one from the environment.
+`
+)
+
+var startEnvCmd = &cobra.Command{
+	Use:   "env",
+	Short: "Starts a ssh tunnel configured through environment variables",
+	Long:  fmt.Sprintf("Starts a ssh tunnel configured through environment variables.\n%s", EnvForwardDoc),
+	Args: func(cmd *cobra.Command, args []string) error {
+		conf.TunnelType = "local"
+
+		if tt := os.Getenv(mole.TypeEnvVar); tt != "" {
+			if tt != "local" && tt != "remote" {
+				return fmt.Errorf("invalid %s: %s: expected local or remote", mole.TypeEnvVar, tt)
+			}
+
+			conf.TunnelType = tt
+		}
+
+		var err error
+
+		cmd.Flags().VisitAll(func(f *flag.Flag) {
+			if err != nil || f.Changed {
+				return
+			}
+
+			name := mole.EnvVarName(f.Name)
+
+			value, ok := os.LookupEnv(name)
+			if !ok {
+				return
+			}
+
+			if e := cmd.Flags().Set(f.Name, value); e != nil {
+				err = fmt.Errorf("invalid %s: %v", name, e)
+			}
+		})
+
+		if err != nil {
+			return err
+		}
+
+		source, destination, err := mole.ParseEnvForwards(os.Environ())
+		if err != nil {
+			return err
+		}
+
+		conf.Source = append(conf.Source, source...)
+		conf.Destination = append(conf.Destination, destination...)
+
+		return nil
+	},
+	Run: func(cmd *cobra.Command, arg []string) {
+		client := mole.New(conf)
+
+		err := client.Start()
+		if err != nil {
+			log.WithError(err).Error("error starting mole")
+			os.Exit(1)
+		}
+	},
+}
+
+func init() {
+	err := bindFlags(conf, startEnvCmd)
+	if err != nil {
+		log.WithError(err).Error("error parsing command line arguments")
+		os.Exit(1)
+	}
+
+	startCmd.AddCommand(startEnvCmd)
+}
@@ -20,15 +20,59 @@ service the source machine does not have direct access to.
 
 Source endpoints are addresses on the same machine where mole is getting executed where clients can connect to access services on the corresponding destination endpoints.
 Destination endpoints are adrresess that can be reached from the jump server.
+Either endpoint can be a unix socket path instead (e.g. /var/run/docker.sock).
+`
+
+	StdioForwardDoc = `
+The --stdio flag forwards the standard input and output of mole to a single
+destination address instead of listening on any source endpoint, the same way
+"ssh -W" does. This allows mole to be used as a ProxyCommand:
+
+  ProxyCommand mole start local --server bastion --stdio %h:%p
+`
+
+	TunForwardDoc = `
+The --tun flag (experimental) forwards ip packets between a local tun device
+and any tun device available on the ssh server, the same way "ssh -w" does.
+It requires the ssh server to allow it (PermitTunnel point-to-point) and is
+only supported on linux. The addresses and routes of both devices need to be
+configured separately.
+`
+
+	DynamicForwardDoc = `
+The --dynamic flag turns every source endpoint into a SOCKS5 proxy, the same
+way "ssh -D" does: each connection is forwarded to the destination its client
+asks for, which is dialed from the ssh server. No destination endpoint is given
+on the command line and, if no source endpoint is given either, the proxy
+listens on a random port of the loopback interface.
 `
 )
 
+var stdio string
+var dynamic bool
+
 var startLocalCmd = &cobra.Command{
 	Use:   "local",
 	Short: "Starts a ssh local port forwarding tunnel",
-	Long:  fmt.Sprintf("Starts a ssh local port forwarding tunnel.\n%s", LocalForwardDoc),
+	Long:  fmt.Sprintf("Starts a ssh local port forwarding tunnel.\n%s%s%s%s", LocalForwardDoc, StdioForwardDoc, TunForwardDoc, DynamicForwardDoc),
 	Args: func(cmd *cobra.Command, args []string) error {
 		conf.TunnelType = "local"
+
+		if stdio != "" {
+			conf.TunnelType = "stdio"
+			conf.Destination = mole.AddressInputList{}
+
+			return conf.Destination.Set(stdio)
+		}
+
+		if conf.TunDevice != "" {
+			conf.TunnelType = "tun"
+		}
+
+		if dynamic {
+			conf.TunnelType = "dynamic"
+		}
+
 		return nil
 	},
 	Run: func(cmd *cobra.Command, arg []string) {
@@ -49,5 +93,16 @@ func init() {
 		os.Exit(1)
 	}
 
+	startLocalCmd.Flags().StringVarP(&conf.DestinationCommand, "destination-command", "", "", `command run on the ssh server to discover the destination addresses, one per line
+a channel is created for each address found, using the source addresses given in the same order`)
+
+	startLocalCmd.Flags().StringVarP(&stdio, "stdio", "", "", `forward the standard input and output to the given destination address: [<host>]:<port>
+no source endpoint is listened on when this flag is given`)
+
+	startLocalCmd.Flags().StringVarP(&conf.TunDevice, "tun", "", "", `experimental: forward ip packets of the given local tun device (e.g. tun0)
+use tun%d to let the system pick the next device available`)
+
+	startLocalCmd.Flags().BoolVarP(&dynamic, "dynamic", "", false, `run a SOCKS5 proxy on each source endpoint, forwarding connections to the destinations asked for by the clients`)
+
 	startCmd.AddCommand(startLocalCmd)
 }
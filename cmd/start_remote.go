@@ -16,7 +16,8 @@ const (
 This could be particular useful for giving someone on the outside access to an internal web application, for example.
 
 Source endpoints are addresses on the jump server where clients can connect to access services running on the corresponding destination endpoints.
-Destination endpoints are addresses of services running on the same machine where mole is getting executed.`
+Destination endpoints are addresses of services running on the same machine where mole is getting executed.
+Either endpoint can be a unix socket path instead (e.g. /var/run/docker.sock).`
 )
 
 var startRemoteCmd = &cobra.Command{
@@ -0,0 +1,44 @@
+package cmd
+
+import (
+	"errors"
+	"os"
+
+	"github.com/davrodpin/mole/mole"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var (
+	watchCmd = &cobra.Command{
+		Use:   "watch [alias name or id]",
+		Short: "Streams the events of an instance of mole",
+		Long: `Streams the events of an instance of mole as they happen, one JSON object per line:
+connections to the ssh server established or lost and connections forwarded by its channels.
+
+The instance must be running with rpc enabled.`,
+		Args: func(cmd *cobra.Command, args []string) error {
+			if len(args) < 1 {
+				return errors.New("alias name or id not provided")
+			}
+
+			id = args[0]
+
+			return nil
+		},
+		Run: func(cmd *cobra.Command, arg []string) {
+			err := mole.Watch(id, os.Stdout)
+			if err != nil {
+				log.WithError(err).WithFields(log.Fields{
+					"id": id,
+				}).Error("error watching mole instance")
+				os.Exit(1)
+			}
+		},
+	}
+)
+
+func init() {
+	rootCmd.AddCommand(watchCmd)
+}
@@ -103,13 +103,13 @@ func TestLogFileLocation(t *testing.T) {
 	instanceId := "id"
 	instanceDir, err := fsutils.InstanceDir(instanceId)
 	if err != nil {
-		t.Errorf("%w", err)
+		t.Errorf("%v", err)
 	}
 
 	expected := filepath.Join(instanceDir.Dir, fsutils.InstanceLogFile)
 	lfp, err := fsutils.GetLogFileLocation(instanceId)
 	if err != nil {
-		t.Errorf("%w", err)
+		t.Errorf("%v", err)
 	}
 
 	if lfp != expected {
@@ -2,7 +2,9 @@ package mole
 
 import (
 	"fmt"
+	"net"
 	"regexp"
+	"strconv"
 	"strings"
 )
 
@@ -10,7 +12,25 @@ const (
 	AddressFormat = "%s:%s"
 )
 
-var re = regexp.MustCompile(`(?P<user>.+@)?(?P<host>[[:alpha:][:digit:]\_\-\.]+)?(?P<port>:[0-9]+)?`)
+var re = regexp.MustCompile(`(?P<user>.+@)?(?P<host>[[:alpha:][:digit:]\_\-\.]+)?(?P<port>:[[:alpha:][:digit:]\_\-]+)?`)
+
+// services maps the names of common services to their well known ports. It is
+// only looked up when a service name can't be found on the system services
+// database (i.e. /etc/services).
+var services = map[string]int{
+	"ssh":           22,
+	"http":          80,
+	"https":         443,
+	"mysql":         3306,
+	"rdp":           3389,
+	"postgres":      5432,
+	"postgresql":    5432,
+	"vnc":           5900,
+	"redis":         6379,
+	"elasticsearch": 9200,
+	"memcached":     11211,
+	"mongodb":       27017,
+}
 
 // AddressInput holds information about a host
 type AddressInput struct {
@@ -32,20 +52,66 @@ func (ai AddressInput) String() string {
 }
 
 // Set parses a string representation of AddressInput into its proper attributes.
+//
+// The port can be given as a service name (e.g. postgres), which is translated
+// to its port number. Unix socket paths, told apart by containing a slash,
+// are kept as the host, with no port.
 func (ai *AddressInput) Set(value string) error {
+	if strings.Contains(value, "/") {
+		ai.User = ""
+		ai.Host = value
+		ai.Port = ""
+
+		return nil
+	}
+
 	result := parseServerInput(value)
+
+	port, err := lookupPort(strings.Trim(result["port"], ":"))
+	if err != nil {
+		return err
+	}
+
 	ai.User = strings.Trim(result["user"], "@")
 	ai.Host = result["host"]
-	ai.Port = strings.Trim(result["port"], ":")
+	ai.Port = port
 
 	return nil
 }
 
+// lookupPort translates a service name to its port number, looking it up on
+// the system services database and then on a built-in list of common
+// services. Port numbers are returned as is.
+func lookupPort(port string) (string, error) {
+	if port == "" {
+		return port, nil
+	}
+
+	if _, err := strconv.Atoi(port); err == nil {
+		return port, nil
+	}
+
+	if p, err := net.LookupPort("tcp", port); err == nil {
+		return strconv.Itoa(p), nil
+	}
+
+	if p, ok := services[strings.ToLower(port)]; ok {
+		return strconv.Itoa(p), nil
+	}
+
+	return "", fmt.Errorf("unknown service name %s: not found on the system services database (/etc/services) nor on the list of common services known by mole, use a port number instead", port)
+}
+
 // Type return a string representation of AddressInput.
 func (ai *AddressInput) Type() string {
 	return "[<user>@][<host>]:<port>"
 }
 
+// IsSocket tells if the address is a unix socket path.
+func (ai AddressInput) IsSocket() bool {
+	return strings.Contains(ai.Host, "/")
+}
+
 // Address returns a string representation of AddressInput to be used to perform
 // network connections.
 func (ai AddressInput) Address() string {
@@ -87,3 +87,63 @@ func TestAddressInputAddress(t *testing.T) {
 		}
 	}
 }
+
+func TestAddressInputServiceName(t *testing.T) {
+	tests := []struct {
+		input string
+		port  string
+		fail  bool
+	}{
+		{"db:5432", "5432", false},
+		{"db:postgres", "5432", false},
+		{"db:MongoDB", "27017", false},
+		{":https", "443", false},
+		{"db", "", false},
+		{"/var/run/docker.sock", "", false},
+		{"db:not-a-service", "", true},
+	}
+
+	for id, test := range tests {
+		var ai mole.AddressInput
+
+		err := ai.Set(test.input)
+		if test.fail != (err != nil) {
+			t.Errorf("test %d: unexpected error result: %v", id, err)
+			continue
+		}
+
+		if test.port != ai.Port {
+			t.Errorf("port does not match on test %d: expected: %s, value: %s", id, test.port, ai.Port)
+		}
+	}
+}
+
+func TestAddressInputSocket(t *testing.T) {
+	tests := []struct {
+		input    string
+		socket   bool
+		expected string
+	}{
+		{"/var/run/docker.sock", true, "/var/run/docker.sock"},
+		{"./mole.sock", true, "./mole.sock"},
+		{"127.0.0.1:2375", false, "127.0.0.1:2375"},
+	}
+
+	for id, test := range tests {
+		var ai mole.AddressInput
+
+		err := ai.Set(test.input)
+		if err != nil {
+			t.Errorf("test %d: unexpected error: %v", id, err)
+			continue
+		}
+
+		if test.socket != ai.IsSocket() {
+			t.Errorf("socket does not match on test %d: expected: %t, value: %t", id, test.socket, ai.IsSocket())
+		}
+
+		if test.expected != ai.String() {
+			t.Errorf("address does not match on test %d: expected: %s, value: %s", id, test.expected, ai.String())
+		}
+	}
+}
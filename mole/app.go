@@ -3,10 +3,14 @@ package mole
 import (
 	"fmt"
 	"os"
+	"strings"
+	"text/tabwriter"
 
 	"github.com/davrodpin/mole/fsutils"
+	"github.com/davrodpin/mole/tunnel"
 
 	"github.com/hpcloud/tail"
+	"golang.org/x/crypto/ssh"
 )
 
 // DetachedInstance holds the location to directories and files associated
@@ -21,6 +25,9 @@ type DetachedInstance struct {
 	// PidFile points to a file path in the file system where the application
 	// procces identifier is stored.
 	PidFile string
+	// handedOff, if set, is closed once the detached process took over the
+	// listeners held by the process starting it.
+	handedOff chan struct{}
 }
 
 // NewDetachedInstance returns a new instance of DetachedInstance, making sure
@@ -70,3 +77,75 @@ func ShowLogs(id string, follow bool) error {
 
 	return nil
 }
+
+// ShowHosts displays the hosts defined on the given ssh config file and on the
+// system-wide one, along with the attributes they resolve to.
+//
+// If namesOnly is set, only the names of hosts that can be given as a server
+// are displayed, one per line, which is suitable for shell completion.
+func ShowHosts(sshConfig string, namesOnly bool) error {
+	cfg, err := tunnel.NewSSHConfigFile(sshConfig)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			return err
+		}
+
+		cfg = tunnel.NewEmptySSHConfigStruct()
+	}
+
+	hosts := cfg.Hosts()
+
+	if namesOnly {
+		for _, h := range hosts {
+			if !h.IsPattern() {
+				fmt.Println(h.Patterns[0])
+			}
+		}
+
+		return nil
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "HOST\tHOSTNAME\tPORT\tUSER")
+
+	for _, h := range hosts {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", strings.Join(h.Patterns, " "), h.Hostname, h.Port, h.User)
+	}
+
+	return w.Flush()
+}
+
+// ShowFingerprint displays the SHA256 and MD5 fingerprints of the host key of
+// the ssh server of the given configuration. The host key is retrieved without
+// being verified nor trusted, so its fingerprints can be compared against the
+// ones obtained out of band before it is added to the known_hosts file.
+func ShowFingerprint(conf *Configuration) error {
+	// the connection ends before authenticating, so no user nor key is needed.
+	opts := []tunnel.ServerOption{tunnel.WithoutCredentials()}
+	if conf.Port != "" {
+		port, err := lookupPort(conf.Port)
+		if err != nil {
+			return err
+		}
+
+		opts = append(opts, tunnel.WithPort(port))
+	}
+
+	s, err := tunnel.NewServer(conf.ServerUser(), conf.Server.Address(), "", "", conf.SshConfig, opts...)
+	if err != nil {
+		return err
+	}
+
+	s.Strict = conf.Strict
+	s.Timeout = conf.Timeout
+
+	key, err := tunnel.HostKey(s)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("%s %s %s\n", s.Address, key.Type(), ssh.FingerprintSHA256(key))
+	fmt.Printf("%s %s MD5:%s\n", s.Address, key.Type(), ssh.FingerprintLegacyMD5(key))
+
+	return nil
+}
@@ -62,6 +62,14 @@ func TestShowLogs(t *testing.T) {
 func TestMain(m *testing.M) {
 	var err error
 
+	// helper processes started by a test share the home directory of the
+	// test process.
+	if h := os.Getenv("MOLE_TEST_HOME"); h != "" {
+		home = h
+		os.Setenv("HOME", home)
+		os.Exit(m.Run())
+	}
+
 	home, err = ioutil.TempDir("", "mole")
 	if err != nil {
 		os.Exit(1)
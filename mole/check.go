@@ -0,0 +1,78 @@
+package mole
+
+import (
+	"fmt"
+
+	"github.com/davrodpin/mole/alias"
+	"github.com/davrodpin/mole/tunnel"
+)
+
+// Check validates the configuration the same way Start does, without
+// connecting to the ssh server nor listening on any address: the ssh server
+// is resolved through the ssh config file and the tunnel channels are created
+// out of the source and destination addresses and channel options.
+//
+// Every problem found is returned, so they can all be fixed at once.
+func (c *Configuration) Check() []error {
+	var problems []error
+
+	switch c.TunnelType {
+	case "local", "remote", "stdio", "tun":
+	default:
+		problems = append(problems, fmt.Errorf("invalid tunnel type %s: expected local, remote, stdio or tun", c.TunnelType))
+	}
+
+	if c.TunnelType == "stdio" && c.Detach {
+		problems = append(problems, fmt.Errorf("stdio tunnels can't be detached"))
+	}
+
+	if c.Detach && c.Key == KeyStdin && c.KeyEnv == "" {
+		problems = append(problems, fmt.Errorf("a key read from the standard input can't be used by a detached instance"))
+	}
+
+	if c.Strict {
+		if err := c.CheckStrict(); err != nil {
+			problems = append(problems, err)
+		}
+	}
+
+	switch c.ExposureCheck {
+	case "", ExposureOff, ExposureWarn:
+	case ExposureRefuse:
+		if err := c.CheckExposure(); err != nil {
+			problems = append(problems, err)
+		}
+	default:
+		problems = append(problems, fmt.Errorf("invalid exposure check %s: expected %s, %s or %s", c.ExposureCheck, ExposureWarn, ExposureRefuse, ExposureOff))
+	}
+
+	if _, err := ParseSocketMode(c.ControlSocketMode); err != nil {
+		problems = append(problems, err)
+	}
+
+	// the keys are only read, so no passphrase is asked for.
+	_, err := buildTunnel(c, func(key *tunnel.PemKey) error { return nil })
+	if err != nil {
+		problems = append(problems, err)
+	}
+
+	return problems
+}
+
+// CheckAlias validates the alias with the given name, without starting its
+// tunnel. See Check.
+func CheckAlias(name string) ([]error, error) {
+	al, err := alias.Get(name)
+	if err != nil {
+		return nil, err
+	}
+
+	conf := &Configuration{}
+
+	err = conf.Merge(al, nil)
+	if err != nil {
+		return []error{err}, nil
+	}
+
+	return conf.Check(), nil
+}
@@ -0,0 +1,93 @@
+package mole
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/davrodpin/mole/tunnel"
+)
+
+// ConsoleEscape is the line that opens the interactive command prompt of a
+// tunnel running on the foreground, just like the "~C" escape of ssh.
+const ConsoleEscape = "~C"
+
+const consoleHelp = `commands:
+  add [<source>] <destination>  forward connections from source to destination
+  remove <source>               stop forwarding connections from source
+  list                          show the tunnel channels
+  help                          show this message
+`
+
+// RunConsole reads lines from in until it is closed. Every time a line with
+// the escape sequence ~C is read, a single command is read from the prompt
+// written to out and applied to the running tunnel.
+func RunConsole(t *tunnel.Tunnel, in io.Reader, out io.Writer) {
+	scanner := bufio.NewScanner(in)
+
+	for scanner.Scan() {
+		if strings.TrimSpace(scanner.Text()) != ConsoleEscape {
+			continue
+		}
+
+		fmt.Fprint(out, "mole> ")
+
+		if !scanner.Scan() {
+			return
+		}
+
+		err := runConsoleCommand(t, strings.Fields(scanner.Text()), out)
+		if err != nil {
+			fmt.Fprintf(out, "error: %v\n", err)
+		}
+	}
+}
+
+func runConsoleCommand(t *tunnel.Tunnel, args []string, out io.Writer) error {
+	if len(args) == 0 {
+		return nil
+	}
+
+	switch args[0] {
+	case "add":
+		var source, destination string
+
+		switch len(args) {
+		case 2:
+			destination = args[1]
+		case 3:
+			source, destination = args[1], args[2]
+		default:
+			return fmt.Errorf("usage: add [<source>] <destination>")
+		}
+
+		ch, err := t.AddChannel(source, destination)
+		if err != nil {
+			return err
+		}
+
+		fmt.Fprintf(out, "forwarding %s -> %s\n", ch.Source, ch.Destination)
+	case "remove":
+		if len(args) != 2 {
+			return fmt.Errorf("usage: remove <source>")
+		}
+
+		err := t.RemoveChannel(args[1])
+		if err != nil {
+			return err
+		}
+
+		fmt.Fprintf(out, "removed %s\n", args[1])
+	case "list":
+		for _, ch := range t.Channels() {
+			fmt.Fprintf(out, "%s\n", ch)
+		}
+	case "help":
+		fmt.Fprint(out, consoleHelp)
+	default:
+		return fmt.Errorf("unknown command %s, type help for the list of commands", args[0])
+	}
+
+	return nil
+}
@@ -0,0 +1,63 @@
+package mole
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// DefaultControlSocketMode is the default file mode of the unix sockets the
+// rpc and pprof servers listen on, only allowing the user running mole in.
+const DefaultControlSocketMode = "0600"
+
+// ParseSocketMode parses a file mode given in octal notation (e.g. 0660).
+// DefaultControlSocketMode is used if none is given.
+func ParseSocketMode(mode string) (os.FileMode, error) {
+	if mode == "" {
+		mode = DefaultControlSocketMode
+	}
+
+	m, err := strconv.ParseUint(mode, 8, 32)
+	if err != nil || m > 0777 {
+		return 0, fmt.Errorf("invalid socket mode %s: expected permissions in octal notation (e.g. 0600)", mode)
+	}
+
+	return os.FileMode(m), nil
+}
+
+// ListenControl listens on the given address of an auxiliary server, like the
+// rpc or pprof servers: a tcp address or, if it contains a slash, the path of
+// a unix socket, which is given the given permissions so only the allowed
+// local users can reach the server.
+//
+// A unix socket left behind by a mole process that is gone is replaced.
+func ListenControl(address string, mode os.FileMode) (net.Listener, error) {
+	if !strings.Contains(address, "/") {
+		return net.Listen("tcp", address)
+	}
+
+	if fi, err := os.Stat(address); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		if conn, err := net.Dial("unix", address); err == nil {
+			conn.Close()
+			return nil, fmt.Errorf("unix socket %s is already in use", address)
+		}
+
+		if err := os.Remove(address); err != nil {
+			return nil, err
+		}
+	}
+
+	lis, err := net.Listen("unix", address)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = os.Chmod(address, mode); err != nil {
+		lis.Close()
+		return nil, err
+	}
+
+	return lis, nil
+}
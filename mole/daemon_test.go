@@ -0,0 +1,44 @@
+package mole
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	daemon "github.com/sevlyar/go-daemon"
+)
+
+func TestStartDaemonProcessMissingDir(t *testing.T) {
+	home, err := ioutil.TempDir("", "mole-daemon")
+	if err != nil {
+		t.Fatalf("error creating temporary directory: %v", err)
+	}
+	defer os.RemoveAll(home)
+
+	dir := filepath.Join(home, "missing", "instance")
+	ic := &DetachedInstance{
+		Id:      "instance",
+		PidFile: filepath.Join(dir, "pid"),
+		LogFile: filepath.Join(dir, "mole.log"),
+	}
+
+	errReborn := errors.New("not started")
+
+	defer func(r func(*daemon.Context) (*os.Process, error)) { reborn = r }(reborn)
+	reborn = func(c *daemon.Context) (*os.Process, error) {
+		for _, f := range []string{c.PidFileName, c.LogFileName} {
+			if _, err := os.Stat(filepath.Dir(f)); err != nil {
+				t.Errorf("directory of %s expected to exist before the detached process starts: %v", f, err)
+			}
+		}
+
+		return nil, errReborn
+	}
+
+	err = startDaemonProcess(ic)
+	if err != errReborn {
+		t.Errorf("unexpected error starting the detached process: %v", err)
+	}
+}
@@ -0,0 +1,115 @@
+package mole
+
+import (
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/davrodpin/mole/tunnel"
+)
+
+const (
+	// EnvVarPrefix is the prefix of every environment variable written to an
+	// environment file.
+	EnvVarPrefix = "MOLE"
+
+	// ForwardEnvVarPrefix is the prefix of the environment variables giving
+	// the channels of a tunnel started by "mole start env", as
+	// MOLE_FORWARD_<N>=<source>=<destination>.
+	ForwardEnvVarPrefix = EnvVarPrefix + "_FORWARD_"
+
+	// TypeEnvVar is the environment variable giving the type of the tunnel
+	// started by "mole start env": local (default) or remote.
+	TypeEnvVar = EnvVarPrefix + "_TYPE"
+)
+
+// WriteEnvFile saves the source address of each given channel to an
+// environment file that can be sourced by shells or loaded by tools like
+// docker-compose.
+//
+// Each channel is written as a line like MOLE_<TYPE>_<N>=<host>:<port>, where
+// TYPE is the channel type (e.g. LOCAL) and N is the channel position,
+// starting from 1, in the list of sources given by the user.
+func WriteEnvFile(path string, channels []*tunnel.SSHChannel) error {
+	var sb strings.Builder
+
+	for _, v := range channelsEnv(channels) {
+		fmt.Fprintln(&sb, v)
+	}
+
+	return ioutil.WriteFile(path, []byte(sb.String()), 0644)
+}
+
+// channelsEnv returns the environment variables giving the source address of
+// each given channel (see WriteEnvFile).
+func channelsEnv(channels []*tunnel.SSHChannel) []string {
+	env := make([]string, len(channels))
+
+	for i, ch := range channels {
+		env[i] = fmt.Sprintf("%s_%s_%d=%s", EnvVarPrefix, strings.ToUpper(ch.ChannelType), i+1, ch.Source)
+	}
+
+	return env
+}
+
+// EnvVarName returns the name of the environment variable setting the given
+// flag on tunnels started by "mole start env" (e.g. MOLE_KEEP_ALIVE_INTERVAL
+// for --keep-alive-interval).
+func EnvVarName(flag string) string {
+	return EnvVarPrefix + "_" + strings.ToUpper(strings.Replace(flag, "-", "_", -1))
+}
+
+// ParseEnvForwards returns the source and destination addresses of the
+// channels given on the given environment, in the format returned by
+// os.Environ, as MOLE_FORWARD_<N>=<source>=<destination>. The channels are
+// ordered by N, which doesn't need to be contiguous.
+func ParseEnvForwards(environ []string) (AddressInputList, AddressInputList, error) {
+	type forward struct {
+		n     int
+		value string
+	}
+
+	var forwards []forward
+
+	for _, e := range environ {
+		if !strings.HasPrefix(e, ForwardEnvVarPrefix) {
+			continue
+		}
+
+		kv := strings.SplitN(e, "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+
+		n, err := strconv.Atoi(strings.TrimPrefix(kv[0], ForwardEnvVarPrefix))
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid forward %s: expected %s<N>", kv[0], ForwardEnvVarPrefix)
+		}
+
+		forwards = append(forwards, forward{n: n, value: kv[1]})
+	}
+
+	sort.Slice(forwards, func(i, j int) bool { return forwards[i].n < forwards[j].n })
+
+	source := AddressInputList{}
+	destination := AddressInputList{}
+
+	for _, f := range forwards {
+		addrs := strings.SplitN(f.value, "=", 2)
+		if len(addrs) != 2 {
+			return nil, nil, fmt.Errorf("invalid forward %s%d: %s: expected <source>=<destination>", ForwardEnvVarPrefix, f.n, f.value)
+		}
+
+		if err := source.Set(addrs[0]); err != nil {
+			return nil, nil, fmt.Errorf("invalid source address on %s%d: %v", ForwardEnvVarPrefix, f.n, err)
+		}
+
+		if err := destination.Set(addrs[1]); err != nil {
+			return nil, nil, fmt.Errorf("invalid destination address on %s%d: %v", ForwardEnvVarPrefix, f.n, err)
+		}
+	}
+
+	return source, destination, nil
+}
@@ -0,0 +1,116 @@
+package mole
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/davrodpin/mole/fsutils"
+	"github.com/davrodpin/mole/rpc"
+	"github.com/davrodpin/mole/tunnel"
+)
+
+// watcherBufferSize is the number of events held for a watcher that can't
+// keep up with the tunnel, after which further events are dropped for it, so
+// slow watchers never hold the tunnel.
+const watcherBufferSize = 256
+
+// eventWatchers fans the events of the tunnel out to every client watching
+// them through the rpc server.
+var eventWatchers = &watchers{chans: make(map[chan tunnel.Event]struct{})}
+
+type watchers struct {
+	mu    sync.RWMutex
+	chans map[chan tunnel.Event]struct{}
+}
+
+// publish hands the event to every watcher with room for it.
+func (w *watchers) publish(event tunnel.Event) {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+
+	for ch := range w.chans {
+		select {
+		case ch <- event:
+		default:
+		}
+	}
+}
+
+func (w *watchers) add() chan tunnel.Event {
+	ch := make(chan tunnel.Event, watcherBufferSize)
+
+	w.mu.Lock()
+	w.chans[ch] = struct{}{}
+	w.mu.Unlock()
+
+	return ch
+}
+
+func (w *watchers) remove(ch chan tunnel.Event) {
+	w.mu.Lock()
+	delete(w.chans, ch)
+	w.mu.Unlock()
+}
+
+// watchEvents hands the events of the tunnel to the clients watching them
+// through the rpc server.
+func (c *Client) watchEvents() {
+	if !c.Conf.Rpc {
+		return
+	}
+
+	c.Tunnel.Notify = eventWatchers.publish
+}
+
+// WatchRpc is a rpc stream that sends every event of the tunnel as it
+// happens (e.g. connections forwarded), until the client disconnects.
+func WatchRpc(params interface{}, notify func(v interface{}) error, done <-chan struct{}) error {
+	if cli == nil || cli.Tunnel == nil {
+		return fmt.Errorf("client tunnel could not be found.")
+	}
+
+	ch := eventWatchers.add()
+	defer eventWatchers.remove(ch)
+
+	for {
+		select {
+		case event := <-ch:
+			if err := notify(event); err != nil {
+				return err
+			}
+		case <-done:
+			return nil
+		}
+	}
+}
+
+// Watch writes the events of another mole instance, given its id or alias, to
+// the given writer as they happen, one JSON object per line, until the
+// instance is gone.
+func Watch(id string, w io.Writer) error {
+	addr, err := fsutils.RpcAddress(id)
+	if err != nil {
+		return err
+	}
+
+	events := make(chan json.RawMessage)
+	result := make(chan error, 1)
+
+	go func() {
+		result <- rpc.Watch(context.Background(), addr, "watch", nil, events)
+	}()
+
+	for {
+		select {
+		case event := <-events:
+			if _, err := fmt.Fprintf(w, "%s\n", event); err != nil {
+				return err
+			}
+		case err := <-result:
+			return err
+		}
+	}
+}
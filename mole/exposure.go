@@ -0,0 +1,90 @@
+package mole
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+const (
+	// ExposureWarn logs a warning for every channel exposing a sensitive port.
+	ExposureWarn = "warn"
+
+	// ExposureRefuse refuses to start a tunnel with any channel exposing a
+	// sensitive port.
+	ExposureRefuse = "refuse"
+
+	// ExposureOff disables the exposure check.
+	ExposureOff = "off"
+)
+
+// DefaultSensitivePorts lists the destination ports of services that are
+// rarely meant to be reachable from the whole network, like databases.
+var DefaultSensitivePorts = []string{
+	"22",    // ssh
+	"1433",  // mssql
+	"1521",  // oracle
+	"2379",  // etcd
+	"3306",  // mysql
+	"5432",  // postgres
+	"6379",  // redis
+	"9200",  // elasticsearch
+	"11211", // memcached
+	"27017", // mongodb
+}
+
+// CheckExposure returns an error describing every channel that listens on a
+// non-loopback address while forwarding to one of the sensitive ports of the
+// configuration (e.g. --source 0.0.0.0:5432 --destination db:5432), which
+// would expose the destination to anyone on the network.
+//
+// Unix sockets and channels listening on the loopback interface are never
+// reported.
+func (c Configuration) CheckExposure() error {
+	if c.TunnelType != "local" && c.TunnelType != "remote" {
+		return nil
+	}
+
+	sensitive := make(map[string]bool, len(c.SensitivePorts))
+	for _, p := range c.SensitivePorts {
+		port, err := lookupPort(p)
+		if err != nil {
+			return fmt.Errorf("invalid sensitive port %s: %v", p, err)
+		}
+
+		sensitive[port] = true
+	}
+
+	var exposed []string
+
+	for i, dst := range c.Destination {
+		if i >= len(c.Source) || dst.IsSocket() || !sensitive[dst.Port] {
+			continue
+		}
+
+		src := c.Source[i]
+		if src.IsSocket() || isLoopbackHost(src.Host) {
+			continue
+		}
+
+		exposed = append(exposed, fmt.Sprintf("%s -> %s", src.Address(), dst.Address()))
+	}
+
+	if len(exposed) > 0 {
+		return fmt.Errorf("sensitive ports exposed on non-loopback addresses: %s", strings.Join(exposed, ", "))
+	}
+
+	return nil
+}
+
+// isLoopbackHost tells if the given host name or address refers to the
+// loopback interface. An empty host is listened on the loopback interface.
+func isLoopbackHost(host string) bool {
+	if host == "" || host == "localhost" {
+		return true
+	}
+
+	ip := net.ParseIP(host)
+
+	return ip != nil && ip.IsLoopback()
+}
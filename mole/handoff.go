@@ -0,0 +1,191 @@
+package mole
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/davrodpin/mole/fsutils"
+	"github.com/davrodpin/mole/tunnel"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// HandoffDir is the directory, inside the instance directory, holding the
+	// handoff socket. It is only accessible by the user running mole.
+	HandoffDir = "handoff"
+
+	// HandoffSocketFile is the unix socket, inside the handoff directory,
+	// through which a new mole process takes over the listeners of a running
+	// instance.
+	HandoffSocketFile = "handoff.sock"
+
+	// handoffDone is sent by the process taking over the listeners once it
+	// holds them, telling the previous owner to stop.
+	handoffDone = "done\n"
+
+	// handoffTimeout is the maximum amount of time waited for each step of a
+	// listeners handoff.
+	handoffTimeout = 10 * time.Second
+)
+
+// HandoffSocket returns the location of the handoff socket of the instance
+// with the given id.
+func HandoffSocket(id string) (string, error) {
+	d, err := fsutils.InstanceDir(id)
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Join(d.Dir, HandoffDir, HandoffSocketFile), nil
+}
+
+// ServeHandoff listens on the handoff socket of the instance with the given id,
+// handing the listeners returned by listeners over to any mole process
+// connecting to it (see Takeover). done is called once a process confirms it
+// took the listeners over, and that process keeps waiting until done returns
+// or this process exits, so done is where the listeners and any other
+// resource shared with the new process (e.g. the instance id) are let go.
+//
+// The socket is only accessible by the user running mole.
+func ServeHandoff(id string, listeners func() map[string]net.Listener, done func()) (net.Listener, error) {
+	path, err := HandoffSocket(id)
+	if err != nil {
+		return nil, err
+	}
+
+	dir := filepath.Dir(path)
+
+	err = os.MkdirAll(filepath.Dir(dir), 0755)
+	if err != nil {
+		return nil, err
+	}
+
+	// the socket is created inside a directory no other user can get into, so
+	// no one else can connect to it, whatever permissions it is created with.
+	err = os.Mkdir(dir, 0700)
+	if err != nil && !os.IsExist(err) {
+		return nil, err
+	}
+
+	err = os.Chmod(dir, 0700)
+	if err != nil {
+		return nil, err
+	}
+
+	// a socket left behind by a previous instance with the same id
+	err = os.Remove(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	lis, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+	if err != nil {
+		return nil, err
+	}
+
+	go func() {
+		for {
+			conn, err := lis.AcceptUnix()
+			if err != nil {
+				return
+			}
+
+			if handOver(conn, listeners()) {
+				lis.Close()
+				done()
+				conn.Close()
+
+				return
+			}
+		}
+	}()
+
+	return lis, nil
+}
+
+// handOver sends the listeners through the given connection, returning true if
+// the process on the other side confirmed it took them over.
+//
+// On success the connection is left open: the other process waits for it to
+// be closed before moving on.
+func handOver(conn *net.UnixConn, listeners map[string]net.Listener) bool {
+	err := conn.SetDeadline(time.Now().Add(handoffTimeout))
+	if err != nil {
+		conn.Close()
+		return false
+	}
+
+	err = tunnel.SendListeners(conn, listeners)
+	if err != nil {
+		log.WithError(err).Warn("error handing listeners over to another mole process")
+		conn.Close()
+
+		return false
+	}
+
+	ack, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil || ack != handoffDone {
+		log.WithError(err).Warn("listeners handoff not confirmed by the other mole process, keeping them")
+		conn.Close()
+
+		return false
+	}
+
+	log.Infof("%d listeners taken over by another mole process", len(listeners))
+
+	return true
+}
+
+// Takeover receives the listeners of the running mole instance with the given
+// id through its handoff socket, then waits for the instance to let go of its
+// resources (e.g. the instance id) and stop.
+//
+// Connections arriving meanwhile wait on the listeners backlog, so no
+// connection is refused during the handoff. Connections already established
+// through the previous instance are closed when it stops.
+func Takeover(id string) (map[string]net.Listener, error) {
+	path, err := HandoffSocket(id)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := net.DialUnix("unix", nil, &net.UnixAddr{Name: path, Net: "unix"})
+	if err != nil {
+		return nil, fmt.Errorf("could not reach instance %s to take over its listeners: %v", id, err)
+	}
+	defer conn.Close()
+
+	err = conn.SetDeadline(time.Now().Add(handoffTimeout))
+	if err != nil {
+		return nil, err
+	}
+
+	listeners, err := tunnel.ReceiveListeners(conn)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = conn.Write([]byte(handoffDone))
+	if err != nil {
+		for _, l := range listeners {
+			l.Close()
+		}
+
+		return nil, fmt.Errorf("error confirming the listeners handoff: %v", err)
+	}
+
+	// the connection is closed by the previous owner of the listeners once it
+	// let go of them, usually by exiting.
+	_, err = ioutil.ReadAll(conn)
+	if err != nil {
+		log.WithError(err).Warnf("instance %s has not stopped after handing its listeners over", id)
+	}
+
+	return listeners, nil
+}
@@ -0,0 +1,86 @@
+package mole
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+	"time"
+
+	"github.com/davrodpin/mole/tunnel"
+)
+
+const (
+	// HookDisconnect is the event of a hook command run once the tunnel loses
+	// its connection to the ssh server.
+	HookDisconnect = "disconnect"
+
+	// HookReconnect is the event of a hook command run once the tunnel is
+	// ready again after reconnecting to the ssh server.
+	HookReconnect = "reconnect"
+
+	// HookReady is the event of the command run once the tunnel is ready for
+	// the first time (see --exec-once).
+	HookReady = "ready"
+)
+
+// Hook describes a tunnel event a hook command is run for. Each attribute is
+// given to the command as an environment variable.
+type Hook struct {
+	// Event is either HookDisconnect, HookReconnect or HookReady, given as
+	// $MOLE_EVENT.
+	Event string
+	// Id is the identifier of the mole instance, given as $MOLE_ID.
+	Id string
+	// Server is the address of the ssh server, given as $MOLE_SERVER.
+	Server string
+	// Time is when the event happened, given as $MOLE_TIMESTAMP in RFC 3339
+	// format.
+	Time time.Time
+	// Err is the reason the connection was lost, given as $MOLE_ERROR, if any.
+	Err error
+	// Channels are the channels of the tunnel, which source addresses are
+	// given as MOLE_<TYPE>_<N>, like on the environment file.
+	Channels []*tunnel.SSHChannel
+}
+
+// Env returns the environment variables describing the hook event.
+func (h Hook) Env() []string {
+	env := []string{
+		fmt.Sprintf("%s_EVENT=%s", EnvVarPrefix, h.Event),
+		fmt.Sprintf("%s_ID=%s", EnvVarPrefix, h.Id),
+		fmt.Sprintf("%s_SERVER=%s", EnvVarPrefix, h.Server),
+		fmt.Sprintf("%s_TIMESTAMP=%s", EnvVarPrefix, h.Time.Format(time.RFC3339)),
+	}
+
+	if h.Err != nil {
+		env = append(env, fmt.Sprintf("%s_ERROR=%s", EnvVarPrefix, h.Err))
+	}
+
+	return append(env, channelsEnv(h.Channels)...)
+}
+
+// RunHook runs the given command through the system shell, along with the
+// environment of mole and the variables describing the hook event, returning
+// once the command is done.
+func RunHook(command string, hook Hook) error {
+	var cmd *exec.Cmd
+	if runtime.GOOS == "windows" {
+		cmd = exec.Command("cmd", "/C", command)
+	} else {
+		cmd = exec.Command("sh", "-c", command)
+	}
+
+	cmd.Env = append(os.Environ(), hook.Env()...)
+
+	var output bytes.Buffer
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("%s hook failed: %v: %s", hook.Event, err, bytes.TrimSpace(output.Bytes()))
+	}
+
+	return nil
+}
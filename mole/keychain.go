@@ -0,0 +1,174 @@
+package mole
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"os/exec"
+	"runtime"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// KeychainService is the service name under which key passphrases are saved
+// on the operating system secret store, with the key file as account name.
+const KeychainService = "mole"
+
+// keychainCommand runs a command of the operating system secret store,
+// writing stdin to it and returning its standard output.
+var keychainCommand = func(stdin []byte, name string, args ...string) ([]byte, error) {
+	cmd := exec.Command(name, args...)
+	cmd.Stdin = bytes.NewReader(stdin)
+
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("%s failed: %v: %s", name, err, bytes.TrimSpace(stderr.Bytes()))
+	}
+
+	return out, nil
+}
+
+// KeychainPassphrase retrieves the passphrase of the given key file from the
+// operating system secret store: the macOS Keychain, through the security
+// command, or any Secret Service implementation (e.g. GNOME Keyring), through
+// the secret-tool command.
+func KeychainPassphrase(keyPath string) ([]byte, error) {
+	var out []byte
+	var err error
+
+	switch runtime.GOOS {
+	case "darwin":
+		out, err = keychainCommand(nil, "security", "find-generic-password", "-s", KeychainService, "-a", keyPath, "-w")
+	case "linux", "freebsd", "openbsd", "netbsd":
+		out, err = keychainCommand(nil, "secret-tool", "lookup", "service", KeychainService, "key", keyPath)
+	default:
+		return nil, fmt.Errorf("no secret store supported on %s", runtime.GOOS)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	pp := bytes.TrimRight(out, "\r\n")
+	if len(pp) == 0 {
+		return nil, fmt.Errorf("no passphrase saved for key %s", keyPath)
+	}
+
+	return pp, nil
+}
+
+// SaveKeychainPassphrase saves the passphrase of the given key file on the
+// operating system secret store, replacing any passphrase saved before.
+func SaveKeychainPassphrase(keyPath string, passphrase []byte) error {
+	var err error
+
+	switch runtime.GOOS {
+	case "darwin":
+		// the arguments of a process can be read by any user (e.g. through ps),
+		// so the command is given to security on its standard input instead,
+		// in interactive mode.
+		cmd := securityAddCommand(keyPath, passphrase)
+		defer wipe(cmd)
+
+		_, err = keychainCommand(cmd, "security", "-i")
+	case "linux", "freebsd", "openbsd", "netbsd":
+		_, err = keychainCommand(passphrase, "secret-tool", "store", "--label", fmt.Sprintf("mole: passphrase of %s", keyPath), "service", KeychainService, "key", keyPath)
+	default:
+		err = fmt.Errorf("no secret store supported on %s", runtime.GOOS)
+	}
+
+	return err
+}
+
+// securityAddCommand returns the command saving the passphrase of the given
+// key file on the macOS Keychain, as read by security in interactive mode.
+// The passphrase is given hex encoded, so it needs no quoting.
+func securityAddCommand(keyPath string, passphrase []byte) []byte {
+	var cmd bytes.Buffer
+
+	fmt.Fprintf(&cmd, "add-generic-password -U -s %s -a %s -X ", quoteSecurityArg(KeychainService), quoteSecurityArg(keyPath))
+
+	pp := make([]byte, hex.EncodedLen(len(passphrase)))
+	hex.Encode(pp, passphrase)
+	cmd.Write(pp)
+	cmd.WriteByte('\n')
+	wipe(pp)
+
+	return cmd.Bytes()
+}
+
+// quoteSecurityArg quotes an argument of a command read by security in
+// interactive mode, which splits its arguments as a shell would.
+func quoteSecurityArg(arg string) string {
+	return "'" + strings.ReplaceAll(arg, "'", `'"'"'`) + "'"
+}
+
+// keychainHandler wraps a passphrase prompt so the passphrase is first looked
+// up on the operating system secret store, falling back to the prompt when the
+// store is unavailable or the passphrase found there is wrong.
+//
+// The passphrase typed at the prompt is kept, so it can be saved on the secret
+// store once it proved to decrypt the key (see finish).
+type keychainHandler struct {
+	keyPath string
+	prompt  func() ([]byte, error)
+	tried   bool
+	typed   []byte
+}
+
+func (h *keychainHandler) passphrase() ([]byte, error) {
+	wipe(h.typed)
+	h.typed = nil
+
+	if !h.tried {
+		h.tried = true
+
+		pp, err := KeychainPassphrase(h.keyPath)
+		if err == nil {
+			return pp, nil
+		}
+
+		log.WithError(err).Debug("could not retrieve the key passphrase from the secret store")
+	}
+
+	pp, err := h.prompt()
+	if err != nil {
+		return nil, err
+	}
+
+	// the passphrase returned is wiped once recorded by the key.
+	h.typed = append([]byte(nil), pp...)
+
+	return pp, nil
+}
+
+// finish saves the last passphrase typed at the prompt, if any, on the secret
+// store when it decrypted the key, wiping it from memory in any case.
+func (h *keychainHandler) finish(decrypted bool) {
+	defer func() {
+		wipe(h.typed)
+		h.typed = nil
+	}()
+
+	if !decrypted || h.typed == nil {
+		return
+	}
+
+	err := SaveKeychainPassphrase(h.keyPath, h.typed)
+	if err != nil {
+		log.WithError(err).Warn("could not save the key passphrase on the secret store")
+		return
+	}
+
+	log.Infof("passphrase of %s saved on the secret store", h.keyPath)
+}
+
+func wipe(b []byte) {
+	for i := range b {
+		b[i] = 0
+	}
+}
@@ -0,0 +1,19 @@
+package mole
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSecurityAddCommand(t *testing.T) {
+	cmd := string(securityAddCommand("/home/o'brien/.ssh/id rsa", []byte("s3cr3t 'pp'")))
+
+	expected := `add-generic-password -U -s 'mole' -a '/home/o'"'"'brien/.ssh/id rsa' -X 7333637233742027707027` + "\n"
+	if cmd != expected {
+		t.Errorf("unexpected command: want: %q, got: %q", expected, cmd)
+	}
+
+	if strings.Contains(cmd, "s3cr3t") {
+		t.Errorf("passphrase expected to be hex encoded: %q", cmd)
+	}
+}
@@ -1,12 +1,17 @@
 package mole
 
 import (
+	"bufio"
 	"context"
 	"fmt"
 	"io/ioutil"
+	"net"
 	"os"
 	"os/signal"
 	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
 	"syscall"
 	"time"
 
@@ -27,6 +32,19 @@ const (
 	// IdFlagName is the name of the flag that carries the unique idenfier for a
 	// mole instance.
 	IdFlagName = "id"
+
+	// StrictEnvVar is the environment variable that, when set to true,
+	// enables strict mode just like the --strict flag.
+	StrictEnvVar = "MOLE_STRICT"
+
+	// DefaultDrainTimeout is the time a detached instance asked to terminate
+	// waits for the connections being forwarded to be closed.
+	DefaultDrainTimeout = 10 * time.Second
+
+	// DefaultEgressPolicyFile is the egress policy applied to every tunnel,
+	// if the file exists, when no other policy is given (e.g. set up by the
+	// operators of a shared bastion).
+	DefaultEgressPolicyFile = "/etc/mole/egress.policy"
 )
 
 // cli keeps a reference to the latest Client object created.
@@ -35,45 +53,174 @@ const (
 var cli *Client
 
 type Configuration struct {
-	Id                string           `json:"id" mapstructure:"id" toml:"id"`
-	TunnelType        string           `json:"tunnel-type" mapstructure:"tunnel-type" toml:"tunnel-type"`
-	Verbose           bool             `json:"verbose" mapstructure:"verbose" toml:"verbose"`
-	Insecure          bool             `json:"insecure" mapstructure:"insecure" toml:"insecure"`
-	Detach            bool             `json:"detach" mapstructure:"detach" toml:"detach"`
-	Source            AddressInputList `json:"source" mapstructure:"source" toml:"source"`
-	Destination       AddressInputList `json:"destination" mapstructure:"destination" toml:"destination"`
-	Server            AddressInput     `json:"server" mapstructure:"server" toml:"server"`
-	Key               string           `json:"key" mapstructure:"key" toml:"key"`
-	KeepAliveInterval time.Duration    `json:"keep-alive-interval" mapstructure:"keep-alive-interva" toml:"keep-alive-interval"`
-	ConnectionRetries int              `json:"connection-retries" mapstructure:"connection-retries" toml:"connection-retries"`
-	WaitAndRetry      time.Duration    `json:"wait-and-retry" mapstructure:"wait-and-retry" toml:"wait-and-retry"`
-	SshAgent          string           `json:"ssh-agent" mapstructure:"ssh-agent" toml:"ssh-agent"`
-	Timeout           time.Duration    `json:"timeout" mapstructure:"timeout" toml:"timeout"`
-	SshConfig         string           `json:"ssh-config" mapstructure:"ssh-config" toml:"ssh-config"`
-	Rpc               bool             `json:"rpc" mapstructure:"rpc" toml:"rpc"`
-	RpcAddress        string           `json:"rpc-address" mapstructure:"rpc-address" toml:"rpc-address"`
+	Id                    string           `json:"id" mapstructure:"id" toml:"id"`
+	TunnelType            string           `json:"tunnel-type" mapstructure:"tunnel-type" toml:"tunnel-type"`
+	Verbose               bool             `json:"verbose" mapstructure:"verbose" toml:"verbose"`
+	Insecure              bool             `json:"insecure" mapstructure:"insecure" toml:"insecure"`
+	Strict                bool             `json:"strict" mapstructure:"strict" toml:"strict"`
+	Detach                bool             `json:"detach" mapstructure:"detach" toml:"detach"`
+	SyncLog               bool             `json:"sync-log" mapstructure:"sync-log" toml:"sync-log"`
+	StickyPorts           bool             `json:"sticky-ports" mapstructure:"sticky-ports" toml:"sticky-ports"`
+	Source                AddressInputList `json:"source" mapstructure:"source" toml:"source"`
+	Destination           AddressInputList `json:"destination" mapstructure:"destination" toml:"destination"`
+	DestinationCommand    string           `json:"destination-command" mapstructure:"destination-command" toml:"destination-command"`
+	TunDevice             string           `json:"tun-device" mapstructure:"tun-device" toml:"tun-device"`
+	ManifestCommand       string           `json:"manifest-command" mapstructure:"manifest-command" toml:"manifest-command"`
+	QuietSource           AddressInputList `json:"quiet-source" mapstructure:"quiet-source" toml:"quiet-source"`
+	HTTPError             AddressInputList `json:"http-error" mapstructure:"http-error" toml:"http-error"`
+	AllowCidr             []string         `json:"allow-cidr" mapstructure:"allow-cidr" toml:"allow-cidr"`
+	Prewarm               []string         `json:"prewarm" mapstructure:"prewarm" toml:"prewarm"`
+	RemoteTLS             []string         `json:"remote-tls" mapstructure:"remote-tls" toml:"remote-tls"`
+	LocalTLSCert          []string         `json:"local-tls-cert" mapstructure:"local-tls-cert" toml:"local-tls-cert"`
+	LocalTLSKey           []string         `json:"local-tls-key" mapstructure:"local-tls-key" toml:"local-tls-key"`
+	Via                   []string         `json:"via" mapstructure:"via" toml:"via"`
+	DialSource            []string         `json:"dial-source" mapstructure:"dial-source" toml:"dial-source"`
+	Protocol              []string         `json:"protocol" mapstructure:"protocol" toml:"protocol"`
+	Server                AddressInput     `json:"server" mapstructure:"server" toml:"server"`
+	FallbackServer        []string         `json:"fallback-server" mapstructure:"fallback-server" toml:"fallback-server"`
+	Jump                  []string         `json:"jump" mapstructure:"jump" toml:"jump"`
+	User                  string           `json:"user" mapstructure:"user" toml:"user"`
+	Port                  string           `json:"port" mapstructure:"port" toml:"port"`
+	Interface             string           `json:"interface" mapstructure:"interface" toml:"interface"`
+	Key                   string           `json:"key" mapstructure:"key" toml:"key"`
+	KeyEnv                string           `json:"key-env" mapstructure:"key-env" toml:"key-env"`
+	IdentitiesOnly        bool             `json:"identities-only" mapstructure:"identities-only" toml:"identities-only"`
+	NoDefaultKey          bool             `json:"no-default-key" mapstructure:"no-default-key" toml:"no-default-key"`
+	Netrc                 bool             `json:"netrc" mapstructure:"netrc" toml:"netrc"`
+	InteractiveAuth       bool             `json:"interactive-auth" mapstructure:"interactive-auth" toml:"interactive-auth"`
+	PassphraseAttempts    int              `json:"passphrase-attempts" mapstructure:"passphrase-attempts" toml:"passphrase-attempts"`
+	UseKeychain           bool             `json:"use-keychain" mapstructure:"use-keychain" toml:"use-keychain"`
+	RSASigAlgorithms      []string         `json:"rsa-signature-algorithms" mapstructure:"rsa-signature-algorithms" toml:"rsa-signature-algorithms"`
+	KnownHosts            []string         `json:"known-hosts" mapstructure:"known-hosts" toml:"known-hosts"`
+	KeepAliveInterval     time.Duration    `json:"keep-alive-interval" mapstructure:"keep-alive-interva" toml:"keep-alive-interval"`
+	KeepAliveData         bool             `json:"keep-alive-data" mapstructure:"keep-alive-data" toml:"keep-alive-data"`
+	KeepAliveIdleOnly     bool             `json:"keep-alive-idle-only" mapstructure:"keep-alive-idle-only" toml:"keep-alive-idle-only"`
+	KeepAliveInitialDelay time.Duration    `json:"keep-alive-initial-delay" mapstructure:"keep-alive-initial-delay" toml:"keep-alive-initial-delay"`
+	ConnectionRetries     int              `json:"connection-retries" mapstructure:"connection-retries" toml:"connection-retries"`
+	MaxReconnects         int              `json:"max-reconnects" mapstructure:"max-reconnects" toml:"max-reconnects"`
+	MaxPendingOpens       int              `json:"max-pending-opens" mapstructure:"max-pending-opens" toml:"max-pending-opens"`
+	MaxChannels           int              `json:"max-channels" mapstructure:"max-channels" toml:"max-channels"`
+	WaitAndRetry          time.Duration    `json:"wait-and-retry" mapstructure:"wait-and-retry" toml:"wait-and-retry"`
+	StablePeriod          time.Duration    `json:"stable-connection-period" mapstructure:"stable-connection-period" toml:"stable-connection-period"`
+	Supervise             time.Duration    `json:"supervise" mapstructure:"supervise" toml:"supervise"`
+	LogRateLimit          time.Duration    `json:"log-rate-limit" mapstructure:"log-rate-limit" toml:"log-rate-limit"`
+	WaitForRemote         time.Duration    `json:"wait-for-remote" mapstructure:"wait-for-remote" toml:"wait-for-remote"`
+	NetworkCheck          time.Duration    `json:"network-check-interval" mapstructure:"network-check-interval" toml:"network-check-interval"`
+	SshAgent              string           `json:"ssh-agent" mapstructure:"ssh-agent" toml:"ssh-agent"`
+	Timeout               time.Duration    `json:"timeout" mapstructure:"timeout" toml:"timeout"`
+	DnsTimeout            time.Duration    `json:"dns-timeout" mapstructure:"dns-timeout" toml:"dns-timeout"`
+	RemoteDialTimeout     time.Duration    `json:"remote-dial-timeout" mapstructure:"remote-dial-timeout" toml:"remote-dial-timeout"`
+	MigrationTimeout      time.Duration    `json:"migration-timeout" mapstructure:"migration-timeout" toml:"migration-timeout"`
+	InitialReadTimeout    time.Duration    `json:"initial-read-timeout" mapstructure:"initial-read-timeout" toml:"initial-read-timeout"`
+	DrainTimeout          time.Duration    `json:"drain-timeout" mapstructure:"drain-timeout" toml:"drain-timeout"`
+	HalfClose             bool             `json:"half-close" mapstructure:"half-close" toml:"half-close"`
+	Trace                 bool             `json:"trace" mapstructure:"trace" toml:"trace"`
+	TraceLimit            int              `json:"trace-limit" mapstructure:"trace-limit" toml:"trace-limit"`
+	ExposureCheck         string           `json:"exposure-check" mapstructure:"exposure-check" toml:"exposure-check"`
+	SensitivePorts        []string         `json:"sensitive-ports" mapstructure:"sensitive-ports" toml:"sensitive-ports"`
+	HostAlias             []string         `json:"host-alias" mapstructure:"host-alias" toml:"host-alias"`
+	EgressPolicy          string           `json:"egress-policy" mapstructure:"egress-policy" toml:"egress-policy"`
+	SshConfig             string           `json:"ssh-config" mapstructure:"ssh-config" toml:"ssh-config"`
+	Rpc                   bool             `json:"rpc" mapstructure:"rpc" toml:"rpc"`
+	RpcAddress            string           `json:"rpc-address" mapstructure:"rpc-address" toml:"rpc-address"`
+	ControlSocketMode     string           `json:"control-socket-mode" mapstructure:"control-socket-mode" toml:"control-socket-mode"`
+	EnvFile               string           `json:"env-file" mapstructure:"env-file" toml:"env-file"`
+	OnDisconnect          string           `json:"on-disconnect" mapstructure:"on-disconnect" toml:"on-disconnect"`
+	OnReconnect           string           `json:"on-reconnect" mapstructure:"on-reconnect" toml:"on-reconnect"`
+	ExecOnce              string           `json:"exec-once" mapstructure:"exec-once" toml:"exec-once"`
+	Pprof                 string           `json:"pprof" mapstructure:"pprof" toml:"pprof"`
+	Takeover              string           `json:"takeover" mapstructure:"takeover" toml:"takeover"`
+	Force                 bool             `json:"force" mapstructure:"force" toml:"force"`
+	Verify                bool             `json:"verify" mapstructure:"verify" toml:"verify"`
+
+	// memoryKey is the key read from the standard input or from an
+	// environment variable, which can only be read once.
+	memoryKey *tunnel.PemKey
+	// alias is the name of the alias the configuration was merged with, if
+	// any, and lastSource the source addresses its channels listened on
+	// the last time it was started (see StickyPorts).
+	alias      string
+	lastSource []string
 }
 
 // ParseAlias translates a Configuration object to an Alias object.
 func (c Configuration) ParseAlias(name string) *alias.Alias {
 	return &alias.Alias{
-		Name:              name,
-		TunnelType:        c.TunnelType,
-		Verbose:           c.Verbose,
-		Insecure:          c.Insecure,
-		Detach:            c.Detach,
-		Source:            c.Source.List(),
-		Destination:       c.Destination.List(),
-		Server:            c.Server.String(),
-		Key:               c.Key,
-		KeepAliveInterval: c.KeepAliveInterval.String(),
-		ConnectionRetries: c.ConnectionRetries,
-		WaitAndRetry:      c.WaitAndRetry.String(),
-		SshAgent:          c.SshAgent,
-		Timeout:           c.Timeout.String(),
-		SshConfig:         c.SshConfig,
-		Rpc:               c.Rpc,
-		RpcAddress:        c.RpcAddress,
+		Name:                  name,
+		TunnelType:            c.TunnelType,
+		Verbose:               c.Verbose,
+		Insecure:              c.Insecure,
+		Strict:                c.Strict,
+		Detach:                c.Detach,
+		SyncLog:               c.SyncLog,
+		StickyPorts:           c.StickyPorts,
+		Source:                c.Source.List(),
+		Destination:           c.Destination.List(),
+		DestinationCommand:    c.DestinationCommand,
+		ManifestCommand:       c.ManifestCommand,
+		QuietSource:           c.QuietSource.List(),
+		HTTPError:             c.HTTPError.List(),
+		AllowCidr:             c.AllowCidr,
+		Prewarm:               c.Prewarm,
+		RemoteTLS:             c.RemoteTLS,
+		LocalTLSCert:          c.LocalTLSCert,
+		LocalTLSKey:           c.LocalTLSKey,
+		Via:                   c.Via,
+		DialSource:            c.DialSource,
+		Protocol:              c.Protocol,
+		FallbackServer:        c.FallbackServer,
+		Jump:                  c.Jump,
+		Server:                c.Server.String(),
+		User:                  c.User,
+		Port:                  c.Port,
+		Interface:             c.Interface,
+		Key:                   c.Key,
+		KeyEnv:                c.KeyEnv,
+		IdentitiesOnly:        c.IdentitiesOnly,
+		NoDefaultKey:          c.NoDefaultKey,
+		Netrc:                 c.Netrc,
+		InteractiveAuth:       c.InteractiveAuth,
+		PassphraseAttempts:    c.PassphraseAttempts,
+		UseKeychain:           c.UseKeychain,
+		RSASigAlgorithms:      c.RSASigAlgorithms,
+		KnownHosts:            c.KnownHosts,
+		KeepAliveInterval:     c.KeepAliveInterval.String(),
+		KeepAliveData:         c.KeepAliveData,
+		KeepAliveIdleOnly:     c.KeepAliveIdleOnly,
+		KeepAliveInitialDelay: c.KeepAliveInitialDelay.String(),
+		ConnectionRetries:     c.ConnectionRetries,
+		MaxReconnects:         c.MaxReconnects,
+		MaxPendingOpens:       c.MaxPendingOpens,
+		MaxChannels:           c.MaxChannels,
+		WaitAndRetry:          c.WaitAndRetry.String(),
+		StablePeriod:          c.StablePeriod.String(),
+		Supervise:             c.Supervise.String(),
+		LogRateLimit:          c.LogRateLimit.String(),
+		WaitForRemote:         c.WaitForRemote.String(),
+		NetworkCheckInterval:  c.NetworkCheck.String(),
+		SshAgent:              c.SshAgent,
+		HostAlias:             c.HostAlias,
+		Timeout:               c.Timeout.String(),
+		DnsTimeout:            c.DnsTimeout.String(),
+		RemoteDialTimeout:     c.RemoteDialTimeout.String(),
+		MigrationTimeout:      c.MigrationTimeout.String(),
+		InitialReadTimeout:    c.InitialReadTimeout.String(),
+		DrainTimeout:          c.DrainTimeout.String(),
+		HalfClose:             c.HalfClose,
+		Trace:                 c.Trace,
+		TraceLimit:            c.TraceLimit,
+		ExposureCheck:         c.ExposureCheck,
+		SensitivePorts:        c.SensitivePorts,
+		EgressPolicy:          c.EgressPolicy,
+		SshConfig:             c.SshConfig,
+		Rpc:                   c.Rpc,
+		RpcAddress:            c.RpcAddress,
+		ControlSocketMode:     c.ControlSocketMode,
+		EnvFile:               c.EnvFile,
+		OnDisconnect:          c.OnDisconnect,
+		OnReconnect:           c.OnReconnect,
+		ExecOnce:              c.ExecOnce,
+		Pprof:                 c.Pprof,
 	}
 }
 
@@ -82,6 +229,9 @@ type Client struct {
 	Conf   *Configuration
 	Tunnel *tunnel.Tunnel
 	sigs   chan os.Signal
+	// notifySystemd tells if mole runs as a systemd service expecting
+	// readiness notifications.
+	notifySystemd bool
 }
 
 // New initializes a new mole's client.
@@ -101,6 +251,76 @@ func (c *Client) Start() error {
 	// This call makes sure all data will be destroy when the program exits.
 	defer memguard.Purge()
 
+	// the standard output carries the forwarded data on stdio tunnels
+	if c.Conf.TunnelType == "stdio" {
+		log.SetOutput(os.Stderr)
+
+		if c.Conf.Detach {
+			return fmt.Errorf("stdio tunnels can't be detached")
+		}
+	}
+
+	if c.Conf.Detach && c.Conf.Key == KeyStdin && c.Conf.KeyEnv == "" {
+		return fmt.Errorf("a key read from the standard input can't be used by a detached instance")
+	}
+
+	if c.Conf.Detach && c.Conf.InteractiveAuth {
+		return fmt.Errorf("interactive authentication can't be used by a detached instance, which has no terminal to prompt on")
+	}
+
+	if strict, _ := strconv.ParseBool(os.Getenv(StrictEnvVar)); strict {
+		c.Conf.Strict = true
+	}
+
+	if c.Conf.Strict {
+		if err := c.Conf.CheckStrict(); err != nil {
+			log.WithError(err).Error("configuration refused by strict mode")
+			return err
+		}
+	}
+
+	switch c.Conf.ExposureCheck {
+	case "", ExposureOff:
+	case ExposureWarn, ExposureRefuse:
+		if err := c.Conf.CheckExposure(); err != nil {
+			if c.Conf.ExposureCheck == ExposureRefuse {
+				log.WithError(err).Error("configuration refused by exposure check")
+				return err
+			}
+
+			log.WithError(err).Warn("clients on the network may reach the destination of these channels")
+		}
+	default:
+		return fmt.Errorf("invalid exposure check %s: expected %s, %s or %s", c.Conf.ExposureCheck, ExposureWarn, ExposureRefuse, ExposureOff)
+	}
+
+	if c.Conf.Verify {
+		return c.verify()
+	}
+
+	socketMode, err := ParseSocketMode(c.Conf.ControlSocketMode)
+	if err != nil {
+		return err
+	}
+
+	// the listeners are taken over before anything else, since the previous
+	// instance may be using the same id.
+	var inherited map[string]net.Listener
+	if c.Conf.Takeover != "" {
+		var err error
+
+		inherited, err = Takeover(c.Conf.Takeover)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"id": c.Conf.Takeover,
+			}).WithError(err).Error("error taking over listeners")
+
+			return err
+		}
+
+		log.Infof("took over %d listeners from instance %s", len(inherited), c.Conf.Takeover)
+	}
+
 	if c.Conf.Id == "" {
 		u, err := uuid.NewV4()
 		if err != nil {
@@ -109,7 +329,13 @@ func (c *Client) Start() error {
 		c.Conf.Id = u.String()[:8]
 	}
 
-	r, err := c.Running()
+	// the process starting a detached instance already checked the id is not
+	// in use, and its pid may still be on the pid file while it exits.
+	var r bool
+	if !daemon.WasReborn() {
+		r, err = c.Running()
+	}
+
 	if err != nil {
 		log.WithFields(log.Fields{
 			"id": c.Conf.Id,
@@ -118,12 +344,23 @@ func (c *Client) Start() error {
 		return err
 	}
 
-	if r {
+	if r && c.Conf.Force {
+		err = c.replace()
+		if err != nil {
+			log.WithFields(log.Fields{
+				"id": c.Conf.Id,
+			}).WithError(err).Error("error stopping the instance using the same id")
+
+			return err
+		}
+
+		log.Infof("instance previously using the id %s stopped", c.Conf.Id)
+	} else if r {
 		log.WithFields(log.Fields{
 			"id": c.Conf.Id,
 		}).Error("can't start. Another instance is already using the same id")
 
-		return fmt.Errorf("can't start. Another instance is already using the same id %s", c.Conf.Id)
+		return fmt.Errorf("can't start. Another instance is already using the same id %s, use --force to replace it", c.Conf.Id)
 	}
 
 	log.Infof("instance identifier is %s", c.Conf.Id)
@@ -137,6 +374,35 @@ func (c *Client) Start() error {
 			return err
 		}
 
+		// listeners can't be inherited by the detached process, so they are
+		// handed over to it the same way they were taken over.
+		if inherited != nil && !daemon.WasReborn() {
+			handedOff := make(chan struct{})
+
+			_, err = ServeHandoff(c.Conf.Takeover, func() map[string]net.Listener { return inherited }, func() {
+				close(handedOff)
+
+				// the detached process can't start until this process is gone,
+				// which closes the handoff connection.
+				select {}
+			})
+			if err != nil {
+				log.WithError(err).Error("error handing listeners over to the detached process")
+				return err
+			}
+
+			ic.handedOff = handedOff
+		}
+
+		// the detached process only reports errors to its log file, so a host
+		// key that can't be verified is reported to the terminal beforehand.
+		if !daemon.WasReborn() {
+			err = verifyHostKey(c.Conf)
+			if err != nil {
+				return err
+			}
+		}
+
 		err = startDaemonProcess(ic)
 		if err != nil {
 			log.WithFields(log.Fields{
@@ -145,6 +411,15 @@ func (c *Client) Start() error {
 
 			return err
 		}
+
+		// the standard output of the detached process is the instance log file
+		if c.Conf.SyncLog {
+			log.SetOutput(syncWriter{os.Stdout})
+		}
+
+		// signals asking the process to terminate (e.g. sent by systemd or
+		// docker) are held until the tunnel is created and can be drained.
+		signal.Notify(c.sigs, syscall.SIGINT, syscall.SIGTERM)
 	} else {
 		go c.handleSignals()
 	}
@@ -163,11 +438,18 @@ func (c *Client) Start() error {
 	}
 
 	if c.Conf.Rpc {
-		addr, err := rpc.Start(c.Conf.RpcAddress)
+		address := c.Conf.RpcAddress
+		if address == "" {
+			address = rpc.DefaultAddress
+		}
+
+		lis, err := ListenControl(address, socketMode)
 		if err != nil {
 			return err
 		}
 
+		addr := rpc.Serve(lis)
+
 		rd := filepath.Join(d.Dir, "rpc")
 
 		err = ioutil.WriteFile(rd, []byte(addr.String()), 0644)
@@ -184,6 +466,16 @@ func (c *Client) Start() error {
 		log.Infof("rpc server address saved on %s", rd)
 	}
 
+	if c.Conf.Pprof != "" {
+		addr, err := StartPprof(c.Conf.Pprof, socketMode)
+		if err != nil {
+			log.WithError(err).Error("error starting pprof server")
+			return err
+		}
+
+		log.Infof("pprof endpoints available on http://%s/debug/pprof/", addr)
+	}
+
 	t, err := createTunnel(c.Conf)
 	if err != nil {
 		log.WithFields(log.Fields{
@@ -195,6 +487,45 @@ func (c *Client) Start() error {
 
 	c.Tunnel = t
 
+	if inherited != nil {
+		c.Tunnel.InheritListeners(inherited)
+	}
+
+	if tunnel.HandoffSupported && c.Conf.TunnelType == "local" {
+		_, err = ServeHandoff(c.Conf.Id, c.Tunnel.Listeners, func() {
+			err := c.Stop()
+			if err != nil {
+				log.WithError(err).Error("instance not properly stopped after handing its listeners over")
+			}
+		})
+		if err != nil {
+			log.WithError(err).Warn("error creating handoff socket, listeners can't be taken over by another mole process")
+		}
+	}
+
+	if os.Getenv("NOTIFY_SOCKET") != "" {
+		c.notifySystemd = true
+		c.watchSystemd()
+	}
+
+	if c.Conf.EnvFile != "" || c.notifySystemd || c.stickyPorts() || c.Conf.ExecOnce != "" {
+		go c.handleReady()
+	}
+
+	c.watchHooks()
+	c.watchEvents()
+
+	if c.Conf.Detach {
+		go c.handleTermination()
+		defer c.removeInstanceFiles()
+	}
+
+	// the interactive console is only available to tunnels running on the
+	// foreground of a terminal.
+	if !c.Conf.Detach && c.Conf.TunnelType != "stdio" && terminal.IsTerminal(int(os.Stdin.Fd())) {
+		go RunConsole(c.Tunnel, os.Stdin, os.Stdout)
+	}
+
 	if err = c.Tunnel.Start(); err != nil {
 		log.WithFields(log.Fields{
 			"tunnel": c.Tunnel.String(),
@@ -206,6 +537,39 @@ func (c *Client) Start() error {
 	return nil
 }
 
+// verify starts the tunnel just long enough to check it works, from the
+// connection to the ssh server to the destination of every channel, instead
+// of keeping it running.
+func (c *Client) verify() error {
+	if c.Conf.Detach {
+		return fmt.Errorf("a tunnel being verified can't be detached")
+	}
+
+	if c.Conf.Verbose {
+		log.SetLevel(log.DebugLevel)
+	}
+
+	t, err := createTunnel(c.Conf)
+	if err != nil {
+		log.WithError(err).Error("error creating tunnel")
+		return err
+	}
+
+	c.Tunnel = t
+
+	if err = t.Verify(); err != nil {
+		log.WithFields(log.Fields{
+			"tunnel": t.String(),
+		}).WithError(err).Error("tunnel verification failed")
+
+		return err
+	}
+
+	log.Info("tunnel verified")
+
+	return nil
+}
+
 // Stop shuts down a detached mole's application instance.
 func (c *Client) Stop() error {
 	pfp, err := fsutils.GetPidFileLocation(c.Conf.Id)
@@ -251,6 +615,156 @@ func (c *Client) Stop() error {
 	return nil
 }
 
+// handleReady updates the environment file and notifies systemd every time the
+// tunnel becomes ready to accept connections.
+func (c *Client) handleReady() {
+	execOnce := c.Conf.ExecOnce
+
+	for range c.Tunnel.Ready {
+		if execOnce != "" {
+			go c.runExecOnce(execOnce)
+			execOnce = ""
+		}
+
+		if c.notifySystemd {
+			_, err := NotifySystemd(SystemdReady)
+			if err != nil {
+				log.WithError(err).Warn("error notifying systemd the tunnel is ready")
+			}
+		}
+
+		if c.stickyPorts() {
+			err := saveLastSource(c.Conf.alias, c.Tunnel.Channels())
+			if err != nil {
+				log.WithFields(log.Fields{
+					"alias": c.Conf.alias,
+				}).WithError(err).Warn("error saving the channels source addresses on the alias")
+			}
+		}
+
+		if c.Conf.EnvFile == "" {
+			continue
+		}
+
+		err := WriteEnvFile(c.Conf.EnvFile, c.Tunnel.Channels())
+		if err != nil {
+			log.WithFields(log.Fields{
+				"id": c.Conf.Id,
+			}).WithError(err).Error("error writing environment file")
+
+			continue
+		}
+
+		log.Infof("tunnel channels addresses saved on %s", c.Conf.EnvFile)
+	}
+}
+
+// runExecOnce runs the given command once the tunnel is ready for the first
+// time. Unlike a failing hook, the command exiting, successfully or not, only
+// gets logged, leaving the tunnel running.
+func (c *Client) runExecOnce(command string) {
+	hook := Hook{
+		Event:    HookReady,
+		Id:       c.Conf.Id,
+		Server:   c.Conf.Server.String(),
+		Time:     time.Now(),
+		Channels: c.Tunnel.Channels(),
+	}
+
+	fields := log.Fields{
+		"id":      c.Conf.Id,
+		"command": command,
+	}
+
+	if err := RunHook(command, hook); err != nil {
+		log.WithFields(fields).WithError(err).Warn("exec once command failed, the tunnel keeps running")
+		return
+	}
+
+	log.WithFields(fields).Info("exec once command exited successfully, the tunnel keeps running")
+}
+
+// stickyPorts tells if the source addresses of the channels are remembered
+// on the alias the tunnel was started from (see StickyPorts).
+func (c *Client) stickyPorts() bool {
+	return c.Conf.StickyPorts && c.Conf.alias != ""
+}
+
+// saveLastSource remembers the source addresses the given channels listen on
+// on the alias with the given name, so the next time it is started, channels
+// listening on random ports prefer the same ones.
+func saveLastSource(name string, channels []*tunnel.SSHChannel) error {
+	al, err := alias.Get(name)
+	if err != nil {
+		return err
+	}
+
+	sources := make([]string, len(channels))
+	for i, ch := range channels {
+		sources[i] = ch.Source
+	}
+
+	if reflect.DeepEqual(al.LastSource, sources) {
+		return nil
+	}
+
+	al.LastSource = sources
+
+	return alias.Add(al)
+}
+
+// watchSystemd pings the systemd watchdog, if enabled, every time the ssh
+// server answers a keep alive request, so a stuck tunnel is restarted by
+// systemd.
+func (c *Client) watchSystemd() {
+	timeout := SystemdWatchdogTimeout()
+	if timeout == 0 {
+		return
+	}
+
+	if c.Tunnel.KeepAliveInterval >= timeout {
+		log.Warnf("keep alive interval (%s) should be shorter than the systemd watchdog timeout (%s)", c.Tunnel.KeepAliveInterval, timeout)
+	}
+
+	c.Tunnel.KeepAliveReplied = func() {
+		_, err := NotifySystemd(SystemdWatchdog)
+		if err != nil {
+			log.WithError(err).Warn("error notifying systemd watchdog")
+		}
+	}
+}
+
+// watchHooks runs the hook commands of the configuration, if any, every time
+// the tunnel disconnects from or reconnects to the ssh server. The commands
+// run in the background, so a slow command doesn't hold the tunnel.
+func (c *Client) watchHooks() {
+	run := func(command string, hook Hook) {
+		hook.Id = c.Conf.Id
+		hook.Server = c.Conf.Server.String()
+		hook.Time = time.Now()
+
+		go func() {
+			if err := RunHook(command, hook); err != nil {
+				log.WithFields(log.Fields{
+					"id": c.Conf.Id,
+				}).WithError(err).Warn("error running hook command")
+			}
+		}()
+	}
+
+	if c.Conf.OnDisconnect != "" {
+		c.Tunnel.Disconnected = func(err error) {
+			run(c.Conf.OnDisconnect, Hook{Event: HookDisconnect, Err: err})
+		}
+	}
+
+	if c.Conf.OnReconnect != "" {
+		c.Tunnel.Reconnected = func() {
+			run(c.Conf.OnReconnect, Hook{Event: HookReconnect})
+		}
+	}
+}
+
 func (c *Client) handleSignals() {
 	signal.Notify(c.sigs, syscall.SIGINT, syscall.SIGTERM, os.Interrupt)
 	sig := <-c.sigs
@@ -261,6 +775,55 @@ func (c *Client) handleSignals() {
 	}
 }
 
+// handleTermination drains the tunnel of a detached instance once the process
+// is asked to terminate, so Start returns once the connections being forwarded
+// are closed, or DrainTimeout expires, instead of the process being killed.
+func (c *Client) handleTermination() {
+	sig := <-c.sigs
+
+	log.WithFields(log.Fields{
+		"id":      c.Conf.Id,
+		"timeout": c.Conf.DrainTimeout,
+	}).Infof("process signal %s received, draining connections", sig)
+
+	open := c.Tunnel.Drain(c.Conf.DrainTimeout)
+	if open > 0 {
+		log.WithFields(log.Fields{
+			"id": c.Conf.Id,
+		}).Warnf("%d connections still open after the drain timeout are closed", open)
+	}
+}
+
+// removeInstanceFiles removes the files telling a detached instance is
+// running, like its pid file and rpc address, once it stops. Its log file is
+// kept, so it can still be looked at.
+func (c *Client) removeInstanceFiles() {
+	d, err := fsutils.InstanceDir(c.Conf.Id)
+	if err != nil {
+		log.WithError(err).Warn("error locating the instance files")
+		return
+	}
+
+	// the handoff directory is removed once the socket inside it is gone.
+	files := []string{d.PidFile, filepath.Join(d.Dir, "rpc"), filepath.Join(d.Dir, HandoffDir, HandoffSocketFile), filepath.Join(d.Dir, HandoffDir)}
+
+	// unix sockets of the rpc server are told apart by containing a slash.
+	if c.Conf.Rpc && strings.Contains(c.Conf.RpcAddress, "/") {
+		files = append(files, c.Conf.RpcAddress)
+	}
+
+	for _, f := range files {
+		err := os.Remove(f)
+		if err != nil && !os.IsNotExist(err) {
+			log.WithError(err).Warnf("error removing instance file %s", f)
+		}
+	}
+
+	log.WithFields(log.Fields{
+		"id": c.Conf.Id,
+	}).Info("instance stopped")
+}
+
 // Merge overwrites Configuration from the given Alias.
 //
 // Certain attributes like Verbose, Insecure and Detach will be overwritten
@@ -277,10 +840,23 @@ func (c *Configuration) Merge(al *alias.Alias, givenFlags []string) error {
 		c.Insecure = al.Insecure
 	}
 
+	if !fl.lookup("strict") {
+		c.Strict = al.Strict
+	}
+
 	if !fl.lookup("detach") {
 		c.Detach = al.Detach
 	}
 
+	c.SyncLog = al.SyncLog
+
+	if !fl.lookup("sticky-ports") {
+		c.StickyPorts = al.StickyPorts
+	}
+
+	c.alias = al.Name
+	c.lastSource = al.LastSource
+
 	c.Id = al.Name
 	c.TunnelType = al.TunnelType
 
@@ -302,6 +878,43 @@ func (c *Configuration) Merge(al *alias.Alias, givenFlags []string) error {
 	}
 	c.Destination = dstl
 
+	c.DestinationCommand = al.DestinationCommand
+
+	c.ManifestCommand = al.ManifestCommand
+
+	qsrcl := AddressInputList{}
+	for _, src := range al.QuietSource {
+		err := qsrcl.Set(src)
+		if err != nil {
+			return err
+		}
+	}
+	c.QuietSource = qsrcl
+
+	hel := AddressInputList{}
+	for _, src := range al.HTTPError {
+		err := hel.Set(src)
+		if err != nil {
+			return err
+		}
+	}
+	c.HTTPError = hel
+
+	c.AllowCidr = al.AllowCidr
+
+	c.Prewarm = al.Prewarm
+
+	c.RemoteTLS = al.RemoteTLS
+
+	c.LocalTLSCert = al.LocalTLSCert
+	c.LocalTLSKey = al.LocalTLSKey
+
+	c.Via = al.Via
+	c.DialSource = al.DialSource
+	c.Protocol = al.Protocol
+	c.FallbackServer = al.FallbackServer
+	c.Jump = al.Jump
+
 	srv := AddressInput{}
 	err := srv.Set(al.Server)
 	if err != nil {
@@ -309,7 +922,22 @@ func (c *Configuration) Merge(al *alias.Alias, givenFlags []string) error {
 	}
 	c.Server = srv
 
+	c.User = al.User
+	c.Port = al.Port
+	c.Interface = al.Interface
+
 	c.Key = al.Key
+	c.KeyEnv = al.KeyEnv
+
+	c.IdentitiesOnly = al.IdentitiesOnly
+	c.NoDefaultKey = al.NoDefaultKey
+	c.Netrc = al.Netrc
+	c.InteractiveAuth = al.InteractiveAuth
+
+	c.PassphraseAttempts = al.PassphraseAttempts
+	c.UseKeychain = al.UseKeychain
+	c.RSASigAlgorithms = al.RSASigAlgorithms
+	c.KnownHosts = al.KnownHosts
 
 	kai, err := time.ParseDuration(al.KeepAliveInterval)
 	if err != nil {
@@ -317,7 +945,22 @@ func (c *Configuration) Merge(al *alias.Alias, givenFlags []string) error {
 	}
 	c.KeepAliveInterval = kai
 
+	c.KeepAliveData = al.KeepAliveData
+	c.KeepAliveIdleOnly = al.KeepAliveIdleOnly
+
+	// aliases created by older versions don't carry this attribute
+	if al.KeepAliveInitialDelay != "" {
+		kid, err := time.ParseDuration(al.KeepAliveInitialDelay)
+		if err != nil {
+			return err
+		}
+		c.KeepAliveInitialDelay = kid
+	}
+
 	c.ConnectionRetries = al.ConnectionRetries
+	c.MaxReconnects = al.MaxReconnects
+	c.MaxPendingOpens = al.MaxPendingOpens
+	c.MaxChannels = al.MaxChannels
 
 	war, err := time.ParseDuration(al.WaitAndRetry)
 	if err != nil {
@@ -325,48 +968,242 @@ func (c *Configuration) Merge(al *alias.Alias, givenFlags []string) error {
 	}
 	c.WaitAndRetry = war
 
+	// aliases created by older versions don't carry this attribute
+	if al.StablePeriod != "" {
+		sp, err := time.ParseDuration(al.StablePeriod)
+		if err != nil {
+			return err
+		}
+		c.StablePeriod = sp
+	}
+
 	c.SshAgent = al.SshAgent
 
+	c.HostAlias = al.HostAlias
+	c.EgressPolicy = al.EgressPolicy
+
 	tim, err := time.ParseDuration(al.Timeout)
 	if err != nil {
 		return err
 	}
 	c.Timeout = tim
 
-	if al.SshConfig != "" {
-		c.SshConfig = al.SshConfig
+	// aliases created by older versions don't carry this attribute
+	if al.DnsTimeout != "" {
+		dt, err := time.ParseDuration(al.DnsTimeout)
+		if err != nil {
+			return err
+		}
+		c.DnsTimeout = dt
 	}
 
-	c.Rpc = al.Rpc
-
-	c.RpcAddress = al.RpcAddress
-
-	return nil
-}
-
-// ShowInstances returns the runtime information about all instances of mole
-// running on the system with rpc enabled.
-func ShowInstances() (*InstancesRuntime, error) {
-	ctx := context.Background()
-	data, err := rpc.ShowAll(ctx)
-	if err != nil {
-		return nil, err
+	// aliases created by older versions don't carry this attribute
+	if al.RemoteDialTimeout != "" {
+		rdt, err := time.ParseDuration(al.RemoteDialTimeout)
+		if err != nil {
+			return err
+		}
+		c.RemoteDialTimeout = rdt
 	}
 
-	var instances []Runtime
-
-	err = mapstructure.Decode(data, &instances)
-	if err != nil {
-		return nil, err
+	// aliases created by older versions don't carry this attribute
+	if al.Supervise != "" {
+		sv, err := time.ParseDuration(al.Supervise)
+		if err != nil {
+			return err
+		}
+		c.Supervise = sv
 	}
 
-	runtime := InstancesRuntime(instances)
-
-	if len(runtime) == 0 {
-		return nil, fmt.Errorf("no instances were found.")
+	// aliases created by older versions don't carry this attribute
+	if al.LogRateLimit != "" {
+		lrl, err := time.ParseDuration(al.LogRateLimit)
+		if err != nil {
+			return err
+		}
+		c.LogRateLimit = lrl
 	}
 
-	return &runtime, nil
+	// aliases created by older versions don't carry this attribute
+	if al.WaitForRemote != "" {
+		wr, err := time.ParseDuration(al.WaitForRemote)
+		if err != nil {
+			return err
+		}
+		c.WaitForRemote = wr
+	}
+
+	// aliases created by older versions don't carry this attribute
+	if al.NetworkCheckInterval != "" {
+		nci, err := time.ParseDuration(al.NetworkCheckInterval)
+		if err != nil {
+			return err
+		}
+		c.NetworkCheck = nci
+	}
+
+	// aliases created by older versions don't carry this attribute
+	if al.MigrationTimeout != "" {
+		mt, err := time.ParseDuration(al.MigrationTimeout)
+		if err != nil {
+			return err
+		}
+		c.MigrationTimeout = mt
+	}
+
+	// aliases created by older versions don't carry this attribute
+	if al.InitialReadTimeout != "" {
+		irt, err := time.ParseDuration(al.InitialReadTimeout)
+		if err != nil {
+			return err
+		}
+		c.InitialReadTimeout = irt
+	}
+
+	// aliases created by older versions don't carry this attribute
+	if al.DrainTimeout != "" {
+		dt, err := time.ParseDuration(al.DrainTimeout)
+		if err != nil {
+			return err
+		}
+		c.DrainTimeout = dt
+	}
+
+	c.HalfClose = al.HalfClose
+	c.Trace = al.Trace
+	c.TraceLimit = al.TraceLimit
+
+	// aliases created by older versions don't carry these attributes, keeping
+	// the defaults instead.
+	if al.ExposureCheck != "" {
+		c.ExposureCheck = al.ExposureCheck
+	}
+
+	if al.SensitivePorts != nil {
+		c.SensitivePorts = al.SensitivePorts
+	}
+
+	if al.SshConfig != "" {
+		c.SshConfig = al.SshConfig
+	}
+
+	c.Rpc = al.Rpc
+
+	c.RpcAddress = al.RpcAddress
+	c.ControlSocketMode = al.ControlSocketMode
+
+	c.EnvFile = al.EnvFile
+	c.OnDisconnect = al.OnDisconnect
+	c.OnReconnect = al.OnReconnect
+	c.ExecOnce = al.ExecOnce
+	c.Pprof = al.Pprof
+
+	return nil
+}
+
+// CheckStrict returns an error listing every option of the configuration that
+// is not allowed in strict mode.
+func (c Configuration) CheckStrict() error {
+	var insecure []string
+
+	if c.Insecure {
+		insecure = append(insecure, "insecure (the server host key must be verified)")
+	}
+
+	if c.Pprof != "" {
+		insecure = append(insecure, "pprof (profiling data is served without authentication)")
+	}
+
+	for _, rt := range c.RemoteTLS {
+		opts, err := parseRemoteTLSOptions(rt)
+		if err == nil && opts.insecure {
+			insecure = append(insecure, "remote-tls insecure (the destination certificate must be verified)")
+			break
+		}
+	}
+
+	if c.Netrc {
+		insecure = append(insecure, "netrc (password authentication is not allowed)")
+	}
+
+	if c.InteractiveAuth {
+		insecure = append(insecure, "interactive-auth (password authentication is not allowed)")
+	}
+
+	if len(insecure) > 0 {
+		return fmt.Errorf("options not allowed in strict mode: %s", strings.Join(insecure, ", "))
+	}
+
+	return nil
+}
+
+// ServerUser returns the user name to authenticate against the ssh server.
+//
+// A user given as part of the server address takes precedence over the one
+// given through the User attribute.
+func (c Configuration) ServerUser() string {
+	if c.Server.User != "" {
+		return c.Server.User
+	}
+
+	return c.User
+}
+
+// splitChannelOption splits an option value given as [<source>=]<value>,
+// which applies only to the channel listening on source, if given, or to all
+// channels otherwise.
+func splitChannelOption(option string) (string, string) {
+	if i := strings.LastIndex(option, "="); i >= 0 {
+		return option[:i], option[i+1:]
+	}
+
+	return "", option
+}
+
+// ParseHostAliases parses a list of host aliases like <name>=<ip>, returning
+// a map of host names to IP addresses.
+func ParseHostAliases(aliases []string) (map[string]string, error) {
+	m := make(map[string]string, len(aliases))
+
+	for _, a := range aliases {
+		kv := strings.SplitN(a, "=", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			return nil, fmt.Errorf("invalid host alias %s: expected <name>=<ip>", a)
+		}
+
+		if net.ParseIP(kv[1]) == nil {
+			return nil, fmt.Errorf("invalid host alias %s: %s is not an ip address", a, kv[1])
+		}
+
+		m[kv[0]] = kv[1]
+	}
+
+	return m, nil
+}
+
+// ShowInstances returns the runtime information about all instances of mole
+// running on the system with rpc enabled.
+func ShowInstances() (*InstancesRuntime, error) {
+	ctx := context.Background()
+	data, err := rpc.ShowAll(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var instances []Runtime
+
+	err = mapstructure.Decode(data, &instances)
+	if err != nil {
+		return nil, err
+	}
+
+	runtime := InstancesRuntime(instances)
+
+	if len(runtime) == 0 {
+		return nil, fmt.Errorf("no instances were found.")
+	}
+
+	return &runtime, nil
 }
 
 // ShowInstance returns the runtime information about an application instance
@@ -387,9 +1224,38 @@ func ShowInstance(id string) (*Runtime, error) {
 	return &r, nil
 }
 
+// syncWriter flushes every write to the underlying file to disk, so readers of
+// the file see the data right away at the cost of slower writes.
+type syncWriter struct {
+	f *os.File
+}
+
+func (w syncWriter) Write(p []byte) (int, error) {
+	n, err := w.f.Write(p)
+	if err != nil {
+		return n, err
+	}
+
+	return n, w.f.Sync()
+}
+
+// reborn starts the detached process, returning it to the process starting
+// it and nil to the detached process itself.
+var reborn = (*daemon.Context).Reborn
+
 func startDaemonProcess(instanceConf *DetachedInstance) error {
 	args := appendIdArg(instanceConf.Id, os.Args)
 
+	// the instance directory may be gone since the instance was created (e.g.
+	// removed along with a stale instance using the same id), which would keep
+	// the detached process from creating its files.
+	for _, f := range []string{instanceConf.PidFile, instanceConf.LogFile} {
+		err := os.MkdirAll(filepath.Dir(f), 0755)
+		if err != nil {
+			return err
+		}
+	}
+
 	cntxt := &daemon.Context{
 		PidFileName: instanceConf.PidFile,
 		PidFilePerm: 0644,
@@ -399,20 +1265,18 @@ func startDaemonProcess(instanceConf *DetachedInstance) error {
 		Args:        args,
 	}
 
-	d, err := cntxt.Reborn()
+	d, err := reborn(cntxt)
 	if err != nil {
 		return err
 	}
 
 	if d != nil {
-		err = os.Rename(instanceConf.PidFile, instanceConf.PidFile)
-		if err != nil {
-			return err
-		}
-
-		err = os.Rename(instanceConf.LogFile, instanceConf.LogFile)
-		if err != nil {
-			return err
+		if instanceConf.handedOff != nil {
+			select {
+			case <-instanceConf.handedOff:
+			case <-time.After(handoffTimeout):
+				log.Warn("detached process has not taken over the listeners in time")
+			}
 		}
 
 		log.Infof("execute \"mole stop %s\" if you like to stop it at any time", instanceConf.Id)
@@ -444,24 +1308,410 @@ func (fs flags) lookup(flag string) bool {
 	return false
 }
 
-func createTunnel(conf *Configuration) (*tunnel.Tunnel, error) {
-	s, err := tunnel.NewServer(conf.Server.User, conf.Server.Address(), conf.Key, conf.SshAgent, conf.SshConfig)
+// KeyStdin is the key path telling the key is read from the standard input.
+const KeyStdin = "-"
+
+// MemoryKey returns the key given through the environment variable named by
+// KeyEnv or, when Key is KeyStdin, through the standard input, which is never
+// written to disk. The key is only read the first time; nil is returned if the
+// key is given as a file.
+func (c *Configuration) MemoryKey() (*tunnel.PemKey, error) {
+	if c.KeyEnv == "" && c.Key != KeyStdin {
+		return nil, nil
+	}
+
+	if c.memoryKey != nil {
+		return c.memoryKey, nil
+	}
+
+	var data []byte
+
+	if c.KeyEnv != "" {
+		v := os.Getenv(c.KeyEnv)
+		if v == "" {
+			return nil, fmt.Errorf("no key found on environment variable %s", c.KeyEnv)
+		}
+
+		data = []byte(v)
+	} else {
+		d, err := ioutil.ReadAll(os.Stdin)
+		if err != nil {
+			return nil, fmt.Errorf("error reading the key from the standard input: %v", err)
+		}
+
+		data = d
+	}
+
+	key, err := tunnel.NewPemKeyFromBytes(data)
+	if err != nil {
+		return nil, err
+	}
+
+	c.memoryKey = key
+
+	return key, nil
+}
+
+// serverKey returns the key file and options used to authenticate against the
+// ssh servers with the key of the given configuration.
+func serverKey(conf *Configuration) (string, []tunnel.ServerOption, error) {
+	key, err := conf.MemoryKey()
+	if err != nil {
+		return "", nil, err
+	}
+
+	if key == nil {
+		return conf.Key, nil, nil
+	}
+
+	return "", []tunnel.ServerOption{tunnel.WithKey(key)}, nil
+}
+
+// egressPolicy loads the egress policy of the given configuration, falling
+// back to DefaultEgressPolicyFile, if any.
+func egressPolicy(conf *Configuration) (*tunnel.EgressPolicy, error) {
+	if conf.EgressPolicy != "" {
+		return tunnel.LoadEgressPolicy(conf.EgressPolicy)
+	}
+
+	p, err := tunnel.LoadEgressPolicy(DefaultEgressPolicyFile)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+
+	return p, err
+}
+
+// serverOptions returns the options used to resolve the attributes of the ssh
+// servers.
+func serverOptions(conf *Configuration) []tunnel.ServerOption {
+	var opts []tunnel.ServerOption
+
+	if conf.NoDefaultKey {
+		opts = append(opts, tunnel.WithoutDefaultKey())
+	}
+
+	if conf.InteractiveAuth {
+		opts = append(opts, tunnel.WithPrompt(promptInteractive))
+	}
+
+	return opts
+}
+
+// stdin reads the answers echoed on the terminal. It is kept across prompts, so
+// no input buffered while reading an answer is lost for the next one.
+var stdin = bufio.NewReader(os.Stdin)
+
+// readPassword reads a secret typed on the terminal, without echoing it.
+func readPassword() ([]byte, error) {
+	p, err := terminal.ReadPassword(int(syscall.Stdin))
+	fmt.Printf("\n")
+
+	return p, err
+}
+
+// promptInteractive answers the password and keyboard-interactive challenges
+// of the ssh servers on the terminal, the same way the passphrase of the keys
+// is asked for. Answers to questions that shouldn't be echoed are read
+// without echoing them.
+func promptInteractive(name, instruction string, questions []string, echos []bool) ([]string, error) {
+	if !terminal.IsTerminal(int(syscall.Stdin)) {
+		return nil, fmt.Errorf("the ssh server asked for interactive authentication, but there is no terminal to prompt on")
+	}
+
+	if name != "" {
+		fmt.Println(name)
+	}
+
+	if instruction != "" {
+		fmt.Println(instruction)
+	}
+
+	answers := make([]string, len(questions))
+
+	for i, q := range questions {
+		fmt.Print(q)
+
+		if echos[i] {
+			line, err := stdin.ReadString('\n')
+			if err != nil {
+				return nil, err
+			}
+
+			answers[i] = strings.TrimRight(line, "\r\n")
+
+			continue
+		}
+
+		p, err := readPassword()
+		if err != nil {
+			return nil, err
+		}
+
+		answers[i] = string(p)
+	}
+
+	return answers, nil
+}
+
+// createViaServer creates the additional ssh server, given as
+// [<user>@]<host>[:<port>], some channels reach their destination through.
+// Its user and key are looked up on the ssh config file, like any other
+// server, while the connection settings are the ones of the tunnel server.
+func createViaServer(conf *Configuration, server *tunnel.Server, address string) (*tunnel.Server, error) {
+	ai := AddressInput{}
+
+	err := ai.Set(address)
+	if err != nil {
+		return nil, err
+	}
+
+	vs, err := tunnel.NewServer(ai.User, ai.Address(), "", conf.SshAgent, conf.SshConfig, serverOptions(conf)...)
+	if err != nil {
+		return nil, err
+	}
+
+	vs.Insecure = server.Insecure
+	vs.Strict = server.Strict
+	vs.RSASignatureAlgorithms = server.RSASignatureAlgorithms
+	vs.KnownHostsFiles = server.KnownHostsFiles
+	vs.Timeout = server.Timeout
+	vs.IdentitiesOnly = vs.IdentitiesOnly || server.IdentitiesOnly
+
+	return vs, nil
+}
+
+// createFallbackServer creates the ssh server, given as
+// [<user>@]<host>[:<port>], the tunnel connects to when its server can't be
+// reached. It authenticates as the tunnel server user, unless another one is
+// given, and takes the same key and connection settings, while its host key
+// is verified on its own.
+func createFallbackServer(conf *Configuration, server *tunnel.Server, address string) (*tunnel.Server, error) {
+	ai := AddressInput{}
+
+	err := ai.Set(address)
+	if err != nil {
+		return nil, err
+	}
+
+	user := ai.User
+	if user == "" {
+		user = conf.User
+	}
+
+	key, opts, err := serverKey(conf)
+	if err != nil {
+		return nil, err
+	}
+
+	fs, err := tunnel.NewServer(user, ai.Address(), key, conf.SshAgent, conf.SshConfig, append(serverOptions(conf), opts...)...)
+	if err != nil {
+		return nil, err
+	}
+
+	// the key shared with the tunnel server is already decrypted, so its
+	// passphrase isn't asked for twice.
+	if fs.Key != nil && server.Key != nil && fs.Key.Path == server.Key.Path {
+		fs.Key = server.Key
+	}
+
+	fs.Insecure = server.Insecure
+	fs.Strict = server.Strict
+	fs.RSASignatureAlgorithms = server.RSASignatureAlgorithms
+	fs.KnownHostsFiles = server.KnownHostsFiles
+	fs.Timeout = server.Timeout
+	fs.DNSTimeout = server.DNSTimeout
+	fs.Interface = server.Interface
+	fs.HostAliases = server.HostAliases
+	fs.IdentitiesOnly = fs.IdentitiesOnly || server.IdentitiesOnly
+
+	return fs, nil
+}
+
+// netrcCredentials returns the credentials given for the given host on the
+// netrc file, if any.
+func netrcCredentials(host string) (NetrcEntry, error) {
+	path, err := NetrcFile()
+	if err != nil {
+		return NetrcEntry{}, err
+	}
+
+	entry, ok, err := LookupNetrc(path, host)
+	if err != nil || !ok {
+		return NetrcEntry{}, err
+	}
+
+	log.Debugf("credentials for %s found on %s", host, path)
+
+	return entry, nil
+}
+
+// verifyHostKey verifies the ssh server host key against the known hosts file,
+// without authenticating.
+func verifyHostKey(conf *Configuration) error {
+	s, err := createServer(conf)
+	if err != nil {
+		return err
+	}
+
+	err = tunnel.VerifyHostKey(s)
+	if err != nil {
+		log.WithError(err).Error("error verifying the ssh server host key")
+		return err
+	}
+
+	return nil
+}
+
+// createServer creates the ssh server the tunnel connects to, out of the
+// server options of the given configuration.
+func createServer(conf *Configuration) (*tunnel.Server, error) {
+	var err error
+
+	user := conf.ServerUser()
+
+	var netrc NetrcEntry
+	if conf.Netrc {
+		netrc, err = netrcCredentials(conf.Server.Host)
+		if err != nil {
+			log.WithError(err).Error("error reading netrc file")
+			return nil, err
+		}
+
+		if user == "" {
+			user = netrc.Login
+		}
+	}
+
+	key, keyOpts, err := serverKey(conf)
+	if err != nil {
+		log.WithError(err).Error("error reading the server key")
+		return nil, err
+	}
+
+	opts := append(serverOptions(conf), keyOpts...)
+	if conf.Port != "" {
+		port, err := lookupPort(conf.Port)
+		if err != nil {
+			log.WithError(err).Error("error processing server port")
+			return nil, err
+		}
+
+		opts = append(opts, tunnel.WithPort(port))
+	}
+
+	s, err := tunnel.NewServer(user, conf.Server.Address(), key, conf.SshAgent, conf.SshConfig, opts...)
 	if err != nil {
 		log.Errorf("error processing server options: %v\n", err)
 		return nil, err
 	}
 
+	// like other netrc clients, the password is only used along with the
+	// login of the same entry.
+	if netrc.Password != "" && (netrc.Login == "" || netrc.Login == s.User) {
+		s.Password = netrc.Password
+	}
+
 	s.Insecure = conf.Insecure
+	s.Strict = conf.Strict
+	s.RSASignatureAlgorithms = conf.RSASigAlgorithms
+	s.KnownHostsFiles = conf.KnownHosts
 	s.Timeout = conf.Timeout
+	s.DNSTimeout = conf.DnsTimeout
+	s.Interface = conf.Interface
 
-	err = s.Key.HandlePassphrase(func() ([]byte, error) {
+	hostAliases, err := ParseHostAliases(conf.HostAlias)
+	if err != nil {
+		log.WithError(err).Error("error processing host aliases")
+		return nil, err
+	}
+	s.HostAliases = hostAliases
+
+	if conf.IdentitiesOnly {
+		s.IdentitiesOnly = true
+	}
+
+	// the jump hosts given on the command line take precedence over the ones
+	// found on the ssh config file (ProxyJump).
+	if len(conf.Jump) > 0 {
+		s.Jump, err = tunnel.JumpServers(strings.Join(conf.Jump, ","), s.User, conf.SshAgent, conf.SshConfig, serverOptions(conf)...)
+		if err != nil {
+			log.WithError(err).Error("error processing jump hosts")
+			return nil, err
+		}
+	}
+
+	// jump hosts take the connection settings of the tunnel server, while
+	// their host keys are verified on their own.
+	for _, js := range s.Jump {
+		js.Insecure = s.Insecure
+		js.Strict = s.Strict
+		js.RSASignatureAlgorithms = s.RSASignatureAlgorithms
+		js.KnownHostsFiles = s.KnownHostsFiles
+		js.Timeout = s.Timeout
+		js.DNSTimeout = s.DNSTimeout
+		js.Interface = s.Interface
+		js.HostAliases = s.HostAliases
+		js.IdentitiesOnly = js.IdentitiesOnly || s.IdentitiesOnly
+	}
+
+	return s, nil
+}
+
+func createTunnel(conf *Configuration) (*tunnel.Tunnel, error) {
+	return buildTunnel(conf, passphraseHandler(conf))
+}
+
+// passphraseHandler returns the function handling the passphrase of the keys
+// of the configuration, asking for it on the terminal or reading it from the
+// keychain.
+func passphraseHandler(conf *Configuration) func(key *tunnel.PemKey) error {
+	prompt := func() ([]byte, error) {
 		fmt.Printf("The key provided is secured by a password. Please provide it below:\n")
 		fmt.Printf("Password: ")
-		p, err := terminal.ReadPassword(int(syscall.Stdin))
-		fmt.Printf("\n")
-		return p, err
-	})
+		return readPassword()
+	}
+
+	return func(key *tunnel.PemKey) error {
+		// servers authenticating through the ssh agent only have no key.
+		if key == nil {
+			return nil
+		}
+
+		key.PassphraseAttempts = conf.PassphraseAttempts
+
+		// keys never written to a file have no path to keep their passphrase
+		// under on the keychain.
+		if !conf.UseKeychain || key.Path == "" {
+			return key.HandlePassphrase(prompt)
+		}
+
+		kc := &keychainHandler{keyPath: key.Path, prompt: prompt}
 
+		err := key.HandlePassphrase(kc.passphrase)
+		kc.finish(err == nil)
+
+		return err
+	}
+}
+
+// buildTunnel creates the tunnel out of the given configuration, handling the
+// passphrase of its keys with the given function.
+func buildTunnel(conf *Configuration, handlePassphrase func(key *tunnel.PemKey) error) (*tunnel.Tunnel, error) {
+	s, err := createServer(conf)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, js := range s.Jump {
+		err = handlePassphrase(js.Key)
+		if err != nil {
+			log.WithError(err).Error("error setting up password handling function")
+			return nil, err
+		}
+	}
+
+	err = handlePassphrase(s.Key)
 	if err != nil {
 		log.WithError(err).Error("error setting up password handling function")
 		return nil, err
@@ -469,6 +1719,25 @@ func createTunnel(conf *Configuration) (*tunnel.Tunnel, error) {
 
 	log.Debugf("server: %s", s)
 
+	var fallbacks []*tunnel.Server
+	for _, address := range conf.FallbackServer {
+		fs, err := createFallbackServer(conf, s, address)
+		if err != nil {
+			log.WithError(err).Errorf("error processing fallback ssh server %s", address)
+			return nil, err
+		}
+
+		err = handlePassphrase(fs.Key)
+		if err != nil {
+			log.WithError(err).Error("error setting up password handling function")
+			return nil, err
+		}
+
+		log.Debugf("fallback server: %s", fs)
+
+		fallbacks = append(fallbacks, fs)
+	}
+
 	source := make([]string, len(conf.Source))
 	for i, r := range conf.Source {
 		source[i] = r.String()
@@ -476,28 +1745,204 @@ func createTunnel(conf *Configuration) (*tunnel.Tunnel, error) {
 
 	destination := make([]string, len(conf.Destination))
 	for i, r := range conf.Destination {
-		if r.Port == "" {
-			log.WithError(err).Errorf("missing port in destination address: %s", r.String())
+		if r.Port == "" && !r.IsSocket() {
+			err = fmt.Errorf("missing port in destination address: %s", r.String())
+			log.Error(err)
 			return nil, err
 		}
 
 		destination[i] = r.String()
 	}
 
-	t, err := tunnel.New(conf.TunnelType, s, source, destination, conf.SshConfig)
+	if conf.TunnelType == "tun" {
+		source, destination = []string{conf.TunDevice}, nil
+	}
+
+	policy, err := egressPolicy(conf)
+	if err != nil {
+		log.WithError(err).Error("error loading egress policy")
+		return nil, err
+	}
+
+	// zero logs every warning on the command line, while it takes the default
+	// window on the tunnel configuration.
+	logRateLimit := conf.LogRateLimit
+	if logRateLimit == 0 {
+		logRateLimit = -1
+	}
+
+	t, err := tunnel.NewFromConfig(tunnel.Config{
+		Type:                   conf.TunnelType,
+		Server:                 s,
+		FallbackServers:        fallbacks,
+		Source:                 source,
+		Destination:            destination,
+		SSHConfig:              conf.SshConfig,
+		DestinationCommand:     conf.DestinationCommand,
+		ManifestCommand:        conf.ManifestCommand,
+		ConnectionRetries:      conf.ConnectionRetries,
+		MaxReconnects:          conf.MaxReconnects,
+		MaxPendingChannelOpens: conf.MaxPendingOpens,
+		MaxChannels:            conf.MaxChannels,
+		WaitAndRetry:           conf.WaitAndRetry,
+		StableConnectionPeriod: conf.StablePeriod,
+		SuperviseInterval:      conf.Supervise,
+		NetworkCheckInterval:   conf.NetworkCheck,
+		DialTimeout:            conf.RemoteDialTimeout,
+		LogRateLimit:           logRateLimit,
+		MigrationTimeout:       conf.MigrationTimeout,
+		InitialReadTimeout:     conf.InitialReadTimeout,
+		HalfClose:              conf.HalfClose,
+		Trace:                  conf.Trace,
+		TraceLimit:             conf.TraceLimit,
+		WaitForRemote:          conf.WaitForRemote,
+		KeepAliveInterval:      conf.KeepAliveInterval,
+		KeepAliveInitialDelay:  conf.KeepAliveInitialDelay,
+		KeepAliveData:          conf.KeepAliveData,
+		KeepAliveIdleOnly:      conf.KeepAliveIdleOnly,
+		HostAliases:            s.HostAliases,
+		EgressPolicy:           policy,
+	})
 	if err != nil {
 		log.Error(err)
 		return nil, err
 	}
 
-	//TODO need to find a way to require the attributes below to be always set
-	// since they are not optional (functionality will break if they are not
-	// set and CLI parsing is the one setting the default values).
-	// That could be done by make them required in the constructor's signature or
-	// by creating a configuration struct for a tunnel object.
-	t.ConnectionRetries = conf.ConnectionRetries
-	t.WaitAndRetry = conf.WaitAndRetry
-	t.KeepAliveInterval = conf.KeepAliveInterval
+	err = t.CheckEgress()
+	if err != nil {
+		log.WithField("policy", policy.Path).Error(err)
+		return nil, err
+	}
+
+	if conf.StickyPorts {
+		t.PreferSources(conf.lastSource)
+	}
+
+	for _, src := range conf.QuietSource {
+		err = t.QuietChannel(src.String())
+		if err != nil {
+			log.Error(err)
+			return nil, err
+		}
+	}
+
+	for _, p := range conf.Protocol {
+		source, protocol := splitChannelOption(p)
+
+		err = t.SetProtocol(source, protocol)
+		if err != nil {
+			log.Error(err)
+			return nil, err
+		}
+	}
+
+	for _, src := range conf.HTTPError {
+		err = t.HTTPErrorChannel(src.String())
+		if err != nil {
+			log.Error(err)
+			return nil, err
+		}
+	}
+
+	for _, ac := range conf.AllowCidr {
+		source, cidr := splitChannelOption(ac)
+
+		err = t.AllowNetwork(source, cidr)
+		if err != nil {
+			log.Error(err)
+			return nil, err
+		}
+	}
+
+	for _, pw := range conf.Prewarm {
+		source, value := splitChannelOption(pw)
+
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			log.WithError(err).Errorf("invalid number of prewarmed connections: %s", pw)
+			return nil, err
+		}
+
+		err = t.PrewarmChannel(source, n)
+		if err != nil {
+			log.Error(err)
+			return nil, err
+		}
+	}
+
+	for _, ds := range conf.DialSource {
+		source, address := splitChannelOption(ds)
+
+		err = t.BindDialSource(source, address)
+		if err != nil {
+			log.Error(err)
+			return nil, err
+		}
+	}
+
+	for _, rt := range conf.RemoteTLS {
+		source, config, err := ParseRemoteTLS(rt)
+		if err != nil {
+			log.WithError(err).Errorf("invalid remote tls option: %s", rt)
+			return nil, err
+		}
+
+		err = t.OriginateTLS(source, config)
+		if err != nil {
+			log.Error(err)
+			return nil, err
+		}
+	}
+
+	localTLS, err := ParseLocalTLS(conf.LocalTLSCert, conf.LocalTLSKey)
+	if err != nil {
+		log.Error(err)
+		return nil, err
+	}
+
+	// the configuration shared by all channels is applied first, so a
+	// channel specific one can override it.
+	if config, ok := localTLS[""]; ok {
+		err = t.TerminateTLS("", config)
+		if err != nil {
+			log.Error(err)
+			return nil, err
+		}
+	}
+
+	for source, config := range localTLS {
+		if source == "" {
+			continue
+		}
+
+		err = t.TerminateTLS(source, config)
+		if err != nil {
+			log.Error(err)
+			return nil, err
+		}
+	}
+
+	for _, v := range conf.Via {
+		source, address := splitChannelOption(v)
+
+		vs, err := createViaServer(conf, s, address)
+		if err != nil {
+			log.WithError(err).Errorf("error processing additional ssh hop %s", address)
+			return nil, err
+		}
+
+		err = handlePassphrase(vs.Key)
+		if err != nil {
+			log.WithError(err).Error("error setting up password handling function")
+			return nil, err
+		}
+
+		err = t.ViaChannel(source, vs)
+		if err != nil {
+			log.Error(err)
+			return nil, err
+		}
+	}
 
 	return t, nil
 }
@@ -514,8 +1959,8 @@ func appendIdArg(id string, args []string) (newArgs []string) {
 
 	newArgs = make([]string, len(args)+2)
 	copy(newArgs, args)
-	newArgs[len(args)-2] = fmt.Sprintf("--%s", IdFlagName)
-	newArgs[len(args)-1] = id
+	newArgs[len(newArgs)-2] = fmt.Sprintf("--%s", IdFlagName)
+	newArgs[len(newArgs)-1] = id
 
 	return
 }
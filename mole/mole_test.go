@@ -1,10 +1,33 @@
 package mole_test
 
 import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
 	"testing"
+	"time"
 
 	"github.com/davrodpin/mole/alias"
+	"github.com/davrodpin/mole/fsutils"
 	"github.com/davrodpin/mole/mole"
+	"github.com/davrodpin/mole/tunnel"
+
+	log "github.com/sirupsen/logrus"
 )
 
 func TestAliasMerge(t *testing.T) {
@@ -114,3 +137,1028 @@ func TestAliasMerge(t *testing.T) {
 	}
 
 }
+
+// TestAliasRoundTrip checks the options persisted on an alias are given back
+// once the alias is merged into a configuration.
+func TestAliasRoundTrip(t *testing.T) {
+	conf := mole.Configuration{
+		KeepAliveInterval: 3 * time.Second,
+		WaitAndRetry:      10 * time.Second,
+		Timeout:           3 * time.Second,
+		DnsTimeout:        2 * time.Second,
+		EnvFile:           "path/to/env",
+		NetworkCheck:      5 * time.Second,
+		Pprof:             "127.0.0.1:6060",
+		ExposureCheck:     mole.ExposureRefuse,
+		SensitivePorts:    []string{"22", "5432"},
+		OnDisconnect:      "echo disconnected",
+		OnReconnect:       "echo reconnected",
+		ControlSocketMode: "0660",
+		ExecOnce:          "echo ready",
+	}
+	conf.Server.Set("user@example.com:22")
+
+	al := conf.ParseAlias("example")
+
+	var merged mole.Configuration
+	if err := merged.Merge(al, []string{}); err != nil {
+		t.Fatalf("error merging alias: %v", err)
+	}
+
+	if merged.DnsTimeout != conf.DnsTimeout {
+		t.Errorf("dns-timeout doesn't match: expected: %s, value: %s", conf.DnsTimeout, merged.DnsTimeout)
+	}
+
+	if merged.EnvFile != conf.EnvFile {
+		t.Errorf("env-file doesn't match: expected: %s, value: %s", conf.EnvFile, merged.EnvFile)
+	}
+
+	if merged.NetworkCheck != conf.NetworkCheck {
+		t.Errorf("network-check-interval doesn't match: expected: %s, value: %s", conf.NetworkCheck, merged.NetworkCheck)
+	}
+
+	if merged.Pprof != conf.Pprof {
+		t.Errorf("pprof doesn't match: expected: %s, value: %s", conf.Pprof, merged.Pprof)
+	}
+
+	if merged.ExposureCheck != conf.ExposureCheck {
+		t.Errorf("exposure-check doesn't match: expected: %s, value: %s", conf.ExposureCheck, merged.ExposureCheck)
+	}
+
+	if !reflect.DeepEqual(merged.SensitivePorts, conf.SensitivePorts) {
+		t.Errorf("sensitive-ports doesn't match: expected: %s, value: %s", conf.SensitivePorts, merged.SensitivePorts)
+	}
+
+	if merged.OnDisconnect != conf.OnDisconnect {
+		t.Errorf("on-disconnect doesn't match: expected: %s, value: %s", conf.OnDisconnect, merged.OnDisconnect)
+	}
+
+	if merged.OnReconnect != conf.OnReconnect {
+		t.Errorf("on-reconnect doesn't match: expected: %s, value: %s", conf.OnReconnect, merged.OnReconnect)
+	}
+
+	if merged.ControlSocketMode != conf.ControlSocketMode {
+		t.Errorf("control-socket-mode doesn't match: expected: %s, value: %s", conf.ControlSocketMode, merged.ControlSocketMode)
+	}
+
+	if merged.ExecOnce != conf.ExecOnce {
+		t.Errorf("exec-once doesn't match: expected: %s, value: %s", conf.ExecOnce, merged.ExecOnce)
+	}
+}
+
+func TestServerUser(t *testing.T) {
+	tests := []struct {
+		server   string
+		user     string
+		expected string
+	}{
+		{"mole@example.com:22", "", "mole"},
+		{"example.com:22", "other", "other"},
+		{"mole@example.com:22", "other", "mole"},
+		{"example.com", "", ""},
+	}
+
+	for id, test := range tests {
+		conf := mole.Configuration{User: test.user}
+		conf.Server.Set(test.server)
+
+		if user := conf.ServerUser(); test.expected != user {
+			t.Errorf("user doesn't match on test %d: expected: %s, value: %s", id, test.expected, user)
+		}
+	}
+}
+
+func TestWriteEnvFile(t *testing.T) {
+	channels := []*tunnel.SSHChannel{
+		{ChannelType: "local", Source: "127.0.0.1:5432", Destination: "172.17.0.10:5432"},
+		{ChannelType: "local", Source: "127.0.0.1:40525", Destination: "172.17.0.10:80"},
+	}
+	expected := "MOLE_LOCAL_1=127.0.0.1:5432\nMOLE_LOCAL_2=127.0.0.1:40525\n"
+
+	path := filepath.Join(home, "mole.env")
+
+	err := mole.WriteEnvFile(path, channels)
+	if err != nil {
+		t.Errorf("error writing environment file: %v", err)
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Errorf("error reading environment file: %v", err)
+	}
+
+	if expected != string(data) {
+		t.Errorf("environment file doesn't match: expected: %s, value: %s", expected, string(data))
+	}
+}
+
+func TestParseEnvForwards(t *testing.T) {
+	environ := []string{
+		"MOLE_SERVER=bastion",
+		"MOLE_FORWARD_10=:8080=web.internal:80",
+		"MOLE_FORWARD_2=127.0.0.1:5432=db.internal:5432",
+		"MOLE_LOCAL_1=127.0.0.1:5432",
+	}
+
+	source, destination, err := mole.ParseEnvForwards(environ)
+	if err != nil {
+		t.Fatalf("error parsing forwards: %v", err)
+	}
+
+	expectedSource := []string{"127.0.0.1:5432", ":8080"}
+	if !reflect.DeepEqual(expectedSource, source.List()) {
+		t.Errorf("unexpected source addresses: want: %v, got: %v", expectedSource, source.List())
+	}
+
+	expectedDestination := []string{"db.internal:5432", "web.internal:80"}
+	if !reflect.DeepEqual(expectedDestination, destination.List()) {
+		t.Errorf("unexpected destination addresses: want: %v, got: %v", expectedDestination, destination.List())
+	}
+
+	for _, e := range []string{"MOLE_FORWARD_A=:80=web:80", "MOLE_FORWARD_1=web:80"} {
+		if _, _, err := mole.ParseEnvForwards([]string{e}); err == nil {
+			t.Errorf("error expected for %s", e)
+		}
+	}
+
+	if name := mole.EnvVarName("keep-alive-interval"); name != "MOLE_KEEP_ALIVE_INTERVAL" {
+		t.Errorf("unexpected environment variable name: want: %s, got: %s", "MOLE_KEEP_ALIVE_INTERVAL", name)
+	}
+}
+
+func TestRunHook(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("hook test relies on a unix shell")
+	}
+
+	dir, err := ioutil.TempDir("", "mole-hook")
+	if err != nil {
+		t.Fatalf("error creating temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	out := filepath.Join(dir, "event")
+	hook := mole.Hook{
+		Event:  mole.HookDisconnect,
+		Id:     "hook-test",
+		Server: "mole@bastion:22",
+		Time:   time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC),
+		Err:    fmt.Errorf("connection lost"),
+	}
+
+	err = mole.RunHook(fmt.Sprintf(`echo "$MOLE_EVENT $MOLE_ID $MOLE_SERVER $MOLE_TIMESTAMP $MOLE_ERROR" > %s`, out), hook)
+	if err != nil {
+		t.Fatalf("error running hook: %v", err)
+	}
+
+	b, err := ioutil.ReadFile(out)
+	if err != nil {
+		t.Fatalf("error reading hook output: %v", err)
+	}
+
+	expected := "disconnect hook-test mole@bastion:22 2020-01-02T03:04:05Z connection lost\n"
+	if string(b) != expected {
+		t.Errorf("unexpected hook output: want: %q, got: %q", expected, string(b))
+	}
+
+	if err := mole.RunHook("exit 1", hook); err == nil {
+		t.Errorf("error expected from a failing hook command")
+	}
+
+	ready := mole.Hook{
+		Event: mole.HookReady,
+		Channels: []*tunnel.SSHChannel{
+			{ChannelType: "local", Source: "127.0.0.1:40525", Destination: "172.17.0.10:80"},
+		},
+	}
+
+	err = mole.RunHook(fmt.Sprintf(`echo "$MOLE_EVENT $MOLE_LOCAL_1" > %s`, out), ready)
+	if err != nil {
+		t.Fatalf("error running hook: %v", err)
+	}
+
+	b, err = ioutil.ReadFile(out)
+	if err != nil {
+		t.Fatalf("error reading hook output: %v", err)
+	}
+
+	expected = "ready 127.0.0.1:40525\n"
+	if string(b) != expected {
+		t.Errorf("unexpected hook output: want: %q, got: %q", expected, string(b))
+	}
+}
+
+func TestNotifySystemd(t *testing.T) {
+	defer os.Unsetenv("NOTIFY_SOCKET")
+
+	os.Unsetenv("NOTIFY_SOCKET")
+
+	sent, err := mole.NotifySystemd(mole.SystemdReady)
+	if sent || err != nil {
+		t.Errorf("no notification was expected without NOTIFY_SOCKET: sent: %t, error: %v", sent, err)
+	}
+
+	socket := filepath.Join(home, "notify.sock")
+
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		t.Fatalf("error creating notify socket: %v", err)
+	}
+	defer conn.Close()
+
+	os.Setenv("NOTIFY_SOCKET", socket)
+
+	sent, err = mole.NotifySystemd(mole.SystemdReady)
+	if !sent || err != nil {
+		t.Fatalf("notification was expected to be sent: sent: %t, error: %v", sent, err)
+	}
+
+	buf := make([]byte, 64)
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatalf("error reading notification: %v", err)
+	}
+
+	if mole.SystemdReady != string(buf[:n]) {
+		t.Errorf("notification doesn't match: expected: %s, value: %s", mole.SystemdReady, string(buf[:n]))
+	}
+}
+
+func TestSystemdWatchdogTimeout(t *testing.T) {
+	defer os.Unsetenv("WATCHDOG_USEC")
+	defer os.Unsetenv("WATCHDOG_PID")
+
+	tests := []struct {
+		usec     string
+		pid      string
+		expected time.Duration
+	}{
+		{"", "", 0},
+		{"30000000", "", 30 * time.Second},
+		{"30000000", strconv.Itoa(os.Getpid()), 30 * time.Second},
+		{"30000000", "1", 0},
+		{"invalid", "", 0},
+	}
+
+	for id, test := range tests {
+		os.Setenv("WATCHDOG_USEC", test.usec)
+		os.Setenv("WATCHDOG_PID", test.pid)
+
+		if timeout := mole.SystemdWatchdogTimeout(); test.expected != timeout {
+			t.Errorf("watchdog timeout doesn't match on test %d: expected: %s, value: %s", id, test.expected, timeout)
+		}
+	}
+}
+
+func TestParseHostAliases(t *testing.T) {
+	tests := []struct {
+		aliases       []string
+		expected      map[string]string
+		expectedError bool
+	}{
+		{nil, map[string]string{}, false},
+		{[]string{"bastion=10.0.0.1", "db=10.0.0.2"}, map[string]string{"bastion": "10.0.0.1", "db": "10.0.0.2"}, false},
+		{[]string{"bastion"}, nil, true},
+		{[]string{"=10.0.0.1"}, nil, true},
+		{[]string{"bastion=example.com"}, nil, true},
+	}
+
+	for id, test := range tests {
+		aliases, err := mole.ParseHostAliases(test.aliases)
+		if test.expectedError != (err != nil) {
+			t.Errorf("unexpected error on test %d: %v", id, err)
+		}
+
+		if !reflect.DeepEqual(test.expected, aliases) {
+			t.Errorf("host aliases don't match on test %d: expected: %v, value: %v", id, test.expected, aliases)
+		}
+	}
+}
+
+func TestLogLevelRpc(t *testing.T) {
+	defer log.SetLevel(log.GetLevel())
+
+	c := mole.New(&mole.Configuration{})
+	c.Tunnel = &tunnel.Tunnel{}
+
+	resp, err := mole.LogLevelRpc([]byte(`"debug"`))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if expected := `{"level":"debug"}`; expected != string(resp) {
+		t.Errorf("response doesn't match: expected: %s, value: %s", expected, string(resp))
+	}
+
+	if log.GetLevel() != log.DebugLevel {
+		t.Errorf("log level was expected to be debug, got %s", log.GetLevel())
+	}
+
+	_, err = mole.LogLevelRpc([]byte(`"loud"`))
+	if err == nil {
+		t.Errorf("error expected for invalid log level")
+	}
+}
+
+func TestRunConsole(t *testing.T) {
+	tun, _ := tunnel.New("local", &tunnel.Server{Name: "mole"}, []string{"127.0.0.1:0"}, []string{"127.0.0.1:80"}, "")
+
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"help\n", ""},
+		{"~C\nhelp\n", "mole> commands:"},
+		{"~C\nlist\n", "mole> [source=127.0.0.1:0, destination=127.0.0.1:80]\n"},
+		{"~C\nfoo\n", "mole> error: unknown command foo"},
+		{"~C\nremove\n", "mole> error: usage: remove <source>\n"},
+		{"~C\nadd 127.0.0.1:8080\n", "mole> error: channels can only be added once the tunnel is started\n"},
+	}
+
+	for _, test := range tests {
+		var out bytes.Buffer
+
+		mole.RunConsole(tun, strings.NewReader(test.input), &out)
+
+		if !strings.HasPrefix(out.String(), test.expected) || (test.expected == "" && out.Len() != 0) {
+			t.Errorf("unexpected console output for %q: want %q, got %q", test.input, test.expected, out.String())
+		}
+	}
+}
+
+func TestStartPprof(t *testing.T) {
+	addr, err := mole.StartPprof(":0", 0600)
+	if err != nil {
+		t.Fatalf("error starting pprof server: %v", err)
+	}
+
+	if !strings.HasPrefix(addr.String(), "127.0.0.1:") {
+		t.Errorf("pprof server was expected to listen on the loopback interface: %s", addr)
+	}
+
+	resp, err := http.Get(fmt.Sprintf("http://%s/debug/pprof/", addr))
+	if err != nil {
+		t.Fatalf("error requesting pprof index: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("unexpected pprof index status code: %d", resp.StatusCode)
+	}
+}
+
+func TestListenControl(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("unix socket permissions are not supported on windows")
+	}
+
+	dir, err := ioutil.TempDir("", "mole-control")
+	if err != nil {
+		t.Fatalf("error creating temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "control.sock")
+
+	lis, err := mole.ListenControl(path, 0660)
+	if err != nil {
+		t.Fatalf("error listening on unix socket: %v", err)
+	}
+
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("error reading unix socket: %v", err)
+	}
+
+	if perm := fi.Mode().Perm(); perm != 0660 {
+		t.Errorf("unexpected unix socket permissions: want: %o, got: %o", 0660, perm)
+	}
+
+	if _, err := mole.ListenControl(path, 0660); err == nil {
+		t.Errorf("error expected listening on a unix socket in use")
+	}
+
+	// a socket left behind by a process that is gone is replaced
+	lis.(*net.UnixListener).SetUnlinkOnClose(false)
+	lis.Close()
+
+	lis, err = mole.ListenControl(path, 0600)
+	if err != nil {
+		t.Fatalf("error listening on stale unix socket: %v", err)
+	}
+	lis.Close()
+
+	if _, err := mole.ParseSocketMode("0999"); err == nil {
+		t.Errorf("error expected parsing an invalid socket mode")
+	}
+}
+
+func TestDialLatencyRpc(t *testing.T) {
+	c := mole.New(&mole.Configuration{})
+	c.Tunnel = &tunnel.Tunnel{}
+
+	resp, err := mole.DialLatencyRpc(nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if expected := `{"auth":"0s","connect":"0s","handshake":"0s","resolve":"0s"}`; expected != string(resp) {
+		t.Errorf("response doesn't match: expected: %s, value: %s", expected, string(resp))
+	}
+}
+
+func TestStatsRpc(t *testing.T) {
+	c := mole.New(&mole.Configuration{})
+	c.Tunnel = &tunnel.Tunnel{}
+
+	resp, err := mole.StatsRpc(nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if expected := `[]`; expected != string(resp) {
+		t.Errorf("response doesn't match: expected: %s, value: %s", expected, string(resp))
+	}
+}
+
+func TestCheckStrict(t *testing.T) {
+	tests := []struct {
+		conf mole.Configuration
+		fail bool
+	}{
+		{mole.Configuration{}, false},
+		{mole.Configuration{Insecure: true}, true},
+		{mole.Configuration{Pprof: ":6060"}, true},
+		{mole.Configuration{RemoteTLS: []string{":8443=sni=db.internal"}}, false},
+		{mole.Configuration{RemoteTLS: []string{":8443=insecure"}}, true},
+		{mole.Configuration{Netrc: true}, true},
+	}
+
+	for i, test := range tests {
+		err := test.conf.CheckStrict()
+		if test.fail != (err != nil) {
+			t.Errorf("test %d: unexpected strict check result: %v", i, err)
+		}
+	}
+}
+
+func TestCheckExposure(t *testing.T) {
+	channels := func(tunnelType, source, destination string) mole.Configuration {
+		conf := mole.Configuration{TunnelType: tunnelType, SensitivePorts: []string{"postgres", "6379"}}
+		conf.Source.Set(source)
+		conf.Destination.Set(destination)
+
+		return conf
+	}
+
+	tests := []struct {
+		conf mole.Configuration
+		fail bool
+	}{
+		{channels("local", "0.0.0.0:5432", "db.internal:5432"), true},
+		{channels("remote", "0.0.0.0:6379", "127.0.0.1:6379"), true},
+		{channels("local", "192.168.1.10:15432", "db.internal:5432"), true},
+		{channels("local", ":5432", "db.internal:5432"), false},
+		{channels("local", "127.0.0.1:5432", "db.internal:5432"), false},
+		{channels("local", "localhost:5432", "db.internal:5432"), false},
+		{channels("local", "0.0.0.0:8080", "web.internal:80"), false},
+		{channels("local", "/tmp/db.sock", "db.internal:5432"), false},
+		{channels("stdio", "", "db.internal:5432"), false},
+	}
+
+	for i, test := range tests {
+		err := test.conf.CheckExposure()
+		if test.fail != (err != nil) {
+			t.Errorf("test %d: unexpected exposure check result: %v", i, err)
+		}
+	}
+}
+
+// TestDetachedTermination starts a detached instance, through a helper
+// process running this same test, and asks it to terminate with SIGTERM, the
+// way systemd or docker do.
+func TestDetachedTermination(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("instances can't be detached on windows")
+	}
+
+	id := "test-detached-termination"
+
+	if server := os.Getenv("MOLE_TEST_DETACHED_SERVER"); server != "" {
+		conf := &mole.Configuration{
+			Id:                id,
+			TunnelType:        "local",
+			Detach:            true,
+			Insecure:          true,
+			Key:               filepath.Join(home, "detached_key"),
+			Rpc:               true,
+			RpcAddress:        "127.0.0.1:0",
+			KeepAliveInterval: 10 * time.Second,
+			WaitAndRetry:      100 * time.Millisecond,
+			DrainTimeout:      time.Second,
+		}
+		conf.Server.Set("mole@" + server)
+		conf.Source.Set("127.0.0.1:0")
+		conf.Destination.Set("127.0.0.1:80")
+
+		err := mole.New(conf).Start()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return
+	}
+
+	pk, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(pk)})
+
+	err = ioutil.WriteFile(filepath.Join(home, "detached_key"), key, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the tunnel keeps trying to reach an ssh server that is gone
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := l.Addr().String()
+	l.Close()
+
+	// the detached process gets an --id argument appended, taken as a test
+	// argument after --.
+	cmd := exec.Command(os.Args[0], "-test.run=^TestDetachedTermination$", "--")
+	cmd.Env = append(os.Environ(), "MOLE_TEST_HOME="+home, "MOLE_TEST_DETACHED_SERVER="+server)
+
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("error starting detached instance: %v: %s", err, out)
+	}
+
+	d, err := fsutils.InstanceDir(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rpcFile := filepath.Join(d.Dir, "rpc")
+
+	waitFor := func(done func() bool) bool {
+		deadline := time.Now().Add(5 * time.Second)
+		for !done() {
+			if time.Now().After(deadline) {
+				return false
+			}
+
+			time.Sleep(50 * time.Millisecond)
+		}
+
+		return true
+	}
+
+	exists := func(path string) bool {
+		_, err := os.Stat(path)
+		return err == nil
+	}
+
+	lf, _ := fsutils.GetLogFileLocation(id)
+
+	if !waitFor(func() bool { return exists(rpcFile) }) {
+		logs, _ := ioutil.ReadFile(lf)
+		t.Fatalf("detached instance didn't start in time, logs:\n%s", logs)
+	}
+
+	pid, err := fsutils.Pid(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = p.Signal(syscall.SIGTERM)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stopped := waitFor(func() bool {
+		return !exists(d.PidFile) && !exists(rpcFile) && !exists(filepath.Join(d.Dir, mole.HandoffDir))
+	})
+	if !stopped {
+		p.Kill()
+		t.Fatalf("instance files expected to be removed once the detached instance is terminated")
+	}
+
+	logs, _ := ioutil.ReadFile(lf)
+
+	if !bytes.Contains(logs, []byte("instance stopped")) {
+		t.Errorf("detached instance expected to stop gracefully, logs:\n%s", logs)
+	}
+}
+
+func TestCheck(t *testing.T) {
+	key := filepath.Join(home, "check_key")
+
+	err := ioutil.WriteFile(key, []byte("key"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conf := func(tunnelType, source, destination string) *mole.Configuration {
+		c := &mole.Configuration{TunnelType: tunnelType, Key: key}
+		c.Server.Set("mole@example.com:22")
+		c.Source.Set(source)
+		c.Destination.Set(destination)
+
+		return c
+	}
+
+	tests := []struct {
+		conf     *mole.Configuration
+		problems int
+	}{
+		{conf("local", ":8080", "web.internal:80"), 0},
+		{conf("local", ":8080", "web.internal"), 1},
+		{conf("invalid", ":8080", "web.internal:80"), 1},
+		{func() *mole.Configuration {
+			c := conf("local", ":8080", "web.internal:80")
+			c.Key = filepath.Join(home, "missing_key")
+			c.ControlSocketMode = "999"
+			return c
+		}(), 2},
+		{func() *mole.Configuration {
+			c := conf("stdio", "", "web.internal:80")
+			c.Detach = true
+			c.Strict = true
+			c.Insecure = true
+			return c
+		}(), 2},
+	}
+
+	for i, test := range tests {
+		problems := test.conf.Check()
+		if len(problems) != test.problems {
+			t.Errorf("test %d: unexpected problems: want: %d, got: %v", i, test.problems, problems)
+		}
+	}
+}
+
+func TestTakeover(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("error creating listener: %v", err)
+	}
+	defer l.Close()
+
+	address := l.Addr().String()
+	done := make(chan struct{})
+
+	lis, err := mole.ServeHandoff("takeover-test", func() map[string]net.Listener {
+		return map[string]net.Listener{address: l}
+	}, func() { close(done) })
+	if err != nil {
+		t.Fatalf("error serving handoff: %v", err)
+	}
+	defer lis.Close()
+
+	socket, err := mole.HandoffSocket("takeover-test")
+	if err != nil {
+		t.Fatalf("error locating handoff socket: %v", err)
+	}
+
+	info, err := os.Stat(filepath.Dir(socket))
+	if err != nil {
+		t.Fatalf("error reading handoff directory: %v", err)
+	}
+
+	if perm := info.Mode().Perm(); perm != 0700 {
+		t.Errorf("handoff directory expected to be only accessible by its owner: %v", perm)
+	}
+
+	listeners, err := mole.Takeover("takeover-test")
+	if err != nil {
+		t.Fatalf("error taking over listeners: %v", err)
+	}
+
+	select {
+	case <-done:
+	case <-time.After(1 * time.Second):
+		t.Fatalf("handoff was expected to be confirmed")
+	}
+
+	inherited, ok := listeners[address]
+	if !ok {
+		t.Fatalf("listener on %s was expected to be taken over: %v", address, listeners)
+	}
+	defer inherited.Close()
+
+	if inherited.Addr().String() != address {
+		t.Errorf("unexpected address for the listener taken over: want %s, got %s", address, inherited.Addr())
+	}
+
+	_, err = mole.Takeover("takeover-test")
+	if err == nil {
+		t.Errorf("listeners were expected to be taken over only once")
+	}
+}
+
+func TestParseRemoteTLS(t *testing.T) {
+	tests := []struct {
+		option   string
+		source   string
+		sni      string
+		insecure bool
+		fail     bool
+	}{
+		{"", "", "", false, false},
+		{"sni=db.internal", "", "db.internal", false, false},
+		{":8443=sni=db.internal,insecure", ":8443", "db.internal", true, false},
+		{"127.0.0.1:8443", "127.0.0.1:8443", "", false, false},
+		{"127.0.0.1:8443=", "127.0.0.1:8443", "", false, false},
+		{"insecure", "", "", true, false},
+		{":8443=verify", "", "", false, true},
+		{":8443=ca=testdata/missing.pem", "", "", false, true},
+	}
+
+	for i, test := range tests {
+		source, config, err := mole.ParseRemoteTLS(test.option)
+		if test.fail != (err != nil) {
+			t.Errorf("test %d: unexpected error result: %v", i, err)
+			continue
+		}
+
+		if test.fail {
+			continue
+		}
+
+		if test.source != source || test.sni != config.ServerName || test.insecure != config.InsecureSkipVerify {
+			t.Errorf("test %d: unexpected result: source: %s, sni: %s, insecure: %t", i, source, config.ServerName, config.InsecureSkipVerify)
+		}
+	}
+}
+
+func TestParseLocalTLS(t *testing.T) {
+	// borrows the certificate of a tls test server
+	ts := httptest.NewTLSServer(http.NotFoundHandler())
+	ts.Close()
+
+	cert := ts.TLS.Certificates[0]
+
+	key, err := x509.MarshalPKCS8PrivateKey(cert.PrivateKey)
+	if err != nil {
+		t.Fatalf("error encoding private key: %v", err)
+	}
+
+	certFile := filepath.Join(home, "local-tls.crt")
+	keyFile := filepath.Join(home, "local-tls.key")
+
+	err = ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]}), 0600)
+	if err != nil {
+		t.Fatalf("error writing certificate file: %v", err)
+	}
+
+	err = ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: key}), 0600)
+	if err != nil {
+		t.Fatalf("error writing key file: %v", err)
+	}
+
+	tests := []struct {
+		certs   []string
+		keys    []string
+		sources []string
+		fail    bool
+	}{
+		{nil, nil, nil, false},
+		{[]string{certFile}, []string{keyFile}, []string{""}, false},
+		{[]string{":8443=" + certFile, certFile}, []string{":8443=" + keyFile, keyFile}, []string{"", ":8443"}, false},
+		{[]string{":8443=" + certFile}, []string{keyFile}, nil, true},
+		{[]string{certFile}, nil, nil, true},
+		{[]string{certFile}, []string{certFile}, nil, true},
+	}
+
+	for i, test := range tests {
+		configs, err := mole.ParseLocalTLS(test.certs, test.keys)
+		if test.fail != (err != nil) {
+			t.Errorf("test %d: unexpected error result: %v", i, err)
+			continue
+		}
+
+		if len(configs) != len(test.sources) {
+			t.Errorf("test %d: unexpected number of configurations: %d", i, len(configs))
+		}
+
+		for _, source := range test.sources {
+			if c, ok := configs[source]; !ok || len(c.Certificates) != 1 {
+				t.Errorf("test %d: missing certificate for source %q", i, source)
+			}
+		}
+	}
+}
+
+func TestKeychainPassphrase(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("secret-tool is only faked on linux")
+	}
+
+	// a fake secret-tool keeping a single secret in a file
+	bin := filepath.Join(home, "bin")
+	store := filepath.Join(home, "secret")
+
+	err := os.MkdirAll(bin, 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	script := fmt.Sprintf(`#!/bin/sh
+case "$1" in
+store) cat > %[1]s ;;
+lookup) cat %[1]s 2>/dev/null ;;
+esac
+`, store)
+
+	err = ioutil.WriteFile(filepath.Join(bin, "secret-tool"), []byte(script), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path := os.Getenv("PATH")
+	os.Setenv("PATH", bin+string(os.PathListSeparator)+path)
+	defer os.Setenv("PATH", path)
+
+	key := "testdata/dotssh/id_rsa"
+
+	_, err = mole.KeychainPassphrase(key)
+	if err == nil {
+		t.Fatalf("error expected when no passphrase is saved")
+	}
+
+	err = mole.SaveKeychainPassphrase(key, []byte("mole"))
+	if err != nil {
+		t.Fatalf("error saving passphrase: %v", err)
+	}
+
+	pp, err := mole.KeychainPassphrase(key)
+	if err != nil {
+		t.Fatalf("error retrieving passphrase: %v", err)
+	}
+
+	if string(pp) != "mole" {
+		t.Errorf("unexpected passphrase: want: mole, got: %s", pp)
+	}
+}
+
+func TestParseNetrc(t *testing.T) {
+	netrc := `
+# company servers
+machine bastion login mole password s3cr3t
+machine example
+  login deploy
+  account ops
+  password "quoted"
+
+macdef init
+machine macro login ignored password ignored
+
+default login anonymous password guest
+`
+
+	expected := []mole.NetrcEntry{
+		{Machine: "bastion", Login: "mole", Password: "s3cr3t"},
+		{Machine: "example", Login: "deploy", Password: `"quoted"`},
+		{Machine: "", Login: "anonymous", Password: "guest"},
+	}
+
+	entries := mole.ParseNetrc([]byte(netrc))
+	if !reflect.DeepEqual(expected, entries) {
+		t.Errorf("unexpected netrc entries: want: %+v, got: %+v", expected, entries)
+	}
+
+	path := filepath.Join(home, "netrc")
+	err := ioutil.WriteFile(path, []byte(netrc), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		machine  string
+		expected mole.NetrcEntry
+	}{
+		{"bastion", expected[0]},
+		{"example", expected[1]},
+		{"unknown", expected[2]},
+	}
+
+	for _, test := range tests {
+		entry, ok, err := mole.LookupNetrc(path, test.machine)
+		if err != nil || !ok {
+			t.Errorf("%s: credentials expected: %v", test.machine, err)
+			continue
+		}
+
+		if test.expected != entry {
+			t.Errorf("%s: unexpected credentials: want: %+v, got: %+v", test.machine, test.expected, entry)
+		}
+	}
+
+	_, ok, err := mole.LookupNetrc(filepath.Join(home, "missing-netrc"), "bastion")
+	if err != nil || ok {
+		t.Errorf("missing netrc file was expected to be ignored: %v", err)
+	}
+}
+
+func TestStartDuplicateId(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the running instance is simulated with a sleep process")
+	}
+
+	id := "test-duplicate-id"
+
+	// an instance run by the test process itself
+	d, err := fsutils.CreateInstanceDir(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = mole.New(&mole.Configuration{Id: id}).Start()
+	if err == nil || !strings.Contains(err.Error(), "--force") {
+		t.Errorf("a second instance using the same id was expected to be refused: %v", err)
+	}
+
+	// an instance run by another process, which a forced start replaces
+	cmd := exec.Command("sleep", "30")
+	err = cmd.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	exited := make(chan struct{})
+	go func() {
+		cmd.Wait()
+		close(exited)
+	}()
+
+	err = ioutil.WriteFile(d.PidFile, []byte(strconv.Itoa(cmd.Process.Pid)), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the tunnel itself can't be started without a server
+	mole.New(&mole.Configuration{Id: id, Force: true}).Start()
+
+	select {
+	case <-exited:
+	case <-time.After(5 * time.Second):
+		cmd.Process.Kill()
+		t.Errorf("instance using the same id was expected to be stopped")
+	}
+}
+
+func TestMemoryKey(t *testing.T) {
+	pk, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(pk)})
+
+	os.Setenv("MOLE_TEST_SSH_KEY", string(key))
+	defer os.Unsetenv("MOLE_TEST_SSH_KEY")
+
+	conf := &mole.Configuration{Key: "path/to/key", KeyEnv: "MOLE_TEST_SSH_KEY"}
+
+	k, err := conf.MemoryKey()
+	if err != nil {
+		t.Fatalf("error reading key from the environment: %v", err)
+	}
+
+	if k == nil {
+		t.Fatalf("key given through the environment takes precedence over the key file")
+	}
+
+	if _, err := k.Parse(); err != nil {
+		t.Errorf("error parsing key read from the environment: %v", err)
+	}
+
+	// the key is only read once.
+	os.Unsetenv("MOLE_TEST_SSH_KEY")
+
+	again, err := conf.MemoryKey()
+	if err != nil || again != k {
+		t.Errorf("the key read first was expected to be returned: %v", err)
+	}
+
+	conf = &mole.Configuration{KeyEnv: "MOLE_TEST_SSH_KEY"}
+	if _, err := conf.MemoryKey(); err == nil {
+		t.Errorf("error expected when the environment variable is not set")
+	}
+
+	conf = &mole.Configuration{Key: "path/to/key"}
+	if k, err := conf.MemoryKey(); k != nil || err != nil {
+		t.Errorf("no key was expected to be read for a key file: %v", err)
+	}
+}
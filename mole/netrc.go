@@ -0,0 +1,140 @@
+package mole
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// NetrcEntry holds the credentials given for a machine on a netrc file. The
+// default entry, used for any machine not listed, has an empty Machine.
+type NetrcEntry struct {
+	Machine  string
+	Login    string
+	Password string
+}
+
+// NetrcFile returns the location of the netrc file of the user running mole,
+// which can be overridden through the NETRC environment variable.
+func NetrcFile() (string, error) {
+	if f := os.Getenv("NETRC"); f != "" {
+		return f, nil
+	}
+
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+
+	name := ".netrc"
+	if runtime.GOOS == "windows" {
+		name = "_netrc"
+	}
+
+	return filepath.Join(home, name), nil
+}
+
+// ParseNetrc parses the content of a netrc file, returning its entries in the
+// order they are defined.
+//
+// Macro definitions (macdef) are skipped, as well as account tokens and
+// comments starting with #.
+func ParseNetrc(data []byte) []NetrcEntry {
+	var entries []NetrcEntry
+
+	// key holds the token waiting for a value, which may be on the next line.
+	var key string
+	macro := false
+
+	for _, line := range strings.Split(string(data), "\n") {
+		// a macro definition goes on until the next empty line.
+		if macro {
+			macro = strings.TrimSpace(line) != ""
+			continue
+		}
+
+	tokens:
+		for _, token := range strings.Fields(line) {
+			if key != "" {
+				n := len(entries)
+
+				switch {
+				case key == "machine":
+					entries = append(entries, NetrcEntry{Machine: token})
+				case key == "login" && n > 0:
+					entries[n-1].Login = token
+				case key == "password" && n > 0:
+					entries[n-1].Password = token
+				case key == "macdef":
+					macro = true
+				}
+
+				key = ""
+
+				if macro {
+					break tokens
+				}
+
+				continue
+			}
+
+			switch token {
+			case "machine", "login", "password", "account", "macdef":
+				key = token
+			case "default":
+				entries = append(entries, NetrcEntry{})
+			default:
+				if strings.HasPrefix(token, "#") {
+					break tokens
+				}
+			}
+		}
+	}
+
+	return entries
+}
+
+// LookupNetrc returns the credentials given for the machine with the given
+// name on the netrc file, falling back to the default entry, if any. The first
+// entry matching the machine name is taken, like any other netrc client does.
+//
+// A missing netrc file is not taken as an error.
+func LookupNetrc(path, machine string) (NetrcEntry, bool, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return NetrcEntry{}, false, nil
+		}
+
+		return NetrcEntry{}, false, err
+	}
+
+	if runtime.GOOS != "windows" {
+		if fi, err := os.Stat(path); err == nil && fi.Mode().Perm()&0077 != 0 {
+			log.Warnf("%s is accessible by other users, consider restricting its permissions to 0600", path)
+		}
+	}
+
+	var def *NetrcEntry
+
+	entries := ParseNetrc(data)
+	for i, e := range entries {
+		if e.Machine == machine {
+			return e, true, nil
+		}
+
+		if e.Machine == "" && def == nil {
+			def = &entries[i]
+		}
+	}
+
+	if def != nil {
+		return *def, true, nil
+	}
+
+	return NetrcEntry{}, false, nil
+}
@@ -0,0 +1,51 @@
+package mole
+
+import (
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"os"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// StartPprof serves the runtime profiling data of the running process, as
+// provided by net/http/pprof, on the given address under /debug/pprof/.
+//
+// An address without a host (e.g. ":6060" or "6060") is bound to the loopback
+// interface, so the profiling data is not exposed to the network unless
+// explicitly requested. An address containing a slash is taken as the path of
+// a unix socket, given the mode permissions (see ListenControl).
+//
+// This is a debugging tool; none of the endpoints require authentication.
+func StartPprof(address string, mode os.FileMode) (net.Addr, error) {
+	if !strings.Contains(address, "/") && !strings.Contains(address, ":") {
+		address = ":" + address
+	}
+
+	if strings.HasPrefix(address, ":") {
+		address = "127.0.0.1" + address
+	}
+
+	lis, err := ListenControl(address, mode)
+	if err != nil {
+		return nil, err
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+
+	go func() {
+		err := http.Serve(lis, mux)
+		if err != nil {
+			log.WithError(err).Warn("pprof server stopped")
+		}
+	}()
+
+	return lis.Addr(), nil
+}
@@ -13,6 +13,11 @@ import (
 
 func init() {
 	rpc.Register("show-instance", ShowRpc)
+	rpc.Register("loglevel", LogLevelRpc)
+	rpc.Register("dial-latency", DialLatencyRpc)
+	rpc.Register("stats", StatsRpc)
+	rpc.Register("restart", RestartRpc)
+	rpc.RegisterStream("watch", WatchRpc)
 }
 
 // ShowRpc is a rpc callback that returns runtime information about the mole client.
@@ -34,6 +39,95 @@ func ShowRpc(params interface{}) (json.RawMessage, error) {
 	return json.RawMessage(cj), nil
 }
 
+// LogLevelRpc is a rpc callback that changes the log level of the mole client
+// (e.g. debug or info) without restarting it.
+func LogLevelRpc(params interface{}) (json.RawMessage, error) {
+	if cli == nil || cli.Tunnel == nil {
+		return nil, fmt.Errorf("client tunnel could not be found.")
+	}
+
+	var level string
+
+	if p, ok := params.([]byte); ok {
+		err := json.Unmarshal(p, &level)
+		if err != nil {
+			return nil, fmt.Errorf("invalid log level: %v", err)
+		}
+	}
+
+	err := cli.Tunnel.SetLogLevel(level)
+	if err != nil {
+		return nil, err
+	}
+
+	lj, err := json.Marshal(map[string]string{"level": level})
+	if err != nil {
+		return nil, err
+	}
+
+	return json.RawMessage(lj), nil
+}
+
+// DialLatencyRpc is a rpc callback that returns the time spent on each phase
+// of the latest connection attempt to the ssh server: host name resolution,
+// tcp connection, ssh handshake and authentication.
+func DialLatencyRpc(params interface{}) (json.RawMessage, error) {
+	if cli == nil || cli.Tunnel == nil {
+		return nil, fmt.Errorf("client tunnel could not be found.")
+	}
+
+	latency := cli.Tunnel.DialLatency()
+
+	lj, err := json.Marshal(map[string]string{
+		"resolve":   latency.Resolve.String(),
+		"connect":   latency.Connect.String(),
+		"handshake": latency.Handshake.String(),
+		"auth":      latency.Auth.String(),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return json.RawMessage(lj), nil
+}
+
+// StatsRpc is a rpc callback that returns the counters of every channel of the
+// tunnel, like the number of connections to its destination that succeeded
+// or failed.
+func StatsRpc(params interface{}) (json.RawMessage, error) {
+	if cli == nil || cli.Tunnel == nil {
+		return nil, fmt.Errorf("client tunnel could not be found.")
+	}
+
+	sj, err := json.Marshal(cli.Tunnel.Stats())
+	if err != nil {
+		return nil, err
+	}
+
+	return json.RawMessage(sj), nil
+}
+
+// RestartRpc is a rpc callback that makes the tunnel reconnect to the ssh
+// server right away, without being penalized by earlier failed connection
+// attempts.
+func RestartRpc(params interface{}) (json.RawMessage, error) {
+	if cli == nil || cli.Tunnel == nil {
+		return nil, fmt.Errorf("client tunnel could not be found.")
+	}
+
+	err := cli.Tunnel.Restart()
+	if err != nil {
+		return nil, err
+	}
+
+	rj, err := json.Marshal(map[string]bool{"restarted": true})
+	if err != nil {
+		return nil, err
+	}
+
+	return json.RawMessage(rj), nil
+}
+
 // Rpc calls a remote procedure on another mole instance given its id or alias.
 func Rpc(id, method string, params interface{}) (string, error) {
 	d, err := fsutils.InstanceDir(id)
@@ -6,6 +6,7 @@ import (
 	"io/ioutil"
 	"os"
 	"strconv"
+	"time"
 
 	"github.com/BurntSushi/toml"
 	"github.com/davrodpin/mole/fsutils"
@@ -97,27 +98,41 @@ func (c *Client) Runtime() (*Runtime, error) {
 	return &runtime, nil
 }
 
+// replaceTimeout is the maximum amount of time waited for an instance replaced
+// by a new one using the same id to exit.
+const replaceTimeout = 5 * time.Second
+
 // Running checks if an instance of mole is running on the system.
 func (c *Client) Running() (bool, error) {
+	pid, err := c.pid()
+	if err != nil || pid == 0 {
+		return false, err
+	}
+
+	return processRunning(pid)
+}
+
+// pid returns the process id kept on the pid file of the instance, or zero if
+// there is no pid file.
+func (c *Client) pid() (int, error) {
 	d, err := fsutils.InstanceDir(c.Conf.Id)
 	if err != nil {
-		return false, err
+		return 0, err
 	}
 
 	if _, err := os.Stat(d.PidFile); os.IsNotExist(err) {
-		return false, nil
+		return 0, nil
 	}
 
 	pd, err := ioutil.ReadFile(d.PidFile)
 	if err != nil {
-		return false, err
+		return 0, err
 	}
 
-	pid, err := strconv.Atoi(string(pd))
-	if err != nil {
-		return false, err
-	}
+	return strconv.Atoi(string(pd))
+}
 
+func processRunning(pid int) (bool, error) {
 	ps, err := ps.FindProcess(pid)
 	if err != nil {
 		return false, err
@@ -129,3 +144,100 @@ func (c *Client) Running() (bool, error) {
 
 	return true, nil
 }
+
+// replace stops the running instance using the same id as the client, waiting
+// for its process to exit, so its pid file is not clobbered while it is still
+// running. The instance logs are kept.
+func (c *Client) replace() error {
+	pid, err := c.pid()
+	if err != nil || pid == 0 {
+		return err
+	}
+
+	if pid == os.Getpid() {
+		return fmt.Errorf("instance %s is run by this process", c.Conf.Id)
+	}
+
+	old := &Client{Conf: &Configuration{Id: c.Conf.Id, Detach: true}}
+
+	err = old.Stop()
+	if err != nil {
+		return err
+	}
+
+	deadline := time.Now().Add(replaceTimeout)
+
+	for {
+		running, err := processRunning(pid)
+		if err != nil || !running {
+			return err
+		}
+
+		if time.Now().After(deadline) {
+			return fmt.Errorf("instance %s (pid %d) has not stopped after %s", c.Conf.Id, pid, replaceTimeout)
+		}
+
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+// Prune removes the files of every application instance which process is no
+// longer running (e.g. an instance that crashed), returning the ids of the
+// instances removed.
+func Prune() ([]string, error) {
+	home, err := fsutils.Dir()
+	if err != nil {
+		return nil, err
+	}
+
+	entries, err := ioutil.ReadDir(home)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+
+		return nil, err
+	}
+
+	var pruned []string
+
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+
+		d, err := fsutils.InstanceDir(entry.Name())
+		if err != nil {
+			return pruned, err
+		}
+
+		// only instance directories keep a pid file
+		if _, err := os.Stat(d.PidFile); err != nil {
+			continue
+		}
+
+		c := &Client{Conf: &Configuration{Id: d.Id}}
+
+		running, err := c.Running()
+		if err != nil {
+			// a pid file that can't be parsed was left behind by an instance that
+			// died while creating it.
+			if _, ok := err.(*strconv.NumError); !ok {
+				return pruned, err
+			}
+		}
+
+		if running {
+			continue
+		}
+
+		err = os.RemoveAll(d.Dir)
+		if err != nil {
+			return pruned, fmt.Errorf("could not remove files of instance %s: %v", d.Id, err)
+		}
+
+		pruned = append(pruned, d.Id)
+	}
+
+	return pruned, nil
+}
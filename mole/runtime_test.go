@@ -1,6 +1,8 @@
 package mole_test
 
 import (
+	"io/ioutil"
+	"os"
 	"strings"
 	"testing"
 
@@ -14,16 +16,62 @@ const expectedInstance string = `id = "id1"
 tunnel-type = ""
 verbose = false
 insecure = false
+strict = false
 detach = false
+sync-log = false
+sticky-ports = false
+destination-command = ""
+tun-device = ""
+manifest-command = ""
+user = ""
+port = ""
+interface = ""
 key = ""
+key-env = ""
+identities-only = false
+no-default-key = false
+netrc = false
+interactive-auth = false
+passphrase-attempts = 0
+use-keychain = false
 keep-alive-interval = 0
+keep-alive-data = false
+keep-alive-idle-only = false
+keep-alive-initial-delay = 0
 connection-retries = 0
+max-reconnects = 0
+max-pending-opens = 0
+max-channels = 0
 wait-and-retry = 0
+stable-connection-period = 0
+supervise = 0
+log-rate-limit = 0
+wait-for-remote = 0
+network-check-interval = 0
 ssh-agent = ""
 timeout = 0
+dns-timeout = 0
+remote-dial-timeout = 0
+migration-timeout = 0
+initial-read-timeout = 0
+drain-timeout = 0
+half-close = false
+trace = false
+trace-limit = 0
+exposure-check = ""
+egress-policy = ""
 ssh-config = ""
 rpc = false
 rpc-address = ""
+control-socket-mode = ""
+env-file = ""
+on-disconnect = ""
+on-reconnect = ""
+exec-once = ""
+pprof = ""
+takeover = ""
+force = false
+verify = false
 
 [server]
   user = ""
@@ -36,16 +84,62 @@ const expectedMultipleInstances string = `[instances]
     tunnel-type = ""
     verbose = false
     insecure = false
+    strict = false
     detach = false
+    sync-log = false
+    sticky-ports = false
+    destination-command = ""
+    tun-device = ""
+    manifest-command = ""
+    user = ""
+    port = ""
+    interface = ""
     key = ""
+    key-env = ""
+    identities-only = false
+    no-default-key = false
+    netrc = false
+    interactive-auth = false
+    passphrase-attempts = 0
+    use-keychain = false
     keep-alive-interval = 0
+    keep-alive-data = false
+    keep-alive-idle-only = false
+    keep-alive-initial-delay = 0
     connection-retries = 0
+    max-reconnects = 0
+    max-pending-opens = 0
+    max-channels = 0
     wait-and-retry = 0
+    stable-connection-period = 0
+    supervise = 0
+    log-rate-limit = 0
+    wait-for-remote = 0
+    network-check-interval = 0
     ssh-agent = ""
     timeout = 0
+    dns-timeout = 0
+    remote-dial-timeout = 0
+    migration-timeout = 0
+    initial-read-timeout = 0
+    drain-timeout = 0
+    half-close = false
+    trace = false
+    trace-limit = 0
+    exposure-check = ""
+    egress-policy = ""
     ssh-config = ""
     rpc = false
     rpc-address = ""
+    control-socket-mode = ""
+    env-file = ""
+    on-disconnect = ""
+    on-reconnect = ""
+    exec-once = ""
+    pprof = ""
+    takeover = ""
+    force = false
+    verify = false
     [instances.id1.server]
       user = ""
       host = ""
@@ -55,16 +149,62 @@ const expectedMultipleInstances string = `[instances]
     tunnel-type = ""
     verbose = false
     insecure = false
+    strict = false
     detach = false
+    sync-log = false
+    sticky-ports = false
+    destination-command = ""
+    tun-device = ""
+    manifest-command = ""
+    user = ""
+    port = ""
+    interface = ""
     key = ""
+    key-env = ""
+    identities-only = false
+    no-default-key = false
+    netrc = false
+    interactive-auth = false
+    passphrase-attempts = 0
+    use-keychain = false
     keep-alive-interval = 0
+    keep-alive-data = false
+    keep-alive-idle-only = false
+    keep-alive-initial-delay = 0
     connection-retries = 0
+    max-reconnects = 0
+    max-pending-opens = 0
+    max-channels = 0
     wait-and-retry = 0
+    stable-connection-period = 0
+    supervise = 0
+    log-rate-limit = 0
+    wait-for-remote = 0
+    network-check-interval = 0
     ssh-agent = ""
     timeout = 0
+    dns-timeout = 0
+    remote-dial-timeout = 0
+    migration-timeout = 0
+    initial-read-timeout = 0
+    drain-timeout = 0
+    half-close = false
+    trace = false
+    trace-limit = 0
+    exposure-check = ""
+    egress-policy = ""
     ssh-config = ""
     rpc = false
     rpc-address = ""
+    control-socket-mode = ""
+    env-file = ""
+    on-disconnect = ""
+    on-reconnect = ""
+    exec-once = ""
+    pprof = ""
+    takeover = ""
+    force = false
+    verify = false
     [instances.id2.server]
       user = ""
       host = ""
@@ -120,3 +260,48 @@ func TestClientRunning(t *testing.T) {
 		t.Errorf("client was supposed to be running")
 	}
 }
+
+func TestPrune(t *testing.T) {
+	running := "test-prune-running"
+	stale := "test-prune-stale"
+
+	_, err := fsutils.CreateInstanceDir(running)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	d, err := fsutils.CreateInstanceDir(stale)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	// Mock a pid file of a process that doesn't exist anymore
+	err = ioutil.WriteFile(d.PidFile, []byte("999999999"), 0644)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	pruned, err := mole.Prune()
+	if err != nil {
+		t.Errorf(err.Error())
+	}
+
+	found := false
+	for _, id := range pruned {
+		if id == running {
+			t.Errorf("running instance %s was not supposed to be pruned", running)
+		}
+
+		if id == stale {
+			found = true
+		}
+	}
+
+	if !found {
+		t.Errorf("stale instance %s was supposed to be pruned: %v", stale, pruned)
+	}
+
+	if _, err := os.Stat(d.Dir); !os.IsNotExist(err) {
+		t.Errorf("directory of stale instance %s was supposed to be removed", stale)
+	}
+}
@@ -0,0 +1,62 @@
+package mole
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// SystemdReady is the state sent to systemd once the tunnel is ready to
+	// accept connections.
+	SystemdReady = "READY=1"
+
+	// SystemdWatchdog is the state sent to systemd to keep the service watchdog
+	// from restarting mole.
+	SystemdWatchdog = "WATCHDOG=1"
+)
+
+// NotifySystemd sends the given state to the systemd service manager through
+// the socket given by $NOTIFY_SOCKET, which is only set when mole runs as a
+// systemd service with Type=notify.
+//
+// It returns false, without any error, if $NOTIFY_SOCKET is not set.
+func NotifySystemd(state string) (bool, error) {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return false, nil
+	}
+
+	// a leading "@" means the socket lives on the linux abstract namespace.
+	if strings.HasPrefix(socket, "@") {
+		socket = "\x00" + socket[1:]
+	}
+
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		return true, err
+	}
+	defer conn.Close()
+
+	_, err = conn.Write([]byte(state))
+
+	return true, err
+}
+
+// SystemdWatchdogTimeout returns the time systemd waits for a watchdog
+// notification before restarting mole, or zero if the systemd watchdog is not
+// enabled for this process.
+func SystemdWatchdogTimeout() time.Duration {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+
+	return time.Duration(usec) * time.Microsecond
+}
@@ -0,0 +1,133 @@
+package mole
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"strings"
+)
+
+// remoteTLSOptions holds the settings given through a --remote-tls option.
+type remoteTLSOptions struct {
+	source   string
+	sni      string
+	ca       string
+	insecure bool
+}
+
+// parseRemoteTLSOptions parses a remote tls option given as
+// [[<host>]:<port>=][sni=<name>][,ca=<file>][,insecure].
+func parseRemoteTLSOptions(option string) (remoteTLSOptions, error) {
+	var opts remoteTLSOptions
+
+	settings := option
+
+	// the source address is the only part of the option with a colon before
+	// the first equal sign.
+	if i := strings.Index(option, "="); i >= 0 && strings.Contains(option[:i], ":") {
+		opts.source, settings = option[:i], option[i+1:]
+	} else if i < 0 && strings.Contains(option, ":") {
+		opts.source, settings = option, ""
+	}
+
+	for _, s := range strings.Split(settings, ",") {
+		kv := strings.SplitN(strings.TrimSpace(s), "=", 2)
+
+		switch {
+		case kv[0] == "":
+		case kv[0] == "insecure" && len(kv) == 1:
+			opts.insecure = true
+		case kv[0] == "sni" && len(kv) == 2:
+			opts.sni = kv[1]
+		case kv[0] == "ca" && len(kv) == 2:
+			opts.ca = kv[1]
+		default:
+			return opts, fmt.Errorf("invalid remote tls setting %s: expected sni=<name>, ca=<file> or insecure", s)
+		}
+	}
+
+	return opts, nil
+}
+
+// ParseRemoteTLS parses a remote tls option given as
+// [[<host>]:<port>=][sni=<name>][,ca=<file>][,insecure], returning the source
+// address of the channel it applies to, if any, and the tls configuration
+// used to connect to the channel destination.
+//
+// The destination certificate is verified against the system certificate
+// authorities unless a ca file is given or insecure is set.
+func ParseRemoteTLS(option string) (string, *tls.Config, error) {
+	opts, err := parseRemoteTLSOptions(option)
+	if err != nil {
+		return "", nil, err
+	}
+
+	config := &tls.Config{
+		ServerName:         opts.sni,
+		InsecureSkipVerify: opts.insecure,
+	}
+
+	if opts.ca != "" {
+		pem, err := ioutil.ReadFile(opts.ca)
+		if err != nil {
+			return "", nil, fmt.Errorf("error reading certificate authority file %s: %v", opts.ca, err)
+		}
+
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return "", nil, fmt.Errorf("no certificate found on certificate authority file %s", opts.ca)
+		}
+	}
+
+	return opts.source, config, nil
+}
+
+// ParseLocalTLS pairs the certificate and key files given as
+// [<source>=]<file>, returning the tls configuration of the listener of each
+// source address. An empty source address applies to all channels.
+func ParseLocalTLS(certs, keys []string) (map[string]*tls.Config, error) {
+	certFiles := make(map[string]string, len(certs))
+	for _, c := range certs {
+		source, file := splitChannelOption(c)
+		certFiles[source] = file
+	}
+
+	keyFiles := make(map[string]string, len(keys))
+	for _, k := range keys {
+		source, file := splitChannelOption(k)
+		keyFiles[source] = file
+	}
+
+	for source := range keyFiles {
+		if _, ok := certFiles[source]; !ok {
+			return nil, fmt.Errorf("missing local tls certificate for the key of %s", describeSource(source))
+		}
+	}
+
+	configs := make(map[string]*tls.Config, len(certFiles))
+
+	for source, certFile := range certFiles {
+		keyFile, ok := keyFiles[source]
+		if !ok {
+			return nil, fmt.Errorf("missing local tls key for the certificate of %s", describeSource(source))
+		}
+
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("error loading local tls certificate of %s: %v", describeSource(source), err)
+		}
+
+		configs[source] = &tls.Config{Certificates: []tls.Certificate{cert}}
+	}
+
+	return configs, nil
+}
+
+func describeSource(source string) string {
+	if source == "" {
+		return "all channels"
+	}
+
+	return source
+}
@@ -2,9 +2,11 @@ package rpc
 
 import (
 	"context"
+	"encoding/json"
 	"net"
 	"os"
 	"path/filepath"
+	"strings"
 
 	"github.com/davrodpin/mole/fsutils"
 
@@ -44,9 +46,10 @@ func CallById(context context.Context, id, method string, params interface{}) (m
 }
 
 // Call initiates a JSON-RPC call to a given rpc server address, using the
-// specified method and waits for the response.
+// specified method and waits for the response. Addresses containing a slash
+// are taken as unix socket paths.
 func Call(ctx context.Context, addr, method string, params interface{}) (map[string]interface{}, error) {
-	tc, err := net.Dial("tcp", addr)
+	tc, err := dial(addr)
 	if err != nil {
 		return nil, err
 	}
@@ -113,3 +116,61 @@ func ShowAll(context context.Context) ([]map[string]interface{}, error) {
 
 	return instances, nil
 }
+
+// Watch calls a stream registered on a given rpc server address (see
+// RegisterStream) and sends the parameters of every notification it sends
+// back to the given channel, until the server closes the stream or ctx is
+// done.
+func Watch(ctx context.Context, addr, method string, params interface{}, notifications chan<- json.RawMessage) error {
+	tc, err := dial(addr)
+	if err != nil {
+		return err
+	}
+
+	stream := jsonrpc2.NewBufferedStream(tc, jsonrpc2.VarintObjectCodec{})
+	h := &notificationHandler{method: method, notifications: notifications}
+	conn := jsonrpc2.NewConn(ctx, stream, h)
+	defer conn.Close()
+
+	var r map[string]interface{}
+	err = conn.Call(ctx, method, params, &r)
+	if err != nil {
+		return err
+	}
+
+	select {
+	case <-conn.DisconnectNotify():
+	case <-ctx.Done():
+	}
+
+	return nil
+}
+
+// notificationHandler forwards the parameters of the notifications sent by a
+// stream to a channel.
+type notificationHandler struct {
+	method        string
+	notifications chan<- json.RawMessage
+}
+
+func (h *notificationHandler) Handle(ctx context.Context, conn *jsonrpc2.Conn, req *jsonrpc2.Request) {
+	if !req.Notif || req.Method != h.method || req.Params == nil {
+		return
+	}
+
+	select {
+	case h.notifications <- *req.Params:
+	case <-ctx.Done():
+	}
+}
+
+// dial connects to a given rpc server address. Addresses containing a slash
+// are taken as unix socket paths.
+func dial(addr string) (net.Conn, error) {
+	network := "tcp"
+	if strings.Contains(addr, "/") {
+		network = "unix"
+	}
+
+	return net.Dial(network, addr)
+}
@@ -13,6 +13,8 @@ import (
 
 var registeredMethods = sync.Map{}
 
+var registeredStreams = sync.Map{}
+
 const (
 	// DefaultAddress is the network address used by the rpc server if none is given.
 	DefaultAddress = "127.0.0.1:0"
@@ -32,6 +34,13 @@ func Start(address string) (net.Addr, error) {
 		return nil, err
 	}
 
+	return Serve(lis), nil
+}
+
+// Serve initializes the jsonrpc 2.0 server which will be waiting for
+// connections on the given listener (e.g. a unix socket), returning its
+// address.
+func Serve(lis net.Listener) net.Addr {
 	ctx := context.Background()
 	h := &Handler{}
 
@@ -40,13 +49,20 @@ func Start(address string) (net.Addr, error) {
 			conn, err := lis.Accept()
 			if err != nil {
 				log.WithError(err).Warnf("error establishing connection with rpc client.")
+
+				// the listener is closed
+				if ne, ok := err.(net.Error); !ok || !ne.Temporary() {
+					return
+				}
+
+				continue
 			}
 			stream := jsonrpc2.NewBufferedStream(conn, jsonrpc2.VarintObjectCodec{})
 			jsonrpc2.NewConn(ctx, stream, h)
 		}
 	}()
 
-	return lis.Addr(), nil
+	return lis.Addr()
 }
 
 // Handler handles JSON-RPC requests and notifications.
@@ -61,6 +77,11 @@ func (h *Handler) Handle(ctx context.Context, conn *jsonrpc2.Conn, req *jsonrpc2
 		"id":           req.ID,
 	}).Info("rpc request received")
 
+	if s, ok := registeredStreams.Load(req.Method); ok {
+		h.handleStream(ctx, conn, req, s.(Stream))
+		return
+	}
+
 	if _, ok := registeredMethods.Load(req.Method); !ok {
 		log.Errorf("rpc request method %s not supported", req.Method)
 
@@ -204,6 +225,61 @@ func Register(name string, method Method) {
 // Method represents a procedure that can be called remotely.
 type Method func(params interface{}) (json.RawMessage, error)
 
+// RegisterStream adds a new stream that can be watched remotely (see Watch).
+func RegisterStream(name string, stream Stream) {
+	registeredStreams.Store(name, stream)
+}
+
+// Stream represents a procedure that keeps sending notifications, named
+// after the procedure, to the client that called it. Each value given to
+// notify is sent as the parameters of a notification. done is closed once
+// the client disconnects, and the stream must return by then.
+type Stream func(params interface{}, notify func(v interface{}) error, done <-chan struct{}) error
+
+// handleStream answers the request right away and keeps sending the
+// notifications of the stream to the client in the background, since the
+// connection must keep reading to notice the client is gone.
+func (h *Handler) handleStream(ctx context.Context, conn *jsonrpc2.Conn, req *jsonrpc2.Request, stream Stream) {
+	params, err := req.Params.MarshalJSON()
+	if err != nil {
+		log.WithFields(log.Fields{
+			"method": req.Method,
+			"id":     req.ID,
+		}).WithError(err).Warn("error executing rpc stream.")
+
+		conn.Close()
+		return
+	}
+
+	if !req.Notif {
+		err = conn.Reply(ctx, req.ID, map[string]bool{"streaming": true})
+		if err != nil {
+			log.WithFields(log.Fields{
+				"method": req.Method,
+				"id":     req.ID,
+			}).WithError(err).Error("could not send rpc response")
+
+			return
+		}
+	}
+
+	go func() {
+		defer conn.Close()
+
+		notify := func(v interface{}) error {
+			return conn.Notify(ctx, req.Method, v)
+		}
+
+		err := stream(params, notify, conn.DisconnectNotify())
+		if err != nil {
+			log.WithFields(log.Fields{
+				"method": req.Method,
+				"id":     req.ID,
+			}).WithError(err).Warn("error executing rpc stream.")
+		}
+	}()
+}
+
 func sendResponse(ctx context.Context, conn *jsonrpc2.Conn, req *jsonrpc2.Request, resp *jsonrpc2.Response) error {
 	if err := conn.SendResponse(ctx, resp); err != nil {
 		return err
@@ -4,8 +4,10 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"net"
 	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/davrodpin/mole/rpc"
@@ -91,6 +93,71 @@ func TestMethodWithError(t *testing.T) {
 	}
 }
 
+func TestUnixSocket(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mole-rpc")
+	if err != nil {
+		t.Fatalf("error creating temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	lis, err := net.Listen("unix", filepath.Join(dir, "rpc.sock"))
+	if err != nil {
+		t.Fatalf("error listening on unix socket: %v", err)
+	}
+	defer lis.Close()
+
+	ua := rpc.Serve(lis)
+
+	rpc.Register("unix", func(params interface{}) (json.RawMessage, error) {
+		return json.RawMessage(`{"message":"ok"}`), nil
+	})
+
+	response, err := rpc.Call(context.Background(), ua.String(), "unix", nil)
+	if err != nil {
+		t.Fatalf("error while calling remote procedure through unix socket: %v", err)
+	}
+
+	if response["message"] != "ok" {
+		t.Errorf("unexpected response for remote procedure call: %v", response)
+	}
+}
+
+func TestStream(t *testing.T) {
+	method := "stream"
+
+	rpc.RegisterStream(method, func(params interface{}, notify func(v interface{}) error, done <-chan struct{}) error {
+		for i := 0; i < 3; i++ {
+			if err := notify(map[string]int{"event": i}); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+
+	notifications := make(chan json.RawMessage)
+	result := make(chan error, 1)
+
+	go func() {
+		result <- rpc.Watch(context.Background(), addr.String(), method, nil, notifications)
+	}()
+
+	for i := 0; i < 3; i++ {
+		select {
+		case n := <-notifications:
+			if expected := fmt.Sprintf(`{"event":%d}`, i); string(n) != expected {
+				t.Errorf("unexpected notification: want: %s, got: %s", expected, n)
+			}
+		case err := <-result:
+			t.Fatalf("stream ended before sending all notifications: %v", err)
+		}
+	}
+
+	if err := <-result; err != nil {
+		t.Errorf("error watching stream: %v", err)
+	}
+}
+
 func TestMain(m *testing.M) {
 	var err error
 
@@ -0,0 +1,116 @@
+package tunnel
+
+import (
+	"net"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// agentClient is a connection to the ssh agent listening on a unix socket,
+// opened the first time the keys it holds are needed and kept open across
+// connections to the ssh server, since the keys are only usable while it is.
+type agentClient struct {
+	path string
+
+	mu     sync.Mutex
+	conn   net.Conn
+	client agent.ExtendedAgent
+}
+
+// Signers returns the keys held by the ssh agent, connecting to it if needed.
+func (a *agentClient) Signers() ([]ssh.Signer, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.client == nil {
+		log.Debugf("ssh agent address: %s", a.path)
+
+		conn, err := net.Dial("unix", a.path)
+		if err != nil {
+			return nil, err
+		}
+
+		a.conn = conn
+		a.client = agent.NewClient(conn)
+	}
+
+	signers, err := a.client.Signers()
+	if err != nil {
+		// the agent may have been restarted, so the connection is opened again
+		// the next time the keys are needed.
+		a.conn.Close()
+		a.conn, a.client = nil, nil
+
+		return nil, err
+	}
+
+	return signers, nil
+}
+
+// Close closes the connection to the ssh agent, if open.
+func (a *agentClient) Close() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.conn == nil {
+		return nil
+	}
+
+	err := a.conn.Close()
+	a.conn, a.client = nil, nil
+
+	return err
+}
+
+// closeAgents closes the connections to the ssh agents used to authenticate
+// against the ssh servers of the tunnel, their jump hosts and the additional
+// ssh servers channels go via.
+func (t *Tunnel) closeAgents() {
+	var servers []*Server
+
+	for _, s := range t.servers() {
+		servers = append(servers, s)
+		servers = append(servers, s.Jump...)
+	}
+
+	for _, ch := range t.channelList() {
+		if ch.Via != nil {
+			servers = append(servers, ch.Via)
+		}
+	}
+
+	agentsMu.Lock()
+	defer agentsMu.Unlock()
+
+	for _, s := range servers {
+		if s.agent != nil {
+			s.agent.Close()
+		}
+	}
+}
+
+// agentsMu guards the connections to the ssh agents of all servers, which are
+// created on demand for servers not created by NewServer.
+var agentsMu sync.Mutex
+
+// sshAgent returns the connection to the ssh agent at SSHAgent, shared by
+// every connection to the server. Servers not created by NewServer get theirs
+// the first time it is needed, so it is closed along with the tunnel too (see
+// closeAgents).
+func (s *Server) sshAgent() *agentClient {
+	agentsMu.Lock()
+	defer agentsMu.Unlock()
+
+	if s.agent == nil || s.agent.path != s.SSHAgent {
+		if s.agent != nil {
+			s.agent.Close()
+		}
+
+		s.agent = &agentClient{path: s.SSHAgent}
+	}
+
+	return s.agent
+}
@@ -0,0 +1,153 @@
+package tunnel
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+)
+
+// ClientPort is given as the port of a dial source address (see
+// BindDialSource) to dial the destination from the same port the client
+// connected from, as reported by the ssh server.
+const ClientPort = "client"
+
+// BindDialSource makes the channel listening on the given source address dial
+// its destination from the given local address, [<host>]:<port>, instead of
+// one picked by the system, for services that tell their clients apart by
+// their source address or port. An empty source applies to all channels. Only
+// remote tunnels are supported, since the destination of local tunnels is
+// dialed by the ssh server.
+//
+// The port can be ClientPort to reuse the port of the client connected to the
+// ssh server, or 0 to let the system pick one. A fixed port can only be used
+// by one connection to the same destination at a time, so dialing fails while
+// a previous connection is open or lingering on TIME_WAIT.
+func (t *Tunnel) BindDialSource(source, address string) error {
+	if t.Type != "remote" {
+		return fmt.Errorf("dial source addresses are only supported by remote tunnels")
+	}
+
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return fmt.Errorf("invalid dial source address %s: %v", address, err)
+	}
+
+	if host != "" && net.ParseIP(host) == nil {
+		return fmt.Errorf("invalid dial source address %s: %s is not an ip address", address, host)
+	}
+
+	if port != ClientPort {
+		if p, err := strconv.Atoi(port); err != nil || p < 0 || p > 65535 {
+			return fmt.Errorf("invalid dial source address %s: invalid port %s", address, port)
+		}
+	}
+
+	channels := t.channelList()
+
+	if len(channels) == 0 {
+		return fmt.Errorf("can't bind the dial source address of a tunnel with no channels")
+	}
+
+	if source == "" {
+		for _, ch := range channels {
+			ch.DialSource = address
+		}
+
+		return nil
+	}
+
+	ch, err := t.findChannel(source)
+	if err != nil {
+		return err
+	}
+
+	ch.DialSource = address
+
+	return nil
+}
+
+// dialLocal dials the destination of a remote tunnel channel on behalf of the
+// given client connection, from the dial source address of the channel, if
+// any.
+func dialLocal(channel *SSHChannel, client net.Conn, destination string, timeout time.Duration) (net.Conn, error) {
+	network := addressNetwork(destination)
+
+	if channel.DialSource == "" || network != "tcp" {
+		return net.DialTimeout(network, destination, timeout)
+	}
+
+	host, port, _ := net.SplitHostPort(channel.DialSource)
+
+	laddr := &net.TCPAddr{IP: net.ParseIP(host)}
+
+	if port == ClientPort {
+		ca, ok := client.RemoteAddr().(*net.TCPAddr)
+		if !ok {
+			return nil, fmt.Errorf("can't dial from the client port: unknown client address %s", client.RemoteAddr())
+		}
+
+		laddr.Port = ca.Port
+	} else {
+		laddr.Port, _ = strconv.Atoi(port)
+	}
+
+	d := net.Dialer{Timeout: timeout, LocalAddr: laddr}
+
+	return d.Dial(network, destination)
+}
+
+// interfaceAddr returns the local address to dial the given address from
+// through the network interface of the given name: its first address of the
+// same ip version as the dialed one, preferring global unicast addresses.
+func interfaceAddr(name, address string) (*net.TCPAddr, error) {
+	iface, err := net.InterfaceByName(name)
+	if err != nil {
+		return nil, fmt.Errorf("can't dial from interface %s: %v", name, err)
+	}
+
+	if iface.Flags&net.FlagUp == 0 {
+		return nil, fmt.Errorf("can't dial from interface %s: interface is down", name)
+	}
+
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return nil, fmt.Errorf("can't dial from interface %s: %v", name, err)
+	}
+
+	host, _, _ := net.SplitHostPort(address)
+	ipv4 := true
+	if ip := net.ParseIP(host); ip != nil {
+		ipv4 = ip.To4() != nil
+	}
+
+	var found net.IP
+	for _, a := range addrs {
+		n, ok := a.(*net.IPNet)
+		if !ok || (n.IP.To4() != nil) != ipv4 {
+			continue
+		}
+
+		if n.IP.IsGlobalUnicast() {
+			return &net.TCPAddr{IP: n.IP}, nil
+		}
+
+		// link local addresses are skipped since they can't reach a server
+		// outside the local link, while loopback ones are only taken when no
+		// global address is found (i.e. on the loopback interface).
+		if found == nil && n.IP.IsLoopback() {
+			found = n.IP
+		}
+	}
+
+	if found == nil {
+		version := "ipv4"
+		if !ipv4 {
+			version = "ipv6"
+		}
+
+		return nil, fmt.Errorf("can't dial from interface %s: interface has no usable %s address", name, version)
+	}
+
+	return &net.TCPAddr{IP: found}, nil
+}
@@ -1,6 +1,7 @@
 package tunnel
 
 import (
+	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
@@ -12,10 +13,18 @@ import (
 
 const homeVar = "$HOME"
 
+// SystemSSHConfigPath is the path of the system-wide ssh config file, which is
+// consulted for any attribute not found on the user ssh config file.
+// Setting it to an empty string disables the system-wide config file.
+var SystemSSHConfigPath = "/etc/ssh/ssh_config"
+
 // SSHConfigFile finds specific attributes of a ssh server configured on a
 // ssh config file.
 type SSHConfigFile struct {
-	sshConfig *ssh_config.Config
+	sshConfig    *ssh_config.Config
+	systemConfig *ssh_config.Config
+	// path is the location of the user ssh config file, if any.
+	path string
 }
 
 // NewSSHConfigFile creates a new instance of SSHConfigFile based on the
@@ -42,12 +51,156 @@ func NewSSHConfigFile(configPath string) (*SSHConfigFile, error) {
 
 	log.Debugf("using ssh config file from: %s", configPath)
 
-	return &SSHConfigFile{sshConfig: cfg}, nil
+	return &SSHConfigFile{sshConfig: cfg, systemConfig: loadSystemSSHConfig(), path: configPath}, nil
 }
 
 func NewEmptySSHConfigStruct() *SSHConfigFile {
 	log.Debugf("generating an empty config struct")
-	return &SSHConfigFile{sshConfig: &ssh_config.Config{}}
+	return &SSHConfigFile{sshConfig: &ssh_config.Config{}, systemConfig: loadSystemSSHConfig()}
+}
+
+// loadSystemSSHConfig decodes the system-wide ssh config file, returning nil
+// if it does not exist or can't be read.
+func loadSystemSSHConfig() *ssh_config.Config {
+	if SystemSSHConfigPath == "" {
+		return nil
+	}
+
+	f, err := os.Open(filepath.Clean(SystemSSHConfigPath))
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			log.Warningf("error reading system ssh config file %s: %v", SystemSSHConfigPath, err)
+		}
+
+		return nil
+	}
+	defer f.Close()
+
+	cfg, err := ssh_config.Decode(f)
+	if err != nil {
+		log.Warningf("error reading system ssh config file %s: %v", SystemSSHConfigPath, err)
+		return nil
+	}
+
+	log.Debugf("using system ssh config file from: %s", SystemSSHConfigPath)
+
+	return cfg
+}
+
+// MatchedHosts describes the Host blocks matching the given host, on the user
+// ssh config file first and on the system-wide one afterwards, in the order
+// their attributes are taken into account.
+func (r SSHConfigFile) MatchedHosts(host string) []string {
+	var matched []string
+
+	files := []struct {
+		path   string
+		config *ssh_config.Config
+	}{
+		{r.path, r.sshConfig},
+		{SystemSSHConfigPath, r.systemConfig},
+	}
+
+	for _, f := range files {
+		if f.config == nil {
+			continue
+		}
+
+		for _, h := range f.config.Hosts {
+			if !h.Matches(host) || !hasDirectives(h) {
+				continue
+			}
+
+			patterns := make([]string, len(h.Patterns))
+			for i, p := range h.Patterns {
+				patterns[i] = p.String()
+			}
+
+			matched = append(matched, fmt.Sprintf("%s: Host %s", f.path, strings.Join(patterns, " ")))
+		}
+	}
+
+	return matched
+}
+
+// Hosts lists the Host blocks defined on the user ssh config file and on the
+// system-wide one, in that order, so the servers they describe can be offered
+// to users (e.g. on shell completion).
+//
+// Blocks naming a single host are summarized with the attributes that host
+// resolves to, taking every matching block into account. Blocks with
+// patterns (e.g. Host *.corp) only show the attributes they set themselves.
+func (r SSHConfigFile) Hosts() []ConfiguredHost {
+	var hosts []ConfiguredHost
+
+	for _, config := range []*ssh_config.Config{r.sshConfig, r.systemConfig} {
+		if config == nil {
+			continue
+		}
+
+		for _, h := range config.Hosts {
+			if !hasDirectives(h) {
+				continue
+			}
+
+			host := ConfiguredHost{Patterns: make([]string, len(h.Patterns))}
+			for i, p := range h.Patterns {
+				host.Patterns[i] = p.String()
+			}
+
+			if host.IsPattern() {
+				host.Hostname = directive(h, "Hostname")
+				host.User = directive(h, "User")
+				host.Port = directive(h, "Port")
+			} else {
+				resolved := r.Get(host.Patterns[0])
+				host.Hostname = resolved.Hostname
+				host.User = resolved.User
+				host.Port = resolved.Port
+			}
+
+			hosts = append(hosts, host)
+		}
+	}
+
+	return hosts
+}
+
+// directive returns the first value the host block sets for the given
+// attribute, if any.
+func directive(h *ssh_config.Host, key string) string {
+	for _, n := range h.Nodes {
+		if kv, ok := n.(*ssh_config.KV); ok && strings.EqualFold(kv.Key, key) {
+			return kv.Value
+		}
+	}
+
+	return ""
+}
+
+// hasDirectives tells if the host block sets any attribute, leaving out empty
+// blocks, like the implicit one at the top of every file.
+func hasDirectives(h *ssh_config.Host) bool {
+	for _, n := range h.Nodes {
+		switch n.(type) {
+		case *ssh_config.KV, *ssh_config.Include:
+			return true
+		}
+	}
+
+	return false
+}
+
+// get returns the value of the given attribute for host. Following OpenSSH
+// rules, the first value found wins and the user ssh config file is
+// consulted before the system-wide one.
+func (r SSHConfigFile) get(host, key string) (string, error) {
+	value, err := r.sshConfig.Get(host, key)
+	if err != nil || value != "" || r.systemConfig == nil {
+		return value, err
+	}
+
+	return r.systemConfig.Get(host, key)
 }
 
 // Get consults a ssh config file to extract some ssh server attributes
@@ -56,12 +209,12 @@ func NewEmptySSHConfigStruct() *SSHConfigFile {
 func (r SSHConfigFile) Get(host string) *SSHHost {
 	hostname := r.getHostname(host)
 
-	port, err := r.sshConfig.Get(host, "Port")
+	port, err := r.get(host, "Port")
 	if err != nil {
 		port = ""
 	}
 
-	user, err := r.sshConfig.Get(host, "User")
+	user, err := r.get(host, "User")
 	if err != nil {
 		user = ""
 	}
@@ -78,24 +231,36 @@ func (r SSHConfigFile) Get(host string) *SSHHost {
 
 	key := r.getKey(host)
 
-	identityAgent, err := r.sshConfig.Get(host, "IdentityAgent")
+	identityAgent, err := r.get(host, "IdentityAgent")
 	if err != nil {
 		identityAgent = ""
 	}
 
+	identitiesOnly, err := r.get(host, "IdentitiesOnly")
+	if err != nil {
+		identitiesOnly = ""
+	}
+
+	proxyJump, err := r.get(host, "ProxyJump")
+	if err != nil {
+		proxyJump = ""
+	}
+
 	return &SSHHost{
-		Hostname:      hostname,
-		Port:          port,
-		User:          user,
-		Key:           key,
-		IdentityAgent: identityAgent,
-		LocalForward:  localForward,
-		RemoteForward: remoteForward,
+		Hostname:       hostname,
+		Port:           port,
+		User:           user,
+		Key:            key,
+		IdentityAgent:  identityAgent,
+		IdentitiesOnly: identitiesOnly,
+		ProxyJump:      proxyJump,
+		LocalForward:   localForward,
+		RemoteForward:  remoteForward,
 	}
 }
 
 func (r SSHConfigFile) getHostname(host string) string {
-	hostname, err := r.sshConfig.Get(host, "Hostname")
+	hostname, err := r.get(host, "Hostname")
 	if err != nil {
 		return ""
 	}
@@ -104,7 +269,7 @@ func (r SSHConfigFile) getHostname(host string) string {
 }
 
 func (r SSHConfigFile) getForward(forwardType, host string) (*ForwardConfig, error) {
-	c, err := r.sshConfig.Get(host, forwardType)
+	c, err := r.get(host, forwardType)
 	if err != nil {
 		return nil, err
 	}
@@ -135,7 +300,7 @@ func (r SSHConfigFile) getForward(forwardType, host string) (*ForwardConfig, err
 }
 
 func (r SSHConfigFile) getKey(host string) string {
-	id, err := r.sshConfig.Get(host, "IdentityFile")
+	id, err := r.get(host, "IdentityFile")
 
 	if err != nil {
 		return ""
@@ -154,18 +319,41 @@ func (r SSHConfigFile) getKey(host string) string {
 
 // SSHHost represents a host configuration extracted from a ssh config file.
 type SSHHost struct {
-	Hostname      string
-	Port          string
-	User          string
-	Key           string
-	IdentityAgent string
-	LocalForward  *ForwardConfig
-	RemoteForward *ForwardConfig
+	Hostname       string
+	Port           string
+	User           string
+	Key            string
+	IdentityAgent  string
+	IdentitiesOnly string
+	ProxyJump      string
+	LocalForward   *ForwardConfig
+	RemoteForward  *ForwardConfig
 }
 
 // String returns a string representation of a SSHHost.
 func (h SSHHost) String() string {
-	return fmt.Sprintf("[hostname=%s, port=%s, user=%s, key=%s, identity_agent=%s, local_forward=%s, remote_forward=%s]", h.Hostname, h.Port, h.User, h.Key, h.IdentityAgent, h.LocalForward, h.RemoteForward)
+	return fmt.Sprintf("[hostname=%s, port=%s, user=%s, key=%s, identity_agent=%s, identities_only=%s, proxy_jump=%s, local_forward=%s, remote_forward=%s]", h.Hostname, h.Port, h.User, h.Key, h.IdentityAgent, h.IdentitiesOnly, h.ProxyJump, h.LocalForward, h.RemoteForward)
+}
+
+// ConfiguredHost summarizes a Host block of a ssh config file. Attributes
+// that can't be resolved without connecting to a server are empty strings.
+type ConfiguredHost struct {
+	// Patterns are the host names or patterns given to the Host keyword.
+	Patterns []string
+	Hostname string
+	User     string
+	Port     string
+}
+
+// IsPattern tells if the host block matches more than a single host name
+// (e.g. Host *.corp or Host example other).
+func (h ConfiguredHost) IsPattern() bool {
+	return len(h.Patterns) != 1 || strings.ContainsAny(h.Patterns[0], "*?")
+}
+
+// String returns a string representation of a ConfiguredHost.
+func (h ConfiguredHost) String() string {
+	return fmt.Sprintf("[host=%s, hostname=%s, port=%s, user=%s]", strings.Join(h.Patterns, " "), h.Hostname, h.Port, h.User)
 }
 
 // ForwardConfig represents either a LocalForward or a RemoteForward configuration
@@ -1,6 +1,9 @@
 package tunnel
 
 import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"reflect"
 	"strings"
 	"testing"
@@ -95,3 +98,140 @@ Host example5
 		}
 	}
 }
+
+func TestSSHConfigFileWithSystemConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mole-ssh-config")
+	if err != nil {
+		t.Fatalf("error creating temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	userConfig := `
+Host example
+	User john
+`
+
+	systemConfig := `
+Host example
+	User mary
+	Port 2222
+Host *
+	IdentityFile /etc/ssh/id_rsa
+`
+
+	userPath := filepath.Join(dir, "config")
+	systemPath := filepath.Join(dir, "ssh_config")
+
+	if err := ioutil.WriteFile(userPath, []byte(userConfig), 0600); err != nil {
+		t.Fatalf("error writing user ssh config file: %v", err)
+	}
+
+	if err := ioutil.WriteFile(systemPath, []byte(systemConfig), 0600); err != nil {
+		t.Fatalf("error writing system ssh config file: %v", err)
+	}
+
+	defer func(path string) { SystemSSHConfigPath = path }(SystemSSHConfigPath)
+	SystemSSHConfigPath = systemPath
+
+	cfg, err := NewSSHConfigFile(userPath)
+	if err != nil {
+		t.Fatalf("error reading ssh config file: %v", err)
+	}
+
+	expected := &SSHHost{
+		User: "john",
+		Port: "2222",
+		Key:  "/etc/ssh/id_rsa",
+	}
+
+	value := cfg.Get("example")
+
+	if !reflect.DeepEqual(expected, value) {
+		t.Errorf("unexpected result:\n\texpected: %s\n\tvalue   : %s", expected, value)
+	}
+
+	SystemSSHConfigPath = filepath.Join(dir, "missing")
+
+	cfg, err = NewSSHConfigFile(userPath)
+	if err != nil {
+		t.Fatalf("error reading ssh config file: %v", err)
+	}
+
+	expected = &SSHHost{User: "john"}
+	value = cfg.Get("example")
+
+	if !reflect.DeepEqual(expected, value) {
+		t.Errorf("unexpected result without system config file:\n\texpected: %s\n\tvalue   : %s", expected, value)
+	}
+}
+
+func TestMatchedHosts(t *testing.T) {
+	config := `
+Host example *.corp
+	User john
+Host !example *
+	Port 2222
+Host other
+	User jane
+`
+
+	system := `
+Host *
+	IdentityFile /etc/ssh/id_rsa
+`
+
+	defer func(path string) { SystemSSHConfigPath = path }(SystemSSHConfigPath)
+	SystemSSHConfigPath = "/etc/ssh/ssh_config"
+
+	c, _ := ssh_config.Decode(strings.NewReader(config))
+	sc, _ := ssh_config.Decode(strings.NewReader(system))
+	cfg := &SSHConfigFile{sshConfig: c, systemConfig: sc, path: "/home/mole/.ssh/config"}
+
+	expected := []string{
+		"/home/mole/.ssh/config: Host example *.corp",
+		"/etc/ssh/ssh_config: Host *",
+	}
+
+	matched := cfg.MatchedHosts("example")
+	if !reflect.DeepEqual(expected, matched) {
+		t.Errorf("unexpected host blocks: want: %v, got: %v", expected, matched)
+	}
+}
+
+func TestHosts(t *testing.T) {
+	config := `
+Host example
+	Hostname 172.17.0.10
+Host *.corp other
+	User john
+	Port 2222
+Host *
+	User jane
+`
+
+	system := `
+Host bastion
+	Hostname 10.0.0.1
+	Port 2200
+`
+
+	c, _ := ssh_config.Decode(strings.NewReader(config))
+	sc, _ := ssh_config.Decode(strings.NewReader(system))
+	cfg := &SSHConfigFile{sshConfig: c, systemConfig: sc}
+
+	expected := []ConfiguredHost{
+		{Patterns: []string{"example"}, Hostname: "172.17.0.10", User: "jane"},
+		{Patterns: []string{"*.corp", "other"}, User: "john", Port: "2222"},
+		{Patterns: []string{"*"}, User: "jane"},
+		{Patterns: []string{"bastion"}, Hostname: "10.0.0.1", User: "jane", Port: "2200"},
+	}
+
+	hosts := cfg.Hosts()
+	if !reflect.DeepEqual(expected, hosts) {
+		t.Errorf("unexpected hosts:\n\texpected: %s\n\tvalue   : %s", expected, hosts)
+	}
+
+	if hosts[0].IsPattern() || !hosts[1].IsPattern() || !hosts[2].IsPattern() {
+		t.Errorf("unexpected pattern detection: %s", hosts)
+	}
+}
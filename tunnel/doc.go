@@ -4,10 +4,33 @@ forwarding, leveraging the SSH configuration file (e.g. $HOME/.ssh/config) to
 find specific attributes of the target ssh server like user name, port, host
 name and key when not provided.
 
+Running a Tunnel
+
+A tunnel can be described all at once by a Config and run until a context is
+done:
+
+	server, err := tunnel.NewServer("mole", "example.com:22", "", "", "")
+	if err != nil {
+		return err
+	}
+
+	return tunnel.Run(ctx, tunnel.Config{
+		Server:            server,
+		Source:            []string{"127.0.0.1:8080"},
+		Destination:       []string{"10.0.0.5:80"},
+		KeepAliveInterval: 10 * time.Second,
+	})
+
+A Tunnel created otherwise can be bound to a context as well through
+StartContext, which gives up connecting to the ssh server, closes the
+connection and the listeners of its channels and returns the context error
+once the context is done.
+
 SSH Config File Support
 
-The module looks for the ssh config file stored on $HOME/.ssh/config only.
-There is no fallback support to try to use /etc/ssh/config.
+The module looks for the ssh config file stored on $HOME/.ssh/config, falling
+back to the system-wide ssh config file, /etc/ssh/ssh_config (see
+SystemSSHConfigPath), for any option not found there.
 
 The current API supports the following ssh config file options:
 
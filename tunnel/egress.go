@@ -0,0 +1,186 @@
+package tunnel
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// EgressPolicy is an allowlist of the destinations the channels of a tunnel
+// may dial, guarding against forwards to prohibited services opened by
+// mistake (e.g. on a shared bastion). It is a client side guardrail only: the
+// ssh server must still enforce its own restrictions.
+//
+// Each rule is a <host>:<port> pattern, where the host is matched as a glob
+// (e.g. *.db.internal or 10.0.1.*) and the port is either a number, a range
+// (e.g. 8000-8999) or *. Rules with no port, like the ones given for unix
+// sockets, are matched as a glob against the whole destination address.
+type EgressPolicy struct {
+	// Path is the file the policy was loaded from, if any.
+	Path  string
+	rules []egressRule
+}
+
+type egressRule struct {
+	pattern string
+	host    string
+	minPort int
+	maxPort int
+	// address tells the pattern is matched against the whole address.
+	address bool
+}
+
+// LoadEgressPolicy reads an egress policy from the given file, which holds a
+// rule per line. Empty lines and lines starting with # are ignored.
+func LoadEgressPolicy(file string) (*EgressPolicy, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	p, err := ParseEgressPolicy(f)
+	if err != nil {
+		return nil, fmt.Errorf("invalid egress policy %s: %v", file, err)
+	}
+
+	p.Path = file
+
+	return p, nil
+}
+
+// ParseEgressPolicy reads an egress policy from the given reader (see
+// LoadEgressPolicy).
+func ParseEgressPolicy(r io.Reader) (*EgressPolicy, error) {
+	p := &EgressPolicy{}
+
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		rule, err := parseEgressRule(line)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", n, err)
+		}
+
+		p.rules = append(p.rules, rule)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return p, nil
+}
+
+func parseEgressRule(pattern string) (egressRule, error) {
+	rule := egressRule{pattern: pattern}
+
+	host, port, err := net.SplitHostPort(pattern)
+	if err != nil {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return rule, fmt.Errorf("invalid rule %s: %v", pattern, err)
+		}
+
+		rule.address = true
+
+		return rule, nil
+	}
+
+	if _, err := path.Match(host, ""); err != nil {
+		return rule, fmt.Errorf("invalid host on rule %s: %v", pattern, err)
+	}
+
+	rule.host = strings.ToLower(host)
+
+	switch {
+	case port == "*":
+		rule.minPort, rule.maxPort = 0, 65535
+	case strings.Contains(port, "-"):
+		bounds := strings.SplitN(port, "-", 2)
+
+		rule.minPort, err = strconv.Atoi(bounds[0])
+		if err == nil {
+			rule.maxPort, err = strconv.Atoi(bounds[1])
+		}
+
+		if err != nil || rule.minPort > rule.maxPort {
+			return rule, fmt.Errorf("invalid port range on rule %s", pattern)
+		}
+	default:
+		rule.minPort, err = strconv.Atoi(port)
+		if err != nil {
+			return rule, fmt.Errorf("invalid port on rule %s", pattern)
+		}
+
+		rule.maxPort = rule.minPort
+	}
+
+	return rule, nil
+}
+
+// Allows tells if the given destination address matches any rule of the
+// policy.
+func (p *EgressPolicy) Allows(address string) bool {
+	host, port, err := net.SplitHostPort(address)
+
+	for _, rule := range p.rules {
+		if rule.address {
+			if ok, _ := path.Match(rule.pattern, address); ok {
+				return true
+			}
+
+			continue
+		}
+
+		if err != nil {
+			continue
+		}
+
+		n, perr := strconv.Atoi(port)
+		if perr != nil || n < rule.minPort || n > rule.maxPort {
+			continue
+		}
+
+		if ok, _ := path.Match(rule.host, strings.ToLower(host)); ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+// CheckEgress returns an error if the destination of any channel of the
+// tunnel is not allowed by its egress policy, if any. The destinations asked
+// for through dynamic channels are checked as they are dialed instead.
+func (t *Tunnel) CheckEgress() error {
+	for _, ch := range t.channelList() {
+		if ch.ChannelType == "dynamic" {
+			continue
+		}
+
+		if err := t.checkEgress(ch); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// checkEgress returns an error if the destination of the given channel is
+// not allowed by the egress policy of the tunnel, if any.
+func (t *Tunnel) checkEgress(channel *SSHChannel) error {
+	if t.EgressPolicy == nil || t.EgressPolicy.Allows(channel.Destination) {
+		return nil
+	}
+
+	return fmt.Errorf("destination %s is not allowed by the egress policy", channel.Destination)
+}
@@ -0,0 +1,133 @@
+package tunnel
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// EventConnect is sent every time the tunnel connects to the ssh server.
+	EventConnect = "connect"
+	// EventDisconnect is sent every time the tunnel loses its connection to
+	// the ssh server.
+	EventDisconnect = "disconnect"
+	// EventChannelOpen is sent every time a connection accepted by a channel
+	// is forwarded to its destination.
+	EventChannelOpen = "channel-open"
+	// EventChannelClose is sent every time a forwarded connection is closed,
+	// along with the number of bytes forwarded in each direction.
+	EventChannelClose = "channel-close"
+)
+
+// Event describes something that happened to a running tunnel (see Notify).
+type Event struct {
+	Type string    `json:"type"`
+	Time time.Time `json:"time"`
+	// Server is the address of the ssh server.
+	Server string `json:"server"`
+	// Source and Destination are the addresses of the channel the event
+	// happened on, if any.
+	Source      string `json:"source,omitempty"`
+	Destination string `json:"destination,omitempty"`
+	// Connection is the identifier of the forwarded connection the event
+	// happened on, if any.
+	Connection string `json:"connection,omitempty"`
+	// Client is the address of the client of the forwarded connection.
+	Client string `json:"client,omitempty"`
+	// BytesSent and BytesReceived are the number of bytes forwarded from the
+	// client to the destination and back, on EventChannelClose.
+	BytesSent     int64 `json:"bytes-sent,omitempty"`
+	BytesReceived int64 `json:"bytes-received,omitempty"`
+	// Error is the reason the connection to the ssh server was lost, on
+	// EventDisconnect.
+	Error string `json:"error,omitempty"`
+}
+
+// notify sends the given event to Notify, if set.
+func (t *Tunnel) notify(event Event) {
+	if t.Notify == nil {
+		return
+	}
+
+	event.Time = time.Now()
+	event.Server = t.server.Address
+
+	t.Notify(event)
+}
+
+// notifyChannel sends EventChannelOpen for the given forwarded connection and
+// returns the connection wrapped so EventChannelClose is sent once it is
+// closed, counting the bytes forwarded meanwhile. The connection is returned
+// as is if Notify is not set, so forwarding isn't slowed down for nothing.
+func (t *Tunnel) notifyChannel(channel *SSHChannel, connId string, conn net.Conn) net.Conn {
+	if t.Notify == nil {
+		return conn
+	}
+
+	event := Event{
+		Source:      channel.Source,
+		Destination: channel.Destination,
+		Connection:  connId,
+		Client:      conn.RemoteAddr().String(),
+	}
+
+	open := event
+	open.Type = EventChannelOpen
+	t.notify(open)
+
+	cc := &countingConn{Conn: conn}
+	cc.closed = func() {
+		closed := event
+		closed.Type = EventChannelClose
+		closed.BytesSent = atomic.LoadInt64(&cc.read)
+		closed.BytesReceived = atomic.LoadInt64(&cc.written)
+		t.notify(closed)
+	}
+
+	return cc
+}
+
+// countingConn is a connection counting the bytes read from and written to
+// it, calling closed once, the first time it is closed.
+type countingConn struct {
+	net.Conn
+	read    int64
+	written int64
+	closed  func()
+	once    sync.Once
+}
+
+func (c *countingConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	atomic.AddInt64(&c.read, int64(n))
+
+	return n, err
+}
+
+func (c *countingConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	atomic.AddInt64(&c.written, int64(n))
+
+	return n, err
+}
+
+func (c *countingConn) Close() error {
+	err := c.Conn.Close()
+	c.once.Do(c.closed)
+
+	return err
+}
+
+// CloseWrite closes the sending side of the underlying connection, if
+// supported (see HalfClose).
+func (c *countingConn) CloseWrite() error {
+	cw, ok := c.Conn.(interface{ CloseWrite() error })
+	if !ok {
+		return fmt.Errorf("connection can't be half closed")
+	}
+
+	return cw.CloseWrite()
+}
@@ -0,0 +1,64 @@
+package tunnel
+
+import (
+	"fmt"
+	"net"
+	"time"
+)
+
+// awaitFirstRead waits up to the given timeout for the client of the given
+// connection to send its first data, returning a connection that still reads
+// it.
+func awaitFirstRead(conn net.Conn, timeout time.Duration) (net.Conn, error) {
+	err := conn.SetReadDeadline(time.Now().Add(timeout))
+	if err != nil {
+		return conn, err
+	}
+
+	first := make([]byte, 1)
+
+	_, err = conn.Read(first)
+	if err != nil {
+		if ne, ok := err.(net.Error); ok && ne.Timeout() {
+			return conn, fmt.Errorf("client sent no data within %s", timeout)
+		}
+
+		return conn, err
+	}
+
+	err = conn.SetReadDeadline(time.Time{})
+	if err != nil {
+		return conn, err
+	}
+
+	return &firstReadConn{Conn: conn, first: first}, nil
+}
+
+// firstReadConn is a connection which first byte was already read by
+// awaitFirstRead, returning it on the next read.
+type firstReadConn struct {
+	net.Conn
+	first []byte
+}
+
+func (c *firstReadConn) Read(b []byte) (int, error) {
+	if len(c.first) == 0 || len(b) == 0 {
+		return c.Conn.Read(b)
+	}
+
+	n := copy(b, c.first)
+	c.first = c.first[n:]
+
+	return n, nil
+}
+
+// CloseWrite closes the sending side of the underlying connection, if
+// supported (see HalfClose).
+func (c *firstReadConn) CloseWrite() error {
+	cw, ok := c.Conn.(interface{ CloseWrite() error })
+	if !ok {
+		return fmt.Errorf("connection can't be half closed")
+	}
+
+	return cw.CloseWrite()
+}
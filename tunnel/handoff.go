@@ -0,0 +1,149 @@
+package tunnel
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// maxHandoffListeners is the maximum number of listeners handed over at once,
+// bound by the number of file descriptors a single unix socket message can
+// carry.
+const maxHandoffListeners = 253
+
+// Listeners returns the listeners of the local channels, keyed by their source
+// address. Listeners are only reported once the tunnel has started (see
+// Started), since they are created while it is starting.
+//
+// Unix socket listeners are left out, since closing them removes the socket
+// file the other process would be listening on.
+func (t *Tunnel) Listeners() map[string]net.Listener {
+	select {
+	case <-t.started:
+	default:
+		return nil
+	}
+
+	listeners := make(map[string]net.Listener)
+
+	for _, ch := range t.channelList() {
+		if l := ch.currentListener(); ch.ChannelType == "local" && l != nil && addressNetwork(ch.Source) == "tcp" {
+			listeners[ch.Source] = l
+		}
+	}
+
+	return listeners
+}
+
+// InheritListeners makes the local channels accept connections on the given
+// listeners, keyed by the source address they are bound to, instead of
+// creating new ones. It must be called before the tunnel is started.
+//
+// A listener is given to the channel with the same source address, or with the
+// same port and no explicit host. Listeners not matching any channel are
+// closed.
+func (t *Tunnel) InheritListeners(listeners map[string]net.Listener) {
+	t.channelsMu.Lock()
+	defer t.channelsMu.Unlock()
+
+	for address, l := range listeners {
+		var inherited bool
+
+		for _, ch := range t.channels {
+			if ch.ChannelType != "local" || ch.currentListener() != nil || !sameAddress(ch.Source, address) {
+				continue
+			}
+
+			ch.setListener(l)
+			ch.Source = l.Addr().String()
+			inherited = true
+
+			log.WithFields(log.Fields{
+				"channel": ch,
+			}).Debug("channel inherited listener")
+
+			break
+		}
+
+		if !inherited {
+			log.WithFields(log.Fields{
+				"address": address,
+			}).Warn("no channel matches inherited listener, closing it")
+
+			l.Close()
+		}
+	}
+}
+
+// SendListeners hands duplicates of the given listeners, keyed by the address
+// they are bound to, over a unix socket connection to another process, which
+// can take them with ReceiveListeners. The listeners are still usable by the
+// sending process.
+func SendListeners(conn *net.UnixConn, listeners map[string]net.Listener) error {
+	if len(listeners) > maxHandoffListeners {
+		return fmt.Errorf("too many listeners to hand over: %d, the maximum is %d", len(listeners), maxHandoffListeners)
+	}
+
+	addresses := make([]string, 0, len(listeners))
+	tcpListeners := make([]*net.TCPListener, 0, len(listeners))
+
+	for address, l := range listeners {
+		tl, ok := l.(*net.TCPListener)
+		if !ok {
+			return fmt.Errorf("listener on %s can't be handed over: not a tcp listener", address)
+		}
+
+		addresses = append(addresses, address)
+		tcpListeners = append(tcpListeners, tl)
+	}
+
+	return sendListeners(conn, addresses, tcpListeners)
+}
+
+// ReceiveListeners takes the listeners handed over by another process through
+// SendListeners, keyed by the address they are bound to.
+func ReceiveListeners(conn *net.UnixConn) (map[string]net.Listener, error) {
+	return receiveListeners(conn)
+}
+
+// parseHandoffAddresses parses the list of addresses sent along with the file
+// descriptors of the listeners handed over.
+func parseHandoffAddresses(data string) []string {
+	data = strings.TrimSuffix(data, "\n")
+	if data == "" {
+		return nil
+	}
+
+	return strings.Split(data, "\n")
+}
+
+// sameAddress tells if a channel with the given source address should take a
+// listener bound to the given address.
+func sameAddress(source, address string) bool {
+	if source == address {
+		return true
+	}
+
+	sh, sp, err := net.SplitHostPort(source)
+	if err != nil {
+		return false
+	}
+
+	ah, ap, err := net.SplitHostPort(address)
+	if err != nil || sp != ap {
+		return false
+	}
+
+	if sh == "" {
+		return true
+	}
+
+	sip, aip := net.ParseIP(sh), net.ParseIP(ah)
+	if sip == nil && sh == "localhost" {
+		sip = net.IPv4(127, 0, 0, 1)
+	}
+
+	return sip != nil && aip != nil && (sip.Equal(aip) || sip.IsUnspecified() && aip.IsUnspecified())
+}
@@ -0,0 +1,113 @@
+//go:build !windows
+// +build !windows
+
+package tunnel
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"syscall"
+)
+
+// HandoffSupported tells if listeners can be handed over to another process
+// on this platform.
+const HandoffSupported = true
+
+func sendListeners(conn *net.UnixConn, addresses []string, listeners []*net.TCPListener) error {
+	fds := make([]int, 0, len(listeners))
+
+	for i, l := range listeners {
+		f, err := l.File()
+		if err != nil {
+			return fmt.Errorf("error duplicating listener on %s: %v", addresses[i], err)
+		}
+		defer f.Close()
+
+		// Fd() would switch the file descriptor, shared with the listener still
+		// in use, to blocking mode.
+		rc, err := f.SyscallConn()
+		if err != nil {
+			return err
+		}
+
+		err = rc.Control(func(fd uintptr) {
+			fds = append(fds, int(fd))
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	var oob []byte
+	if len(fds) > 0 {
+		oob = syscall.UnixRights(fds...)
+	}
+
+	// the list of addresses always carries a line break, so the message is
+	// never empty.
+	_, _, err := conn.WriteMsgUnix([]byte(strings.Join(addresses, "\n")+"\n"), oob, nil)
+
+	return err
+}
+
+func receiveListeners(conn *net.UnixConn) (map[string]net.Listener, error) {
+	buf := make([]byte, 64*1024)
+	oob := make([]byte, syscall.CmsgSpace(maxHandoffListeners*4))
+
+	n, oobn, _, _, err := conn.ReadMsgUnix(buf, oob)
+	if err != nil {
+		return nil, fmt.Errorf("error receiving listeners: %v", err)
+	}
+
+	msgs, err := syscall.ParseSocketControlMessage(oob[:oobn])
+	if err != nil {
+		return nil, fmt.Errorf("error parsing listeners file descriptors: %v", err)
+	}
+
+	var fds []int
+	for _, msg := range msgs {
+		rights, err := syscall.ParseUnixRights(&msg)
+		if err != nil {
+			continue
+		}
+
+		fds = append(fds, rights...)
+	}
+
+	addresses := parseHandoffAddresses(string(buf[:n]))
+
+	if len(addresses) != len(fds) {
+		for _, fd := range fds {
+			syscall.Close(fd)
+		}
+
+		return nil, fmt.Errorf("error receiving listeners: got %d file descriptors for %d addresses", len(fds), len(addresses))
+	}
+
+	listeners := make(map[string]net.Listener, len(fds))
+
+	for i, fd := range fds {
+		f := os.NewFile(uintptr(fd), addresses[i])
+
+		l, err := net.FileListener(f)
+		f.Close()
+
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+
+			for _, fd := range fds[i+1:] {
+				syscall.Close(fd)
+			}
+
+			return nil, fmt.Errorf("error restoring listener on %s: %v", addresses[i], err)
+		}
+
+		listeners[addresses[i]] = l
+	}
+
+	return listeners, nil
+}
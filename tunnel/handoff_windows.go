@@ -0,0 +1,18 @@
+package tunnel
+
+import (
+	"fmt"
+	"net"
+)
+
+// HandoffSupported tells if listeners can be handed over to another process
+// on this platform.
+const HandoffSupported = false
+
+func sendListeners(conn *net.UnixConn, addresses []string, listeners []*net.TCPListener) error {
+	return fmt.Errorf("listeners can't be handed over on this platform")
+}
+
+func receiveListeners(conn *net.UnixConn) (map[string]net.Listener, error) {
+	return nil, fmt.Errorf("listeners can't be handed over on this platform")
+}
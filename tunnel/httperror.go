@@ -0,0 +1,45 @@
+package tunnel
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"time"
+)
+
+// httpErrorTimeout is the maximum amount of time spent answering a client
+// with a 503 Service Unavailable response (see SSHChannel.HTTPError).
+const httpErrorTimeout = 2 * time.Second
+
+const httpErrorBody = "mole: the destination of this tunnel channel can't be reached\n"
+
+var httpErrorResponse = fmt.Sprintf("HTTP/1.1 503 Service Unavailable\r\n"+
+	"Content-Type: text/plain; charset=utf-8\r\n"+
+	"Content-Length: %d\r\n"+
+	"Connection: close\r\n"+
+	"\r\n"+
+	"%s", len(httpErrorBody), httpErrorBody)
+
+// writeHTTPError answers the client with a 503 Service Unavailable response,
+// closing the connection afterwards.
+//
+// The client request is read until the client closes its side of the
+// connection, or the timeout is over, since closing a connection with unread
+// data makes most systems reset it, which may discard the response.
+func writeHTTPError(conn net.Conn) {
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(httpErrorTimeout))
+
+	_, err := io.WriteString(conn, httpErrorResponse)
+	if err != nil {
+		return
+	}
+
+	if cw, ok := conn.(interface{ CloseWrite() error }); ok {
+		cw.CloseWrite()
+	}
+
+	io.Copy(ioutil.Discard, conn)
+}
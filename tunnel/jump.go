@@ -0,0 +1,92 @@
+package tunnel
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/ssh"
+)
+
+// dialJump opens a connection to the ssh server through its chain of jump
+// hosts, each one reached through the previous one, giving up on each hop
+// after the given timeout. The jump hosts are disconnected, from the last one
+// to the first, once the returned connection is closed.
+func (s *Server) dialJump(timeout time.Duration) (net.Conn, error) {
+	hops := make([]*ssh.Client, 0, len(s.Jump))
+
+	closeHops := func() {
+		for i := len(hops) - 1; i >= 0; i-- {
+			hops[i].Close()
+		}
+	}
+
+	for i, jump := range s.Jump {
+		config, err := sshClientConfig(jump)
+		if err != nil {
+			closeHops()
+			return nil, fmt.Errorf("error generating ssh client config for jump host %s: %v", jump, err)
+		}
+
+		var client *ssh.Client
+		if i == 0 {
+			client, err = dialServer(jump, config, &DialLatency{})
+		} else {
+			client, err = dialHop(hops[i-1], jump, config, timeout)
+		}
+
+		if err != nil {
+			closeHops()
+			return nil, fmt.Errorf("error connecting to jump host %s: %v", jump.Address, err)
+		}
+
+		log.WithFields(log.Fields{
+			"jump":   jump,
+			"server": s,
+		}).Debug("connection to jump host is established")
+
+		hops = append(hops, client)
+	}
+
+	conn, err := dialTimeout(hops[len(hops)-1], s.Address, timeout)
+	if err != nil {
+		closeHops()
+		return nil, err
+	}
+
+	return &jumpConn{Conn: conn, closeHops: closeHops}, nil
+}
+
+// dialHop establishes a ssh connection to the given jump host through the
+// previous one.
+func dialHop(previous *ssh.Client, server *Server, config *ssh.ClientConfig, timeout time.Duration) (*ssh.Client, error) {
+	conn, err := dialTimeout(previous, server.Address, timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	c, chans, reqs, err := ssh.NewClientConn(conn, hostKeyAddress(server.Address), config)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return ssh.NewClient(c, chans, reqs), nil
+}
+
+// jumpConn is a connection to the ssh server opened through jump hosts, which
+// are disconnected along with it.
+type jumpConn struct {
+	net.Conn
+	closeHops func()
+	once      sync.Once
+}
+
+func (c *jumpConn) Close() error {
+	err := c.Conn.Close()
+	c.once.Do(c.closeHops)
+
+	return err
+}
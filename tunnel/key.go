@@ -5,11 +5,17 @@ import (
 	"encoding/pem"
 	"fmt"
 	"io/ioutil"
+	"sync"
 
 	"github.com/awnumar/memguard"
+	log "github.com/sirupsen/logrus"
 	"golang.org/x/crypto/ssh"
 )
 
+// DefaultPassphraseAttempts is the number of times a passphrase is asked for
+// before giving up on decrypting a protected key.
+const DefaultPassphraseAttempts = 3
+
 // PemKeyParser translates pem keys to a signature signer.
 type PemKeyParser interface {
 	// Parse returns a key signer to create signatures that verify against a
@@ -22,8 +28,29 @@ type PemKey struct {
 	// Data holds the data for a PEM private key
 	Data []byte
 
+	// Path is the file the key was read from, if any.
+	Path string
+
+	// PassphraseAttempts is the number of times HandlePassphrase asks for the
+	// passphrase of a protected key before giving up. Zero means
+	// DefaultPassphraseAttempts.
+	PassphraseAttempts int
+
 	// passphrase used to parse a PEM encoded private key
 	passphrase *memguard.LockedBuffer
+
+	// memory holds the key given by NewPemKeyFromBytes, which is never written
+	// to Data.
+	memory *memoryKey
+}
+
+// memoryKey holds a PEM private key that was never written to disk, locked in
+// memory until it is parsed for the first time. From then on, only its signer
+// is kept and the PEM data is destroyed.
+type memoryKey struct {
+	mu     sync.Mutex
+	data   *memguard.LockedBuffer
+	signer ssh.Signer
 }
 
 func NewPemKey(keyPath, passphrase string) (*PemKey, error) {
@@ -32,7 +59,7 @@ func NewPemKey(keyPath, passphrase string) (*PemKey, error) {
 		return nil, err
 	}
 
-	k := &PemKey{Data: data}
+	k := &PemKey{Data: data, Path: keyPath}
 
 	if passphrase != "" {
 		k.updatePassphrase([]byte(passphrase))
@@ -41,10 +68,56 @@ func NewPemKey(keyPath, passphrase string) (*PemKey, error) {
 	return k, nil
 }
 
+// NewPemKeyFromBytes creates a new PemKey out of PEM data that was never
+// written to a file (e.g. read from the standard input). The data is moved to
+// a locked memory buffer, wiping the given slice, and purged right after the
+// key is parsed for the first time.
+func NewPemKeyFromBytes(data []byte) (*PemKey, error) {
+	p, err := decodePemKey(data)
+	if err == nil && p == nil {
+		err = fmt.Errorf("error while parsing key: no PEM data found")
+	}
+
+	if err != nil {
+		memguard.WipeBytes(data)
+		return nil, err
+	}
+
+	return &PemKey{memory: &memoryKey{data: memguard.NewBufferFromBytes(data)}}, nil
+}
+
+// data returns the PEM data of the key, which is empty once a key given by
+// NewPemKeyFromBytes is parsed.
+func (k PemKey) data() []byte {
+	if k.memory == nil {
+		return k.Data
+	}
+
+	if k.memory.data == nil {
+		return nil
+	}
+
+	return k.memory.data.Bytes()
+}
+
 // IsEncrypted inspects the key data block to tell if it is whether encrypted
 // or not.
 func (k PemKey) IsEncrypted() (bool, error) {
-	p, err := decodePemKey(k.Data)
+	if k.memory != nil {
+		k.memory.mu.Lock()
+		defer k.memory.mu.Unlock()
+
+		// the key is already decrypted.
+		if k.memory.signer != nil {
+			return false, nil
+		}
+	}
+
+	return isEncryptedPemKey(k.data())
+}
+
+func isEncryptedPemKey(data []byte) (bool, error) {
+	p, err := decodePemKey(data)
 	if err != nil {
 		return false, err
 	}
@@ -54,10 +127,41 @@ func (k PemKey) IsEncrypted() (bool, error) {
 
 // Parse translates a pem key to a signer to create signatures that verify
 // against a public key.
+//
+// Keys given by NewPemKeyFromBytes are only parsed once: their PEM data and
+// passphrase are purged from memory right after and the same signer is
+// returned from then on.
 func (k *PemKey) Parse() (ssh.Signer, error) {
+	if k.memory == nil {
+		return k.parse()
+	}
+
+	k.memory.mu.Lock()
+	defer k.memory.mu.Unlock()
+
+	if k.memory.signer != nil {
+		return k.memory.signer, nil
+	}
+
+	signer, err := k.parse()
+	if err != nil {
+		return nil, err
+	}
+
+	k.memory.signer = signer
+	k.memory.data.Destroy()
+	k.memory.data = nil
+	k.updatePassphrase(nil)
+
+	return signer, nil
+}
+
+func (k *PemKey) parse() (ssh.Signer, error) {
 	var signer ssh.Signer
 
-	enc, err := k.IsEncrypted()
+	data := k.data()
+
+	enc, err := isEncryptedPemKey(data)
 	if err != nil {
 		return nil, err
 	}
@@ -67,12 +171,12 @@ func (k *PemKey) Parse() (ssh.Signer, error) {
 			return nil, fmt.Errorf("can't read protected ssh key because no passphrase was provided")
 		}
 
-		signer, err = ssh.ParsePrivateKeyWithPassphrase(k.Data, k.passphrase.Bytes())
+		signer, err = ssh.ParsePrivateKeyWithPassphrase(data, k.passphrase.Bytes())
 		if err != nil {
 			return nil, err
 		}
 	} else {
-		signer, err = ssh.ParsePrivateKey(k.Data)
+		signer, err = ssh.ParsePrivateKey(data)
 		if err != nil {
 			return nil, err
 		}
@@ -83,6 +187,9 @@ func (k *PemKey) Parse() (ssh.Signer, error) {
 
 // HandlePassphrase securely records a passphrase given by a callback to the
 // memory.
+//
+// The callback is called again every time the passphrase given fails to
+// decrypt the key, up to PassphraseAttempts times.
 func (k *PemKey) HandlePassphrase(handler func() ([]byte, error)) error {
 	enc, err := k.IsEncrypted()
 	if err != nil {
@@ -93,14 +200,41 @@ func (k *PemKey) HandlePassphrase(handler func() ([]byte, error)) error {
 		return nil
 	}
 
-	pp, err := handler()
-	if err != nil {
-		return fmt.Errorf("error while reading password: %v", err)
+	attempts := k.PassphraseAttempts
+	if attempts <= 0 {
+		attempts = DefaultPassphraseAttempts
 	}
 
-	k.updatePassphrase(pp)
+	for i := 1; i <= attempts; i++ {
+		pp, err := handler()
+		if err != nil {
+			return fmt.Errorf("error while reading password: %v", err)
+		}
+
+		// the buffer holding the passphrase given is wiped once it is copied to
+		// the locked buffer.
+		k.updatePassphrase(pp)
+
+		if k.passphrase != nil {
+			_, err = ssh.ParsePrivateKeyWithPassphrase(k.data(), k.passphrase.Bytes())
+			if err == nil {
+				return nil
+			}
+
+			if err != x509.IncorrectPasswordError {
+				return fmt.Errorf("error while reading ssh key: %v", err)
+			}
+		}
+
+		// a failed passphrase is not kept around in memory.
+		k.updatePassphrase(nil)
+
+		log.WithFields(log.Fields{
+			"attempt": i,
+		}).Warn("incorrect passphrase for the ssh key")
+	}
 
-	return nil
+	return fmt.Errorf("could not decrypt ssh key: incorrect passphrase after %d attempts", attempts)
 }
 
 func (k *PemKey) updatePassphrase(pp []byte) {
@@ -108,3 +108,94 @@ func TestUpdatePassphrase(t *testing.T) {
 		t.Error("expected nil passphrase")
 	}
 }
+
+func TestHandlePassphraseAttempts(t *testing.T) {
+	tests := []struct {
+		attempts    int
+		passphrases []string
+		expected    int
+		fail        bool
+	}{
+		{0, []string{"mole"}, 1, false},
+		{0, []string{"wrong", "", "mole"}, 3, false},
+		{0, []string{"wrong", "wrong", "wrong", "mole"}, 3, true},
+		{1, []string{"wrong", "mole"}, 1, true},
+		{5, []string{"wrong", "wrong", "wrong", "wrong", "mole"}, 5, false},
+	}
+
+	for i, test := range tests {
+		key, _ := NewPemKey("testdata/dotssh/id_rsa_encrypted", "")
+		key.PassphraseAttempts = test.attempts
+
+		calls := 0
+		err := key.HandlePassphrase(func() ([]byte, error) {
+			pp := []byte(test.passphrases[calls])
+			calls++
+			return pp, nil
+		})
+
+		if test.fail != (err != nil) {
+			t.Errorf("test %d: unexpected error result: %v", i, err)
+		}
+
+		if calls != test.expected {
+			t.Errorf("test %d: expected %d attempts, got %d", i, test.expected, calls)
+		}
+
+		if test.fail && key.passphrase != nil {
+			t.Errorf("test %d: failed passphrase was expected to be discarded", i)
+		}
+	}
+}
+
+func TestPemKeyFromBytes(t *testing.T) {
+	data, err := ioutil.ReadFile("testdata/dotssh/id_rsa_encrypted")
+	if err != nil {
+		t.Fatalf("can't read key file: %v", err)
+	}
+
+	key, err := NewPemKeyFromBytes(data)
+	if err != nil {
+		t.Fatalf("error creating key from bytes: %v", err)
+	}
+
+	for _, b := range data {
+		if b != 0 {
+			t.Fatalf("the given key data was expected to be wiped")
+		}
+	}
+
+	if key.Data != nil {
+		t.Errorf("the key data was not expected to be kept in regular memory")
+	}
+
+	err = key.HandlePassphrase(func() ([]byte, error) {
+		return []byte("mole"), nil
+	})
+	if err != nil {
+		t.Fatalf("error handling the key passphrase: %v", err)
+	}
+
+	signer, err := key.Parse()
+	if err != nil {
+		t.Fatalf("error parsing key: %v", err)
+	}
+
+	if key.memory.data != nil || key.passphrase != nil {
+		t.Errorf("the key data and passphrase were expected to be purged once parsed")
+	}
+
+	// reconnections reuse the signer, since the key data is gone.
+	again, err := key.Parse()
+	if err != nil || again != signer {
+		t.Errorf("the same signer was expected to be returned: %v", err)
+	}
+
+	if enc, err := key.IsEncrypted(); err != nil || enc {
+		t.Errorf("a parsed key was not expected to be reported as encrypted: %t, %v", enc, err)
+	}
+
+	if _, err := NewPemKeyFromBytes([]byte("not a key")); err == nil {
+		t.Errorf("error expected for data holding no key")
+	}
+}
@@ -0,0 +1,58 @@
+package tunnel
+
+import (
+	"fmt"
+	"net"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// dialLimited opens a connection to the given address through the ssh server,
+// like dialTimeout does, but first waits for one of the MaxPendingChannelOpens
+// slots to be available, so a burst of clients doesn't open a storm of ssh
+// channels at once. The time spent waiting counts towards DialTimeout.
+func (t *Tunnel) dialLimited(client *ssh.Client, address string) (net.Conn, error) {
+	if t.MaxPendingChannelOpens <= 0 {
+		return dialTimeout(client, address, t.DialTimeout)
+	}
+
+	t.pendingOpensOnce.Do(func() {
+		t.pendingOpens = make(chan struct{}, t.MaxPendingChannelOpens)
+	})
+
+	start := time.Now()
+
+	var expired <-chan time.Time
+	if t.DialTimeout > 0 {
+		timer := time.NewTimer(t.DialTimeout)
+		defer timer.Stop()
+
+		expired = timer.C
+	}
+
+	select {
+	case t.pendingOpens <- struct{}{}:
+	case <-expired:
+		return nil, fmt.Errorf("timeout opening connection to %s after %s: %d connections are already being opened", address, t.DialTimeout, t.MaxPendingChannelOpens)
+	}
+
+	timeout := t.DialTimeout
+	if timeout > 0 {
+		timeout -= time.Since(start)
+
+		if timeout <= 0 {
+			<-t.pendingOpens
+			return nil, fmt.Errorf("timeout opening connection to %s after %s", address, t.DialTimeout)
+		}
+	}
+
+	// the slot is only released once the ssh server answers, even if the
+	// client gave up waiting for it, since the channel open is still in
+	// progress until then.
+	return awaitDial(func() (net.Conn, error) {
+		defer func() { <-t.pendingOpens }()
+
+		return client.Dial(addressNetwork(address), address)
+	}, address, timeout)
+}
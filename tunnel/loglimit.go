@@ -0,0 +1,85 @@
+package tunnel
+
+import (
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// logLimiter collapses repeated log messages, so a tunnel failing to reach the
+// ssh server over and over doesn't flood the logs.
+//
+// The first occurrence of a message is logged right away. Any identical
+// message logged within the window that follows is only counted, and a summary
+// of how many times it was repeated is logged along with the next occurrence
+// after the window or when the limiter is flushed.
+type logLimiter struct {
+	mu      sync.Mutex
+	entries map[string]*limitedLog
+}
+
+type limitedLog struct {
+	entry      *log.Entry
+	level      log.Level
+	since      time.Time
+	suppressed int
+}
+
+// log logs the message with the given entry and level, unless the same message
+// was already logged less than window ago. A window of zero or less disables
+// the rate limiting.
+func (l *logLimiter) log(window time.Duration, entry *log.Entry, level log.Level, msg string) {
+	if window <= 0 {
+		entry.Log(level, msg)
+		return
+	}
+
+	now := time.Now()
+
+	l.mu.Lock()
+
+	if l.entries == nil {
+		l.entries = make(map[string]*limitedLog)
+	}
+
+	prev := l.entries[msg]
+	if prev != nil && now.Sub(prev.since) < window {
+		prev.entry = entry
+		prev.suppressed++
+		l.mu.Unlock()
+
+		return
+	}
+
+	l.entries[msg] = &limitedLog{entry: entry, level: level, since: now}
+
+	l.mu.Unlock()
+
+	if prev != nil && prev.suppressed > 0 {
+		summarize(prev, msg, now)
+	}
+
+	entry.Log(level, msg)
+}
+
+// flush logs a summary of every message suppressed so far and forgets about
+// them, so the next occurrence of any message is logged right away.
+func (l *logLimiter) flush() {
+	now := time.Now()
+
+	l.mu.Lock()
+	entries := l.entries
+	l.entries = nil
+	l.mu.Unlock()
+
+	for msg, e := range entries {
+		if e.suppressed > 0 {
+			summarize(e, msg, now)
+		}
+	}
+}
+
+func summarize(e *limitedLog, msg string, now time.Time) {
+	e.entry.WithField("suppressed", e.suppressed).Logf(e.level, "%s: repeated %d times in last %s", msg, e.suppressed, now.Sub(e.since).Round(time.Second))
+}
@@ -0,0 +1,218 @@
+package tunnel
+
+import (
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/ssh"
+)
+
+// migratingConn is a connection to a channel destination that can be replaced,
+// while data is forwarded, by a new connection opened through another
+// connection to the ssh server.
+type migratingConn struct {
+	mu   sync.Mutex
+	conn net.Conn
+	// swapped is closed, and replaced, every time the destination connection
+	// changes or the forwarding is over.
+	swapped chan struct{}
+	done    bool
+}
+
+func (m *migratingConn) current() (net.Conn, chan struct{}, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.conn, m.swapped, m.done
+}
+
+func (m *migratingConn) swap(conn net.Conn) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.conn = conn
+	close(m.swapped)
+	m.swapped = make(chan struct{})
+}
+
+func (m *migratingConn) finish() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.done {
+		return
+	}
+
+	m.done = true
+	m.conn.Close()
+	close(m.swapped)
+}
+
+// forwardMigrating forwards data between a client connection and its
+// destination, like forward does, but survives the loss of the connection to
+// the ssh server: the client connection is held open for up to
+// MigrationTimeout while the tunnel reconnects and the destination is dialed
+// again through the new ssh connection.
+//
+// The destination sees a brand new connection, so only protocols that can
+// tolerate it (e.g. stateless requests or idle sessions) survive a migration.
+// Data sent by the destination right before the ssh connection was lost may
+// never reach the client.
+func (t *Tunnel) forwardMigrating(channel *SSHChannel, connId string, conn net.Conn, destinationConn net.Conn, client *ssh.Client) {
+	defer conn.Close()
+
+	m := &migratingConn{conn: destinationConn, swapped: make(chan struct{})}
+	defer m.finish()
+
+	var clientClosed uint32
+
+	bufferSize := t.CopyBufferSize
+	if bufferSize <= 0 {
+		bufferSize = 32 * 1024
+	}
+
+	// client to destination: a write failing because the ssh connection was
+	// lost is retried on the destination connection replacing it.
+	go func() {
+		buf := make([]byte, bufferSize)
+
+		for {
+			n, err := conn.Read(buf)
+			if n > 0 && !writeMigrating(m, buf[:n]) {
+				return
+			}
+
+			if err != nil {
+				atomic.StoreUint32(&clientClosed, 1)
+				m.finish()
+				return
+			}
+		}
+	}()
+
+	destination := t.aliasedAddress(channel.Destination)
+
+	for {
+		dc, _, _ := m.current()
+
+		_, err := io.Copy(conn, dc)
+
+		if atomic.LoadUint32(&clientClosed) == 1 || !t.connectionLost(client) {
+			logCopyError(connId, err)
+
+			closedBy := "destination"
+			if atomic.LoadUint32(&clientClosed) == 1 {
+				closedBy = "client"
+			}
+
+			if !channel.Quiet {
+				log.WithFields(log.Fields{
+					"channel":    channel,
+					"connection": connId,
+					"client":     conn.RemoteAddr(),
+					"closed-by":  closedBy,
+				}).Debug("connection closed")
+			}
+
+			return
+		}
+
+		dc.Close()
+
+		log.WithFields(log.Fields{
+			"channel":    channel,
+			"connection": connId,
+		}).Info("connection to the ssh server lost, holding the connection while the tunnel reconnects")
+
+		newClient := t.waitForNewClient(client, t.MigrationTimeout)
+		if newClient == nil {
+			log.WithFields(log.Fields{
+				"channel":    channel,
+				"connection": connId,
+			}).Warn("connection could not be migrated: the tunnel did not reconnect in time")
+
+			return
+		}
+
+		newConn, err := t.dialDestination(channel, newClient, destination)
+		if err != nil {
+			log.WithError(err).WithFields(log.Fields{
+				"channel":    channel,
+				"connection": connId,
+			}).Warn("connection could not be migrated: error dialing destination")
+
+			return
+		}
+
+		client = newClient
+		m.swap(newConn)
+
+		log.WithFields(log.Fields{
+			"channel":    channel,
+			"connection": connId,
+		}).Info("connection migrated to the new connection to the ssh server")
+	}
+}
+
+// writeMigrating writes data to the destination connection, waiting for it to
+// be replaced if the write fails. It returns false once the forwarding is
+// over.
+func writeMigrating(m *migratingConn, data []byte) bool {
+	for {
+		dc, swapped, done := m.current()
+		if done {
+			return false
+		}
+
+		_, err := dc.Write(data)
+		if err == nil {
+			return true
+		}
+
+		<-swapped
+	}
+}
+
+// connectionLost tells if the given connection to the ssh server is gone.
+func (t *Tunnel) connectionLost(client *ssh.Client) bool {
+	if t.sshClient() != client {
+		return true
+	}
+
+	_, _, err := client.SendRequest("keepalive@mole", true, nil)
+
+	return err != nil
+}
+
+// waitForNewClient waits up to the given timeout for the tunnel to establish
+// a connection to the ssh server other than old. nil is returned if the
+// timeout expires.
+func (t *Tunnel) waitForNewClient(old *ssh.Client, timeout time.Duration) *ssh.Client {
+	deadline := time.After(timeout)
+
+	for {
+		t.clientMu.RLock()
+		client, connected := t.client, t.connected
+		t.clientMu.RUnlock()
+
+		if client != nil && client != old {
+			return client
+		}
+
+		// the tunnel may not have noticed the connection is gone yet
+		if client != nil {
+			connected = nil
+		}
+
+		select {
+		case <-connected:
+		case <-time.After(100 * time.Millisecond):
+		case <-deadline:
+			return nil
+		}
+	}
+}
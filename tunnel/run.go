@@ -0,0 +1,293 @@
+package tunnel
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// drainInterval is the time waited by Drain between checks of the forwarded
+// connections still open.
+const drainInterval = 50 * time.Millisecond
+
+// Config holds everything needed to create a Tunnel with NewFromConfig or to
+// run one with Run, instead of setting each attribute of a Tunnel after it is
+// created. The ssh server connection settings, including how it is dialed and
+// how its host key is verified, are kept by Server.
+//
+// Unless stated otherwise, each attribute has the same meaning as the Tunnel
+// attribute of the same name.
+type Config struct {
+	// Type is the kind of forwarding handled by the tunnel: local, remote,
+	// dynamic (a SOCKS5 proxy, each client telling the destination it wants),
+	// stdio or tun. Defaults to local.
+	Type            string
+	Server          *Server
+	FallbackServers []*Server
+
+	// Source and Destination are the addresses of the channels, just like the
+	// ones given to New. The source of a tun tunnel is its tun device.
+	Source      []string
+	Destination []string
+	// SSHConfig is the ssh config file the channels are looked up on when no
+	// source and destination addresses are given.
+	SSHConfig string
+	// DestinationCommand, if set, discovers the destination addresses of a
+	// local tunnel (see NewDiscovered).
+	DestinationCommand string
+	// ManifestCommand, if set, adds channels to the tunnel once it is started
+	// (see ManifestCommand on Tunnel). The channels are only taken from the
+	// command when no source and destination addresses are given.
+	ManifestCommand string
+
+	ConnectionRetries      int
+	MaxReconnects          int
+	MaxPendingChannelOpens int
+	// MaxChannels takes DefaultMaxChannels when zero. A negative value means
+	// no limit.
+	MaxChannels            int
+	WaitAndRetry           time.Duration
+	StableConnectionPeriod time.Duration
+	SuperviseInterval      time.Duration
+	NetworkCheckInterval   time.Duration
+
+	// DialTimeout, ConnectionWaitTimeout and LogRateLimit take the defaults of
+	// New when zero. A negative value disables them.
+	DialTimeout           time.Duration
+	ConnectionWaitTimeout time.Duration
+	LogRateLimit          time.Duration
+	MigrationTimeout      time.Duration
+	InitialReadTimeout    time.Duration
+	WaitForRemote         time.Duration
+
+	KeepAliveInterval     time.Duration
+	KeepAliveInitialDelay time.Duration
+	KeepAliveData         bool
+	KeepAliveIdleOnly     bool
+
+	CopyBufferSize int
+	HalfClose      bool
+	Trace          bool
+	TraceLimit     int
+	HostAliases    map[string]string
+	EgressPolicy   *EgressPolicy
+
+	// Logger, if set, is the logger the tunnel messages are written to. Like
+	// SetLogLevel, it applies to the standard logger, shared by all tunnels of
+	// the process, which takes its output, formatter, level and hooks.
+	Logger *log.Logger
+
+	// Ready, if set, is called by Run every time the tunnel channels are ready
+	// to accept connections, after connecting or reconnecting to the ssh
+	// server, the same way values are sent through Ready on Tunnel.
+	Ready func(t *Tunnel)
+
+	Disconnected func(err error)
+	Reconnected  func()
+	Notify       func(Event)
+}
+
+// NewFromConfig creates a new instance of Tunnel from the given configuration.
+func NewFromConfig(cfg Config) (*Tunnel, error) {
+	if cfg.Server == nil {
+		return nil, fmt.Errorf("missing ssh server")
+	}
+
+	if cfg.Type == "" {
+		cfg.Type = "local"
+	}
+
+	var t *Tunnel
+	var err error
+
+	if cfg.DestinationCommand != "" {
+		if cfg.Type != "local" {
+			return nil, fmt.Errorf("destination command is only supported by local tunnels")
+		}
+
+		t, err = NewDiscovered(cfg.Server, cfg.Source, cfg.DestinationCommand)
+	} else if cfg.ManifestCommand != "" && len(cfg.Source) == 0 && len(cfg.Destination) == 0 {
+		t, err = NewManifest(cfg.Type, cfg.Server, cfg.ManifestCommand)
+	} else {
+		t, err = New(cfg.Type, cfg.Server, cfg.Source, cfg.Destination, cfg.SSHConfig)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	t.FallbackServers = cfg.FallbackServers
+	t.ManifestCommand = cfg.ManifestCommand
+	t.ConnectionRetries = cfg.ConnectionRetries
+	t.MaxReconnects = cfg.MaxReconnects
+	t.MaxPendingChannelOpens = cfg.MaxPendingChannelOpens
+	if cfg.MaxChannels != 0 {
+		t.MaxChannels = cfg.MaxChannels
+	}
+	t.WaitAndRetry = cfg.WaitAndRetry
+	t.StableConnectionPeriod = cfg.StableConnectionPeriod
+	t.SuperviseInterval = cfg.SuperviseInterval
+	t.NetworkCheckInterval = cfg.NetworkCheckInterval
+	t.DialTimeout = durationOrDefault(cfg.DialTimeout, t.DialTimeout)
+	t.ConnectionWaitTimeout = durationOrDefault(cfg.ConnectionWaitTimeout, t.ConnectionWaitTimeout)
+	t.LogRateLimit = durationOrDefault(cfg.LogRateLimit, t.LogRateLimit)
+	t.MigrationTimeout = cfg.MigrationTimeout
+	t.InitialReadTimeout = cfg.InitialReadTimeout
+	t.WaitForRemote = cfg.WaitForRemote
+	t.KeepAliveInterval = cfg.KeepAliveInterval
+	t.KeepAliveInitialDelay = cfg.KeepAliveInitialDelay
+	t.KeepAliveData = cfg.KeepAliveData
+	t.KeepAliveIdleOnly = cfg.KeepAliveIdleOnly
+	t.CopyBufferSize = cfg.CopyBufferSize
+	t.HalfClose = cfg.HalfClose
+	t.Trace = cfg.Trace
+	t.TraceLimit = cfg.TraceLimit
+	t.HostAliases = cfg.HostAliases
+	t.EgressPolicy = cfg.EgressPolicy
+	t.Disconnected = cfg.Disconnected
+	t.Reconnected = cfg.Reconnected
+	t.Notify = cfg.Notify
+
+	// channels given upfront are refused right away, rather than once the
+	// tunnel is started.
+	if err := t.checkMaxChannels(len(t.channelList())); err != nil {
+		return nil, err
+	}
+
+	if cfg.Logger != nil {
+		std := log.StandardLogger()
+		std.SetOutput(cfg.Logger.Out)
+		std.SetFormatter(cfg.Logger.Formatter)
+		std.SetLevel(cfg.Logger.GetLevel())
+		std.ReplaceHooks(cfg.Logger.Hooks)
+	}
+
+	return t, nil
+}
+
+// Run creates a Tunnel from the given configuration and starts it, returning
+// once the tunnel fails or the given context is done. The listeners of the
+// channels are closed before returning.
+//
+// Like StartContext, it returns the context error once the context is done.
+func Run(ctx context.Context, cfg Config) error {
+	t, err := NewFromConfig(cfg)
+	if err != nil {
+		return err
+	}
+
+	stopped := make(chan struct{})
+	defer close(stopped)
+
+	// Ready must be kept drained, otherwise the tunnel blocks on its next
+	// reconnection.
+	go func() {
+		for {
+			select {
+			case <-t.Ready:
+				if cfg.Ready != nil {
+					cfg.Ready(t)
+				}
+			case <-stopped:
+				return
+			}
+		}
+	}()
+
+	defer t.closeListeners()
+
+	return t.StartContext(ctx)
+}
+
+// Verify starts the tunnel just long enough to tell it works: it connects to
+// the ssh server, listens on the source address of every channel and checks
+// their destinations can be reached (see CheckDestinations), stopping the
+// tunnel and closing its listeners before returning.
+//
+// The forwarded channels are logged once the tunnel is ready, so the resolved
+// addresses can be reviewed. Stdio tunnels can't be verified, since they
+// would consume the standard input.
+func (t *Tunnel) Verify() error {
+	if t.Type == "stdio" {
+		return fmt.Errorf("stdio tunnels can't be verified")
+	}
+
+	result := make(chan error, 1)
+	go func() { result <- t.Start() }()
+
+	defer t.closeListeners()
+
+	select {
+	case <-t.Ready:
+	case err := <-result:
+		if err == nil {
+			err = fmt.Errorf("tunnel stopped before being ready")
+		}
+
+		return err
+	}
+
+	err := t.CheckDestinations()
+
+	t.Stop()
+	<-result
+
+	return err
+}
+
+// Drain stops the tunnel gracefully: its channels stop accepting connections
+// right away, while the connections already being forwarded are given up to
+// the given timeout to be closed by their ends, before the tunnel is stopped
+// (see Stop) and the remaining ones with it.
+//
+// It returns the number of forwarded connections still open when the timeout
+// expired.
+func (t *Tunnel) Drain(timeout time.Duration) int64 {
+	for _, ch := range t.channelList() {
+		// the listeners are closed on purpose, so the tunnel doesn't fail.
+		atomic.StoreUint32(&ch.closed, 1)
+
+		if l := ch.currentListener(); l != nil {
+			l.Close()
+		}
+
+		drainPool(ch)
+	}
+
+	deadline := time.Now().Add(timeout)
+	for t.OpenSSHChannels() > 0 && time.Now().Before(deadline) {
+		time.Sleep(drainInterval)
+	}
+
+	open := t.OpenSSHChannels()
+
+	t.Stop()
+
+	return open
+}
+
+// closeListeners closes the listeners of all channels of the tunnel.
+func (t *Tunnel) closeListeners() {
+	for _, ch := range t.channelList() {
+		if l := ch.currentListener(); l != nil {
+			l.Close()
+		}
+	}
+}
+
+// durationOrDefault returns the given duration, or the default one if zero.
+// Negative durations are taken as zero.
+func durationOrDefault(d, def time.Duration) time.Duration {
+	if d < 0 {
+		return 0
+	}
+
+	if d == 0 {
+		return def
+	}
+
+	return d
+}
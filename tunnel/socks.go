@@ -0,0 +1,315 @@
+package tunnel
+
+import (
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/ssh"
+)
+
+// socksHandshakeTimeout is how long a client of a dynamic channel has to
+// tell, through the socks handshake, where its connection goes.
+const socksHandshakeTimeout = 10 * time.Second
+
+const (
+	socksVersion = 0x05
+
+	socksAuthNone         = 0x00
+	socksAuthPassword     = 0x02
+	socksAuthUnacceptable = 0xff
+
+	socksPasswordVersion = 0x01
+
+	socksCommandConnect = 0x01
+
+	socksAddressIPv4   = 0x01
+	socksAddressDomain = 0x03
+	socksAddressIPv6   = 0x04
+)
+
+// socks reply codes, as defined by RFC 1928.
+const (
+	socksSucceeded               = 0x00
+	socksGeneralFailure          = 0x01
+	socksNotAllowed              = 0x02
+	socksHostUnreachable         = 0x04
+	socksConnectionRefused       = 0x05
+	socksCommandNotSupported     = 0x07
+	socksAddressTypeNotSupported = 0x08
+)
+
+// socksError is a socks handshake failure to be answered with the given reply
+// code.
+type socksError struct {
+	reply byte
+	err   error
+}
+
+func (e *socksError) Error() string {
+	return e.err.Error()
+}
+
+// forwardSOCKS forwards a connection accepted by a channel of a dynamic
+// tunnel to the destination the client asks for through a SOCKS5 handshake.
+func (t *Tunnel) forwardSOCKS(channel *SSHChannel, connId string, conn net.Conn) {
+	// the socks handshake goes through tls, just like the data of any other
+	// channel terminating tls.
+	if channel.LocalTLS != nil {
+		conn = tls.Server(conn, channel.LocalTLS)
+	}
+
+	fields := log.Fields{
+		"channel":    channel,
+		"connection": connId,
+		"client":     conn.RemoteAddr(),
+	}
+
+	err := conn.SetDeadline(time.Now().Add(socksHandshakeTimeout))
+	if err != nil {
+		conn.Close()
+		return
+	}
+
+	destination, err := readSOCKSRequest(conn)
+	if err != nil {
+		log.WithError(err).WithFields(fields).Warn("connection refused: invalid socks request")
+
+		var se *socksError
+		if errors.As(err, &se) {
+			writeSOCKSReply(conn, se.reply)
+		}
+
+		conn.Close()
+		return
+	}
+
+	fields["destination"] = destination
+
+	if !channel.Quiet {
+		log.WithFields(fields).Debug("connection established")
+	}
+
+	client := t.waitForClient(t.ConnectionWaitTimeout)
+	if client == nil {
+		log.WithFields(fields).Warn("tunnel channel can't be established: missing connection to the ssh server")
+
+		writeSOCKSReply(conn, socksGeneralFailure)
+		conn.Close()
+		return
+	}
+
+	if t.EgressPolicy != nil && !t.EgressPolicy.Allows(destination) {
+		log.WithFields(fields).Warn("connection refused: destination is not allowed by the egress policy")
+
+		writeSOCKSReply(conn, socksNotAllowed)
+		conn.Close()
+		return
+	}
+
+	atomic.AddUint64(&channel.dials.attempts, 1)
+
+	destinationConn, err := t.dialThrough(channel, client, t.aliasedAddress(destination))
+	if err != nil {
+		atomic.AddUint64(&channel.dials.failures, 1)
+
+		log.WithError(err).WithFields(fields).Error("error dialing destination")
+
+		writeSOCKSReply(conn, socksDialReply(err))
+		conn.Close()
+		return
+	}
+
+	atomic.AddUint64(&channel.dials.successes, 1)
+
+	// the ssh protocol doesn't tell the address the ssh server connected to,
+	// so the one asked for by the client is the best known.
+	channel.dials.lastPeer.Store(destination)
+
+	err = writeSOCKSReply(conn, socksSucceeded)
+	if err == nil {
+		err = conn.SetDeadline(time.Time{})
+	}
+
+	if err != nil {
+		log.WithError(err).WithFields(fields).Warn("connection dropped: error answering the socks request")
+
+		destinationConn.Close()
+		conn.Close()
+		return
+	}
+
+	if !channel.Quiet {
+		log.WithFields(fields).Debug("tunnel channel has been established")
+	}
+
+	conn = t.notifyChannel(channel, connId, conn)
+
+	t.forward(channel, connId, conn, destinationConn)
+}
+
+// readSOCKSRequest goes through the SOCKS5 method negotiation and reads the
+// request that follows it, returning the address the client wants to connect
+// to. Only the CONNECT command is supported.
+//
+// Clients are accepted whether they authenticate or not: the username and
+// password given, if any, are not checked, since the tunnel is only reachable
+// from where its listener is.
+func readSOCKSRequest(conn net.Conn) (string, error) {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return "", err
+	}
+
+	if header[0] != socksVersion {
+		return "", fmt.Errorf("unsupported socks version %d", header[0])
+	}
+
+	methods := make([]byte, header[1])
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return "", err
+	}
+
+	method := byte(socksAuthUnacceptable)
+	for _, m := range methods {
+		if m == socksAuthNone {
+			method = socksAuthNone
+			break
+		}
+
+		if m == socksAuthPassword {
+			method = socksAuthPassword
+		}
+	}
+
+	if _, err := conn.Write([]byte{socksVersion, method}); err != nil {
+		return "", err
+	}
+
+	switch method {
+	case socksAuthUnacceptable:
+		return "", fmt.Errorf("no supported socks authentication method offered")
+	case socksAuthPassword:
+		if err := readSOCKSPassword(conn); err != nil {
+			return "", err
+		}
+	}
+
+	request := make([]byte, 4)
+	if _, err := io.ReadFull(conn, request); err != nil {
+		return "", err
+	}
+
+	if request[0] != socksVersion {
+		return "", fmt.Errorf("unsupported socks version %d", request[0])
+	}
+
+	if request[1] != socksCommandConnect {
+		return "", &socksError{reply: socksCommandNotSupported, err: fmt.Errorf("unsupported socks command %d", request[1])}
+	}
+
+	var host string
+
+	switch request[3] {
+	case socksAddressIPv4, socksAddressIPv6:
+		size := net.IPv4len
+		if request[3] == socksAddressIPv6 {
+			size = net.IPv6len
+		}
+
+		ip := make([]byte, size)
+		if _, err := io.ReadFull(conn, ip); err != nil {
+			return "", err
+		}
+
+		host = net.IP(ip).String()
+	case socksAddressDomain:
+		size := make([]byte, 1)
+		if _, err := io.ReadFull(conn, size); err != nil {
+			return "", err
+		}
+
+		domain := make([]byte, size[0])
+		if _, err := io.ReadFull(conn, domain); err != nil {
+			return "", err
+		}
+
+		host = string(domain)
+	default:
+		return "", &socksError{reply: socksAddressTypeNotSupported, err: fmt.Errorf("unsupported socks address type %d", request[3])}
+	}
+
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(conn, port); err != nil {
+		return "", err
+	}
+
+	return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port)))), nil
+}
+
+// readSOCKSPassword reads the username and password sent by the client (see
+// RFC 1929), accepting any.
+func readSOCKSPassword(conn net.Conn) error {
+	version := make([]byte, 2)
+	if _, err := io.ReadFull(conn, version); err != nil {
+		return err
+	}
+
+	if version[0] != socksPasswordVersion {
+		return fmt.Errorf("unsupported socks username/password authentication version %d", version[0])
+	}
+
+	// username, followed by the size of the password
+	username := make([]byte, int(version[1])+1)
+	if _, err := io.ReadFull(conn, username); err != nil {
+		return err
+	}
+
+	password := make([]byte, username[len(username)-1])
+	if _, err := io.ReadFull(conn, password); err != nil {
+		return err
+	}
+
+	_, err := conn.Write([]byte{socksPasswordVersion, socksSucceeded})
+
+	return err
+}
+
+// writeSOCKSReply answers a socks request with the given reply code. The bound
+// address is not meaningful to the client, since the connection to the
+// destination is opened by the ssh server, so it is always left unspecified.
+func writeSOCKSReply(conn net.Conn, reply byte) error {
+	_, err := conn.Write([]byte{socksVersion, reply, 0x00, socksAddressIPv4, 0, 0, 0, 0, 0, 0})
+
+	return err
+}
+
+// socksDialReply returns the socks reply code telling why the given error
+// happened while dialing a destination through the ssh server.
+func socksDialReply(err error) byte {
+	var oce *ssh.OpenChannelError
+	if !errors.As(err, &oce) {
+		return socksGeneralFailure
+	}
+
+	switch oce.Reason {
+	case ssh.Prohibited:
+		return socksNotAllowed
+	case ssh.ConnectionFailed:
+		if strings.Contains(strings.ToLower(oce.Message), "refused") {
+			return socksConnectionRefused
+		}
+
+		return socksHostUnreachable
+	}
+
+	return socksGeneralFailure
+}
@@ -0,0 +1,202 @@
+package tunnel
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// dialCounters counts the attempts made by a channel to open a connection to
+// its destination and the data forwarded through those connections.
+type dialCounters struct {
+	attempts  uint64
+	successes uint64
+	failures  uint64
+	sent      uint64
+	received  uint64
+	// lastPeer is the address of the peer the latest connection to the
+	// destination was opened to, if known.
+	lastPeer atomic.Value
+	// open is the number of ssh channels currently opened by forwarded
+	// connections of the channel.
+	open int64
+}
+
+// ChannelStats holds counters about the connections forwarded by a channel.
+//
+// Counters are cumulative over the whole life of the channel: since the
+// channel keeps listening while the tunnel reconnects to the ssh server, they
+// are never reset on a reconnection, and only go away along with the channel
+// once it is removed. Generation tells which connection to the ssh server the
+// tunnel was on when the counters were read, so drops in throughput can be
+// correlated with reconnections.
+type ChannelStats struct {
+	Source      string `json:"source"`
+	Destination string `json:"destination"`
+	// Protocol is the protocol hint of the channel, if any (see SetProtocol).
+	Protocol string `json:"protocol,omitempty"`
+	// DialAttempts is the number of connections to the destination opened on
+	// behalf of a client, successfully or not. Clients dropped because the
+	// tunnel is not connected to the ssh server are not counted.
+	DialAttempts uint64 `json:"dial-attempts"`
+	// DialSuccesses is the number of connections to the destination opened.
+	DialSuccesses uint64 `json:"dial-successes"`
+	// DialFailures is the number of connections to the destination that could
+	// not be opened (e.g. the destination refused the connection), which tells
+	// a flaky destination apart from problems with the tunnel itself.
+	DialFailures uint64 `json:"dial-failures"`
+	// LastPeer is the address the latest connection to the destination was
+	// actually opened to, which may change over time for a destination given
+	// as a host name. It is only known for remote tunnels, since the ssh
+	// protocol doesn't tell the address the ssh server connected to, and for
+	// dynamic tunnels, where it is the destination the latest client asked for.
+	LastPeer string `json:"last-peer,omitempty"`
+	// OpenSSHChannels is the number of ssh channels currently opened on the
+	// connection to the ssh server on behalf of the channel, one for each
+	// forwarded or prewarmed connection.
+	OpenSSHChannels int64 `json:"open-ssh-channels"`
+	// BytesSent is the number of bytes forwarded from the clients to the
+	// destination, counted as they flow rather than once connections close.
+	BytesSent uint64 `json:"bytes-sent"`
+	// BytesReceived is the number of bytes forwarded from the destination
+	// back to the clients, counted as they flow.
+	BytesReceived uint64 `json:"bytes-received"`
+	// Generation is the number of connections established to the ssh server
+	// by the tunnel so far (see Generation on Tunnel).
+	Generation uint64 `json:"generation"`
+	// ConnectionUptime is how long the tunnel has been on its current
+	// connection to the ssh server (see Uptime on Tunnel), which, along with
+	// the byte counters, tells the throughput of the channel.
+	ConnectionUptime time.Duration `json:"connection-uptime"`
+}
+
+// Stats returns the counters of every channel of the tunnel.
+func (t *Tunnel) Stats() []ChannelStats {
+	channels := t.channelList()
+	stats := make([]ChannelStats, len(channels))
+	generation := t.Generation()
+	uptime := t.Uptime()
+
+	for i, ch := range channels {
+		peer, _ := ch.dials.lastPeer.Load().(string)
+
+		stats[i] = ChannelStats{
+			Source:           ch.Source,
+			Destination:      ch.Destination,
+			Protocol:         ch.Protocol,
+			DialAttempts:     atomic.LoadUint64(&ch.dials.attempts),
+			DialSuccesses:    atomic.LoadUint64(&ch.dials.successes),
+			DialFailures:     atomic.LoadUint64(&ch.dials.failures),
+			LastPeer:         peer,
+			OpenSSHChannels:  atomic.LoadInt64(&ch.dials.open),
+			BytesSent:        atomic.LoadUint64(&ch.dials.sent),
+			BytesReceived:    atomic.LoadUint64(&ch.dials.received),
+			Generation:       generation,
+			ConnectionUptime: uptime,
+		}
+	}
+
+	return stats
+}
+
+// Generation returns the number of connections established to the ssh server
+// by the tunnel so far, which is 0 until it connects for the first time and
+// goes up every time it connects again, either after losing the connection or
+// on a Restart. It changes along with the connection, unlike the channel
+// counters, which are cumulative across reconnections (see ChannelStats).
+func (t *Tunnel) Generation() uint64 {
+	return atomic.LoadUint64(&t.generation)
+}
+
+// Uptime returns how long the tunnel has been on its current connection to
+// the ssh server, or zero before it first connects and while it connects
+// again.
+func (t *Tunnel) Uptime() time.Duration {
+	since := atomic.LoadInt64(&t.connectedSince)
+	if since == 0 || t.sshClient() == nil {
+		return 0
+	}
+
+	return time.Since(time.Unix(0, since))
+}
+
+// OpenSSHChannels returns the number of ssh channels currently opened by the
+// forwarded connections of all channels of the tunnel, including the ones of
+// channels already removed. Since every channel is multiplexed over a single
+// connection to the ssh server, it helps telling when the server limits on
+// the number of channels (e.g. "administratively prohibited" open failures)
+// are being hit.
+func (t *Tunnel) OpenSSHChannels() int64 {
+	return atomic.LoadInt64(&t.sshChannels)
+}
+
+// trackSSHChannel counts the given connection, carried by an ssh channel, as
+// opened on behalf of the given channel until it is closed.
+func (t *Tunnel) trackSSHChannel(channel *SSHChannel, conn net.Conn) net.Conn {
+	atomic.AddInt64(&t.sshChannels, 1)
+	atomic.AddInt64(&channel.dials.open, 1)
+
+	return &trackedConn{Conn: conn, closed: func() {
+		atomic.AddInt64(&t.sshChannels, -1)
+		atomic.AddInt64(&channel.dials.open, -1)
+	}}
+}
+
+// trackedConn is a connection calling closed once, the first time it is
+// closed.
+type trackedConn struct {
+	net.Conn
+	closed func()
+	once   sync.Once
+}
+
+func (c *trackedConn) Close() error {
+	c.once.Do(c.closed)
+
+	return c.Conn.Close()
+}
+
+// CloseWrite closes the sending side of the underlying connection, if
+// supported (see HalfClose).
+func (c *trackedConn) CloseWrite() error {
+	cw, ok := c.Conn.(interface{ CloseWrite() error })
+	if !ok {
+		return fmt.Errorf("connection can't be half closed")
+	}
+
+	return cw.CloseWrite()
+}
+
+// countedConn is a connection adding the number of bytes read from it to a
+// counter and, if lastRead is set, recording the time, in unix nanoseconds,
+// data was last read from it.
+type countedConn struct {
+	net.Conn
+	count    *uint64
+	lastRead *int64
+}
+
+func (c countedConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	atomic.AddUint64(c.count, uint64(n))
+
+	if n > 0 && c.lastRead != nil {
+		atomic.StoreInt64(c.lastRead, time.Now().UnixNano())
+	}
+
+	return n, err
+}
+
+// peerAddress returns the address of the peer the given connection to a
+// channel destination is opened to, or an empty string if unknown, like for
+// connections opened through the ssh server, which only carry a zero address.
+func peerAddress(conn net.Conn) string {
+	addr, ok := conn.RemoteAddr().(*net.TCPAddr)
+	if !ok || addr.IP.IsUnspecified() {
+		return ""
+	}
+
+	return addr.String()
+}
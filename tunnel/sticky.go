@@ -0,0 +1,50 @@
+package tunnel
+
+import (
+	"net"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// PreferSources makes the channels of a local tunnel that would listen on a
+// random port listen on the given addresses instead, matched by the order the
+// channels were created in, so clients can keep using the ports picked by a
+// previous run of the tunnel. An address is only taken if it is on the same
+// host as the channel source and the port is still free; otherwise the
+// channel keeps listening on a random port.
+//
+// It must be called before the tunnel is started.
+func (t *Tunnel) PreferSources(addresses []string) {
+	if t.Type != "local" {
+		return
+	}
+
+	for i, ch := range t.channelList() {
+		if i >= len(addresses) {
+			return
+		}
+
+		host, port, err := net.SplitHostPort(ch.Source)
+		if err != nil || port != "0" {
+			continue
+		}
+
+		preferredHost, preferredPort, err := net.SplitHostPort(addresses[i])
+		if err != nil || preferredHost != host || preferredPort == "0" {
+			continue
+		}
+
+		l, err := net.Listen("tcp", addresses[i])
+		if err != nil {
+			log.WithError(err).WithFields(log.Fields{
+				"channel": ch,
+				"address": addresses[i],
+			}).Debug("source address used on the previous run is taken, listening on a random port")
+
+			continue
+		}
+		l.Close()
+
+		ch.Source = addresses[i]
+	}
+}
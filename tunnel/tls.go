@@ -0,0 +1,113 @@
+package tunnel
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"time"
+)
+
+// OriginateTLS makes the channel listening on the given source address speak
+// TLS to its destination, so plaintext clients can reach services only
+// accepting TLS connections. An empty source applies the configuration to all
+// channels.
+//
+// The destination host name is used to verify the destination certificate
+// unless the configuration sets a ServerName.
+func (t *Tunnel) OriginateTLS(source string, config *tls.Config) error {
+	if config == nil {
+		return fmt.Errorf("missing tls configuration")
+	}
+
+	channels := t.channelList()
+
+	if len(channels) == 0 {
+		return fmt.Errorf("can't originate tls on a tunnel with no channels")
+	}
+
+	if source == "" {
+		for _, ch := range channels {
+			ch.RemoteTLS = config
+		}
+
+		return nil
+	}
+
+	ch, err := t.findChannel(source)
+	if err != nil {
+		return err
+	}
+
+	ch.RemoteTLS = config
+
+	return nil
+}
+
+// TerminateTLS makes the channel listening on the given source address
+// accept tls connections, forwarding the decrypted data to its destination,
+// so a plaintext service can be exposed through a secure endpoint. An empty
+// source applies the configuration to all channels.
+//
+// The configuration must carry the certificate presented to clients.
+func (t *Tunnel) TerminateTLS(source string, config *tls.Config) error {
+	if config == nil || (len(config.Certificates) == 0 && config.GetCertificate == nil) {
+		return fmt.Errorf("missing tls certificate")
+	}
+
+	channels := t.channelList()
+
+	if len(channels) == 0 {
+		return fmt.Errorf("can't terminate tls on a tunnel with no channels")
+	}
+
+	if source == "" {
+		for _, ch := range channels {
+			ch.LocalTLS = config
+		}
+
+		return nil
+	}
+
+	ch, err := t.findChannel(source)
+	if err != nil {
+		return err
+	}
+
+	ch.LocalTLS = config
+
+	return nil
+}
+
+// originateTLS wraps a connection to the channel destination in a tls client
+// connection, completing the handshake within the given timeout. Zero means
+// no timeout.
+func originateTLS(channel *SSHChannel, conn net.Conn, timeout time.Duration) (net.Conn, error) {
+	config := channel.RemoteTLS
+
+	if config.ServerName == "" && !config.InsecureSkipVerify {
+		host, _, err := net.SplitHostPort(channel.Destination)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+
+		config = config.Clone()
+		config.ServerName = host
+	}
+
+	tc := tls.Client(conn, config)
+
+	if timeout > 0 {
+		tc.SetDeadline(time.Now().Add(timeout))
+	}
+
+	err := tc.Handshake()
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("tls handshake with destination failed: %v", err)
+	}
+
+	tc.SetDeadline(time.Time{})
+
+	return tc, nil
+}
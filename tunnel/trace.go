@@ -0,0 +1,123 @@
+package tunnel
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// DefaultTraceLimit is the number of bursts recorded for each traced
+	// connection when TraceLimit is not set.
+	DefaultTraceLimit = 100
+
+	// traceBurstGap is the time data must stop flowing on a direction of a
+	// traced connection for the data read next to start a new burst.
+	traceBurstGap = 10 * time.Millisecond
+)
+
+// burst is a period of time data kept flowing through one direction of a
+// forwarded connection, with no pauses longer than traceBurstGap.
+type burst struct {
+	direction string
+	start     time.Time
+	end       time.Time
+	bytes     int64
+}
+
+// connTrace records the bursts of data flowing through each direction of a
+// forwarded connection, up to a limit, so its memory use is bounded no matter
+// how long the connection lasts.
+type connTrace struct {
+	opened  time.Time
+	limit   int
+	mu      sync.Mutex
+	bursts  []burst
+	current map[string]int
+	dropped int
+}
+
+func newConnTrace(limit int) *connTrace {
+	if limit <= 0 {
+		limit = DefaultTraceLimit
+	}
+
+	return &connTrace{
+		opened:  time.Now(),
+		limit:   limit,
+		current: make(map[string]int),
+	}
+}
+
+// record accounts n bytes read from the given direction of the connection,
+// either extending the burst in progress or starting a new one.
+func (ct *connTrace) record(direction string, n int) {
+	if n <= 0 {
+		return
+	}
+
+	now := time.Now()
+
+	ct.mu.Lock()
+	defer ct.mu.Unlock()
+
+	if i, ok := ct.current[direction]; ok && now.Sub(ct.bursts[i].end) <= traceBurstGap {
+		ct.bursts[i].end = now
+		ct.bursts[i].bytes += int64(n)
+
+		return
+	}
+
+	delete(ct.current, direction)
+
+	if len(ct.bursts) >= ct.limit {
+		ct.dropped++
+		return
+	}
+
+	ct.bursts = append(ct.bursts, burst{direction: direction, start: now, end: now, bytes: int64(n)})
+	ct.current[direction] = len(ct.bursts) - 1
+}
+
+// log logs every burst recorded, relative to the time the connection was
+// opened, followed by a summary of the trace.
+func (ct *connTrace) log(channel *SSHChannel, connId string) {
+	ct.mu.Lock()
+	defer ct.mu.Unlock()
+
+	for _, b := range ct.bursts {
+		log.WithFields(log.Fields{
+			"channel":    channel,
+			"connection": connId,
+			"direction":  b.direction,
+			"start":      b.start.Sub(ct.opened),
+			"duration":   b.end.Sub(b.start),
+			"bytes":      b.bytes,
+		}).Info("connection trace burst")
+	}
+
+	log.WithFields(log.Fields{
+		"channel":    channel,
+		"connection": connId,
+		"duration":   time.Since(ct.opened),
+		"bursts":     len(ct.bursts),
+		"dropped":    ct.dropped,
+	}).Info("connection trace")
+}
+
+// tracedConn is a connection recording the data read from it on a trace,
+// under the given direction.
+type tracedConn struct {
+	net.Conn
+	trace     *connTrace
+	direction string
+}
+
+func (c tracedConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.trace.record(c.direction, n)
+
+	return n, err
+}
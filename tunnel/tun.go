@@ -0,0 +1,152 @@
+package tunnel
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	// TunChannelType is the ssh channel type used by OpenSSH to forward ip
+	// packets between tun devices (i.e. "ssh -w").
+	TunChannelType = "tun@openssh.com"
+
+	// TunAnyUnit asks the ssh server to pick any tun device available on its
+	// side of the tunnel.
+	TunAnyUnit = 0x7fffffff
+
+	// tunModePointToPoint forwards layer 3 packets, as opposed to the ethernet
+	// mode which forwards layer 2 frames.
+	tunModePointToPoint = 1
+
+	// address families used to tag each packet forwarded through a tun channel.
+	// OpenSSH always uses the OpenBSD values, regardless of the platform.
+	tunAFInet  = 2
+	tunAFInet6 = 24
+
+	// tunMTU is the largest ip packet read from a tun device.
+	tunMTU = 65535
+)
+
+// TunDevice is a virtual network interface exchanging raw ip packets with the
+// process that opened it. Every Read returns a single packet and every Write
+// must carry a single packet.
+type TunDevice interface {
+	io.ReadWriteCloser
+
+	// Name returns the name of the network interface (e.g. tun0).
+	Name() string
+}
+
+// OpenTun creates, or attaches to, the tun device with the given name. A name
+// with a "%d" (e.g. TunDefaultDevice) lets the operating system number a new
+// device.
+//
+// Configuring the addresses and routes of the device is left to the user, the
+// same way "ssh -w" does.
+func OpenTun(name string) (TunDevice, error) {
+	return openTun(name)
+}
+
+// forwardTun relays the ip packets read from the tun device of the channel to
+// a tun device of the ssh server and vice versa, until either side fails.
+//
+// The ssh server needs to allow tun forwarding (i.e. PermitTunnel
+// point-to-point).
+func (t *Tunnel) forwardTun(channel *SSHChannel, client *ssh.Client) error {
+	if client == nil {
+		return fmt.Errorf("tun channel can't be established: missing connection to the ssh server")
+	}
+
+	payload := ssh.Marshal(struct {
+		Mode uint32
+		Unit uint32
+	}{tunModePointToPoint, TunAnyUnit})
+
+	conn, reqs, err := client.OpenChannel(TunChannelType, payload)
+	if err != nil {
+		return fmt.Errorf("error opening tun channel, make sure the ssh server permits tunnel forwarding: %v", err)
+	}
+	defer conn.Close()
+
+	go ssh.DiscardRequests(reqs)
+
+	log.WithFields(log.Fields{
+		"channel": channel,
+		"server":  t.server,
+	}).Info("tun channel has been established")
+
+	errs := make(chan error, 2)
+
+	go func() {
+		errs <- writeTunPackets(conn, channel.tun)
+	}()
+
+	go func() {
+		errs <- readTunPackets(channel.tun, conn)
+	}()
+
+	return <-errs
+}
+
+// writeTunPackets reads packets from the tun device and writes them to the
+// ssh channel, each one prefixed by its length and address family.
+func writeTunPackets(w io.Writer, dev io.Reader) error {
+	buf := make([]byte, 8+tunMTU)
+
+	for {
+		n, err := dev.Read(buf[8:])
+		if err != nil {
+			return err
+		}
+
+		if n == 0 {
+			continue
+		}
+
+		af := uint32(tunAFInet)
+		if buf[8]>>4 == 6 {
+			af = tunAFInet6
+		}
+
+		binary.BigEndian.PutUint32(buf[0:4], uint32(4+n))
+		binary.BigEndian.PutUint32(buf[4:8], af)
+
+		_, err = w.Write(buf[:8+n])
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// readTunPackets reads packets from the ssh channel and writes them to the tun
+// device, stripping the length and address family headers.
+func readTunPackets(dev io.Writer, r io.Reader) error {
+	header := make([]byte, 4)
+	buf := make([]byte, 4+tunMTU)
+
+	for {
+		_, err := io.ReadFull(r, header)
+		if err != nil {
+			return err
+		}
+
+		size := binary.BigEndian.Uint32(header)
+		if size < 4 || size > uint32(len(buf)) {
+			return fmt.Errorf("invalid tun packet size: %d", size)
+		}
+
+		_, err = io.ReadFull(r, buf[:size])
+		if err != nil {
+			return err
+		}
+
+		_, err = dev.Write(buf[4:size])
+		if err != nil {
+			return err
+		}
+	}
+}
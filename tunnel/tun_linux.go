@@ -0,0 +1,47 @@
+package tunnel
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+type linuxTun struct {
+	*os.File
+	name string
+}
+
+func (d *linuxTun) Name() string {
+	return d.name
+}
+
+func openTun(name string) (TunDevice, error) {
+	f, err := os.OpenFile("/dev/net/tun", os.O_RDWR, 0)
+	if err != nil {
+		return nil, fmt.Errorf("error opening tun device: %v", err)
+	}
+
+	var req struct {
+		Name  [syscall.IFNAMSIZ]byte
+		Flags uint16
+		_     [22]byte
+	}
+
+	if len(name) >= syscall.IFNAMSIZ {
+		f.Close()
+		return nil, fmt.Errorf("tun device name is too long: %s", name)
+	}
+
+	copy(req.Name[:], name)
+	req.Flags = syscall.IFF_TUN | syscall.IFF_NO_PI
+
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, f.Fd(), uintptr(syscall.TUNSETIFF), uintptr(unsafe.Pointer(&req)))
+	if errno != 0 {
+		f.Close()
+		return nil, fmt.Errorf("error creating tun device %s: %v", name, errno)
+	}
+
+	return &linuxTun{File: f, name: strings.TrimRight(string(req.Name[:]), "\x00")}, nil
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+// +build !linux
+
+package tunnel
+
+import (
+	"fmt"
+	"runtime"
+)
+
+func openTun(name string) (TunDevice, error) {
+	return nil, fmt.Errorf("tun tunnels are not supported on %s", runtime.GOOS)
+}
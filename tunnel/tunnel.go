@@ -1,18 +1,22 @@
 package tunnel
 
 import (
+	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net"
 	"os"
 	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
-	"golang.org/x/crypto/ssh/agent"
-
 	log "github.com/sirupsen/logrus"
 	"golang.org/x/crypto/ssh"
 	"golang.org/x/crypto/ssh/knownhosts"
@@ -21,7 +25,98 @@ import (
 const (
 	HostMissing        = "server host has to be provided as part of the server address"
 	RandomPortAddress  = "127.0.0.1:0"
+	LoopbackAddress    = "127.0.0.1"
 	NoDestinationGiven = "cannot create a tunnel without at least one remote address"
+
+	// StdioSource is the source of channels forwarding the standard input and
+	// output of the process.
+	StdioSource = "stdio"
+
+	// TunDefaultDevice is the name of the local tun device used by tun
+	// channels when none is given, letting the operating system pick the
+	// next tun device available.
+	TunDefaultDevice = "tun%d"
+
+	// TunAnyDestination is the destination of tun channels, forwarding packets
+	// to any tun device available on the ssh server.
+	TunAnyDestination = "any"
+
+	// DefaultConnectionWaitTimeout is the default amount of time a connection
+	// accepted while the tunnel is reconnecting waits for the ssh server
+	// connection to be restablished.
+	DefaultConnectionWaitTimeout = 5 * time.Second
+
+	// DefaultDialTimeout is the default maximum amount of time spent opening a
+	// connection to a channel destination.
+	DefaultDialTimeout = 10 * time.Second
+
+	// ChannelPending, ChannelListening and ChannelEstablished are the states
+	// reported by SSHChannel.State.
+	ChannelPending     = "pending"
+	ChannelListening   = "listening"
+	ChannelEstablished = "established"
+
+	// DefaultLogRateLimit is the default window within which repeated
+	// reconnection and keep alive warnings are collapsed into a summary.
+	DefaultLogRateLimit = 1 * time.Minute
+
+	// DefaultMaxChannels is the default maximum number of channels a tunnel
+	// accepts.
+	DefaultMaxChannels = 64
+)
+
+// relistenInterval is how often a remote channel which listener was closed
+// checks if the tunnel listens again on its behalf.
+const relistenInterval = 100 * time.Millisecond
+
+// errConnectionFailed is returned once the tunnel gives up connecting to the
+// ssh server.
+var errConnectionFailed = errors.New("error while connecting to ssh server")
+
+// errStopped is returned once the tunnel gives up connecting to the ssh
+// server because it was stopped.
+var errStopped = errors.New("tunnel stopped")
+
+// ErrMaxReconnects is returned by Start once the tunnel loses its connection
+// to the ssh server more than MaxReconnects times.
+var ErrMaxReconnects = errors.New("maximum number of reconnections to the ssh server reached")
+
+var (
+	// StrictKeyExchanges are the only key exchange algorithms negotiated with
+	// the ssh server in strict mode.
+	StrictKeyExchanges = []string{
+		"curve25519-sha256@libssh.org",
+		"ecdh-sha2-nistp256",
+		"ecdh-sha2-nistp384",
+		"ecdh-sha2-nistp521",
+	}
+
+	// StrictCiphers are the only ciphers negotiated with the ssh server in
+	// strict mode.
+	StrictCiphers = []string{
+		"chacha20-poly1305@openssh.com",
+		"aes128-gcm@openssh.com",
+		"aes256-ctr",
+		"aes192-ctr",
+		"aes128-ctr",
+	}
+
+	// StrictMACs are the only message authentication code algorithms
+	// negotiated with the ssh server in strict mode.
+	StrictMACs = []string{
+		"hmac-sha2-256-etm@openssh.com",
+		"hmac-sha2-256",
+	}
+
+	// RSASignatureAlgorithms are the signature algorithms offered by default
+	// to the ssh server when authenticating with an RSA key, in order of
+	// preference. The first one the ssh server supports is used, falling back
+	// to ssh-rsa (SHA-1) when the server doesn't tell which ones it supports.
+	RSASignatureAlgorithms = []string{
+		ssh.KeyAlgoRSASHA256,
+		ssh.KeyAlgoRSASHA512,
+		ssh.KeyAlgoRSA,
+	}
 )
 
 // Server holds the SSH Server attributes used for the client to connect to it.
@@ -35,12 +130,158 @@ type Server struct {
 	Timeout  time.Duration
 	// SSHAgent is the path to the unix socket where an ssh agent is listening
 	SSHAgent string
+	// IdentitiesOnly restricts the authentication to the key explicitly given,
+	// ignoring the keys held by the ssh agent, like the OpenSSH option of the
+	// same name. It prevents servers from dropping the connection after too
+	// many keys are offered (see MaxAuthTries).
+	IdentitiesOnly bool
+	// Password, if set, is offered to the ssh server through password
+	// authentication once the keys are refused.
+	Password string
+	// Prompt, if set, asks the user for the password of the server, when not
+	// given, and answers the keyboard-interactive challenges of the server
+	// (e.g. one-time codes) once the keys are refused.
+	Prompt ssh.KeyboardInteractiveChallenge
+	// Strict refuses to connect without verifying the server host key and
+	// only negotiates the algorithms listed by StrictKeyExchanges,
+	// StrictCiphers and StrictMACs.
+	Strict bool
+	// Resolver is used to lookup the server host name. If nil, the default
+	// resolver is used.
+	Resolver *net.Resolver
+	// DNSTimeout is the maximum amount of time spent resolving the server host
+	// name, apart from the connection Timeout. Zero means no timeout.
+	DNSTimeout time.Duration
+	// HostAliases maps host names to IP addresses, like /etc/hosts does. The
+	// server host name is looked up on it before being resolved through DNS.
+	HostAliases map[string]string
+	// Dialer is used to open the tcp connection to the ssh server (e.g. through
+	// a proxy). If nil, the connection is opened directly.
+	Dialer Dialer
+	// Interface, if set, is the name of the local network interface (e.g. a
+	// vpn interface) the connection to the ssh server is opened from. Its
+	// address is looked up every time the server is dialed, so an address
+	// change (e.g. a new dhcp lease) is picked up on reconnection. It is
+	// ignored when the connection is opened through Dialer.
+	Interface string
+	// Jump lists the jump hosts (i.e. bastions) the server is reached
+	// through, like the ProxyJump option of OpenSSH: the first one is dialed
+	// directly and every other one, along with the server itself, through the
+	// previous one. The whole chain is dialed again on every connection to
+	// the server.
+	Jump []*Server
+
+	// agent is the connection to the ssh agent at SSHAgent, shared by every
+	// connection to the server.
+	agent *agentClient
+	// HostKeyCallback, if set, verifies the server host key instead of the
+	// known_hosts files. It is ignored in insecure mode.
+	HostKeyCallback ssh.HostKeyCallback
+	// KnownHostsFiles lists the known_hosts files the server host key is
+	// looked up on. If empty, the known_hosts file of the user and the system
+	// wide one are used, like OpenSSH does.
+	KnownHostsFiles []string
+	// RSASignatureAlgorithms, if set, restricts the signature algorithms
+	// offered when authenticating with RSA keys to the given subset of
+	// RSASignatureAlgorithms (e.g. only rsa-sha2-512), keeping their order of
+	// preference. Servers refusing ssh-rsa (SHA-1) signatures are supported
+	// by default.
+	RSASignatureAlgorithms []string
+}
+
+// Dialer opens network connections, as *net.Dialer does.
+type Dialer interface {
+	DialContext(ctx context.Context, network, address string) (net.Conn, error)
+}
+
+// ServerOption changes how NewServer resolves the attributes of a server.
+type ServerOption func(*serverOptions)
+
+type serverOptions struct {
+	noDefaultKey  bool
+	noCredentials bool
+	noJump        bool
+	port          string
+	user          string
+	key           *PemKey
+	prompt        ssh.KeyboardInteractiveChallenge
+}
+
+// WithoutDefaultKey keeps NewServer from falling back to $HOME/.ssh/id_rsa
+// when no key is given nor found on the ssh config file, failing right away
+// instead, unless an ssh agent is available to authenticate with.
+func WithoutDefaultKey() ServerOption {
+	return func(o *serverOptions) {
+		o.noDefaultKey = true
+	}
+}
+
+// WithoutCredentials keeps NewServer from requiring a user and a key for
+// servers that are never authenticated against, like the ones only reached to
+// retrieve their host key (see HostKey).
+func WithoutCredentials() ServerOption {
+	return func(o *serverOptions) {
+		o.noCredentials = true
+	}
+}
+
+// WithKey makes NewServer authenticate with the given key, like one that was
+// never written to a file (see NewPemKeyFromBytes), instead of reading one
+// from the key file given or found on the ssh config file.
+func WithKey(key *PemKey) ServerOption {
+	return func(o *serverOptions) {
+		o.key = key
+	}
+}
+
+// WithPrompt makes NewServer set the given function to prompt the user for
+// the password and the keyboard-interactive challenges of the server (see
+// Server.Prompt). A key isn't required then, the default key being skipped if
+// it doesn't exist.
+func WithPrompt(prompt ssh.KeyboardInteractiveChallenge) ServerOption {
+	return func(o *serverOptions) {
+		o.prompt = prompt
+	}
+}
+
+// WithPort sets the port of the server when it isn't given as part of its
+// address, taking precedence over the port found on the ssh config file.
+func WithPort(port string) ServerOption {
+	return func(o *serverOptions) {
+		o.port = port
+	}
+}
+
+// withoutJump keeps NewServer from resolving the jump hosts found on the ssh
+// config file (ProxyJump), which is the case of the jump hosts themselves.
+func withoutJump() ServerOption {
+	return func(o *serverOptions) {
+		o.noJump = true
+	}
+}
+
+// withDefaultUser sets the user of the server when it is neither given nor
+// found on the ssh config file.
+func withDefaultUser(user string) ServerOption {
+	return func(o *serverOptions) {
+		o.user = user
+	}
 }
 
 // NewServer creates a new instance of Server using $HOME/.ssh/config to
-// resolve the missing connection attributes (e.g. user, hostname, port, key
-// and ssh agent) required to connect to the remote server, if any.
-func NewServer(user, address, key, sshAgent, cfgPath string) (*Server, error) {
+// resolve the missing connection attributes (e.g. user, hostname, port, key,
+// ssh agent and jump hosts) required to connect to the remote server, if any.
+//
+// If no key is given nor found on the ssh config file, $HOME/.ssh/id_rsa is
+// used, unless WithoutDefaultKey is given. Likewise, if no ssh agent is given
+// nor found on the ssh config file (IdentityAgent), the one $SSH_AUTH_SOCK
+// points to is used, unless WithoutDefaultKey is given.
+func NewServer(user, address, key, sshAgent, cfgPath string, options ...ServerOption) (*Server, error) {
+	var opts serverOptions
+	for _, o := range options {
+		o(&opts)
+	}
+
 	var host string
 	var hostname string
 	var port string
@@ -69,11 +310,22 @@ func NewServer(user, address, key, sshAgent, cfgPath string) (*Server, error) {
 
 	h := c.Get(host)
 	hostname = reconcile(h.Hostname, host)
+	port = reconcile(port, opts.port)
 	port = reconcile(port, h.Port)
 	user = reconcile(user, h.User)
+	user = reconcile(user, opts.user)
 	key = reconcile(key, h.Key)
 	sshAgent = reconcile(sshAgent, h.IdentityAgent)
 
+	// like OpenSSH, the agent the environment points to is used unless
+	// another one is given, or none at all. Servers opting out of the default
+	// key only use the agent given explicitly.
+	if sshAgent == "" && !opts.noDefaultKey {
+		sshAgent = os.Getenv("SSH_AUTH_SOCK")
+	} else if strings.EqualFold(sshAgent, "none") {
+		sshAgent = ""
+	}
+
 	if host == "" {
 		return nil, fmt.Errorf(HostMissing)
 	}
@@ -86,60 +338,296 @@ func NewServer(user, address, key, sshAgent, cfgPath string) (*Server, error) {
 		port = "22"
 	}
 
-	if user == "" {
+	if user == "" && !opts.noCredentials {
 		return nil, fmt.Errorf("no user could be found for server %s", host)
 	}
 
-	if key == "" {
-		home, err := os.UserHomeDir()
+	if strings.HasPrefix(sshAgent, "$") {
+		sshAgent = os.Getenv(sshAgent[1:])
+	}
+
+	var pk *PemKey
+
+	switch {
+	case opts.noCredentials:
+		// the server is never authenticated against, so its key isn't read.
+	case opts.key != nil:
+		pk = opts.key
+	case key == "" && opts.noDefaultKey:
+		if sshAgent == "" && opts.prompt == nil {
+			return nil, fmt.Errorf("no key given for server %s nor found on the ssh config file (IdentityFile), and the default key fallback is disabled", host)
+		}
+	default:
+		if key == "" {
+			home, err := os.UserHomeDir()
+			if err != nil {
+				return nil, fmt.Errorf("could not obtain user home directory: %v", err)
+			}
+
+			key = filepath.Join(home, ".ssh", "id_rsa")
+
+			// servers authenticated against interactively don't need one.
+			if _, err := os.Stat(key); opts.prompt != nil && os.IsNotExist(err) {
+				key = ""
+				break
+			}
+		}
+
+		pk, err = NewPemKey(key, "")
 		if err != nil {
-			return nil, fmt.Errorf("could not obtain user home directory: %v", err)
+			return nil, fmt.Errorf("error while reading key %s: %v", key, err)
+		}
+	}
+
+	if log.IsLevelEnabled(log.DebugLevel) {
+		for _, m := range c.MatchedHosts(host) {
+			log.WithFields(log.Fields{
+				"host": host,
+			}).Debugf("ssh config host block matched: %s", m)
 		}
 
-		key = filepath.Join(home, ".ssh", "id_rsa")
+		log.WithFields(log.Fields{
+			"host":            host,
+			"hostname":        hostname,
+			"port":            port,
+			"user":            user,
+			"key":             key,
+			"identity-agent":  sshAgent,
+			"identities-only": h.IdentitiesOnly,
+			"proxy-jump":      h.ProxyJump,
+		}).Debug("server settings resolved from ssh config and command line options")
 	}
 
-	pk, err := NewPemKey(key, "")
-	if err != nil {
-		return nil, fmt.Errorf("error while reading key %s: %v", key, err)
+	var jump []*Server
+
+	// servers never authenticated against are dialed directly, since the jump
+	// hosts would need credentials of their own.
+	if h.ProxyJump != "" && !strings.EqualFold(h.ProxyJump, "none") && !opts.noJump && !opts.noCredentials {
+		var jumpOpts []ServerOption
+		if opts.noDefaultKey {
+			jumpOpts = append(jumpOpts, WithoutDefaultKey())
+		}
+
+		if opts.prompt != nil {
+			jumpOpts = append(jumpOpts, WithPrompt(opts.prompt))
+		}
+
+		jump, err = JumpServers(h.ProxyJump, user, sshAgent, cfgPath, jumpOpts...)
+		if err != nil {
+			return nil, fmt.Errorf("error resolving jump hosts of server %s: %v", host, err)
+		}
 	}
 
-	if strings.HasPrefix(sshAgent, "$") {
-		sshAgent = os.Getenv(sshAgent[1:])
+	var ac *agentClient
+	if sshAgent != "" {
+		ac = &agentClient{path: sshAgent}
 	}
 
 	return &Server{
-		Name:     host,
-		Address:  fmt.Sprintf("%s:%s", hostname, port),
-		User:     user,
-		Key:      pk,
-		SSHAgent: sshAgent,
+		Name:           host,
+		Address:        fmt.Sprintf("%s:%s", hostname, port),
+		User:           user,
+		Key:            pk,
+		SSHAgent:       sshAgent,
+		IdentitiesOnly: strings.EqualFold(h.IdentitiesOnly, "yes"),
+		Jump:           jump,
+		Prompt:         opts.prompt,
+		agent:          ac,
 	}, nil
 }
 
+// JumpServers creates the servers of the given comma separated list of jump
+// hosts, each one given as [<user>@]<host>[:<port>] like the ProxyJump option
+// of OpenSSH does. Their attributes are resolved through the ssh config file,
+// just like any other server, apart from their own jump hosts, which are not
+// followed. Jump hosts with no user, either given or found on the ssh config
+// file, authenticate as the given user.
+//
+// The given options (e.g. WithoutDefaultKey or WithPrompt) apply to every jump
+// host.
+func JumpServers(jumps, user, sshAgent, cfgPath string, options ...ServerOption) ([]*Server, error) {
+	opts := append([]ServerOption{withoutJump(), withDefaultUser(user)}, options...)
+
+	var servers []*Server
+
+	for _, jump := range strings.Split(jumps, ",") {
+		jump = strings.TrimSpace(jump)
+
+		var jumpUser string
+		if i := strings.LastIndex(jump, "@"); i >= 0 {
+			jumpUser, jump = jump[:i], jump[i+1:]
+		}
+
+		if jump == "" {
+			return nil, fmt.Errorf("invalid jump host list: %s", jumps)
+		}
+
+		s, err := NewServer(jumpUser, jump, "", sshAgent, cfgPath, opts...)
+		if err != nil {
+			return nil, err
+		}
+
+		servers = append(servers, s)
+	}
+
+	return servers, nil
+}
+
+// resolve translates the host portion of the server address to the list of ip
+// addresses the server can be reached on.
+func (s Server) resolve() ([]string, error) {
+	host, port, err := net.SplitHostPort(s.Address)
+	if err != nil {
+		return nil, err
+	}
+
+	if net.ParseIP(host) != nil {
+		return []string{s.Address}, nil
+	}
+
+	if ip, ok := lookupHostAlias(s.HostAliases, host); ok {
+		return []string{net.JoinHostPort(ip, port)}, nil
+	}
+
+	resolver := s.Resolver
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+
+	ctx := context.Background()
+	if s.DNSTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.DNSTimeout)
+		defer cancel()
+	}
+
+	ips, err := resolver.LookupHost(ctx, host)
+	if err != nil {
+		return nil, fmt.Errorf("could not resolve ssh server host name %s: %v", host, err)
+	}
+
+	addrs := make([]string, len(ips))
+	for i, ip := range ips {
+		addrs[i] = net.JoinHostPort(ip, port)
+	}
+
+	return addrs, nil
+}
+
+// lookupHostAlias returns the IP address given to host on the aliases map.
+// Host names are case insensitive.
+func lookupHostAlias(aliases map[string]string, host string) (string, bool) {
+	for name, ip := range aliases {
+		if strings.EqualFold(name, host) {
+			return ip, true
+		}
+	}
+
+	return "", false
+}
+
 // String provided a string representation of a Server.
 func (s Server) String() string {
 	return fmt.Sprintf("[name=%s, address=%s, user=%s]", s.Name, s.Address, s.User)
 }
 
 type SSHChannel struct {
+	// dials is kept as the first field so its counters are 64-bit aligned, as
+	// required by sync/atomic on 32-bit platforms.
+	dials dialCounters
+
 	ChannelType string
 	Source      string
 	Destination string
-	listener    net.Listener
-	conn        net.Conn
+	// Quiet disables the logging of each connection handled by the channel.
+	// Errors are still logged.
+	Quiet bool
+	// HTTPError makes the channel answer its clients with a 503 Service
+	// Unavailable response, instead of just closing their connection, when
+	// the destination can't be reached. Only meant for channels forwarding
+	// http traffic.
+	HTTPError bool
+	// AllowedNetworks restricts the clients allowed to connect to the channel
+	// to the ones with an address belonging to any of the networks listed. All
+	// clients are allowed if empty.
+	AllowedNetworks []*net.IPNet
+	// RemoteTLS, if set, wraps the connections to the destination in tls (see
+	// OriginateTLS).
+	RemoteTLS *tls.Config
+	// LocalTLS, if set, terminates tls on the connections accepted by the
+	// channel (see TerminateTLS).
+	LocalTLS *tls.Config
+	// DialSource, if set, is the local address the destination of a remote
+	// tunnel channel is dialed from (see BindDialSource).
+	DialSource string
+	// Via, if set, is an additional ssh server, reached through the tunnel ssh
+	// server, the destination is dialed from (see ViaChannel).
+	Via *Server
+	// Protocol, if set, is a hint of the protocol carried by the channel (e.g.
+	// http, postgres or redis), attached to its logs and stats (see
+	// SetProtocol).
+	Protocol string
+	// listenerMu guards listener, which is replaced on every connection to the
+	// ssh server for remote channels.
+	listenerMu sync.Mutex
+	listener   net.Listener
+	conn       net.Conn
+	// pool keeps connections to the destination opened ahead of time, so they
+	// can be handed to clients right away.
+	pool chan prewarmedConn
+	// closed is set once the channel is removed from a running tunnel.
+	closed uint32
+	// tun is the device forwarded by tun channels.
+	tun TunDevice
 }
 
-// Listen creates tcp listeners for each channel defined.
+// prewarmedConn is a connection to a channel destination opened ahead of time
+// through a specific connection to the ssh server.
+type prewarmedConn struct {
+	conn   net.Conn
+	client *ssh.Client
+}
+
+// Listen creates the listener of the channel: a tcp listener or, if the source
+// is a unix socket path, a unix socket listener.
 func (ch *SSHChannel) Listen(serverClient *ssh.Client) error {
 	var l net.Listener
 	var err error
 
+	// stdio channels forward the process standard input and output, so there is
+	// nothing to listen on.
+	if ch.ChannelType == "stdio" {
+		return nil
+	}
+
+	// tun channels forward the packets of a local tun device, which is kept
+	// open across reconnections just like listeners.
+	if ch.ChannelType == "tun" {
+		if ch.tun == nil {
+			dev, err := OpenTun(ch.Source)
+			if err != nil {
+				return err
+			}
+
+			ch.tun = dev
+			ch.Source = dev.Name()
+		}
+
+		return nil
+	}
+
+	ch.listenerMu.Lock()
+	defer ch.listenerMu.Unlock()
+
 	if ch.listener == nil {
-		if ch.ChannelType == "local" {
-			l, err = net.Listen("tcp", ch.Source)
+		network := addressNetwork(ch.Source)
+
+		if ch.ChannelType == "local" || ch.ChannelType == "dynamic" {
+			l, err = net.Listen(network, ch.Source)
+		} else if ch.ChannelType == "remote" && network == "unix" {
+			l, err = serverClient.ListenUnix(ch.Source)
 		} else if ch.ChannelType == "remote" {
-			l, err = serverClient.Listen("tcp", ch.Source)
+			l, err = serverClient.Listen(network, ch.Source)
 		} else {
 			return fmt.Errorf("channel can't listen on endpoint: unknown channel type %s", ch.ChannelType)
 		}
@@ -151,8 +639,12 @@ func (ch *SSHChannel) Listen(serverClient *ssh.Client) error {
 		ch.listener = l
 
 		// update the endpoint value with assigned port for the cases where the user
-		// haven't explicitily specified one
-		ch.Source = l.Addr().String()
+		// haven't explicitily specified one. Remote channels listen again on the
+		// same address after reconnecting, which is left untouched since the
+		// channel may be read concurrently (see Channels).
+		if addr := l.Addr().String(); addr != ch.Source {
+			ch.Source = addr
+		}
 	}
 
 	return nil
@@ -162,45 +654,387 @@ func (ch *SSHChannel) Listen(serverClient *ssh.Client) error {
 func (ch *SSHChannel) Accept() error {
 	var err error
 
-	if ch.conn, err = ch.listener.Accept(); err != nil {
+	if ch.conn, err = ch.currentListener().Accept(); err != nil {
 		return fmt.Errorf("error while establishing connection: %v", err)
 	}
 
 	return nil
 }
 
+// allowed tells if a client with the given address is allowed to connect to
+// the channel.
+func (ch *SSHChannel) allowed(addr net.Addr) bool {
+	if len(ch.AllowedNetworks) == 0 {
+		return true
+	}
+
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return false
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+
+	for _, n := range ch.AllowedNetworks {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
 // String returns a string representation of a SSHChannel
-func (ch SSHChannel) String() string {
+func (ch *SSHChannel) String() string {
+	if ch.Protocol != "" {
+		return fmt.Sprintf("[source=%s, destination=%s, protocol=%s]", ch.Source, ch.Destination, ch.Protocol)
+	}
+
 	return fmt.Sprintf("[source=%s, destination=%s]", ch.Source, ch.Destination)
 }
 
+// State tells if the channel is ready to forward data: ChannelListening once
+// the local listener of a local or dynamic channel is open, ChannelEstablished
+// once the forwarding is set up on the ssh server side for the other channel
+// types, and ChannelPending otherwise.
+func (ch *SSHChannel) State() string {
+	switch ch.ChannelType {
+	case "local", "dynamic":
+		if ch.currentListener() != nil {
+			return ChannelListening
+		}
+	case "remote":
+		if ch.currentListener() != nil {
+			return ChannelEstablished
+		}
+	case "tun":
+		if ch.tun != nil {
+			return ChannelEstablished
+		}
+	case "stdio":
+		return ChannelEstablished
+	}
+
+	return ChannelPending
+}
+
+// currentListener returns the listener the channel accepts connections on, if
+// any.
+func (ch *SSHChannel) currentListener() net.Listener {
+	ch.listenerMu.Lock()
+	defer ch.listenerMu.Unlock()
+
+	return ch.listener
+}
+
+// setListener makes the channel accept connections on the given listener.
+func (ch *SSHChannel) setListener(l net.Listener) {
+	ch.listenerMu.Lock()
+	defer ch.listenerMu.Unlock()
+
+	ch.listener = l
+}
+
+// dropListener closes the listener of the channel, so a new one is created by
+// the next call to Listen.
+func (ch *SSHChannel) dropListener() {
+	ch.listenerMu.Lock()
+	defer ch.listenerMu.Unlock()
+
+	if ch.listener != nil {
+		ch.listener.Close()
+		ch.listener = nil
+	}
+}
+
 // Tunnel represents the ssh tunnel and the channels connecting local and
 // remote endpoints.
 type Tunnel struct {
-	// Type tells what kind of port forwarding this tunnel will handle: local or remote
+	// Type tells what kind of port forwarding this tunnel will handle: local,
+	// remote, stdio or tun (experimental)
 	Type string
 
-	// Ready tells when the Tunnel is ready to accept connections
+	// Stdin and Stdout are the streams forwarded to the destination of a stdio
+	// tunnel. They default to the process standard input and output.
+	Stdin  io.Reader
+	Stdout io.Writer
+
+	// Ready tells when the Tunnel is ready to accept connections. A value is
+	// sent every time the tunnel (re)connects to the ssh server, so a single
+	// reader is expected to keep receiving from it. Use Started to wait for the
+	// tunnel to be ready from multiple goroutines.
 	Ready chan bool
 
 	// KeepAliveInterval is the time period used to send keep alive packets to
 	// the remote ssh server
 	KeepAliveInterval time.Duration
 
+	// KeepAliveInitialDelay is the time waited after connecting to the ssh
+	// server before sending the first keep alive packet, giving slow servers
+	// room to settle down after the handshake. It defaults to
+	// KeepAliveInterval.
+	//
+	// The delay starts over on every reconnection, so a connection that
+	// fails before it is over is only noticed through its read errors, not
+	// through failed keep alive packets.
+	KeepAliveInitialDelay time.Duration
+
+	// KeepAliveData also sends keep alive packets as channel data, through a
+	// session running "cat" on the ssh server, which echoes them back. It is a
+	// workaround for load balancers and other middleboxes that drop idle
+	// connections and don't take keep alive requests into account.
+	KeepAliveData bool
+
+	// KeepAliveIdleOnly skips the keep alive packets while forwarded
+	// connections are receiving data from the ssh server, which already
+	// proves the connection is alive, so busy tunnels don't send them for
+	// nothing. A keep alive packet is only sent once no data was received
+	// for a whole KeepAliveInterval.
+	KeepAliveIdleOnly bool
+
+	// KeepAliveReplied, if set, is called every time the ssh server answers a
+	// keep alive request, telling the connection is still healthy.
+	KeepAliveReplied func()
+
+	// Disconnected, if set, is called every time the connection to the ssh
+	// server is lost, with the error that made it fail, right before the
+	// tunnel tries to reconnect.
+	Disconnected func(err error)
+
+	// Reconnected, if set, is called every time the channels are ready to
+	// accept connections again after the tunnel reconnects to the ssh server.
+	// Unlike Ready, it isn't called once the tunnel is ready for the first
+	// time.
+	Reconnected func()
+
+	// Notify, if set, is called with every Event happening to the tunnel, like
+	// losing the connection to the ssh server or forwarding a connection. It
+	// is called synchronously, from the goroutine handling the event, so it
+	// must return quickly.
+	Notify func(Event)
+
+	// FallbackServers are the ssh servers tried, in order, every time the
+	// tunnel fails to connect to its ssh server, like a secondary bastion.
+	// Each attempt to connect goes through the servers until one of them can
+	// be reached, starting from the last one the tunnel connected to. The host
+	// key of each server is verified on its own.
+	FallbackServers []*Server
+
 	// ConnectionRetries is the number os attempts to reconnect to the ssh server
 	// when the current connection fails
 	ConnectionRetries int
 
+	// ShouldRetry, if set, is called after each failed attempt to connect to
+	// the ssh server, with the number of failed attempts so far and the error
+	// of the last one. Returning false gives up connecting, as if the
+	// ConnectionRetries limit was reached.
+	ShouldRetry func(attempt int, lastErr error) bool
+
+	// MaxReconnects is the maximum number of times the tunnel reconnects to
+	// the ssh server after losing its connection, over the whole tunnel
+	// lifetime. Unlike ConnectionRetries, which limits the attempts made to
+	// recover from a single outage, it tells a path that can't stay up apart
+	// from a single bad outage. Once exceeded, Start returns ErrMaxReconnects.
+	// Zero means no limit.
+	MaxReconnects int
+
+	// ConnectionWaitTimeout is the maximum amount of time a connection accepted
+	// by a channel while the tunnel is reconnecting to the ssh server is held
+	// waiting for the connection to be restablished, before giving up on it.
+	ConnectionWaitTimeout time.Duration
+
+	// MigrationTimeout is the maximum amount of time a connection forwarded by
+	// a local tunnel is held open after the connection to the ssh server is
+	// lost, waiting for the tunnel to reconnect so its destination can be
+	// dialed again through the new connection. Zero disables the migration of
+	// connections, closing them as soon as the ssh connection is lost.
+	MigrationTimeout time.Duration
+
+	// InitialReadTimeout, if set, is the maximum amount of time a client
+	// connected to a local tunnel channel has to send its first data, after
+	// which its connection is dropped before its destination is dialed, so
+	// clients that connect but never send anything (e.g. a slow-loris attack
+	// on a shared forward) don't hold ssh channels open. It must not be used
+	// with protocols where the server talks first (e.g. ssh, smtp or mysql).
+	InitialReadTimeout time.Duration
+
+	// DialTimeout is the maximum amount of time spent opening a connection to
+	// the destination of a channel, after which the client connection is
+	// closed. Zero means no timeout.
+	DialTimeout time.Duration
+
+	// MaxPendingChannelOpens limits the number of connections to channel
+	// destinations being opened through the ssh server at the same time,
+	// queuing the others, so a burst of clients doesn't trip the limits some
+	// ssh servers put on the rate of channel opens. Unlike a limit on open
+	// connections, connections already established don't count. Zero means
+	// no limit.
+	MaxPendingChannelOpens int
+
+	// MaxChannels is the maximum number of channels the tunnel accepts, as a
+	// safety valve against malformed forward definitions (e.g. pasted by
+	// mistake or generated by automation) exhausting the local resources.
+	// Starting a tunnel with more channels, or adding channels beyond the
+	// limit, fails. Defaults to DefaultMaxChannels; a negative value means no
+	// limit.
+	MaxChannels int
+
+	// CopyBufferSize is the size, in bytes, of the buffer used to copy data
+	// between the two ends of each forwarded connection. A zero value lets the
+	// connections pick the most efficient way to copy the data themselves.
+	//
+	// Larger buffers mean fewer, bigger writes to the ssh channel, which may
+	// improve throughput of bulk transfers at the cost of more memory per
+	// connection (two buffers are allocated for each connection). Note the
+	// ssh channel window size (2MB) and maximum packet size (32KB) are fixed by
+	// golang.org/x/crypto/ssh and can't be tuned.
+	CopyBufferSize int
+
+	// HalfClose makes a forwarded connection closed by one of its ends, the
+	// client or the destination, only close the sending side of the other end,
+	// which can still send data back until it closes the connection too (e.g.
+	// protocols relying on a shutdown of the socket to signal the end of a
+	// request). By default, both ends are closed as soon as one of them is.
+	// Connections migrated across reconnections (see MigrationTimeout) are
+	// always closed as a whole.
+	HalfClose bool
+
+	// Trace records when data starts and stops flowing through each direction
+	// of every forwarded connection, logging the bursts of data, sent by the
+	// client or received from the destination, once the connection is closed
+	// (e.g. to spot a destination stalling). Up to TraceLimit bursts are kept
+	// for each connection, DefaultTraceLimit if zero, the later ones being
+	// only counted.
+	Trace      bool
+	TraceLimit int
+
+	// NetworkCheckInterval is the time interval used to look for changes on the
+	// addresses of the local network interfaces (e.g. switching wifi networks).
+	// A change forces the tunnel to reconnect to the ssh server right away,
+	// instead of waiting for the stale connection to time out. Zero disables
+	// the check.
+	NetworkCheckInterval time.Duration
+
+	// ManifestCommand is a command run on the ssh server once the tunnel is
+	// started. Each line of its output is a forward definition,
+	// "[<source>] <destination>", added to the tunnel as a new channel. Empty
+	// lines and lines starting with # are ignored.
+	ManifestCommand string
+
+	// HostAliases maps host names to IP addresses, like /etc/hosts does. The
+	// host names of the destination addresses are replaced by the
+	// corresponding IP address before being dialed.
+	HostAliases map[string]string
+
+	// StableConnectionPeriod is the time a connection to the ssh server needs to
+	// stay up before the failed connection attempts counted against
+	// ConnectionRetries are reset to zero. A zero value resets the counter as
+	// soon as a connection is established.
+	StableConnectionPeriod time.Duration
+
 	// WaitAndRetry is the time waited before trying to reconnect to the ssh
 	// server
 	WaitAndRetry time.Duration
 
-	server        *Server
-	channels      []*SSHChannel
-	done          chan error
-	client        *ssh.Client
-	stopKeepAlive chan bool
+	// SuperviseInterval, if set, keeps the tunnel from giving up once it can't
+	// connect to the ssh server within ConnectionRetries attempts: a fresh
+	// cycle of attempts is started after waiting the given interval, until the
+	// tunnel is stopped.
+	SuperviseInterval time.Duration
+
+	// LogRateLimit is the window within which identical reconnection and keep
+	// alive warnings are logged only once. The number of repeated warnings is
+	// logged on the next occurrence after the window or once the connection to
+	// the ssh server is established again. Zero logs every warning.
+	LogRateLimit time.Duration
+
+	// WaitForRemote, if set, holds the tunnel from signalling it is ready for
+	// the first time until the destination of every channel can be reached, so
+	// Ready can be used as a readiness gate for services still starting up. The
+	// tunnel fails if any destination is still unreachable after the given
+	// timeout.
+	WaitForRemote time.Duration
+
+	// EgressPolicy, if set, restricts the destinations the channels may dial.
+	// The tunnel refuses to start with a channel whose destination is not
+	// allowed, channels added later are refused the same way and connections
+	// to a destination that is not allowed are never dialed.
+	EgressPolicy *EgressPolicy
+
+	server *Server
+	// lastServer is the index, on the list of servers returned by servers, of
+	// the last ssh server the tunnel connected to.
+	lastServer int
+	channels   []*SSHChannel
+	// channelsMu guards the list of channels, which can change while the tunnel
+	// is running.
+	channelsMu sync.Mutex
+	done       chan error
+	client     *ssh.Client
+	clientMu   sync.RWMutex
+	// latency holds the time spent on each phase of the latest connection
+	// attempt to the ssh server.
+	latency DialLatency
+	// logs collapses the warnings repeated while the tunnel can't keep a
+	// connection to the ssh server.
+	logs logLimiter
+	// connected is closed when a connection to the ssh server is available.
+	connected chan struct{}
+	// keepAliveStop is closed to stop the keep alive loop of the current
+	// connection to the ssh server, which closes keepAliveDone once it returns.
+	keepAliveStop chan struct{}
+	keepAliveDone chan struct{}
 	reconnect     chan error
+	retries       int
+	// restart wakes up a tunnel waiting to retry a failed connection attempt
+	// once a restart is requested (see Restart).
+	restart chan struct{}
+	// restarting is set while the connection to the ssh server is closed on
+	// behalf of Restart, telling the reconnection apart from a failure.
+	restarting int32
+	// stopping is closed once the tunnel is stopped, so it doesn't wait to
+	// retry a failed connection attempt.
+	stopping chan struct{}
+	stopOnce sync.Once
+	// reconnects is the number of times the connection to the ssh server was
+	// lost so far.
+	reconnects  int
+	connectedAt time.Time
+	// connectedSince is connectedAt in unix nanoseconds, read by Uptime from
+	// other goroutines.
+	connectedSince int64
+	// generation is the number of connections established to the ssh server
+	// so far (see Generation).
+	generation uint64
+	// lastReceived is the time, in unix nanoseconds, forwarded data was last
+	// received from the ssh server (see KeepAliveIdleOnly).
+	lastReceived int64
+	// accepting tells if the channels are already accepting connections.
+	accepting bool
+	// started is closed once the channels are accepting connections.
+	started chan struct{}
+	// lastConnId is the identifier given to the latest connection accepted by
+	// any of the tunnel channels.
+	lastConnId uint32
+	// sshChannels is the number of ssh channels currently opened by forwarded
+	// connections (see OpenSSHChannels).
+	sshChannels int64
+	// pendingOpens holds a slot for each connection to a channel destination
+	// being opened (see MaxPendingChannelOpens).
+	pendingOpens     chan struct{}
+	pendingOpensOnce sync.Once
+	// destinationCommand is the command run on the ssh server to discover the
+	// destination addresses of the channels, along with the source addresses
+	// to be used by them.
+	destinationCommand string
+	discoverySource    []string
+	// hops holds the connections to the additional ssh servers channels go
+	// via (see ViaChannel).
+	hopsMu sync.Mutex
+	hops   map[*Server]*hop
 }
 
 // New creates a new instance of Tunnel.
@@ -214,37 +1048,170 @@ func New(tunnelType string, server *Server, source, destination []string, config
 	}
 
 	for _, channel := range channels {
-		if channel.Source == "" || channel.Destination == "" {
+		// the destination of dynamic channels is given by each client.
+		if channel.Source == "" || (channel.Destination == "" && channel.ChannelType != "dynamic") {
 			return nil, fmt.Errorf("invalid ssh channel: source=%s, destination=%s", channel.Source, channel.Destination)
 		}
 	}
 
+	return newTunnel(tunnelType, server, channels), nil
+}
+
+// NewDiscovered creates a local port forwarding Tunnel which destination
+// addresses are only known by the ssh server.
+//
+// The given command is run on the ssh server once the tunnel connects to it
+// for the first time and each line of its output is taken as a destination
+// address (e.g. a command querying a service registry). A channel is created
+// for each destination, listening on the source address given in the same
+// position or, if not given, on a random port of the loopback interface.
+func NewDiscovered(server *Server, source []string, command string) (*Tunnel, error) {
+	if command == "" {
+		return nil, fmt.Errorf("destination command can't be empty")
+	}
+
+	t := newTunnel("local", server, nil)
+	t.destinationCommand = command
+	t.discoverySource = source
+
+	return t, nil
+}
+
+// NewManifest creates a Tunnel, of the given type, which channels are all
+// defined by the output of a command run on the ssh server. See
+// ManifestCommand.
+func NewManifest(tunnelType string, server *Server, command string) (*Tunnel, error) {
+	if command == "" {
+		return nil, fmt.Errorf("manifest command can't be empty")
+	}
+
+	if tunnelType != "local" && tunnelType != "remote" {
+		return nil, fmt.Errorf("manifest command is not supported by %s tunnels", tunnelType)
+	}
+
+	t := newTunnel(tunnelType, server, []*SSHChannel{})
+	t.ManifestCommand = command
+
+	return t, nil
+}
+
+func newTunnel(tunnelType string, server *Server, channels []*SSHChannel) *Tunnel {
 	return &Tunnel{
-		Type:          tunnelType,
-		Ready:         make(chan bool, 1),
-		channels:      channels,
-		server:        server,
-		reconnect:     make(chan error, 1),
-		done:          make(chan error, 1),
-		stopKeepAlive: make(chan bool, 1),
-	}, nil
+		Type:                  tunnelType,
+		Ready:                 make(chan bool, 1),
+		Stdin:                 os.Stdin,
+		Stdout:                os.Stdout,
+		ConnectionWaitTimeout: DefaultConnectionWaitTimeout,
+		DialTimeout:           DefaultDialTimeout,
+		LogRateLimit:          DefaultLogRateLimit,
+		MaxChannels:           DefaultMaxChannels,
+		channels:              channels,
+		server:                server,
+		reconnect:             make(chan error, 1),
+		restart:               make(chan struct{}, 1),
+		done:                  make(chan error, 1),
+		stopping:              make(chan struct{}),
+		connected:             make(chan struct{}),
+		started:               make(chan struct{}),
+	}
 }
 
 // Start creates the ssh tunnel and initialized all channels allowing data
 // exchange between local and remote enpoints.
 func (t *Tunnel) Start() error {
+	return t.StartContext(context.Background())
+}
+
+// StartContext is like Start, but the tunnel is also stopped once the given
+// context is done: connection attempts to the ssh server, including the wait
+// between retries, are given up, the connection to the ssh server and the
+// listeners of the channels are closed and the context error is returned.
+func (t *Tunnel) StartContext(ctx context.Context) error {
 	log.Debugf("tunnel: %s", t)
 
+	if err := t.checkMaxChannels(len(t.channelList())); err != nil {
+		return err
+	}
+
+	if err := t.CheckEgress(); err != nil {
+		return err
+	}
+
+	if t.NetworkCheckInterval > 0 {
+		stopNetworkCheck := make(chan struct{})
+		defer close(stopNetworkCheck)
+
+		go t.watchNetwork(stopNetworkCheck)
+	}
+
+	// the tunnel connects to the ssh server before waiting on anything else, so
+	// it is told to stop, giving up on the connection attempts, as soon as the
+	// context is done.
+	returned := make(chan struct{})
+	defer close(returned)
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			t.stopOnce.Do(func() { close(t.stopping) })
+		case <-returned:
+		}
+	}()
+
+	// whatever the reason the tunnel is done for, a connection established
+	// from now on is closed instead of used.
+	defer func() {
+		t.stopOnce.Do(func() { close(t.stopping) })
+		t.shutdown()
+	}()
+
 	t.connect()
 
 	for {
 		select {
+		case <-ctx.Done():
+			t.closeListeners()
+
+			return ctx.Err()
 		case err := <-t.reconnect:
 			if err != nil {
-				log.WithError(err).Warnf("reconnecting to ssh server")
+				restarting := atomic.SwapInt32(&t.restarting, 0) == 1
+
+				if restarting {
+					log.WithFields(log.Fields{
+						"server": t.server,
+					}).Info("restarting the connection to the ssh server")
+				} else {
+					t.logs.log(t.LogRateLimit, log.WithError(err), log.WarnLevel, "reconnecting to ssh server")
+				}
+
+				if t.Disconnected != nil {
+					t.Disconnected(err)
+				}
+
+				t.notify(Event{Type: EventDisconnect, Error: err.Error()})
+
+				t.sshClient().Close()
+				t.stopKeepAlive()
+				t.setClient(nil)
+
+				// a restart requested by the user is not a failure, so it neither
+				// counts towards MaxReconnects nor is penalized by the failed
+				// connection attempts that preceded it.
+				if restarting {
+					t.retries = 0
+				} else {
+					t.reconnects++
+				}
+
+				if t.MaxReconnects > 0 && t.reconnects > t.MaxReconnects {
+					log.WithFields(log.Fields{
+						"server":     t.server,
+						"reconnects": t.MaxReconnects,
+					}).Error("maximum number of reconnections to the ssh server reached")
 
-				t.stopKeepAlive <- true
-				t.client.Close()
+					return ErrMaxReconnects
+				}
 
 				log.Debugf("restablishing the tunnel after disconnection: %s", t)
 
@@ -259,9 +1226,24 @@ func (t *Tunnel) Start() error {
 				go t.connect()
 			}
 		case err := <-t.done:
-			if t.client != nil {
-				t.stopKeepAlive <- true
-				t.client.Close()
+			if err == errConnectionFailed && t.SuperviseInterval > 0 {
+				log.Warnf("could not connect to the ssh server, trying again in %s", t.SuperviseInterval)
+
+				select {
+				case <-time.After(t.SuperviseInterval):
+				case err = <-t.done:
+					return err
+				case <-ctx.Done():
+					t.closeListeners()
+
+					return ctx.Err()
+				}
+
+				t.retries = 0
+
+				go t.connect()
+
+				continue
 			}
 
 			return err
@@ -269,10 +1251,24 @@ func (t *Tunnel) Start() error {
 	}
 }
 
+// shutdown closes the connection to the ssh server, along with the ones to
+// the jump hosts and ssh agents, once the tunnel is done.
+func (t *Tunnel) shutdown() {
+	t.closeHops()
+
+	if client := t.sshClient(); client != nil {
+		client.Close()
+	}
+
+	t.stopKeepAlive()
+
+	t.closeAgents()
+}
+
 // Listen creates tcp listeners for each channel defined.
 func (t *Tunnel) Listen() error {
-	for _, ch := range t.channels {
-		if err := ch.Listen(t.client); err != nil {
+	for _, ch := range t.channelList() {
+		if err := ch.Listen(t.sshClient()); err != nil {
 			return err
 		}
 	}
@@ -280,6 +1276,13 @@ func (t *Tunnel) Listen() error {
 	return nil
 }
 
+// startChannel waits for the next connection to the given channel and forwards
+// it to the channel destination.
+//
+// Only errors affecting the channel listener are returned, since those
+// prevent any further connection to be accepted. Failing to forward a single
+// connection (e.g. the tunnel is reconnecting to the ssh server or the
+// destination is unreachable) closes that connection only.
 func (t *Tunnel) startChannel(channel *SSHChannel) error {
 	var err error
 
@@ -288,194 +1291,1730 @@ func (t *Tunnel) startChannel(channel *SSHChannel) error {
 		return err
 	}
 
-	log.WithFields(log.Fields{
-		"channel": channel,
-	}).Debug("connection established")
+	conn := channel.conn
+	connId := t.nextConnId()
 
-	if t.client == nil {
-		return fmt.Errorf("tunnel channel can't be established: missing connection to the ssh server")
+	// connections accepted by remote tunnels come through an ssh channel
+	// opened by the ssh server.
+	if t.Type == "remote" {
+		conn = t.trackSSHChannel(channel, conn)
 	}
 
-	var destinationConn net.Conn
+	if !channel.allowed(conn.RemoteAddr()) {
+		log.WithFields(log.Fields{
+			"channel":    channel,
+			"connection": connId,
+			"client":     conn.RemoteAddr(),
+		}).Warn("connection refused: client address is not allowed")
 
-	if t.Type == "local" {
-		destinationConn, err = t.client.Dial("tcp", channel.Destination)
-	} else if t.Type == "remote" {
-		destinationConn, err = net.Dial("tcp", channel.Destination)
-	} else {
-		return fmt.Errorf("unknown tunnel type %s", t.Type)
+		conn.Close()
+		return nil
 	}
 
-	if err != nil {
-		return fmt.Errorf("dial error: %s", err)
-	}
+	// waiting for the first data must not hold the channel from accepting
+	// other connections.
+	if t.Type == "local" && t.InitialReadTimeout > 0 {
+		go func() {
+			conn, err := awaitFirstRead(conn, t.InitialReadTimeout)
+			if err != nil {
+				log.WithError(err).WithFields(log.Fields{
+					"channel":    channel,
+					"connection": connId,
+					"client":     conn.RemoteAddr(),
+				}).Warn("connection dropped: no data received from the client")
+
+				conn.Close()
+				return
+			}
 
-	go copyConn(channel.conn, destinationConn)
-	go copyConn(destinationConn, channel.conn)
+			t.forwardConnection(channel, connId, conn)
+		}()
 
-	log.WithFields(log.Fields{
-		"channel": channel,
-		"server":  t.server,
-	}).Debug("tunnel channel has been established")
+		return nil
+	}
 
-	return nil
-}
+	// the destination is only known once the client goes through the socks
+	// handshake, which must not hold the channel from accepting other
+	// connections either.
+	if t.Type == "dynamic" {
+		go t.forwardSOCKS(channel, connId, conn)
+		return nil
+	}
 
-// Stop cancels the tunnel, closing all connections.
-func (t Tunnel) Stop() {
-	t.done <- nil
+	return t.forwardConnection(channel, connId, conn)
 }
 
-// String returns a string representation of a Tunnel.
-func (t Tunnel) String() string {
-	return fmt.Sprintf("[channels:%s, server:%s]", t.channels, t.server.Address)
-}
+// forwardConnection forwards the given connection, accepted by the channel,
+// to the channel destination.
+func (t *Tunnel) forwardConnection(channel *SSHChannel, connId string, conn net.Conn) error {
+	var err error
 
-func (t *Tunnel) dial() error {
-	if t.client != nil {
-		t.client.Close()
+	// the handshake happens on the first read or write, so a slow client
+	// doesn't hold the other connections waiting.
+	if channel.LocalTLS != nil {
+		conn = tls.Server(conn, channel.LocalTLS)
 	}
 
-	c, err := sshClientConfig(*t.server)
-	if err != nil {
-		return fmt.Errorf("error generating ssh client config: %s", err)
+	if !channel.Quiet {
+		log.WithFields(log.Fields{
+			"channel":    channel,
+			"connection": connId,
+			"client":     conn.RemoteAddr(),
+		}).Debug("connection established")
 	}
 
-	retries := 0
-	for {
-		if t.ConnectionRetries > 0 && retries == t.ConnectionRetries {
-			log.WithFields(log.Fields{
-				"server":  t.server,
-				"retries": retries,
-			}).Error("maximum number of connection retries to the ssh server reached")
+	client := t.waitForClient(t.ConnectionWaitTimeout)
+	if client == nil {
+		log.WithFields(log.Fields{
+			"channel":    channel,
+			"connection": connId,
+		}).Warn("tunnel channel can't be established: missing connection to the ssh server")
 
-			return fmt.Errorf("error while connecting to ssh server")
-		}
+		t.reject(channel, conn)
+		return nil
+	}
 
-		t.client, err = ssh.Dial("tcp", t.server.Address, c)
-		if err != nil {
-			log.WithError(err).WithFields(log.Fields{
-				"server":  t.server,
-				"retries": retries,
-			}).Error("error while connecting to ssh server")
+	// every connection is checked too, so a destination that is not allowed
+	// is never dialed, whichever way its channel was created.
+	if err := t.checkEgress(channel); err != nil {
+		log.WithError(err).WithFields(log.Fields{
+			"channel":    channel,
+			"connection": connId,
+		}).Warn("connection refused")
 
-			if t.ConnectionRetries < 0 {
-				break
-			}
+		t.reject(channel, conn)
+		return nil
+	}
 
-			retries = retries + 1
+	var destinationConn net.Conn
 
-			time.Sleep(t.WaitAndRetry)
-			continue
-		}
+	destination := t.aliasedAddress(channel.Destination)
+
+	if t.Type == "local" {
+		atomic.AddUint64(&channel.dials.attempts, 1)
+		destinationConn, err = t.dialDestination(channel, client, destination)
+	} else if t.Type == "remote" {
+		atomic.AddUint64(&channel.dials.attempts, 1)
+		destinationConn, err = dialLocal(channel, conn, destination, t.DialTimeout)
+		if err == nil && channel.RemoteTLS != nil {
+			destinationConn, err = originateTLS(channel, destinationConn, t.DialTimeout)
+		}
+	} else {
+		conn.Close()
+		return fmt.Errorf("unknown tunnel type %s", t.Type)
+	}
+
+	if err != nil {
+		atomic.AddUint64(&channel.dials.failures, 1)
+
+		log.WithError(err).WithFields(log.Fields{
+			"channel":    channel,
+			"connection": connId,
+		}).Error("error dialing destination")
+
+		t.reject(channel, conn)
+		return nil
+	}
+
+	atomic.AddUint64(&channel.dials.successes, 1)
+
+	peer := peerAddress(destinationConn)
+	if peer != "" {
+		channel.dials.lastPeer.Store(peer)
+	}
+
+	if !channel.Quiet {
+		fields := log.Fields{
+			"channel":    channel,
+			"connection": connId,
+			"server":     t.server,
+		}
+
+		if peer != "" {
+			fields["peer"] = peer
+		}
+
+		log.WithFields(fields).Debug("tunnel channel has been established")
+	}
+
+	conn = t.notifyChannel(channel, connId, conn)
+
+	if t.Type == "local" && t.MigrationTimeout > 0 {
+		go t.forwardMigrating(channel, connId, conn, destinationConn, client)
+		return nil
+	}
+
+	go t.forward(channel, connId, conn, destinationConn)
+
+	return nil
+}
+
+// reject closes a client connection which destination can't be reached,
+// answering with a 503 Service Unavailable response first if the channel
+// forwards http traffic.
+func (t *Tunnel) reject(channel *SSHChannel, conn net.Conn) {
+	if !channel.HTTPError {
+		conn.Close()
+		return
+	}
+
+	// a slow client must not hold the channel from accepting connections.
+	go writeHTTPError(conn)
+}
+
+// dialDestination opens a connection to the channel destination through the
+// ssh server, taking it from the pool of prewarmed connections when
+// available.
+func (t *Tunnel) dialDestination(channel *SSHChannel, client *ssh.Client, destination string) (net.Conn, error) {
+	conn, err := t.dialPooled(channel, client, destination)
+	if err != nil || channel.RemoteTLS == nil {
+		return conn, err
+	}
+
+	return originateTLS(channel, conn, t.DialTimeout)
+}
+
+func (t *Tunnel) dialPooled(channel *SSHChannel, client *ssh.Client, destination string) (net.Conn, error) {
+	if channel.pool == nil {
+		return t.dialThrough(channel, client, destination)
+	}
+
+	// replace the connection taken from the pool
+	defer func() { go t.prewarm(channel, client, 1) }()
+
+	for {
+		select {
+		case pc := <-channel.pool:
+			if pc.client == client {
+				return pc.conn, nil
+			}
+
+			// opened through a previous connection to the ssh server
+			pc.conn.Close()
+		default:
+			return t.dialThrough(channel, client, destination)
+		}
+	}
+}
+
+// dialTimeout opens a connection to the given address, or unix socket path,
+// through the ssh server, giving up after the given timeout. Zero means no
+// timeout.
+func dialTimeout(client *ssh.Client, address string, timeout time.Duration) (net.Conn, error) {
+	network := addressNetwork(address)
+
+	return awaitDial(func() (net.Conn, error) {
+		return client.Dial(network, address)
+	}, address, timeout)
+}
+
+// awaitDial waits for the given dial to open a connection to the given
+// address, giving up after the given timeout. Zero means no timeout.
+func awaitDial(dial func() (net.Conn, error), address string, timeout time.Duration) (net.Conn, error) {
+	if timeout <= 0 {
+		return dial()
+	}
+
+	type dialResult struct {
+		conn net.Conn
+		err  error
+	}
+
+	result := make(chan dialResult, 1)
+
+	go func() {
+		conn, err := dial()
+		result <- dialResult{conn, err}
+	}()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case r := <-result:
+		return r.conn, r.err
+	case <-timer.C:
+		// the ssh client can't cancel a dial, so a connection opened too late is
+		// closed as soon as it is available.
+		go func() {
+			if r := <-result; r.conn != nil {
+				r.conn.Close()
+			}
+		}()
+
+		return nil, fmt.Errorf("timeout opening connection to %s after %s", address, timeout)
+	}
+}
+
+// prewarm opens n connections to the channel destination, adding them to
+// the channel pool until it is full.
+func (t *Tunnel) prewarm(channel *SSHChannel, client *ssh.Client, n int) {
+	for i := 0; i < n; i++ {
+		conn, err := t.dialThrough(channel, client, t.aliasedAddress(channel.Destination))
+		if err != nil {
+			log.WithError(err).WithFields(log.Fields{
+				"channel": channel,
+			}).Warn("error opening prewarmed connection to destination")
+
+			return
+		}
+
+		select {
+		case channel.pool <- prewarmedConn{conn: conn, client: client}:
+		default:
+			conn.Close()
+			return
+		}
+	}
+}
+
+// drainPool closes all prewarmed connections of the channel.
+func drainPool(channel *SSHChannel) {
+	for {
+		select {
+		case pc := <-channel.pool:
+			pc.conn.Close()
+		default:
+			return
+		}
+	}
+}
+
+// aliasedAddress replaces the host name of the given address by the IP
+// address it is aliased to, if any.
+func (t *Tunnel) aliasedAddress(address string) string {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return address
+	}
+
+	if ip, ok := lookupHostAlias(t.HostAliases, host); ok {
+		return net.JoinHostPort(ip, port)
+	}
+
+	return address
+}
+
+// forwardStdio copies the tunnel standard input to a single connection to the
+// channel destination and the data received from it to the tunnel standard
+// output, returning once the destination closes the connection.
+func (t *Tunnel) forwardStdio(channel *SSHChannel) error {
+	client := t.sshClient()
+	if client == nil {
+		return fmt.Errorf("stdio channel can't be established: missing connection to the ssh server")
+	}
+
+	conn, err := dialTimeout(client, t.aliasedAddress(channel.Destination), t.DialTimeout)
+	if err != nil {
+		return fmt.Errorf("dial error: %s", err)
+	}
+
+	conn = t.trackSSHChannel(channel, conn)
+	defer conn.Close()
+
+	log.WithFields(log.Fields{
+		"channel": channel,
+		"server":  t.server,
+	}).Debug("stdio channel has been established")
+
+	go func() {
+		_, err := io.Copy(conn, t.Stdin)
+		if err != nil {
+			log.WithError(err).Warn("error reading from standard input")
+		}
+
+		// signal the end of the input but keep reading until the destination is
+		// done sending data.
+		if cw, ok := conn.(interface{ CloseWrite() error }); ok {
+			cw.CloseWrite()
+		}
+	}()
+
+	_, err = io.Copy(t.Stdout, conn)
+
+	return err
+}
+
+// sshClient returns the current connection to the ssh server, which is nil
+// while the tunnel is (re)connecting.
+func (t *Tunnel) sshClient() *ssh.Client {
+	t.clientMu.RLock()
+	defer t.clientMu.RUnlock()
+
+	return t.client
+}
+
+func (t *Tunnel) setClient(client *ssh.Client) {
+	t.clientMu.Lock()
+	defer t.clientMu.Unlock()
+
+	t.storeClient(client)
+}
+
+// installClient sets the given connection as the current one to the ssh
+// server, unless the tunnel is being stopped, in which case false is returned.
+func (t *Tunnel) installClient(client *ssh.Client) bool {
+	t.clientMu.Lock()
+	defer t.clientMu.Unlock()
+
+	select {
+	case <-t.stopping:
+		return false
+	default:
+	}
+
+	t.storeClient(client)
+
+	return true
+}
+
+// storeClient must be called with clientMu held.
+func (t *Tunnel) storeClient(client *ssh.Client) {
+	t.client = client
+
+	select {
+	case <-t.connected:
+		if client == nil {
+			t.connected = make(chan struct{})
+		}
+	default:
+		if client != nil {
+			close(t.connected)
+		}
+	}
+}
+
+// waitForClient returns the current connection to the ssh server, waiting up
+// to the given timeout for it to be restablished if the tunnel is
+// reconnecting. nil is returned if the timeout expires.
+func (t *Tunnel) waitForClient(timeout time.Duration) *ssh.Client {
+	t.clientMu.RLock()
+	client, connected := t.client, t.connected
+	t.clientMu.RUnlock()
+
+	if client != nil {
+		return client
+	}
+
+	select {
+	case <-connected:
+		return t.sshClient()
+	case <-time.After(timeout):
+		return nil
+	}
+}
+
+// nextConnId returns a short identifier to correlate all log messages related
+// to a single connection accepted by a channel.
+func (t *Tunnel) nextConnId() string {
+	return strconv.FormatUint(uint64(atomic.AddUint32(&t.lastConnId, 1)), 10)
+}
+
+// SetLogLevel changes, at runtime, the level of the messages logged (e.g.
+// debug, info or warning). The level applies to the standard logger, shared by
+// all tunnels of the process.
+func (t *Tunnel) SetLogLevel(level string) error {
+	l, err := log.ParseLevel(level)
+	if err != nil {
+		return err
+	}
+
+	log.SetLevel(l)
+
+	log.WithFields(log.Fields{
+		"level": l,
+	}).Info("log level changed")
+
+	return nil
+}
+
+// Started returns a channel which is closed once the tunnel channels are
+// ready to accept connections for the first time. Unlike Ready, it can be
+// waited on by any number of goroutines and it stays closed even while the
+// tunnel is reconnecting to the ssh server.
+func (t *Tunnel) Started() <-chan struct{} {
+	return t.started
+}
+
+// Stop cancels the tunnel, closing all connections.
+func (t *Tunnel) Stop() {
+	t.stopOnce.Do(func() { close(t.stopping) })
+	t.done <- nil
+}
+
+// String returns a string representation of a Tunnel.
+func (t *Tunnel) String() string {
+	return fmt.Sprintf("[channels:%s, server:%s]", t.channelList(), t.server.Address)
+}
+
+func (t *Tunnel) dial() error {
+	if client := t.sshClient(); client != nil {
+		client.Close()
+		t.setClient(nil)
+	}
+
+	servers := t.servers()
+	configs := make([]*ssh.ClientConfig, len(servers))
+	for i, server := range servers {
+		c, err := sshClientConfig(server)
+		if err != nil {
+			return fmt.Errorf("error generating ssh client config for %s: %s", server, err)
+		}
+
+		configs[i] = c
+	}
+
+	// failed attempts are only forgiven if the previous connection proved to be
+	// stable, so a flapping connection can't retry forever.
+	if time.Since(t.connectedAt) >= t.StableConnectionPeriod {
+		t.retries = 0
+	}
+
+	var client *ssh.Client
+
+	for {
+		if t.ConnectionRetries > 0 && t.retries >= t.ConnectionRetries {
+			log.WithFields(log.Fields{
+				"server":  t.server,
+				"retries": t.retries,
+			}).Error("maximum number of connection retries to the ssh server reached")
+
+			return errConnectionFailed
+		}
+
+		var latency DialLatency
+		var err error
+		client, err = t.dialServers(servers, configs, &latency)
+		t.setLatency(latency)
+		if err == nil && !t.installClient(client) {
+			// the tunnel was stopped while the connection was being
+			// established, so there is no one left to close it later.
+			client.Close()
+
+			return errStopped
+		}
+
+		if err != nil {
+			t.logs.log(t.LogRateLimit, log.WithError(err).WithFields(log.Fields{
+				"server":  t.server,
+				"retries": t.retries,
+			}), log.ErrorLevel, "error while connecting to ssh server")
+
+			if t.ConnectionRetries < 0 {
+				return fmt.Errorf("error while connecting to ssh server: %v", err)
+			}
+
+			t.retries = t.retries + 1
+
+			if t.ShouldRetry != nil && !t.ShouldRetry(t.retries, err) {
+				log.WithFields(log.Fields{
+					"server":  t.server,
+					"retries": t.retries,
+				}).Error("connection retries to the ssh server aborted")
+
+				return errConnectionFailed
+			}
+
+			select {
+			case <-time.After(t.WaitAndRetry):
+			case <-t.stopping:
+				return errStopped
+			case <-t.restart:
+				log.WithFields(log.Fields{
+					"server": t.server,
+				}).Info("restarting the connection to the ssh server")
+
+				t.retries = 0
+			}
+
+			continue
+		}
 
 		break
 	}
 
-	go t.keepAlive()
+	// a restart requested while the connection was being established is
+	// already fulfilled.
+	select {
+	case <-t.restart:
+	default:
+	}
+
+	t.connectedAt = time.Now()
+	atomic.StoreInt64(&t.connectedSince, t.connectedAt.UnixNano())
+	atomic.AddUint64(&t.generation, 1)
+	t.logs.flush()
+
+	t.notify(Event{Type: EventConnect})
+
+	t.startKeepAlive(client)
+
+	if t.reconnectEnabled() {
+		go t.waitAndReconnect()
+	} else {
+		go t.waitAndStop()
+	}
+
+	latency := t.DialLatency()
+
+	log.WithFields(log.Fields{
+		"server":    servers[t.lastServer],
+		"resolve":   latency.Resolve,
+		"connect":   latency.Connect,
+		"handshake": latency.Handshake,
+		"auth":      latency.Auth,
+	}).Debug("connection to the ssh server is established")
+
+	return nil
+}
+
+// servers returns the ssh server of the tunnel followed by its fallback
+// servers.
+func (t *Tunnel) servers() []*Server {
+	return append([]*Server{t.server}, t.FallbackServers...)
+}
+
+// dialServers connects to the first of the given servers that can be
+// reached, starting from the last one the tunnel connected to, and returns
+// the error of the last server tried if none can.
+func (t *Tunnel) dialServers(servers []*Server, configs []*ssh.ClientConfig, latency *DialLatency) (*ssh.Client, error) {
+	if t.lastServer >= len(servers) {
+		t.lastServer = 0
+	}
+
+	var err error
+
+	for i := range servers {
+		n := (t.lastServer + i) % len(servers)
+
+		var client *ssh.Client
+		*latency = DialLatency{}
+		client, err = dialServer(servers[n], configs[n], latency)
+		if err == nil {
+			if n != t.lastServer {
+				log.WithFields(log.Fields{
+					"server":   servers[n],
+					"previous": servers[t.lastServer],
+				}).Warn("switching to another ssh server")
+			}
+
+			t.lastServer = n
+
+			return client, nil
+		}
+
+		if len(servers) > 1 {
+			log.WithError(err).WithFields(log.Fields{
+				"server": servers[n],
+			}).Debug("could not connect to ssh server, trying the next one")
+		}
+	}
+
+	return nil, err
+}
+
+// DialLatency holds the time spent on each phase of the latest attempt to
+// connect to the ssh server. Phases not reached are zero.
+type DialLatency struct {
+	// Resolve is the time spent resolving the ssh server host name.
+	Resolve time.Duration
+	// Connect is the time spent establishing the tcp connection.
+	Connect time.Duration
+	// Handshake is the time spent on the ssh key exchange, up to the
+	// verification of the server host key.
+	Handshake time.Duration
+	// Auth is the time spent authenticating against the ssh server.
+	Auth time.Duration
+}
+
+// DialLatency returns the time spent on each phase of the latest attempt to
+// connect to the ssh server, which helps telling a slow network apart from a
+// slow authentication on the server side.
+func (t *Tunnel) DialLatency() DialLatency {
+	t.clientMu.RLock()
+	defer t.clientMu.RUnlock()
+
+	return t.latency
+}
+
+func (t *Tunnel) setLatency(latency DialLatency) {
+	t.clientMu.Lock()
+	defer t.clientMu.Unlock()
+
+	t.latency = latency
+}
+
+// dialServer establishes a ssh connection to the given server, recording the
+// time spent on each phase of the connection on latency.
+//
+// The server host name is resolved apart from the tcp connection, so dns
+// failures are reported (and time bound) on its own. The host name is still
+// the one used to verify the server host key.
+func dialServer(server *Server, config *ssh.ClientConfig, latency *DialLatency) (*ssh.Client, error) {
+	var conn net.Conn
+	var err error
+
+	// the server host name is resolved by the last jump host, if any.
+	if len(server.Jump) > 0 {
+		start := time.Now()
+		conn, err = server.dialJump(config.Timeout)
+		latency.Connect = time.Since(start)
+	} else {
+		conn, err = server.dialDirect(config.Timeout, latency)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	// the server host key is verified at the end of the key exchange, right
+	// before the authentication starts.
+	start := time.Now()
+	var kexDone time.Time
+
+	cfg := *config
+	cfg.HostKeyCallback = func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		kexDone = time.Now()
+		latency.Handshake = kexDone.Sub(start)
+
+		return config.HostKeyCallback(hostname, remote, key)
+	}
+
+	sshConn, chans, reqs, err := ssh.NewClientConn(conn, hostKeyAddress(server.Address), &cfg)
+	if !kexDone.IsZero() {
+		latency.Auth = time.Since(kexDone)
+	} else {
+		latency.Handshake = time.Since(start)
+	}
+
+	if err != nil {
+		conn.Close()
+
+		if isTooManyAuthFailures(err) && !server.IdentitiesOnly {
+			return nil, fmt.Errorf("%v: the ssh server gave up after too many keys were offered, consider using identities only mode to offer just the given key", err)
+		}
+
+		return nil, err
+	}
+
+	return ssh.NewClient(sshConn, chans, reqs), nil
+}
+
+// dialDirect opens a tcp connection to the first address of the ssh server
+// that can be reached, recording the time spent resolving and connecting to it
+// on latency.
+func (s *Server) dialDirect(timeout time.Duration, latency *DialLatency) (net.Conn, error) {
+	start := time.Now()
+
+	addrs, err := s.resolve()
+	latency.Resolve = time.Since(start)
+	if err != nil {
+		return nil, err
+	}
+
+	start = time.Now()
+
+	var conn net.Conn
+	for _, addr := range addrs {
+		conn, err = s.dial(addr, timeout)
+		if err == nil {
+			break
+		}
+	}
+
+	latency.Connect = time.Since(start)
+
+	return conn, err
+}
+
+// dial opens a tcp connection to the given address of the ssh server, through
+// the server Dialer, if any, giving up after the given timeout. Zero means no
+// timeout.
+func (s *Server) dial(address string, timeout time.Duration) (net.Conn, error) {
+	if s.Dialer == nil && s.Interface != "" {
+		laddr, err := interfaceAddr(s.Interface, address)
+		if err != nil {
+			return nil, err
+		}
+
+		d := net.Dialer{Timeout: timeout, LocalAddr: laddr}
+
+		return d.Dial("tcp", address)
+	}
+
+	if s.Dialer == nil {
+		return net.DialTimeout("tcp", address, timeout)
+	}
+
+	ctx := context.Background()
+
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	return s.Dialer.DialContext(ctx, "tcp", address)
+}
+
+// isTooManyAuthFailures tells if the ssh server disconnected the client for
+// exceeding its maximum number of authentication attempts.
+func isTooManyAuthFailures(err error) bool {
+	return strings.Contains(strings.ToLower(err.Error()), "too many authentication failures")
+}
+
+// hostKeyAddress returns the address used to lookup the server host key on
+// the known_hosts file.
+//
+// Just like OpenSSH does, the host name is lowercased before the lookup, so
+// entries added by OpenSSH match regardless of the case used to refer to the
+// server. That is mandatory for hashed entries (i.e. HashKnownHosts yes),
+// which can't be compared in a case insensitive way.
+func hostKeyAddress(address string) string {
+	return strings.ToLower(address)
+}
+
+// networkAddrs returns a representation of the addresses of all local network
+// interfaces.
+var networkAddrs = func() (string, error) {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return "", err
+	}
+
+	l := make([]string, len(addrs))
+	for i, addr := range addrs {
+		l[i] = addr.String()
+	}
+	sort.Strings(l)
+
+	return strings.Join(l, ","), nil
+}
+
+// watchNetwork closes the connection to the ssh server, triggering a
+// reconnection, every time the addresses of the local network interfaces
+// change.
+func (t *Tunnel) watchNetwork(stop <-chan struct{}) {
+	ticker := time.NewTicker(t.NetworkCheckInterval)
+	defer ticker.Stop()
+
+	last, err := networkAddrs()
+	if err != nil {
+		log.WithError(err).Warn("error reading network interfaces addresses")
+	}
+
+	for {
+		select {
+		case <-ticker.C:
+			addrs, err := networkAddrs()
+			if err != nil {
+				log.WithError(err).Warn("error reading network interfaces addresses")
+				continue
+			}
+
+			if addrs == last {
+				continue
+			}
+
+			last = addrs
+
+			log.WithFields(log.Fields{
+				"server": t.server,
+			}).Info("network interfaces changed, reconnecting to ssh server")
+
+			if client := t.sshClient(); client != nil {
+				client.Close()
+			}
+		case <-stop:
+			return
+		}
+	}
+}
+
+// Restart reconnects to the ssh server right away, on behalf of the user (e.g.
+// after fixing the network or the ssh server).
+//
+// Unlike the reconnections caused by failures, a restart clears the failed
+// connection attempts counted against ConnectionRetries, regardless of
+// StableConnectionPeriod, and doesn't count towards MaxReconnects. If the
+// tunnel is waiting to retry a failed connection attempt, the attempt is made
+// immediately instead of waiting for WaitAndRetry.
+func (t *Tunnel) Restart() error {
+	if !t.reconnectEnabled() {
+		return fmt.Errorf("tunnel can't be restarted: reconnection to the ssh server is disabled")
+	}
+
+	if client := t.sshClient(); client != nil {
+		atomic.StoreInt32(&t.restarting, 1)
+		return client.Close()
+	}
+
+	select {
+	case t.restart <- struct{}{}:
+	default:
+	}
+
+	return nil
+}
+
+func (t *Tunnel) waitAndReconnect() {
+	t.reconnect <- t.sshClient().Wait()
+}
+
+// waitAndStop stops the tunnel once the connection to the ssh server is lost,
+// since nothing else would tell while reconnection is disabled.
+func (t *Tunnel) waitAndStop() {
+	err := t.sshClient().Wait()
+	if err == nil {
+		err = io.EOF
+	}
+
+	// the tunnel may already be done, e.g. the connection was closed by Stop.
+	select {
+	case t.done <- fmt.Errorf("connection to the ssh server lost: %v", err):
+	default:
+	}
+}
+
+// reconnectEnabled tells if the tunnel reconnects to the ssh server once the
+// connection is lost.
+func (t *Tunnel) reconnectEnabled() bool {
+	return t.ConnectionRetries > 0
+}
+
+func (t *Tunnel) connect() {
+	var err error
+
+	err = t.dial()
+	if err == errStopped {
+		// Stop already told the tunnel it is done.
+		return
+	}
+
+	if err != nil {
+		t.done <- err
+		return
+	}
+
+	if t.destinationCommand != "" && t.channels == nil {
+		err = t.discoverChannels()
+		if err != nil {
+			t.done <- err
+			return
+		}
+	}
+
+	// the listeners of remote channels live on the ssh server, so they are lost
+	// along with the previous connection and opened again through the new one,
+	// on the same address.
+	if t.Type == "remote" && t.accepting {
+		for _, ch := range t.channelList() {
+			ch.dropListener()
+		}
+	}
+
+	err = t.Listen()
+	if err != nil {
+		t.done <- err
+		return
+	}
+
+	if t.Type == "local" {
+		client := t.sshClient()
+
+		for _, ch := range t.channelList() {
+			if ch.pool != nil {
+				drainPool(ch)
+				go t.prewarm(ch, client, cap(ch.pool))
+			}
+		}
+	}
+
+	// a stdio tunnel forwards a single stream that can't survive a reconnection,
+	// so the tunnel is done as soon as the stream is over.
+	if t.Type == "stdio" {
+		if t.accepting {
+			return
+		}
+
+		t.accepting = true
+		close(t.started)
+		t.logChannelTable()
+		t.Ready <- true
+
+		go func() {
+			t.done <- t.forwardStdio(t.channels[0])
+		}()
+
+		return
+	}
+
+	// a tun channel is opened again on every connection to the ssh server,
+	// while the local tun device is kept.
+	if t.Type == "tun" {
+		go func(channel *SSHChannel, client *ssh.Client) {
+			err := t.forwardTun(channel, client)
+			if err != nil {
+				log.WithError(err).WithFields(log.Fields{
+					"channel": channel,
+				}).Warn("tun channel closed")
+			}
+		}(t.channels[0], t.sshClient())
+
+		if !t.accepting {
+			t.accepting = true
+			close(t.started)
+		} else if t.Reconnected != nil {
+			t.Reconnected()
+		}
+
+		t.logChannelTable()
+
+		go func() {
+			t.Ready <- true
+		}()
+
+		return
+	}
+
+	// listeners are kept open across reconnections to the ssh server, so local
+	// ports don't change and clients can still connect while the tunnel is
+	// reconnecting. That means the goroutines accepting connections on them are
+	// only started on the first connection.
+	if t.accepting {
+		log.WithFields(log.Fields{
+			"server": t.server,
+		}).Info("tunnel channels are ready to accept connections after reconnection")
+
+		t.logChannelTable()
+
+		if t.Reconnected != nil {
+			t.Reconnected()
+		}
+
+		go func() {
+			t.Ready <- true
+		}()
+
+		return
+	}
+
+	t.accepting = true
+
+	channels := t.channelList()
+
+	wg := &sync.WaitGroup{}
+	wg.Add(len(channels))
+
+	// wait for all ssh channels to be ready to accept connections then sends a
+	// single message signalling all tunnels are ready
+	go func(tunnel *Tunnel, waitgroup *sync.WaitGroup) {
+		waitgroup.Wait()
+
+		if t.WaitForRemote > 0 {
+			err := t.waitForDestinations(t.WaitForRemote)
+			if err != nil {
+				t.done <- err
+				return
+			}
+		}
+
+		close(t.started)
+
+		if t.ManifestCommand != "" {
+			_, err := t.addManifestChannels()
+			if err != nil {
+				t.done <- err
+				return
+			}
+		}
+
+		t.logChannelTable()
+		t.Ready <- true
+	}(t, wg)
+
+	for _, ch := range channels {
+		go t.acceptConnections(ch, wg.Done)
+	}
+
+}
+
+// logChannelTable logs the resolved source, destination and state of every
+// channel, so the forwards can be confirmed to be intact after connecting, or
+// reconnecting, to the ssh server.
+func (t *Tunnel) logChannelTable() {
+	channels := t.Channels()
+
+	log.WithFields(log.Fields{
+		"server":   t.server,
+		"channels": len(channels),
+	}).Info("forwarded channels")
+
+	for i, ch := range channels {
+		fields := log.Fields{
+			"channel":     i + 1,
+			"type":        ch.ChannelType,
+			"source":      ch.Source,
+			"destination": ch.Destination,
+			"state":       ch.State(),
+		}
+
+		if ch.Protocol != "" {
+			fields["protocol"] = ch.Protocol
+		}
+
+		log.WithFields(fields).Info("forwarded channel")
+	}
+}
+
+// acceptConnections forwards every connection accepted by the channel until
+// its listener fails, calling ready once the channel starts accepting.
+func (t *Tunnel) acceptConnections(channel *SSHChannel, ready func()) {
+	fields := log.Fields{
+		"source":      channel.Source,
+		"destination": channel.Destination,
+	}
+
+	if channel.Protocol != "" {
+		fields["protocol"] = channel.Protocol
+	}
+
+	log.WithFields(fields).Info("tunnel channel is waiting for connection")
+
+	ready()
+
+	for {
+		listener := channel.currentListener()
+
+		err := t.startChannel(channel)
+		if err != nil {
+			// the listener of a channel removed from the tunnel is closed on
+			// purpose.
+			if atomic.LoadUint32(&channel.closed) == 1 {
+				return
+			}
+
+			// the listener of a remote channel is closed along with the
+			// connection to the ssh server, the channel accepting connections
+			// again once a new one is opened through the next connection.
+			if t.Type == "remote" && t.reconnectEnabled() {
+				if t.awaitListener(channel, listener) {
+					continue
+				}
+
+				return
+			}
+
+			t.done <- err
+			return
+		}
+	}
+}
+
+// awaitListener waits for the given remote channel to listen again, through
+// a new connection to the ssh server, after the given listener failed. It
+// returns false if the tunnel is stopped first.
+func (t *Tunnel) awaitListener(channel *SSHChannel, failed net.Listener) bool {
+	log.WithFields(log.Fields{
+		"channel": channel,
+	}).Debug("remote channel listener closed, waiting for the tunnel to listen again")
+
+	for {
+		if l := channel.currentListener(); l != nil && l != failed {
+			return true
+		}
+
+		select {
+		case <-t.stopping:
+			return false
+		case <-time.After(relistenInterval):
+		}
+	}
+}
+
+// startKeepAlive starts sending keep alive packets through the given
+// connection to the ssh server, unless the tunnel is being stopped.
+func (t *Tunnel) startKeepAlive(client *ssh.Client) {
+	t.clientMu.Lock()
+	defer t.clientMu.Unlock()
+
+	select {
+	case <-t.stopping:
+		return
+	default:
+	}
+
+	stop, done := make(chan struct{}), make(chan struct{})
+	t.keepAliveStop, t.keepAliveDone = stop, done
+
+	go func() {
+		defer close(done)
+		t.keepAlive(client, stop)
+	}()
+}
+
+// stopKeepAlive stops sending keep alive packets through the current
+// connection to the ssh server, waiting for the keep alive loop to return.
+func (t *Tunnel) stopKeepAlive() {
+	t.clientMu.Lock()
+	stop, done := t.keepAliveStop, t.keepAliveDone
+	t.keepAliveStop, t.keepAliveDone = nil, nil
+	t.clientMu.Unlock()
+
+	if stop == nil {
+		return
+	}
+
+	close(stop)
+	<-done
+}
+
+func (t *Tunnel) keepAlive(client *ssh.Client, stop <-chan struct{}) {
+	delay := time.NewTimer(t.keepAliveDelay())
+	defer delay.Stop()
+
+	// the ticker starts once the initial delay is over.
+	var tick <-chan time.Time
+
+	log.Debug("start sending keep alive packets")
+
+	var data io.WriteCloser
+	if t.KeepAliveData {
+		var err error
+
+		data, err = keepAliveSession(client)
+		if err != nil {
+			log.WithError(err).Warn("could not start keep alive session, only keep alive requests will be sent")
+		} else {
+			defer data.Close()
+		}
+	}
+
+	for {
+		select {
+		case <-delay.C:
+			ticker := time.NewTicker(t.KeepAliveInterval)
+			defer ticker.Stop()
+
+			tick = ticker.C
+			t.sendKeepAlive(client, data)
+		case <-tick:
+			if t.KeepAliveIdleOnly && t.receivedWithin(t.KeepAliveInterval) {
+				continue
+			}
+
+			t.sendKeepAlive(client, data)
+		case <-stop:
+			log.Debug("stop sending keep alive packets")
+			return
+		}
+	}
+}
+
+// receivedWithin tells if forwarded data was received from the ssh server
+// within the given period.
+func (t *Tunnel) receivedWithin(period time.Duration) bool {
+	last := atomic.LoadInt64(&t.lastReceived)
+
+	return last != 0 && time.Since(time.Unix(0, last)) < period
+}
+
+// keepAliveDelay returns the time to wait before sending the first keep alive
+// packet through a new connection to the ssh server.
+func (t *Tunnel) keepAliveDelay() time.Duration {
+	if t.KeepAliveInitialDelay > 0 {
+		return t.KeepAliveInitialDelay
+	}
+
+	return t.KeepAliveInterval
+}
+
+// sendKeepAlive sends a keep alive request through the given connection to the
+// ssh server and, if given, a keep alive packet as data through the keep alive
+// session.
+func (t *Tunnel) sendKeepAlive(client *ssh.Client, data io.Writer) {
+	_, _, err := client.SendRequest("keepalive@mole", true, nil)
+	if err != nil {
+		t.logs.log(t.LogRateLimit, log.WithError(err), log.WarnLevel, "error sending keep-alive request to ssh server")
+	} else if t.KeepAliveReplied != nil {
+		t.KeepAliveReplied()
+	}
+
+	if data != nil {
+		_, err = data.Write([]byte{0})
+		if err != nil {
+			t.logs.log(t.LogRateLimit, log.WithError(err), log.WarnLevel, "error sending keep-alive data to ssh server")
+		}
+	}
+}
+
+// keepAliveSession starts a session running "cat" on the ssh server through the
+// given connection, returning the standard input of the command. The data
+// echoed back by the server is discarded.
+func keepAliveSession(client *ssh.Client) (io.WriteCloser, error) {
+	session, err := client.NewSession()
+	if err != nil {
+		return nil, err
+	}
+
+	stdin, err := session.StdinPipe()
+	if err != nil {
+		session.Close()
+		return nil, err
+	}
+
+	session.Stdout = ioutil.Discard
+
+	err = session.Start("cat")
+	if err != nil {
+		session.Close()
+		return nil, err
+	}
+
+	return keepAliveWriter{stdin, session}, nil
+}
+
+// keepAliveWriter is the standard input of a keep alive session, which also
+// closes the session when closed.
+type keepAliveWriter struct {
+	io.WriteCloser
+	session *ssh.Session
+}
+
+func (s keepAliveWriter) Close() error {
+	s.WriteCloser.Close()
+	return s.session.Close()
+}
+
+// channelList returns a snapshot of the list of channels of the tunnel.
+func (t *Tunnel) channelList() []*SSHChannel {
+	t.channelsMu.Lock()
+	defer t.channelsMu.Unlock()
+
+	channels := make([]*SSHChannel, len(t.channels))
+	copy(channels, t.channels)
+
+	return channels
+}
+
+// AddChannel creates a new channel on a running tunnel, forwarding
+// connections from source to destination, and returns a copy of it.
+//
+// The tunnel type decides the kind of forwarding (i.e. local or remote). An
+// empty source listens on a random port of the loopback interface.
+func (t *Tunnel) AddChannel(source, destination string) (*SSHChannel, error) {
+	if t.Type != "local" && t.Type != "remote" {
+		return nil, fmt.Errorf("channels can't be added to %s tunnels", t.Type)
+	}
+
+	select {
+	case <-t.started:
+	default:
+		return nil, fmt.Errorf("channels can only be added once the tunnel is started")
+	}
+
+	var sources []string
+	if source != "" {
+		sources = []string{source}
+	}
+
+	channels, err := buildSSHChannels(t.server.Name, t.Type, sources, []string{destination}, "")
+	if err != nil {
+		return nil, err
+	}
+
+	ch := channels[0]
+
+	err = t.checkMaxChannels(len(t.channelList()) + 1)
+	if err != nil {
+		return nil, err
+	}
+
+	err = t.checkEgress(ch)
+	if err != nil {
+		return nil, err
+	}
+
+	client := t.sshClient()
+	if t.Type == "remote" && client == nil {
+		return nil, fmt.Errorf("channel can't be added: missing connection to the ssh server")
+	}
+
+	err = ch.Listen(client)
+	if err != nil {
+		return nil, err
+	}
+
+	t.channelsMu.Lock()
+	t.channels = append(t.channels, ch)
+	t.channelsMu.Unlock()
+
+	go t.acceptConnections(ch, func() {})
+
+	return &SSHChannel{ChannelType: ch.ChannelType, Source: ch.Source, Destination: ch.Destination, listener: ch.currentListener()}, nil
+}
+
+// RemoveChannel stops the channel listening on the given source address from
+// accepting new connections and removes it from the tunnel. Connections
+// already established through the channel are kept open.
+func (t *Tunnel) RemoveChannel(source string) error {
+	ch, err := t.findChannel(source)
+	if err != nil {
+		return err
+	}
+
+	t.channelsMu.Lock()
+	for i, c := range t.channels {
+		if c == ch {
+			t.channels = append(t.channels[:i], t.channels[i+1:]...)
+			break
+		}
+	}
+	t.channelsMu.Unlock()
+
+	atomic.StoreUint32(&ch.closed, 1)
+
+	if l := ch.currentListener(); l != nil {
+		return l.Close()
+	}
+
+	return nil
+}
+
+// runCommand runs the given command on the ssh server, returning its standard
+// output.
+func (t *Tunnel) runCommand(command string) ([]byte, error) {
+	client := t.sshClient()
+	if client == nil {
+		return nil, fmt.Errorf("missing connection to the ssh server")
+	}
+
+	session, err := client.NewSession()
+	if err != nil {
+		return nil, err
+	}
+	defer session.Close()
+
+	return session.Output(command)
+}
+
+// addManifestChannels runs the manifest command on the ssh server, adding a
+// channel for each forward definition found on its output.
+func (t *Tunnel) addManifestChannels() ([]*SSHChannel, error) {
+	out, err := t.runCommand(t.ManifestCommand)
+	if err != nil {
+		return nil, fmt.Errorf("error running manifest command %s: %v", t.ManifestCommand, err)
+	}
+
+	forwards, err := parseManifest(string(out))
+	if err != nil {
+		return nil, fmt.Errorf("invalid output of manifest command %s: %v", t.ManifestCommand, err)
+	}
+
+	var channels []*SSHChannel
+	for _, f := range forwards {
+		ch, err := t.AddChannel(f[0], f[1])
+		if err != nil {
+			return nil, fmt.Errorf("error adding channel from manifest: %v", err)
+		}
+
+		log.WithFields(log.Fields{
+			"source":      ch.Source,
+			"destination": ch.Destination,
+		}).Info("tunnel channel added from manifest")
+
+		channels = append(channels, ch)
+	}
+
+	return channels, nil
+}
+
+// parseManifest returns the source and destination addresses of each forward
+// definition of a manifest. The source address is empty when not given.
+func parseManifest(manifest string) ([][2]string, error) {
+	var forwards [][2]string
+
+	for i, line := range strings.Split(manifest, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		var f [2]string
+
+		fields := strings.Fields(line)
+		switch len(fields) {
+		case 1:
+			f[1] = fields[0]
+		case 2:
+			f[0], f[1] = fields[0], fields[1]
+		default:
+			return nil, fmt.Errorf("line %d: expected \"[<source>] <destination>\", got %q", i+1, line)
+		}
+
+		if _, _, err := net.SplitHostPort(f[1]); err != nil {
+			return nil, fmt.Errorf("line %d: invalid destination address: %v", i+1, err)
+		}
+
+		forwards = append(forwards, f)
+	}
+
+	return forwards, nil
+}
+
+// discoverChannels runs the destination command on the ssh server, creating a
+// channel for each destination address found on its output.
+func (t *Tunnel) discoverChannels() error {
+	out, err := t.runCommand(t.destinationCommand)
+	if err != nil {
+		return fmt.Errorf("error running destination command %s: %v", t.destinationCommand, err)
+	}
+
+	var destination []string
+	for _, line := range strings.Split(string(out), "\n") {
+		if addr := strings.TrimSpace(line); addr != "" {
+			if _, _, err := net.SplitHostPort(addr); err != nil {
+				return fmt.Errorf("invalid destination address returned by destination command: %v", err)
+			}
+
+			destination = append(destination, addr)
+		}
+	}
+
+	if len(destination) == 0 {
+		return fmt.Errorf("no destination address returned by destination command %s", t.destinationCommand)
+	}
+
+	source := make([]string, len(t.discoverySource))
+	copy(source, t.discoverySource)
+
+	channels, err := buildSSHChannels(t.server.Name, t.Type, source, destination, "")
+	if err != nil {
+		return err
+	}
 
-	if t.ConnectionRetries > 0 {
-		go t.waitAndReconnect()
+	err = t.checkMaxChannels(len(channels))
+	if err != nil {
+		return fmt.Errorf("too many destination addresses returned by destination command %s: %v", t.destinationCommand, err)
 	}
 
 	log.WithFields(log.Fields{
-		"server": t.server,
-	}).Debug("connection to the ssh server is established")
+		"command":     t.destinationCommand,
+		"destination": destination,
+	}).Debug("destination addresses discovered")
+
+	t.channelsMu.Lock()
+	t.channels = channels
+	t.channelsMu.Unlock()
 
 	return nil
 }
 
-func (t *Tunnel) waitAndReconnect() {
-	t.reconnect <- t.client.Wait()
+// checkMaxChannels returns an error if the given number of channels is over
+// the maximum accepted by the tunnel.
+func (t *Tunnel) checkMaxChannels(n int) error {
+	if t.MaxChannels >= 0 && n > t.MaxChannels {
+		return fmt.Errorf("%d channels requested, over the maximum of %d channels per tunnel", n, t.MaxChannels)
+	}
+
+	return nil
 }
 
-func (t *Tunnel) connect() {
-	var err error
+// Channels returns a copy of all channels configured for the tunnel.
+func (t *Tunnel) Channels() []*SSHChannel {
+	list := t.channelList()
+	channels := make([]*SSHChannel, len(list))
+
+	for i, c := range list {
+		// the connection being accepted is left out since it is constantly
+		// replaced while the channel is in use.
+		channels[i] = &SSHChannel{
+			ChannelType:     c.ChannelType,
+			Source:          c.Source,
+			Destination:     c.Destination,
+			Quiet:           c.Quiet,
+			HTTPError:       c.HTTPError,
+			AllowedNetworks: c.AllowedNetworks,
+			RemoteTLS:       c.RemoteTLS,
+			LocalTLS:        c.LocalTLS,
+			Via:             c.Via,
+			DialSource:      c.DialSource,
+			Protocol:        c.Protocol,
+			listener:        c.currentListener(),
+			tun:             c.tun,
+		}
+	}
 
-	err = t.dial()
+	return channels
+}
+
+// QuietChannel disables the logging of each connection handled by the channel
+// listening on the given source address.
+func (t *Tunnel) QuietChannel(source string) error {
+	ch, err := t.findChannel(source)
 	if err != nil {
-		t.done <- err
-		return
+		return err
 	}
 
-	err = t.Listen()
+	ch.Quiet = true
+
+	return nil
+}
+
+// HTTPErrorChannel makes the channel listening on the given source address
+// answer with a 503 Service Unavailable response when its destination can't
+// be reached.
+func (t *Tunnel) HTTPErrorChannel(source string) error {
+	ch, err := t.findChannel(source)
 	if err != nil {
-		t.done <- err
-		return
+		return err
 	}
 
-	wg := &sync.WaitGroup{}
-	wg.Add(len(t.channels))
+	ch.HTTPError = true
 
-	// wait for all ssh channels to be ready to accept connections then sends a
-	// single message signalling all tunnels are ready
-	go func(tunnel *Tunnel, waitgroup *sync.WaitGroup) {
-		waitgroup.Wait()
-		t.Ready <- true
-	}(t, wg)
+	return nil
+}
 
-	for _, ch := range t.channels {
-		go func(channel *SSHChannel, waitgroup *sync.WaitGroup) {
-			var err error
-			var once sync.Once
+// SetProtocol tags the channel listening on the given source address with a
+// hint of the protocol it carries (e.g. http, postgres or redis), attached to
+// its logs and stats. An empty source applies to all channels.
+//
+// Some protocols enable the behaviors specific to them: channels carrying
+// http answer with a 503 Service Unavailable response when their destination
+// can't be reached (see HTTPErrorChannel).
+func (t *Tunnel) SetProtocol(source, protocol string) error {
+	if protocol == "" {
+		return fmt.Errorf("protocol of channel %s can't be empty", source)
+	}
 
-			for {
-				once.Do(func() {
-					log.WithFields(log.Fields{
-						"source":      channel.Source,
-						"destination": channel.Destination,
-					}).Info("tunnel channel is waiting for connection")
+	channels := t.channelList()
 
-					waitgroup.Done()
-				})
+	if len(channels) == 0 {
+		return fmt.Errorf("can't set the protocol of a tunnel with no channels")
+	}
 
-				err = t.startChannel(channel)
-				if err != nil {
-					t.done <- err
-					return
-				}
-			}
-		}(ch, wg)
+	if source != "" {
+		ch, err := t.findChannel(source)
+		if err != nil {
+			return err
+		}
+
+		channels = []*SSHChannel{ch}
+	}
+
+	for _, ch := range channels {
+		ch.Protocol = protocol
+
+		if strings.EqualFold(protocol, "http") {
+			ch.HTTPError = true
+		}
 	}
 
+	return nil
 }
 
-func (t *Tunnel) keepAlive() {
-	ticker := time.NewTicker(t.KeepAliveInterval)
+// AllowNetwork restricts the clients allowed to connect to the channel
+// listening on the given source address to the ones belonging to the given
+// network (e.g. 192.168.1.0/24). An empty source applies the restriction to
+// all channels.
+func (t *Tunnel) AllowNetwork(source, cidr string) error {
+	_, network, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return fmt.Errorf("invalid network %s: %v", cidr, err)
+	}
 
-	log.Debug("start sending keep alive packets")
+	// the channels of tunnels using a destination command are only created
+	// once connected, so the restriction would be silently lost.
+	channels := t.channelList()
 
-	for {
-		select {
-		case <-ticker.C:
-			_, _, err := t.client.SendRequest("keepalive@mole", true, nil)
-			if err != nil {
-				log.Warnf("error sending keep-alive request to ssh server: %v", err)
-			}
-		case <-t.stopKeepAlive:
-			log.Debug("stop sending keep alive packets")
-			return
+	if len(channels) == 0 {
+		return fmt.Errorf("can't restrict clients of a tunnel with no channels")
+	}
+
+	if source == "" {
+		for _, ch := range channels {
+			ch.AllowedNetworks = append(ch.AllowedNetworks, network)
 		}
+
+		return nil
+	}
+
+	ch, err := t.findChannel(source)
+	if err != nil {
+		return err
 	}
+
+	ch.AllowedNetworks = append(ch.AllowedNetworks, network)
+
+	return nil
 }
 
-// Channels returns a copy of all channels configured for the tunnel.
-func (t *Tunnel) Channels() []*SSHChannel {
-	channels := make([]*SSHChannel, len(t.channels))
+// PrewarmChannel keeps n connections to the destination of the channel
+// listening on the given source address opened ahead of time, so clients
+// don't wait for a new connection to be opened through the ssh server. An
+// empty source applies to all channels. Only local tunnels are supported.
+//
+// Prewarmed connections reduce the latency of protocols opening many short
+// connections but they stay idle, using resources on the ssh server and on
+// the destination, which may close them after a while.
+func (t *Tunnel) PrewarmChannel(source string, n int) error {
+	if t.Type != "local" {
+		return fmt.Errorf("prewarmed connections are only supported by local tunnels")
+	}
 
-	for i, c := range t.channels {
-		cc := *c
-		channels[i] = &cc
+	if n <= 0 {
+		return fmt.Errorf("invalid number of prewarmed connections: %d", n)
 	}
 
-	return channels
+	channels := t.channelList()
+
+	if len(channels) == 0 {
+		return fmt.Errorf("can't prewarm connections of a tunnel with no channels")
+	}
+
+	if source == "" {
+		for _, ch := range channels {
+			ch.pool = make(chan prewarmedConn, n)
+		}
+
+		return nil
+	}
+
+	ch, err := t.findChannel(source)
+	if err != nil {
+		return err
+	}
+
+	ch.pool = make(chan prewarmedConn, n)
+
+	return nil
+}
+
+// findChannel returns the channel listening on the given source address.
+func (t *Tunnel) findChannel(source string) (*SSHChannel, error) {
+	expanded := expandAddress(source)
+	if t.Type == "remote" {
+		expanded = expandServerAddress(source)
+	}
+
+	for _, ch := range t.channelList() {
+		if ch.Source == source || ch.Source == expanded {
+			return ch, nil
+		}
+	}
+
+	return nil, fmt.Errorf("no channel found with source address %s", source)
 }
 
-func sshClientConfig(server Server) (*ssh.ClientConfig, error) {
+func sshClientConfig(server *Server) (*ssh.ClientConfig, error) {
 	var signers []ssh.Signer
 
-	if server.Key == nil && server.SSHAgent == "" {
-		return nil, fmt.Errorf("at least one authentication method (key or ssh agent) must be present.")
+	if server.Strict && server.Insecure {
+		return nil, fmt.Errorf("the server host key must be verified in strict mode")
+	}
+
+	if server.Key == nil && server.SSHAgent == "" && server.Password == "" && server.Prompt == nil {
+		return nil, fmt.Errorf("at least one authentication method (key, ssh agent, password or prompt) must be present.")
 	}
 
 	if server.Key != nil {
@@ -487,57 +3026,284 @@ func sshClientConfig(server Server) (*ssh.ClientConfig, error) {
 		}
 	}
 
-	if server.SSHAgent != "" {
+	var ac *agentClient
+
+	if server.SSHAgent != "" && server.IdentitiesOnly {
+		log.Debugf("identities only mode enabled. Will not use keys from ssh agent %s", server.SSHAgent)
+	} else if server.SSHAgent != "" {
 		if _, err := os.Stat(server.SSHAgent); err == nil {
-			agentSigners, err := getAgentSigners(server.SSHAgent)
-			if err != nil {
-				return nil, err
-			}
-			signers = append(signers, agentSigners...)
+			ac = server.sshAgent()
 		} else {
 			log.WithError(err).Warnf("%s cannot be read. Will not try to talk to ssh agent", server.SSHAgent)
 		}
 	}
 
-	if len(signers) == 0 {
-		return nil, fmt.Errorf("at least one working authentication method (key or ssh agent) must be present.")
+	if len(server.RSASignatureAlgorithms) > 0 {
+		var err error
+
+		signers, err = restrictRSASignatures(signers, server.RSASignatureAlgorithms)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var auth []ssh.AuthMethod
+
+	// a single public key method is tried per connection, so the keys held by
+	// the agent are offered along with the given key, after it.
+	if ac != nil {
+		auth = append(auth, ssh.PublicKeysCallback(func() ([]ssh.Signer, error) {
+			agentSigners, err := ac.Signers()
+			if err == nil && len(server.RSASignatureAlgorithms) > 0 {
+				agentSigners, err = restrictRSASignatures(agentSigners, server.RSASignatureAlgorithms)
+			}
+
+			if err != nil {
+				log.WithError(err).Warnf("error retrieving keys from ssh agent %s", server.SSHAgent)
+				return signers, nil
+			}
+
+			return append(append([]ssh.Signer{}, signers...), agentSigners...), nil
+		}))
+	} else if len(signers) > 0 {
+		auth = append(auth, ssh.PublicKeys(signers...))
+	}
+
+	if server.Password != "" {
+		auth = append(auth, ssh.Password(server.Password))
+	} else if server.Prompt != nil {
+		auth = append(auth, ssh.PasswordCallback(func() (string, error) {
+			question := fmt.Sprintf("%s@%s's password: ", server.User, server.Name)
+
+			answers, err := server.Prompt("", "", []string{question}, []bool{false})
+			if err != nil {
+				return "", err
+			}
+
+			return answers[0], nil
+		}))
 	}
 
-	clb, err := knownHostsCallback(server.Insecure)
-	if err != nil {
-		return nil, err
+	if server.Prompt != nil {
+		auth = append(auth, ssh.KeyboardInteractive(server.Prompt))
 	}
 
-	return &ssh.ClientConfig{
-		User: server.User,
-		Auth: []ssh.AuthMethod{
-			ssh.PublicKeys(signers...),
-		},
+	if len(auth) == 0 {
+		return nil, fmt.Errorf("at least one working authentication method (key, ssh agent, password or prompt) must be present.")
+	}
+
+	clb := server.HostKeyCallback
+	if clb == nil || server.Insecure {
+		var err error
+
+		clb, err = knownHostsCallback(server.Insecure, server.KnownHostsFiles...)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	config := &ssh.ClientConfig{
+		User:            server.User,
+		Auth:            auth,
 		HostKeyCallback: clb,
 		Timeout:         server.Timeout,
-	}, nil
+	}
+
+	if server.Strict {
+		config.KeyExchanges = StrictKeyExchanges
+		config.Ciphers = StrictCiphers
+		config.MACs = StrictMACs
+	}
+
+	return config, nil
 }
 
-func copyConn(writer, reader net.Conn) {
-	_, err := io.Copy(writer, reader)
-	defer writer.Close()
-	defer reader.Close()
-	if err != nil {
-		log.Errorf("%v", err)
+// restrictRSASignatures makes the RSA keys among the given signers only sign
+// using the given algorithms.
+func restrictRSASignatures(signers []ssh.Signer, algorithms []string) ([]ssh.Signer, error) {
+	supported := make(map[string]bool, len(RSASignatureAlgorithms))
+	for _, a := range RSASignatureAlgorithms {
+		supported[a] = true
+	}
+
+	for _, a := range algorithms {
+		if !supported[a] {
+			return nil, fmt.Errorf("invalid rsa signature algorithm %s: expected one of %s", a, strings.Join(RSASignatureAlgorithms, ", "))
+		}
+	}
+
+	restricted := make([]ssh.Signer, len(signers))
+
+	for i, signer := range signers {
+		restricted[i] = signer
+
+		if signer.PublicKey().Type() != ssh.KeyAlgoRSA {
+			continue
+		}
+
+		as, ok := signer.(ssh.AlgorithmSigner)
+		if !ok {
+			continue
+		}
+
+		ms, err := ssh.NewSignerWithAlgorithms(as, algorithms)
+		if err != nil {
+			return nil, err
+		}
+
+		restricted[i] = ms
 	}
+
+	return restricted, nil
 }
 
-func getAgentSigners(addr string) ([]ssh.Signer, error) {
-	log.Debugf("ssh agent address: %s", addr)
-	conn, err := net.Dial("unix", addr)
-	if err != nil {
-		return nil, err
+// forward copies data both ways between a client connection and its
+// destination until one of them closes its end, which is logged as the reason
+// the forwarded connection was closed.
+//
+// The other connection is then closed right away, so a client sitting idle
+// doesn't hold its connection, and the ssh channel, open once the destination
+// is gone. If the tunnel is set to HalfClose, only its sending side is closed
+// instead, and the forwarded connection lasts until both ends are closed.
+func (t *Tunnel) forward(channel *SSHChannel, connId string, conn, destinationConn net.Conn) {
+	defer conn.Close()
+	defer destinationConn.Close()
+
+	closed := make(chan closeReason, 2)
+
+	reader, destinationReader := conn, destinationConn
+
+	var trace *connTrace
+	if t.Trace {
+		trace = newConnTrace(t.TraceLimit)
+		reader = tracedConn{Conn: conn, trace: trace, direction: "sent"}
+		destinationReader = tracedConn{Conn: destinationConn, trace: trace, direction: "received"}
+	}
+
+	sent := countedConn{Conn: reader, count: &channel.dials.sent}
+	received := countedConn{Conn: destinationReader, count: &channel.dials.received}
+
+	// the end of the connection carried by an ssh channel is the destination
+	// on local tunnels and the client on remote ones.
+	if t.Type == "remote" {
+		sent.lastRead = &t.lastReceived
+	} else {
+		received.lastRead = &t.lastReceived
+	}
+
+	reader, destinationReader = sent, received
+
+	go func() {
+		closed <- closeReason{by: "destination", err: copyConn(conn, destinationReader, t.CopyBufferSize)}
+	}()
+
+	go func() {
+		closed <- closeReason{by: "client", err: copyConn(destinationConn, reader, t.CopyBufferSize)}
+	}()
+
+	first := <-closed
+	logCopyError(connId, first.err)
+
+	if t.HalfClose && first.err == nil && closeWrite(first.peer(conn, destinationConn)) {
+		logCopyError(connId, (<-closed).err)
+	} else {
+		conn.Close()
+		destinationConn.Close()
+
+		// the other copy fails reading from the connections just closed.
+		<-closed
+	}
+
+	if channel.Quiet {
+		return
+	}
+
+	if trace != nil {
+		trace.log(channel, connId)
+	}
+
+	fields := log.Fields{
+		"channel":    channel,
+		"connection": connId,
+		"client":     conn.RemoteAddr(),
+		"closed-by":  first.by,
+	}
+
+	if first.err != nil {
+		fields["reason"] = first.err
+	}
+
+	log.WithFields(fields).Debug("connection closed")
+}
+
+// closeReason tells which end of a forwarded connection closed it first, the
+// client or the destination, along with the error that made it close, if any.
+type closeReason struct {
+	by  string
+	err error
+}
+
+// peer returns the connection data was being copied to when the connection
+// was closed, out of the given client and destination connections.
+func (r closeReason) peer(conn, destinationConn net.Conn) net.Conn {
+	if r.by == "destination" {
+		return conn
+	}
+
+	return destinationConn
+}
+
+// closeWrite closes the sending side of the given connection, returning false
+// if the connection doesn't support closing only one of its sides.
+func closeWrite(conn net.Conn) bool {
+	cw, ok := conn.(interface{ CloseWrite() error })
+	if !ok {
+		return false
+	}
+
+	return cw.CloseWrite() == nil
+}
+
+// logCopyError logs the given error, if any, returned while copying data
+// between the ends of a forwarded connection.
+func logCopyError(connId string, err error) {
+	if err == nil {
+		return
 	}
-	client := agent.NewClient(conn)
-	return client.Signers()
+
+	log.WithError(err).WithFields(log.Fields{
+		"connection": connId,
+	}).Error("error copying data between connections")
+}
+
+// copyConn copies data from reader to writer until reader reaches EOF or an
+// error occurs, returning the error if it's not EOF.
+//
+// Unless a buffer size is given, the connections are handed to io.Copy as
+// they are, so a copy between two tcp connections takes place in the kernel
+// (splice) on linux. Forwarded connections always have an ssh channel on one
+// of their ends though, whose data is encrypted in user space, so they can't
+// benefit from it.
+func copyConn(writer, reader net.Conn, bufferSize int) error {
+	if bufferSize > 0 {
+		// hide any io.ReaderFrom or io.WriterTo implementation, which would
+		// make io.CopyBuffer ignore the given buffer.
+		_, err := io.CopyBuffer(struct{ io.Writer }{writer}, struct{ io.Reader }{reader}, make([]byte, bufferSize))
+		return err
+	}
+
+	_, err := io.Copy(writer, reader)
+	return err
 }
 
-func knownHostsCallback(insecure bool) (ssh.HostKeyCallback, error) {
+// SystemKnownHostsFile is the location of the system wide known_hosts file,
+// consulted along with the known_hosts file of the user by default.
+var SystemKnownHostsFile = "/etc/ssh/ssh_known_hosts"
+
+// knownHostsCallback returns a callback verifying host keys against all the
+// given known_hosts files. If none is given, the known_hosts file of the user
+// and SystemKnownHostsFile are used, skipping the ones that don't exist.
+func knownHostsCallback(insecure bool, files ...string) (ssh.HostKeyCallback, error) {
 	var clb func(hostname string, remote net.Addr, key ssh.PublicKey) error
 
 	if insecure {
@@ -546,23 +3312,53 @@ func knownHostsCallback(insecure bool) (ssh.HostKeyCallback, error) {
 		}
 	} else {
 		var err error
-		home, err := os.UserHomeDir()
-		if err != nil {
-			return nil, fmt.Errorf("could not obtain user home directory :%v", err)
+
+		if len(files) == 0 {
+			files, err = defaultKnownHostsFiles()
+			if err != nil {
+				return nil, err
+			}
 		}
 
-		knownHostFile := filepath.Join(home, ".ssh", "known_hosts")
-		log.Debugf("known_hosts file used: %s", knownHostFile)
+		log.Debugf("known_hosts files used: %s", strings.Join(files, ", "))
 
-		clb, err = knownhosts.New(knownHostFile)
+		verify, err := knownhosts.New(files...)
 		if err != nil {
-			return nil, fmt.Errorf("error while parsing 'known_hosts' file: %s: %v", knownHostFile, err)
+			return nil, fmt.Errorf("error while parsing 'known_hosts' files: %s: %v", strings.Join(files, ", "), err)
+		}
+
+		clb = func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+			return newHostKeyError(hostname, key, files, verify(hostname, remote, key))
 		}
 	}
 
 	return clb, nil
 }
 
+// defaultKnownHostsFiles returns the known_hosts file of the user along with
+// the system wide one, if it exists.
+//
+// The known_hosts file of the user is always returned if there is no system
+// wide file, so a meaningful error is reported when neither exist.
+func defaultKnownHostsFiles() ([]string, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return nil, fmt.Errorf("could not obtain user home directory :%v", err)
+	}
+
+	userFile := filepath.Join(home, ".ssh", "known_hosts")
+
+	if _, err := os.Stat(SystemKnownHostsFile); err != nil {
+		return []string{userFile}, nil
+	}
+
+	if _, err := os.Stat(userFile); err != nil {
+		return []string{SystemKnownHostsFile}, nil
+	}
+
+	return []string{userFile, SystemKnownHostsFile}, nil
+}
+
 func reconcile(precident, subsequent string) string {
 	if precident != "" {
 		return precident
@@ -571,15 +3367,84 @@ func reconcile(precident, subsequent string) string {
 	return subsequent
 }
 
+// expandAddress fills in the loopback address on addresses given without a
+// host (e.g. ":8080").
 func expandAddress(address string) string {
 	if strings.HasPrefix(address, ":") {
-		return fmt.Sprintf("127.0.0.1%s", address)
+		return fmt.Sprintf("%s%s", LoopbackAddress, address)
 	}
 
 	return address
 }
 
+// addressNetwork returns the network of the given channel address: "unix" for
+// unix socket paths, which, unlike host and port pairs, contain a slash (e.g.
+// /var/run/docker.sock), and "tcp" otherwise.
+func addressNetwork(address string) string {
+	if strings.Contains(address, "/") {
+		return "unix"
+	}
+
+	return "tcp"
+}
+
+// expandServerAddress expands an address that is dialed or listened on by the
+// ssh server.
+//
+// Both an empty host and "localhost" refer to the loopback interface of the
+// ssh server itself, never to the loopback interface of the machine running
+// mole. "localhost" is kept as given, so it is resolved by the ssh server on
+// its own side (e.g. to ::1 for services only bound to it).
+func expandServerAddress(address string) string {
+	return expandAddress(address)
+}
+
 func buildSSHChannels(serverName, channelType string, source, destination []string, cfgPath string) ([]*SSHChannel, error) {
+	if channelType == "stdio" {
+		if len(destination) != 1 {
+			return nil, fmt.Errorf("a stdio tunnel requires exactly one destination address")
+		}
+
+		return []*SSHChannel{{ChannelType: channelType, Source: StdioSource, Destination: expandServerAddress(destination[0])}}, nil
+	}
+
+	// the source of a tun channel is the name of the local tun device.
+	if channelType == "tun" {
+		if len(source) > 1 {
+			return nil, fmt.Errorf("a tun tunnel accepts at most one tun device")
+		}
+
+		ch := &SSHChannel{ChannelType: channelType, Source: TunDefaultDevice, Destination: TunAnyDestination}
+		if len(source) == 1 && source[0] != "" {
+			ch.Source = source[0]
+		}
+
+		return []*SSHChannel{ch}, nil
+	}
+
+	// dynamic channels forward each connection to the destination its client
+	// asks for, so only the addresses to listen on are given.
+	if channelType == "dynamic" {
+		if len(destination) > 0 {
+			return nil, fmt.Errorf("a dynamic tunnel doesn't accept destination addresses")
+		}
+
+		if len(source) == 0 {
+			source = []string{RandomPortAddress}
+		}
+
+		channels := make([]*SSHChannel, len(source))
+		for i, addr := range source {
+			if addr == "" {
+				addr = RandomPortAddress
+			}
+
+			channels[i] = &SSHChannel{ChannelType: channelType, Source: expandAddress(addr)}
+		}
+
+		return channels, nil
+	}
+
 	// if source and destination were not given, try to find the addresses from the
 	// SSH configuration file.
 	if len(source) == 0 && len(destination) == 0 {
@@ -624,12 +3489,22 @@ func buildSSHChannels(serverName, channelType string, source, destination []stri
 		}
 	}
 
+	// for local port forwarding the destination is dialed by the ssh server and,
+	// for remote port forwarding, the source is listened on by the ssh server.
 	for i, addr := range source {
-		source[i] = expandAddress(addr)
+		if channelType == "remote" {
+			source[i] = expandServerAddress(addr)
+		} else {
+			source[i] = expandAddress(addr)
+		}
 	}
 
 	for i, addr := range destination {
-		destination[i] = expandAddress(addr)
+		if channelType == "local" {
+			destination[i] = expandServerAddress(addr)
+		} else {
+			destination[i] = expandAddress(addr)
+		}
 	}
 
 	channels := make([]*SSHChannel, len(destination))
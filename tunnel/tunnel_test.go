@@ -1,6 +1,12 @@
 package tunnel
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/binary"
 	"errors"
 	"fmt"
@@ -8,14 +14,21 @@ import (
 	"io/ioutil"
 	"net"
 	"net/http"
+	"net/http/httptest"
 	"os"
 	"path/filepath"
 	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/phayes/freeport"
+	log "github.com/sirupsen/logrus"
 	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
 	"golang.org/x/crypto/ssh/knownhosts"
 )
 
@@ -92,6 +105,48 @@ func TestServerOptions(t *testing.T) {
 			},
 			nil,
 		},
+		{
+			"",
+			"identitiesOnly",
+			"",
+			"testdata/.ssh/config",
+			&Server{
+				Name:           "identitiesOnly",
+				Address:        "127.0.0.1:2222",
+				User:           "mole_test",
+				Key:            k1,
+				IdentitiesOnly: true,
+			},
+			nil,
+		},
+		{
+			"",
+			"behindBastion",
+			"",
+			"testdata/.ssh/config",
+			&Server{
+				Name:    "behindBastion",
+				Address: "10.0.0.5:22",
+				User:    "mole_test",
+				Key:     k1,
+				Jump: []*Server{
+					{
+						Name:    "test",
+						Address: "127.0.0.1:2222",
+						User:    "mole_test",
+						Key:     k1,
+					},
+					{
+						Name:           "identitiesOnly",
+						Address:        "127.0.0.1:2200",
+						User:           "jumper",
+						Key:            k1,
+						IdentitiesOnly: true,
+					},
+				},
+			},
+			nil,
+		},
 		{
 			"",
 			"",
@@ -120,6 +175,188 @@ func TestServerOptions(t *testing.T) {
 	}
 }
 
+func TestWithoutDefaultKey(t *testing.T) {
+	k, _ := NewPemKey("testdata/.ssh/id_rsa", "")
+
+	// no key is configured for this server on the ssh config file
+	s, err := NewServer("mole", "127.0.0.1:2222", "", "", "testdata/.ssh/config", WithoutDefaultKey())
+	if err == nil {
+		t.Errorf("error expected when no key is given and the default key fallback is disabled")
+	}
+
+	if s != nil {
+		t.Errorf("no server was expected to be created, got: %s", s)
+	}
+
+	s, err = NewServer("mole", "127.0.0.1:2222", "", "/tmp/agent.sock", "testdata/.ssh/config", WithoutDefaultKey())
+	if err != nil {
+		t.Fatalf("unexpected error when an ssh agent is available: %v", err)
+	}
+
+	if s.Key != nil {
+		t.Errorf("no key was expected to be used along with the ssh agent, got: %s", s.Key.Path)
+	}
+
+	// keys found on the ssh config file are still used
+	s, err = NewServer("", "test", "", "", "testdata/.ssh/config", WithoutDefaultKey())
+	if err != nil {
+		t.Fatalf("unexpected error when a key is found on the ssh config file: %v", err)
+	}
+
+	if !reflect.DeepEqual(k, s.Key) {
+		t.Errorf("unexpected key: expected: %v, value: %v", k, s.Key)
+	}
+
+	// the default key is still taken if the fallback is not disabled
+	s, err = NewServer("mole", "127.0.0.1:2222", "", "", "testdata/.ssh/config")
+	if err != nil {
+		t.Fatalf("unexpected error when falling back to the default key: %v", err)
+	}
+
+	if s.Key == nil || filepath.Base(s.Key.Path) != "id_rsa" {
+		t.Errorf("default key was expected to be used, got: %v", s.Key)
+	}
+}
+
+func TestWithPort(t *testing.T) {
+	tests := []struct {
+		address  string
+		options  []ServerOption
+		expected string
+	}{
+		// the port given as part of the address takes precedence
+		{"test:3333", []ServerOption{WithPort("4444")}, "127.0.0.1:3333"},
+		// then the one given as an option, over the ssh config file
+		{"test", []ServerOption{WithPort("4444")}, "127.0.0.1:4444"},
+		{"test", nil, "127.0.0.1:2222"},
+		{"172.17.0.10", []ServerOption{WithPort("4444")}, "172.17.0.10:4444"},
+		{"172.17.0.10", []ServerOption{WithPort("")}, "172.17.0.10:22"},
+	}
+
+	for i, test := range tests {
+		s, err := NewServer("mole", test.address, "testdata/.ssh/id_rsa", "", "testdata/.ssh/config", test.options...)
+		if err != nil {
+			t.Fatalf("test %d: unexpected error: %v", i, err)
+		}
+
+		if test.expected != s.Address {
+			t.Errorf("test %d: unexpected server address: expected: %s, value: %s", i, test.expected, s.Address)
+		}
+	}
+}
+
+func TestIdentitiesOnly(t *testing.T) {
+	sshServer, err := createSSHServer(t, "", keyPath)
+	if err != nil {
+		t.Fatalf("error while creating ssh server: %s", err)
+	}
+	defer sshServer.Close()
+
+	sock, accepted, _ := createSSHAgent(t)
+
+	k, _ := NewPemKey("testdata/.ssh/id_rsa", "")
+
+	for _, identitiesOnly := range []bool{true, false} {
+		ac := &agentClient{path: sock}
+		srv := &Server{User: "mole", Address: sshServer.Addr().String(), Key: k, SSHAgent: sock, Insecure: true, IdentitiesOnly: identitiesOnly, agent: ac}
+
+		c, err := sshClientConfig(srv)
+		if err != nil {
+			t.Fatalf("unexpected error generating client config: %v", err)
+		}
+
+		client, err := dialServer(srv, c, &DialLatency{})
+		if err != nil {
+			t.Fatalf("unexpected error connecting to ssh server: %v", err)
+		}
+		client.Close()
+		ac.Close()
+
+		if used := atomic.LoadInt32(accepted) > 0; used == identitiesOnly {
+			t.Errorf("unexpected use of the ssh agent: identities only: %t, used: %t", identitiesOnly, used)
+		}
+	}
+}
+
+func TestPasswordAuthentication(t *testing.T) {
+	srv := Server{User: "mole", Password: "mole", Insecure: true}
+
+	c, err := sshClientConfig(&srv)
+	if err != nil {
+		t.Fatalf("password was expected to be enough to authenticate: %v", err)
+	}
+
+	if len(c.Auth) != 1 {
+		t.Errorf("unexpected number of authentication methods: %d", len(c.Auth))
+	}
+
+	k, _ := NewPemKey("testdata/.ssh/id_rsa", "")
+	srv.Key = k
+
+	c, err = sshClientConfig(&srv)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if len(c.Auth) != 2 {
+		t.Errorf("password was expected to be offered along with the key: %d methods", len(c.Auth))
+	}
+}
+
+func TestStrictMode(t *testing.T) {
+	k, _ := NewPemKey("testdata/.ssh/id_rsa", "")
+	srv := Server{User: "mole", Key: k, Insecure: true, Strict: true}
+
+	_, err := sshClientConfig(&srv)
+	if err == nil {
+		t.Errorf("error expected when skipping host key verification in strict mode")
+	}
+
+	sshServer, err := createSSHServer(t, "", keyPath)
+	if err != nil {
+		t.Fatalf("error while creating ssh server: %s", err)
+	}
+	defer sshServer.Close()
+
+	err = generateKnownHosts(sshServer.Addr(), publicKeyPath, knownHostsPath)
+	if err != nil {
+		t.Fatalf("error generating known hosts file for tests: %v", err)
+	}
+
+	l, hs := createHttpServer()
+	defer hs.Close()
+
+	s, _ := NewServer("mole", sshServer.Addr().String(), "", "", "testdata/.ssh/config")
+	s.Strict = true
+
+	c, err := sshClientConfig(s)
+	if err != nil {
+		t.Fatalf("unexpected error generating strict client config: %v", err)
+	}
+
+	if !reflect.DeepEqual(StrictCiphers, c.Ciphers) || !reflect.DeepEqual(StrictKeyExchanges, c.KeyExchanges) || !reflect.DeepEqual(StrictMACs, c.MACs) {
+		t.Errorf("strict algorithms were expected on client config: %+v", c.Config)
+	}
+
+	tun, _ := New("local", s, []string{"127.0.0.1:0"}, []string{l.Addr().String()}, configPath)
+	tun.ConnectionRetries = NoSshRetries
+	tun.KeepAliveInterval = 10 * time.Second
+
+	go tun.Start()
+	defer tun.Stop()
+
+	select {
+	case <-tun.Ready:
+	case <-time.After(2 * time.Second):
+		t.Fatalf("strict tunnel was not ready in time")
+	}
+
+	err = validateTunnelConnectivity(t, "ABC", tun)
+	if err != nil {
+		t.Errorf("%v", err)
+	}
+}
+
 func TestLocalTunnel(t *testing.T) {
 	c := &tunnelConfig{t, "local", 1, false, NoSshRetries}
 	tun, _, _ := prepareTunnel(c)
@@ -140,6 +377,43 @@ func TestLocalTunnel(t *testing.T) {
 	tun.Stop()
 }
 
+func TestTunnelStarted(t *testing.T) {
+	c := &tunnelConfig{t, "local", 1, false, NoSshRetries}
+	tun, _, _ := prepareTunnel(c)
+	defer tun.Stop()
+
+	waiters := 3
+	started := make(chan bool, waiters)
+
+	for i := 0; i < waiters; i++ {
+		go func() {
+			select {
+			case <-tun.Started():
+				started <- true
+			case <-time.After(1 * time.Second):
+				started <- false
+			}
+		}()
+	}
+
+	for i := 0; i < waiters; i++ {
+		if !<-started {
+			t.Errorf("error waiting for tunnel to be started")
+		}
+	}
+
+	select {
+	case <-tun.Ready:
+	case <-time.After(1 * time.Second):
+		t.Errorf("ready was expected to be signaled along with started")
+	}
+
+	err := validateTunnelConnectivity(t, "ABC", tun)
+	if err != nil {
+		t.Errorf("%v", err)
+	}
+}
+
 func TestRemoteTunnel(t *testing.T) {
 	c := &tunnelConfig{t, "remote", 1, true, NoSshRetries}
 	tun, _, _ := prepareTunnel(c)
@@ -249,61 +523,580 @@ func TestReconnectSSHServer(t *testing.T) {
 	tun.Stop()
 }
 
-func validateTunnelConnectivity(t *testing.T, expected string, tun *Tunnel) error {
-	for _, sshChan := range tun.channels {
-		url := fmt.Sprintf("http://%s/%s", sshChan.listener.Addr(), expected)
-		timeout := time.Duration(500 * time.Millisecond)
-		client := http.Client{
-			Timeout: timeout,
-		}
-		resp, err := client.Get(url)
-		if err != nil {
-			return fmt.Errorf("error while making http request: %v", err)
-		}
-		defer resp.Body.Close()
+func TestReconnectKeepsListeners(t *testing.T) {
+	c := &tunnelConfig{t, "local", 1, false, 3}
+	tun, ssh, _ := prepareTunnel(c)
 
-		body, _ := ioutil.ReadAll(resp.Body)
-		response := string(body)
+	select {
+	case <-tun.Ready:
+		t.Log("tunnel is ready to accept connections")
+	case <-time.After(1 * time.Second):
+		t.Errorf("error waiting for tunnel to be ready")
+		return
+	}
 
-		if expected != response {
-			return fmt.Errorf("expected: %s, value: %s", expected, response)
+	listener := tun.channels[0].currentListener()
+	source := tun.channels[0].Source
+
+	ssh.Close()
+
+	// the local port must still accept connections while the tunnel is
+	// reconnecting, even if they can't be forwarded.
+	conn, err := net.Dial("tcp", source)
+	if err != nil {
+		t.Errorf("local listener is not accepting connections during reconnection: %v", err)
+		return
+	}
+	conn.Close()
+
+	_, err = createSSHServer(t, ssh.Addr().String(), keyPath)
+	if err != nil {
+		t.Errorf("error while recreating ssh server: %s", err)
+		return
+	}
+
+	select {
+	case <-tun.Ready:
+		t.Log("tunnel is ready to accept connections")
+	case <-time.After(10 * time.Second):
+		t.Errorf("error waiting for tunnel to be ready")
+		return
+	}
+
+	if listener != tun.channels[0].listener || source != tun.channels[0].Source {
+		t.Errorf("listener changed after reconnection: expected: %s, value: %s", source, tun.channels[0].Source)
+	}
+
+	err = validateTunnelConnectivity(t, "ABC", tun)
+	if err != nil {
+		t.Errorf("%v", err)
+	}
+
+	tun.Stop()
+}
+
+func TestStdioTunnel(t *testing.T) {
+	sshListener, err := createSSHServer(t, "", keyPath)
+	if err != nil {
+		t.Errorf("error while creating ssh server: %s", err)
+		return
+	}
+	defer sshListener.Close()
+
+	l, _ := createHttpServer()
+
+	srv, _ := NewServer("mole", sshListener.Addr().String(), "", "", "testdata/.ssh/config")
+	srv.Insecure = true
+
+	tun, err := New("stdio", srv, nil, []string{l.Addr().String()}, configPath)
+	if err != nil {
+		t.Errorf("error creating stdio tunnel: %v", err)
+		return
+	}
+
+	stdout := &bytes.Buffer{}
+	tun.Stdin = strings.NewReader("GET /ABC HTTP/1.0\r\n\r\n")
+	tun.Stdout = stdout
+	tun.ConnectionRetries = NoSshRetries
+	tun.KeepAliveInterval = 10 * time.Second
+
+	result := make(chan error, 1)
+	go func() {
+		result <- tun.Start()
+	}()
+
+	select {
+	case err = <-result:
+		if err != nil {
+			t.Errorf("error returned from stdio tunnel: %v", err)
 		}
+	case <-time.After(2 * time.Second):
+		t.Errorf("stdio tunnel did not finish after the destination closed the connection")
+		return
 	}
 
-	return nil
+	if !strings.HasSuffix(stdout.String(), "ABC") {
+		t.Errorf("unexpected response received through stdio tunnel: %s", stdout.String())
+	}
 }
 
-func TestMain(m *testing.M) {
-	err := prepareTestEnv()
+func TestConnectionAcceptedWhileReconnecting(t *testing.T) {
+	c := &tunnelConfig{t, "local", 1, false, NoSshRetries}
+	tun, _, _ := prepareTunnel(c)
+
+	select {
+	case <-tun.Ready:
+		t.Log("tunnel is ready to accept connections")
+	case <-time.After(1 * time.Second):
+		t.Errorf("error waiting for tunnel to be ready")
+		return
+	}
+
+	// simulates the window where the tunnel is reconnecting to the ssh server
+	client := tun.sshClient()
+	tun.setClient(nil)
+
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		tun.setClient(client)
+	}()
+
+	err := validateTunnelConnectivity(t, "ABC", tun)
 	if err != nil {
-		fmt.Printf("could not start test suite: %v\n", err)
-		os.RemoveAll(sshDir)
-		os.Exit(1)
+		t.Errorf("%v", err)
 	}
 
-	code := m.Run()
+	tun.Stop()
+}
 
-	os.RemoveAll(sshDir)
+func TestHashedKnownHosts(t *testing.T) {
+	d, _ := ioutil.ReadFile(publicKeyPath)
+	pk, _, _, _, _ := ssh.ParseAuthorizedKey(d)
 
-	os.Exit(code)
+	tests := []struct {
+		knownHost string
+		address   string
+	}{
+		{"example.com:22", "example.com:22"},
+		{"example.com:2222", "example.com:2222"},
+		{"example.com:2222", "Example.COM:2222"},
+		{"172.17.0.10:2222", "172.17.0.10:2222"},
+	}
+
+	for id, test := range tests {
+		l := knownhosts.Line([]string{knownhosts.HashHostname(knownhosts.Normalize(test.knownHost))}, pk)
+		ioutil.WriteFile(knownHostsPath, []byte(l), 0600)
+
+		clb, err := knownHostsCallback(false)
+		if err != nil {
+			t.Errorf("error creating known hosts callback on test %d: %v", id, err)
+			continue
+		}
+
+		remote := &net.TCPAddr{IP: net.ParseIP("192.168.1.1"), Port: 2222}
+		err = clb(hostKeyAddress(test.address), remote, pk)
+		if err != nil {
+			t.Errorf("hashed known_hosts entry for %s did not match %s on test %d: %v", test.knownHost, test.address, id, err)
+		}
+	}
 }
 
-func TestBuildSSHChannels(t *testing.T) {
+func TestKnownHostsFiles(t *testing.T) {
+	d, _ := ioutil.ReadFile(publicKeyPath)
+	pk, _, _, _, _ := ssh.ParseAuthorizedKey(d)
+
+	systemFile := filepath.Join(sshDir, "ssh_known_hosts")
+	defer os.Remove(systemFile)
+
+	defer func(f string) { SystemKnownHostsFile = f }(SystemKnownHostsFile)
+	SystemKnownHostsFile = systemFile
+
+	ioutil.WriteFile(knownHostsPath, []byte(knownhosts.Line([]string{"user.example.com:22"}, pk)), 0600)
+	ioutil.WriteFile(systemFile, []byte(knownhosts.Line([]string{"system.example.com:22"}, pk)), 0600)
+
+	remote := &net.TCPAddr{IP: net.ParseIP("192.168.1.1"), Port: 22}
+
 	tests := []struct {
-		serverName    string
-		source        []string
-		destination   []string
-		config        string
-		expected      int
-		expectedError error
+		files    []string
+		accepted []string
+		rejected []string
 	}{
 		{
-			serverName:    "test",
-			source:        []string{":3360"},
-			destination:   []string{":3360"},
-			config:        "testdata/.ssh/config",
-			expected:      1,
-			expectedError: nil,
+			nil,
+			[]string{"user.example.com:22", "system.example.com:22"},
+			[]string{"other.example.com:22"},
+		},
+		{
+			[]string{systemFile},
+			[]string{"system.example.com:22"},
+			[]string{"user.example.com:22"},
+		},
+		{
+			[]string{knownHostsPath, systemFile},
+			[]string{"user.example.com:22", "system.example.com:22"},
+			nil,
+		},
+	}
+
+	for id, test := range tests {
+		clb, err := knownHostsCallback(false, test.files...)
+		if err != nil {
+			t.Errorf("error creating known hosts callback on test %d: %v", id, err)
+			continue
+		}
+
+		for _, address := range test.accepted {
+			if err := clb(address, remote, pk); err != nil {
+				t.Errorf("host key of %s expected to be accepted on test %d: %v", address, id, err)
+			}
+		}
+
+		for _, address := range test.rejected {
+			if err := clb(address, remote, pk); err == nil {
+				t.Errorf("host key of %s expected to be rejected on test %d", address, id)
+			}
+		}
+	}
+
+	// a missing system wide file is skipped unless given explicitly
+	os.Remove(systemFile)
+
+	if _, err := knownHostsCallback(false); err != nil {
+		t.Errorf("error creating known hosts callback without a system wide file: %v", err)
+	}
+
+	if _, err := knownHostsCallback(false, knownHostsPath, systemFile); err == nil {
+		t.Errorf("error expected creating known hosts callback with a missing file")
+	}
+}
+
+func TestReconnectOnNetworkChange(t *testing.T) {
+	var changed int32
+
+	defaultNetworkAddrs := networkAddrs
+	networkAddrs = func() (string, error) {
+		if atomic.LoadInt32(&changed) == 1 {
+			return "192.168.1.2/24", nil
+		}
+
+		return "192.168.1.1/24", nil
+	}
+	defer func() { networkAddrs = defaultNetworkAddrs }()
+
+	sshListener, err := createSSHServer(t, "", keyPath)
+	if err != nil {
+		t.Errorf("error while creating ssh server: %s", err)
+		return
+	}
+	defer sshListener.Close()
+
+	l, _ := createHttpServer()
+
+	srv, _ := NewServer("mole", sshListener.Addr().String(), "", "", "testdata/.ssh/config")
+	srv.Insecure = true
+
+	tun, _ := New("local", srv, []string{"127.0.0.1:0"}, []string{l.Addr().String()}, configPath)
+	tun.ConnectionRetries = 3
+	tun.WaitAndRetry = 100 * time.Millisecond
+	tun.KeepAliveInterval = 10 * time.Second
+	tun.NetworkCheckInterval = 50 * time.Millisecond
+
+	go tun.Start()
+	defer tun.Stop()
+
+	select {
+	case <-tun.Ready:
+		t.Log("tunnel is ready to accept connections")
+	case <-time.After(1 * time.Second):
+		t.Errorf("error waiting for tunnel to be ready")
+		return
+	}
+
+	client := tun.sshClient()
+	atomic.StoreInt32(&changed, 1)
+
+	select {
+	case <-tun.Ready:
+		t.Log("tunnel is ready to accept connections after network change")
+	case <-time.After(2 * time.Second):
+		t.Errorf("tunnel did not reconnect after network change")
+		return
+	}
+
+	if client == tun.sshClient() {
+		t.Errorf("tunnel is still using the connection established before the network change")
+	}
+
+	err = validateTunnelConnectivity(t, "ABC", tun)
+	if err != nil {
+		t.Errorf("%v", err)
+	}
+}
+
+func TestRetriesResetAfterStablePeriod(t *testing.T) {
+	tests := []struct {
+		connectedAt      time.Time
+		retries          int
+		expectedAttempts int
+	}{
+		{time.Now(), 2, 1},
+		{time.Now().Add(-2 * time.Hour), 2, 3},
+	}
+
+	for id, test := range tests {
+		l, attempts := createFailingServer()
+
+		srv, _ := NewServer("mole", l.Addr().String(), "", "", "testdata/.ssh/config")
+		srv.Insecure = true
+
+		tun, _ := New("local", srv, []string{"127.0.0.1:0"}, []string{"127.0.0.1:80"}, configPath)
+		tun.ConnectionRetries = 3
+		tun.WaitAndRetry = 10 * time.Millisecond
+		tun.StableConnectionPeriod = 1 * time.Hour
+		tun.connectedAt = test.connectedAt
+		tun.retries = test.retries
+
+		err := tun.dial()
+		l.Close()
+
+		if err == nil {
+			t.Errorf("dial was expected to fail on test %d", id)
+		}
+
+		if a := <-attempts; test.expectedAttempts != a {
+			t.Errorf("unexpected number of connection attempts on test %d: expected: %d, value: %d", id, test.expectedAttempts, a)
+		}
+	}
+}
+
+func TestServerResolve(t *testing.T) {
+	failingResolver := &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			return nil, errors.New("dns server unreachable")
+		},
+	}
+
+	tests := []struct {
+		server        Server
+		expected      []string
+		expectedError bool
+	}{
+		{Server{Address: "127.0.0.1:22"}, []string{"127.0.0.1:22"}, false},
+		{Server{Address: "127.0.0.1:22", Resolver: failingResolver}, []string{"127.0.0.1:22"}, false},
+		{Server{Address: "mole.example:22", Resolver: failingResolver, DNSTimeout: time.Second}, nil, true},
+		{Server{Address: "Mole.Example:22", Resolver: failingResolver, HostAliases: map[string]string{"mole.example": "10.0.0.1"}}, []string{"10.0.0.1:22"}, false},
+	}
+
+	for id, test := range tests {
+		addrs, err := test.server.resolve()
+		if test.expectedError != (err != nil) {
+			t.Errorf("unexpected error on test %d: %v", id, err)
+		}
+
+		if !reflect.DeepEqual(test.expected, addrs) {
+			t.Errorf("unexpected addresses on test %d: expected: %s, value: %s", id, test.expected, addrs)
+		}
+	}
+}
+
+func BenchmarkCopyBufferSize(b *testing.B) {
+	for _, size := range []int{0, 4 * 1024, 256 * 1024} {
+		b.Run(fmt.Sprintf("buffer=%d", size), func(b *testing.B) {
+			benchmarkTunnelThroughput(b, size)
+		})
+	}
+}
+
+// BenchmarkCopyConn measures copyConn between two tcp connections, which
+// linux copies in the kernel (splice) unless a copy buffer size is given.
+func BenchmarkCopyConn(b *testing.B) {
+	for _, size := range []int{0, 32 * 1024} {
+		b.Run(fmt.Sprintf("buffer=%d", size), func(b *testing.B) {
+			benchmarkCopyConn(b, size)
+		})
+	}
+}
+
+func benchmarkCopyConn(b *testing.B, bufferSize int) {
+	const payloadSize = 64 * 1024 * 1024
+
+	// tcpPair returns both ends of a tcp connection.
+	tcpPair := func() (net.Conn, net.Conn) {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			b.Fatal(err)
+		}
+		defer l.Close()
+
+		accepted := make(chan net.Conn, 1)
+		go func() {
+			conn, _ := l.Accept()
+			accepted <- conn
+		}()
+
+		conn, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			b.Fatal(err)
+		}
+
+		return conn, <-accepted
+	}
+
+	payload := make([]byte, payloadSize)
+
+	b.SetBytes(payloadSize)
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		client, reader := tcpPair()
+		writer, destination := tcpPair()
+
+		copied := make(chan error, 1)
+		go func() {
+			copied <- copyConn(writer, reader, bufferSize)
+			writer.Close()
+		}()
+
+		go func() {
+			client.Write(payload)
+			client.Close()
+		}()
+
+		n, err := io.Copy(ioutil.Discard, destination)
+		if err != nil || n != payloadSize {
+			b.Fatalf("unexpected copy result: %d bytes, %v", n, err)
+		}
+
+		if err := <-copied; err != nil {
+			b.Fatalf("error copying data: %v", err)
+		}
+
+		reader.Close()
+		destination.Close()
+	}
+}
+
+// benchmarkTunnelThroughput measures how fast data can be sent through a local
+// tunnel to a destination that discards everything it receives.
+func benchmarkTunnelThroughput(b *testing.B, bufferSize int) {
+	const payloadSize = 8 * 1024 * 1024
+
+	sshServer, err := createSSHServer(b, "", keyPath)
+	if err != nil {
+		b.Fatalf("error while creating ssh server: %s", err)
+	}
+	defer sshServer.Close()
+
+	sink, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatalf("error while creating destination server: %s", err)
+	}
+	defer sink.Close()
+
+	go func() {
+		for {
+			conn, err := sink.Accept()
+			if err != nil {
+				return
+			}
+
+			go func(conn net.Conn) {
+				defer conn.Close()
+
+				_, err := io.CopyN(ioutil.Discard, conn, payloadSize)
+				if err == nil {
+					conn.Write([]byte{0})
+				}
+			}(conn)
+		}
+	}()
+
+	srv, _ := NewServer("mole", sshServer.Addr().String(), "", "", "testdata/.ssh/config")
+	srv.Insecure = true
+
+	tun, err := New("local", srv, []string{"127.0.0.1:0"}, []string{sink.Addr().String()}, configPath)
+	if err != nil {
+		b.Fatalf("error creating tunnel: %v", err)
+	}
+	tun.CopyBufferSize = bufferSize
+	tun.ConnectionRetries = -1
+	tun.KeepAliveInterval = 10 * time.Second
+
+	go tun.Start()
+	defer tun.Stop()
+
+	select {
+	case <-tun.Ready:
+	case <-time.After(5 * time.Second):
+		b.Fatalf("tunnel did not get ready")
+	}
+
+	payload := make([]byte, payloadSize)
+	ack := make([]byte, 1)
+
+	b.SetBytes(payloadSize)
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		conn, err := net.Dial("tcp", tun.channels[0].listener.Addr().String())
+		if err != nil {
+			b.Fatalf("error connecting to the tunnel: %v", err)
+		}
+
+		_, err = conn.Write(payload)
+		if err != nil {
+			b.Fatalf("error sending data through the tunnel: %v", err)
+		}
+
+		_, err = io.ReadFull(conn, ack)
+		if err != nil {
+			b.Fatalf("error waiting for the data to be received: %v", err)
+		}
+
+		conn.Close()
+	}
+}
+
+func validateTunnelConnectivity(t *testing.T, expected string, tun *Tunnel) error {
+	for _, sshChan := range tun.channels {
+		url := fmt.Sprintf("http://%s/%s", sshChan.listener.Addr(), expected)
+		timeout := time.Duration(500 * time.Millisecond)
+		client := http.Client{
+			Timeout: timeout,
+		}
+		resp, err := client.Get(url)
+		if err != nil {
+			return fmt.Errorf("error while making http request: %v", err)
+		}
+		defer resp.Body.Close()
+
+		body, _ := ioutil.ReadAll(resp.Body)
+		response := string(body)
+
+		if expected != response {
+			return fmt.Errorf("expected: %s, value: %s", expected, response)
+		}
+	}
+
+	return nil
+}
+
+func TestMain(m *testing.M) {
+	// the system-wide ssh config file of the machine running the tests would
+	// change their results.
+	SystemSSHConfigPath = ""
+
+	err := prepareTestEnv()
+	if err != nil {
+		fmt.Printf("could not start test suite: %v\n", err)
+		os.RemoveAll(sshDir)
+		os.Exit(1)
+	}
+
+	code := m.Run()
+
+	os.RemoveAll(sshDir)
+
+	os.Exit(code)
+}
+
+func TestBuildSSHChannels(t *testing.T) {
+	tests := []struct {
+		serverName    string
+		source        []string
+		destination   []string
+		config        string
+		expected      int
+		expectedError error
+	}{
+		{
+			serverName:    "test",
+			source:        []string{":3360"},
+			destination:   []string{":3360"},
+			config:        "testdata/.ssh/config",
+			expected:      1,
+			expectedError: nil,
 		},
 		{
 			serverName:    "test",
@@ -395,6 +1188,25 @@ func TestBuildSSHChannels(t *testing.T) {
 	}
 }
 
+func TestExpandServerAddress(t *testing.T) {
+	tests := []struct {
+		address  string
+		expected string
+	}{
+		{":8080", "127.0.0.1:8080"},
+		{"localhost:8080", "localhost:8080"},
+		{"127.0.0.1:8080", "127.0.0.1:8080"},
+		{"172.17.0.10:8080", "172.17.0.10:8080"},
+		{"example.com:8080", "example.com:8080"},
+	}
+
+	for _, test := range tests {
+		if address := expandServerAddress(test.address); test.expected != address {
+			t.Errorf("unexpected address for %s: expected: %s, value: %s", test.address, test.expected, address)
+		}
+	}
+}
+
 type tunnelConfig struct {
 	T          *testing.T
 	TunnelType string
@@ -519,6 +1331,7 @@ func prepareTestEnv() error {
 
 	os.Setenv("HOME", home)
 	os.Setenv("USERPROFILE", home)
+	os.Unsetenv("SSH_AUTH_SOCK")
 
 	return nil
 }
@@ -549,17 +1362,43 @@ func createHttpServer() (net.Listener, *http.Server) {
 	return l, server
 }
 
+// createFailingServer starts a tcp server that drops every connection right
+// after accepting it, making any ssh handshake fail.
+// The number of accepted connections is sent through the returned channel once
+// the listener is closed.
+func createFailingServer() (net.Listener, <-chan int) {
+	attempts := make(chan int, 1)
+	l, _ := net.Listen("tcp", "127.0.0.1:0")
+
+	go func() {
+		count := 0
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				attempts <- count
+				return
+			}
+
+			count = count + 1
+			conn.Close()
+		}
+	}()
+
+	return l, attempts
+}
+
 // createSSHServer starts a SSH server that authenticates connections using
 // the given keyPath, listens on a random user port and returns the SSH Server
 // address.
 //
 // The SSH Server created by this function only responds to "direct-tcpip",
-// which is used to establish local port forwarding.
+// which is used to establish local port forwarding, and its unix socket
+// counterpart, "direct-streamlocal@openssh.com".
 //
 // References:
 // https://gist.github.com/jpillora/b480fde82bff51a06238
 // https://tools.ietf.org/html/rfc4254#section-7.2
-func createSSHServer(t *testing.T, address string, keyPath string) (net.Listener, error) {
+func createSSHServer(t testing.TB, address string, keyPath string) (net.Listener, error) {
 	conf := &ssh.ServerConfig{
 		PublicKeyCallback: func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
 			return &ssh.Permissions{}, nil
@@ -593,14 +1432,18 @@ func createSSHServer(t *testing.T, address string, keyPath string) (net.Listener
 				break
 			}
 
-			serverConn, chans, reqs, _ := ssh.NewServerConn(conn, conf)
+			serverConn, chans, reqs, err := ssh.NewServerConn(conn, conf)
+			if err != nil {
+				conn.Close()
+				continue
+			}
 			conns = append(conns, serverConn)
 
 			// go routine to handle ssh client requests. In the context of mole's test,
 			// this is needed when a remote ssh forwarding listens to a port on the jump
 			// server and the port needs to be randomized (port is given as 0).
 			// The reply's needs to carry the port to be listened in its payload.
-			// All requests but "tcpip-forward" are discarded.
+			// All requests but "tcpip-forward" (e.g. keep alive) are refused.
 			go func(reqs <-chan *ssh.Request) {
 				var err error
 
@@ -609,8 +1452,9 @@ func createSSHServer(t *testing.T, address string, keyPath string) (net.Listener
 						err = newReq.Reply(false, nil)
 						if err != nil {
 							t.Errorf("error replying to tcpip-forward request: %v", err)
+							return
 						}
-						return
+						continue
 					}
 
 					if newReq.WantReply {
@@ -632,13 +1476,52 @@ func createSSHServer(t *testing.T, address string, keyPath string) (net.Listener
 
 			// go routine to handle requests to create new ssh channels. This particular
 			// implementation only supports "direct-tcpip", which is the identifier used
-			// for ssh port forwarding.
+			// for ssh port forwarding, its unix socket counterpart,
+			// "direct-streamlocal@openssh.com", "session", limited to echo commands, and
+			// tun channels, which echo packets back.
 			go func(chans <-chan ssh.NewChannel) {
 				for newChan := range chans {
 					go func(newChan ssh.NewChannel) {
 						var err error
 
-						if ct := newChan.ChannelType(); ct != "direct-tcpip" {
+						if newChan.ChannelType() == "session" {
+							handleEchoSession(newChan)
+							return
+						}
+
+						// tun channels send every packet received back to the client
+						if newChan.ChannelType() == TunChannelType {
+							ch, reqs, err := newChan.Accept()
+							if err != nil {
+								return
+							}
+							go ssh.DiscardRequests(reqs)
+							io.Copy(ch, ch)
+							ch.Close()
+							return
+						}
+
+						var remoteConn net.Conn
+
+						switch ct := newChan.ChannelType(); ct {
+						case "direct-tcpip":
+							payload := newChan.ExtraData()
+							pad := byte(4)
+							l := payload[3]
+							remoteIP := string(payload[pad : pad+l])
+							remotePort := binary.BigEndian.Uint32(payload[pad+l : pad+l+4])
+
+							remoteConn, err = net.Dial("tcp", net.JoinHostPort(remoteIP, strconv.Itoa(int(remotePort))))
+						case "direct-streamlocal@openssh.com":
+							var msg struct {
+								SocketPath string
+								Reserved0  string
+								Reserved1  uint32
+							}
+							ssh.Unmarshal(newChan.ExtraData(), &msg)
+
+							remoteConn, err = net.Dial("unix", msg.SocketPath)
+						default:
 							err = newChan.Reject(ssh.UnknownChannelType, fmt.Sprintf("unknown channel type: %s", ct))
 							if err != nil {
 								t.Errorf("error rejecting unsupported channel: %v", err)
@@ -646,21 +1529,26 @@ func createSSHServer(t *testing.T, address string, keyPath string) (net.Listener
 							return
 						}
 
-						payload := newChan.ExtraData()
-						pad := byte(4)
-						l := payload[3]
-						remoteIP := string(payload[pad : pad+l])
-						remotePort := binary.BigEndian.Uint32(payload[pad+l : pad+l+4])
+						if err != nil {
+							newChan.Reject(ssh.ConnectionFailed, err.Error())
+							return
+						}
 
 						conn, _, _ := newChan.Accept()
-						remoteConn, _ := net.Dial("tcp", fmt.Sprintf("%s:%d", remoteIP, remotePort))
 
 						go func() {
 							io.Copy(conn, remoteConn)
+							conn.Close()
 						}()
 
 						go func() {
 							io.Copy(remoteConn, conn)
+
+							// pass the end of the data sent by the client on, like the openssh
+							// server does.
+							if cw, ok := remoteConn.(interface{ CloseWrite() error }); ok {
+								cw.CloseWrite()
+							}
 						}()
 					}(newChan)
 				}
@@ -671,12 +1559,58 @@ func createSSHServer(t *testing.T, address string, keyPath string) (net.Listener
 	return l, nil
 }
 
-// generateKnownHosts creates a new "known_hosts" file on a given path with a
-// single entry based on the given SSH server address and public key.
-func generateKnownHosts(sshAddr net.Addr, pubKeyPath, knownHostsPath string) error {
-	d, err := ioutil.ReadFile(pubKeyPath)
+// catBytes counts the bytes received by all "cat" commands run on the test
+// ssh servers.
+var catBytes uint32
+
+// handleEchoSession serves a ssh session which only supports running
+// "echo <text>" commands, sending <text> back to the client, and "cat", which
+// sends back any data received.
+func handleEchoSession(newChan ssh.NewChannel) {
+	ch, reqs, err := newChan.Accept()
 	if err != nil {
-		return err
+		return
+	}
+	defer ch.Close()
+
+	for req := range reqs {
+		if req.Type != "exec" {
+			req.Reply(false, nil)
+			continue
+		}
+
+		var cmd struct{ Command string }
+		ssh.Unmarshal(req.Payload, &cmd)
+		req.Reply(true, nil)
+
+		if cmd.Command == "cat" {
+			go ssh.DiscardRequests(reqs)
+
+			buf := make([]byte, 1024)
+			for {
+				n, err := ch.Read(buf)
+				if err != nil {
+					return
+				}
+
+				atomic.AddUint32(&catBytes, uint32(n))
+				ch.Write(buf[:n])
+			}
+		}
+
+		io.WriteString(ch, strings.TrimPrefix(cmd.Command, "echo ")+"\n")
+		ch.SendRequest("exit-status", false, ssh.Marshal(struct{ Status uint32 }{0}))
+
+		return
+	}
+}
+
+// generateKnownHosts creates a new "known_hosts" file on a given path with a
+// single entry based on the given SSH server address and public key.
+func generateKnownHosts(sshAddr net.Addr, pubKeyPath, knownHostsPath string) error {
+	d, err := ioutil.ReadFile(pubKeyPath)
+	if err != nil {
+		return err
 	}
 
 	pk, _, _, _, err := ssh.ParseAuthorizedKey([]byte(d))
@@ -689,3 +1623,4289 @@ func generateKnownHosts(sshAddr net.Addr, pubKeyPath, knownHostsPath string) err
 
 	return nil
 }
+
+func TestQuietChannel(t *testing.T) {
+	srv := &Server{Name: "example"}
+
+	tun, err := New("local", srv, []string{":5432", "127.0.0.1:8080"}, []string{"172.17.0.10:5432", "172.17.0.10:80"}, "")
+	if err != nil {
+		t.Fatalf("error creating tunnel: %v", err)
+	}
+
+	err = tun.QuietChannel(":5432")
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	channels := tun.Channels()
+	if !channels[0].Quiet || channels[1].Quiet {
+		t.Errorf("only the channel listening on :5432 was expected to be quiet: %v, %v", channels[0].Quiet, channels[1].Quiet)
+	}
+
+	err = tun.QuietChannel("127.0.0.1:9090")
+	if err == nil {
+		t.Errorf("error expected for unknown source address")
+	}
+}
+
+func TestAllowNetwork(t *testing.T) {
+	srv := &Server{Name: "example"}
+
+	tun, err := New("local", srv, []string{":5432", "127.0.0.1:8080"}, []string{"172.17.0.10:5432", "172.17.0.10:80"}, "")
+	if err != nil {
+		t.Fatalf("error creating tunnel: %v", err)
+	}
+
+	local := &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 40000}
+	lan := &net.TCPAddr{IP: net.ParseIP("192.168.1.10"), Port: 40000}
+
+	channels := tun.Channels()
+	if !channels[0].allowed(local) || !channels[0].allowed(lan) {
+		t.Errorf("all clients were expected to be allowed when no network is given")
+	}
+
+	err = tun.AllowNetwork("", "192.168.1.0/24")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	err = tun.AllowNetwork(":5432", "127.0.0.0/8")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	channels = tun.Channels()
+
+	tests := []struct {
+		channel  *SSHChannel
+		addr     net.Addr
+		expected bool
+	}{
+		{channels[0], local, true},
+		{channels[0], lan, true},
+		{channels[1], local, false},
+		{channels[1], lan, true},
+	}
+
+	for id, test := range tests {
+		if allowed := test.channel.allowed(test.addr); test.expected != allowed {
+			t.Errorf("unexpected result on test %d for %s on %s: expected: %t, value: %t", id, test.addr, test.channel, test.expected, allowed)
+		}
+	}
+
+	err = tun.AllowNetwork("", "192.168.1.0")
+	if err == nil {
+		t.Errorf("error expected for invalid network")
+	}
+}
+
+func TestShouldRetry(t *testing.T) {
+	l, attempts := createFailingServer()
+
+	srv, _ := NewServer("mole", l.Addr().String(), "", "", "testdata/.ssh/config")
+	srv.Insecure = true
+
+	tun, _ := New("local", srv, []string{"127.0.0.1:0"}, []string{"127.0.0.1:80"}, configPath)
+	tun.ConnectionRetries = 0
+	tun.WaitAndRetry = 10 * time.Millisecond
+
+	var calls []int
+	tun.ShouldRetry = func(attempt int, lastErr error) bool {
+		if lastErr == nil {
+			t.Errorf("error of the failed attempt was expected on attempt %d", attempt)
+		}
+
+		calls = append(calls, attempt)
+
+		return attempt < 2
+	}
+
+	err := tun.dial()
+	l.Close()
+
+	if err == nil {
+		t.Errorf("dial was expected to fail")
+	}
+
+	if a := <-attempts; a != 2 {
+		t.Errorf("unexpected number of connection attempts: expected: 2, value: %d", a)
+	}
+
+	if !reflect.DeepEqual([]int{1, 2}, calls) {
+		t.Errorf("unexpected attempts given to ShouldRetry: %v", calls)
+	}
+}
+
+func TestFallbackServers(t *testing.T) {
+	l, attempts := createFailingServer()
+
+	sshServer, err := createSSHServer(t, "", keyPath)
+	if err != nil {
+		t.Fatalf("error while creating ssh server: %s", err)
+	}
+	defer sshServer.Close()
+
+	srv, _ := NewServer("mole", l.Addr().String(), "", "", "testdata/.ssh/config")
+	srv.Insecure = true
+
+	fallback, _ := NewServer("mole", sshServer.Addr().String(), "", "", "testdata/.ssh/config")
+	fallback.Insecure = true
+
+	tun, _ := New("local", srv, []string{"127.0.0.1:0"}, []string{"127.0.0.1:80"}, configPath)
+	tun.FallbackServers = []*Server{fallback}
+	tun.ConnectionRetries = -1
+	tun.KeepAliveInterval = 10 * time.Second
+
+	if err := tun.dial(); err != nil {
+		t.Fatalf("dial was expected to connect to the fallback server: %v", err)
+	}
+
+	if tun.lastServer != 1 {
+		t.Errorf("fallback server was expected to be remembered, index: %d", tun.lastServer)
+	}
+
+	// the next attempt starts from the fallback server, which is still up.
+	if err := tun.dial(); err != nil {
+		t.Fatalf("dial was expected to connect to the fallback server again: %v", err)
+	}
+
+	tun.sshClient().Close()
+	l.Close()
+
+	if a := <-attempts; a != 1 {
+		t.Errorf("unexpected number of connection attempts to the primary server: expected: 1, value: %d", a)
+	}
+}
+
+func TestSupervise(t *testing.T) {
+	l, attempts := createFailingServer()
+
+	srv, _ := NewServer("mole", l.Addr().String(), "", "", "testdata/.ssh/config")
+	srv.Insecure = true
+
+	tun, _ := New("local", srv, []string{"127.0.0.1:0"}, []string{"127.0.0.1:80"}, configPath)
+	tun.ConnectionRetries = 1
+	tun.WaitAndRetry = 10 * time.Millisecond
+	tun.SuperviseInterval = 10 * time.Millisecond
+
+	var cycles uint32
+	tun.ShouldRetry = func(attempt int, lastErr error) bool {
+		if attempt != 1 {
+			t.Errorf("every cycle of attempts was expected to start from scratch: attempt %d", attempt)
+		}
+
+		atomic.AddUint32(&cycles, 1)
+
+		return true
+	}
+
+	result := make(chan error, 1)
+	go func() {
+		result <- tun.Start()
+	}()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for atomic.LoadUint32(&cycles) < 3 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	tun.Stop()
+
+	select {
+	case err := <-result:
+		if err != nil {
+			t.Errorf("supervised tunnel was expected to stop without errors: %v", err)
+		}
+	case <-time.After(1 * time.Second):
+		t.Fatalf("supervised tunnel was expected to stop")
+	}
+
+	l.Close()
+
+	if a := <-attempts; a < 3 {
+		t.Errorf("supervised tunnel was expected to keep connecting to the ssh server: %d attempts", a)
+	}
+}
+
+func TestDestinationCommand(t *testing.T) {
+	sshServer, err := createSSHServer(t, "", keyPath)
+	if err != nil {
+		t.Fatalf("error while creating ssh server: %s", err)
+	}
+	defer sshServer.Close()
+
+	l1, hs1 := createHttpServer()
+	defer hs1.Close()
+
+	l2, hs2 := createHttpServer()
+	defer hs2.Close()
+
+	srv, _ := NewServer("mole", sshServer.Addr().String(), "", "", "testdata/.ssh/config")
+	srv.Insecure = true
+
+	command := fmt.Sprintf("echo %s\n%s", l1.Addr(), l2.Addr())
+
+	tun, err := NewDiscovered(srv, []string{"127.0.0.1:0"}, command)
+	if err != nil {
+		t.Fatalf("error creating tunnel: %v", err)
+	}
+	tun.ConnectionRetries = -1
+	tun.KeepAliveInterval = 10 * time.Second
+
+	go tun.Start()
+	defer tun.Stop()
+
+	select {
+	case <-tun.Ready:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("tunnel did not get ready")
+	}
+
+	channels := tun.Channels()
+	if len(channels) != 2 {
+		t.Fatalf("unexpected number of channels: expected: 2, value: %d", len(channels))
+	}
+
+	for i, l := range []net.Listener{l1, l2} {
+		if l.Addr().String() != channels[i].Destination {
+			t.Errorf("unexpected destination for channel %d: expected: %s, value: %s", i, l.Addr(), channels[i].Destination)
+		}
+	}
+
+	err = validateTunnelConnectivity(t, "ABC", tun)
+	if err != nil {
+		t.Errorf("%v", err)
+	}
+}
+
+func TestAliasedAddress(t *testing.T) {
+	tun := &Tunnel{HostAliases: map[string]string{"db.internal": "10.0.0.5"}}
+
+	tests := []struct {
+		address  string
+		expected string
+	}{
+		{"db.internal:5432", "10.0.0.5:5432"},
+		{"DB.Internal:5432", "10.0.0.5:5432"},
+		{"other.internal:5432", "other.internal:5432"},
+		{"172.17.0.10:80", "172.17.0.10:80"},
+	}
+
+	for _, test := range tests {
+		if address := tun.aliasedAddress(test.address); test.expected != address {
+			t.Errorf("unexpected address for %s: expected: %s, value: %s", test.address, test.expected, address)
+		}
+	}
+}
+
+// countingListener counts the connections accepted by the wrapped listener.
+type countingListener struct {
+	net.Listener
+	accepted uint32
+}
+
+func (l *countingListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err == nil {
+		atomic.AddUint32(&l.accepted, 1)
+	}
+
+	return conn, err
+}
+
+func TestPrewarmChannel(t *testing.T) {
+	sshServer, err := createSSHServer(t, "", keyPath)
+	if err != nil {
+		t.Fatalf("error while creating ssh server: %s", err)
+	}
+	defer sshServer.Close()
+
+	l, _ := net.Listen("tcp", "127.0.0.1:0")
+	cl := &countingListener{Listener: l}
+
+	hs := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, r.URL.Path[1:])
+	})}
+	go hs.Serve(cl)
+	defer hs.Close()
+
+	srv, _ := NewServer("mole", sshServer.Addr().String(), "", "", "testdata/.ssh/config")
+	srv.Insecure = true
+
+	tun, _ := New("local", srv, []string{"127.0.0.1:0"}, []string{l.Addr().String()}, configPath)
+	tun.ConnectionRetries = -1
+	tun.KeepAliveInterval = 10 * time.Second
+
+	err = tun.PrewarmChannel("", 2)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	go tun.Start()
+	defer tun.Stop()
+
+	select {
+	case <-tun.Ready:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("tunnel did not get ready")
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for atomic.LoadUint32(&cl.accepted) < 2 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if a := atomic.LoadUint32(&cl.accepted); a != 2 {
+		t.Fatalf("unexpected number of prewarmed connections: expected: 2, value: %d", a)
+	}
+
+	err = validateTunnelConnectivity(t, "ABC", tun)
+	if err != nil {
+		t.Errorf("%v", err)
+	}
+
+	remote, _ := New("remote", srv, []string{"127.0.0.1:0"}, []string{"127.0.0.1:80"}, configPath)
+	if err := remote.PrewarmChannel("", 2); err == nil {
+		t.Errorf("error expected when prewarming connections of a remote tunnel")
+	}
+}
+
+func TestDialTimeout(t *testing.T) {
+	conf := &ssh.ServerConfig{NoClientAuth: true}
+
+	b, _ := ioutil.ReadFile(keyPath)
+	p, _ := ssh.ParsePrivateKey(b)
+	conf.AddHostKey(p)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("error while creating listener: %v", err)
+	}
+	defer l.Close()
+
+	// ssh server that never answers requests to open new channels, like a
+	// destination that is a black hole.
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+
+		_, chans, reqs, err := ssh.NewServerConn(conn, conf)
+		if err != nil {
+			return
+		}
+
+		go ssh.DiscardRequests(reqs)
+
+		var pending []ssh.NewChannel
+		for newChan := range chans {
+			pending = append(pending, newChan)
+		}
+	}()
+
+	client, err := ssh.Dial("tcp", l.Addr().String(), &ssh.ClientConfig{
+		User:            "mole",
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	})
+	if err != nil {
+		t.Fatalf("error connecting to ssh server: %v", err)
+	}
+	defer client.Close()
+
+	start := time.Now()
+
+	_, err = dialTimeout(client, "10.255.255.1:80", 100*time.Millisecond)
+	if err == nil {
+		t.Errorf("error expected when dialing a destination that never answers")
+	}
+
+	if elapsed := time.Since(start); elapsed > 1*time.Second {
+		t.Errorf("dial was expected to give up after the timeout, took %s", elapsed)
+	}
+}
+
+func TestMaxPendingChannelOpens(t *testing.T) {
+	conf := &ssh.ServerConfig{NoClientAuth: true}
+
+	b, _ := ioutil.ReadFile(keyPath)
+	p, _ := ssh.ParsePrivateKey(b)
+	conf.AddHostKey(p)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("error while creating listener: %v", err)
+	}
+	defer l.Close()
+
+	var pending, maxPending int32
+
+	// ssh server that takes a while to answer requests to open new channels,
+	// keeping track of how many are pending at the same time.
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+
+		_, chans, reqs, err := ssh.NewServerConn(conn, conf)
+		if err != nil {
+			return
+		}
+
+		go ssh.DiscardRequests(reqs)
+
+		for newChan := range chans {
+			go func(newChan ssh.NewChannel) {
+				n := atomic.AddInt32(&pending, 1)
+				for {
+					m := atomic.LoadInt32(&maxPending)
+					if n <= m || atomic.CompareAndSwapInt32(&maxPending, m, n) {
+						break
+					}
+				}
+
+				time.Sleep(50 * time.Millisecond)
+				atomic.AddInt32(&pending, -1)
+
+				newChan.Reject(ssh.ConnectionFailed, "unreachable")
+			}(newChan)
+		}
+	}()
+
+	client, err := ssh.Dial("tcp", l.Addr().String(), &ssh.ClientConfig{
+		User:            "mole",
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	})
+	if err != nil {
+		t.Fatalf("error connecting to ssh server: %v", err)
+	}
+	defer client.Close()
+
+	tun := &Tunnel{MaxPendingChannelOpens: 2, DialTimeout: 2 * time.Second}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 6; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			tun.dialLimited(client, "10.0.0.1:80")
+		}()
+	}
+	wg.Wait()
+
+	if m := atomic.LoadInt32(&maxPending); m != 2 {
+		t.Errorf("unexpected number of channel opens pending at the same time: want: 2, got: %d", m)
+	}
+
+	// a queued channel open gives up once the dial timeout expires, while the
+	// slot is still held by a channel open the server hasn't answered yet.
+	tun = &Tunnel{MaxPendingChannelOpens: 1, DialTimeout: 30 * time.Millisecond}
+
+	errs := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			_, err := tun.dialLimited(client, "10.0.0.1:80")
+			errs <- err
+		}()
+	}
+
+	queued := 0
+	for i := 0; i < 2; i++ {
+		err := <-errs
+		if err == nil || !strings.Contains(err.Error(), "timeout") {
+			t.Errorf("timeout error expected, got: %v", err)
+			continue
+		}
+
+		if strings.Contains(err.Error(), "already being opened") {
+			queued++
+		}
+	}
+
+	if queued != 1 {
+		t.Errorf("unexpected number of channel opens timing out while queued: want: 1, got: %d", queued)
+	}
+}
+
+func TestAddRemoveChannel(t *testing.T) {
+	c := &tunnelConfig{t, "local", 1, false, NoSshRetries}
+	tun, _, _ := prepareTunnel(c)
+	defer tun.Stop()
+
+	select {
+	case <-tun.Started():
+	case <-time.After(1 * time.Second):
+		t.Fatalf("error waiting for tunnel to be started")
+	}
+
+	l, _ := createHttpServer()
+
+	ch, err := tun.AddChannel("", l.Addr().String())
+	if err != nil {
+		t.Fatalf("error adding channel: %v", err)
+	}
+
+	if len(tun.Channels()) != 2 {
+		t.Fatalf("expected 2 channels, got %d", len(tun.Channels()))
+	}
+
+	err = validateTunnelConnectivity(t, "ABC", tun)
+	if err != nil {
+		t.Errorf("%v", err)
+	}
+
+	err = tun.RemoveChannel(ch.Source)
+	if err != nil {
+		t.Fatalf("error removing channel: %v", err)
+	}
+
+	if len(tun.Channels()) != 1 {
+		t.Fatalf("expected 1 channel, got %d", len(tun.Channels()))
+	}
+
+	_, err = net.DialTimeout("tcp", ch.Source, 500*time.Millisecond)
+	if err == nil {
+		t.Errorf("connection to removed channel was expected to fail")
+	}
+
+	// the tunnel must keep running after a channel is removed
+	select {
+	case err = <-tun.done:
+		t.Errorf("tunnel stopped after removing a channel: %v", err)
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	err = validateTunnelConnectivity(t, "ABC", tun)
+	if err != nil {
+		t.Errorf("%v", err)
+	}
+
+	err = tun.RemoveChannel(ch.Source)
+	if err == nil {
+		t.Errorf("removing a channel twice was expected to fail")
+	}
+}
+
+func TestAddChannelBeforeStart(t *testing.T) {
+	srv, _ := NewServer("mole", "127.0.0.1:22", "", "", "testdata/.ssh/config")
+	tun, _ := New("local", srv, []string{"127.0.0.1:0"}, []string{"127.0.0.1:80"}, configPath)
+
+	_, err := tun.AddChannel("", "127.0.0.1:8080")
+	if err == nil {
+		t.Errorf("adding a channel to a tunnel not started was expected to fail")
+	}
+}
+
+// fakeTun is a tun device exchanging packets through go channels.
+type fakeTun struct {
+	in  chan []byte
+	out chan []byte
+}
+
+func (d *fakeTun) Read(p []byte) (int, error) {
+	pkt, ok := <-d.in
+	if !ok {
+		return 0, io.EOF
+	}
+
+	return copy(p, pkt), nil
+}
+
+func (d *fakeTun) Write(p []byte) (int, error) {
+	pkt := make([]byte, len(p))
+	copy(pkt, p)
+	d.out <- pkt
+
+	return len(p), nil
+}
+
+func (d *fakeTun) Close() error {
+	return nil
+}
+
+func (d *fakeTun) Name() string {
+	return "tun99"
+}
+
+func TestTunTunnel(t *testing.T) {
+	sshListener, err := createSSHServer(t, "", keyPath)
+	if err != nil {
+		t.Fatalf("error while creating ssh server: %s", err)
+	}
+	defer sshListener.Close()
+
+	srv, _ := NewServer("mole", sshListener.Addr().String(), "", "", "testdata/.ssh/config")
+	srv.Insecure = true
+
+	tun, err := New("tun", srv, nil, nil, configPath)
+	if err != nil {
+		t.Fatalf("error creating tun tunnel: %v", err)
+	}
+
+	dev := &fakeTun{in: make(chan []byte, 2), out: make(chan []byte, 2)}
+	tun.channels[0].tun = dev
+	tun.ConnectionRetries = NoSshRetries
+	tun.KeepAliveInterval = 10 * time.Second
+
+	go tun.Start()
+	defer tun.Stop()
+
+	select {
+	case <-tun.Ready:
+	case <-time.After(2 * time.Second):
+		t.Fatalf("tun tunnel was not ready in time")
+	}
+
+	// minimal ipv4 and ipv6 packets, only the version matters to the tunnel
+	packets := [][]byte{{0x45, 0x00, 0x01, 0x02}, {0x60, 0x00, 0x03}}
+
+	for _, pkt := range packets {
+		dev.in <- pkt
+
+		select {
+		case echoed := <-dev.out:
+			if !bytes.Equal(pkt, echoed) {
+				t.Errorf("unexpected packet received: want %v, got %v", pkt, echoed)
+			}
+		case <-time.After(2 * time.Second):
+			t.Errorf("packet %v was not received back", pkt)
+		}
+	}
+}
+
+func TestTunPacketFraming(t *testing.T) {
+	var buf bytes.Buffer
+
+	err := writeTunPackets(&buf, &fakeTun{in: func() chan []byte {
+		c := make(chan []byte, 1)
+		c <- []byte{0x60, 0x01}
+		close(c)
+		return c
+	}()})
+	if err != io.EOF {
+		t.Fatalf("unexpected error writing packets: %v", err)
+	}
+
+	expected := []byte{0, 0, 0, 6, 0, 0, 0, tunAFInet6, 0x60, 0x01}
+	if !bytes.Equal(buf.Bytes(), expected) {
+		t.Errorf("unexpected framing: want %v, got %v", expected, buf.Bytes())
+	}
+
+	dev := &fakeTun{out: make(chan []byte, 1)}
+	err = readTunPackets(dev, bytes.NewReader(expected))
+	if err != io.EOF {
+		t.Fatalf("unexpected error reading packets: %v", err)
+	}
+
+	if pkt := <-dev.out; !bytes.Equal(pkt, []byte{0x60, 0x01}) {
+		t.Errorf("unexpected packet read: %v", pkt)
+	}
+
+	err = readTunPackets(dev, bytes.NewReader([]byte{0, 0, 0, 1}))
+	if err == nil {
+		t.Errorf("invalid packet size was expected to fail")
+	}
+}
+
+func TestManifestCommand(t *testing.T) {
+	sshServer, err := createSSHServer(t, "", keyPath)
+	if err != nil {
+		t.Fatalf("error while creating ssh server: %s", err)
+	}
+	defer sshServer.Close()
+
+	l1, hs1 := createHttpServer()
+	defer hs1.Close()
+
+	l2, hs2 := createHttpServer()
+	defer hs2.Close()
+
+	srv, _ := NewServer("mole", sshServer.Addr().String(), "", "", "testdata/.ssh/config")
+	srv.Insecure = true
+
+	command := fmt.Sprintf("echo # forwards\n%s\n\n127.0.0.1:0 %s", l1.Addr(), l2.Addr())
+
+	tun, err := NewManifest("local", srv, command)
+	if err != nil {
+		t.Fatalf("error creating tunnel: %v", err)
+	}
+	tun.ConnectionRetries = -1
+	tun.KeepAliveInterval = 10 * time.Second
+
+	go tun.Start()
+	defer tun.Stop()
+
+	select {
+	case <-tun.Ready:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("tunnel did not get ready")
+	}
+
+	channels := tun.Channels()
+	if len(channels) != 2 {
+		t.Fatalf("unexpected number of channels: expected: 2, value: %d", len(channels))
+	}
+
+	for i, l := range []net.Listener{l1, l2} {
+		if l.Addr().String() != channels[i].Destination {
+			t.Errorf("unexpected destination for channel %d: expected: %s, value: %s", i, l.Addr(), channels[i].Destination)
+		}
+	}
+
+	err = validateTunnelConnectivity(t, "ABC", tun)
+	if err != nil {
+		t.Errorf("%v", err)
+	}
+}
+
+func TestParseManifest(t *testing.T) {
+	tests := []struct {
+		manifest string
+		expected [][2]string
+		fail     bool
+	}{
+		{"", nil, false},
+		{"# comment\n\n  127.0.0.1:80  \n", [][2]string{{"", "127.0.0.1:80"}}, false},
+		{":8080 db:5432\n", [][2]string{{":8080", "db:5432"}}, false},
+		{"127.0.0.1:80 127.0.0.1:81 127.0.0.1:82", nil, true},
+		{"db", nil, true},
+	}
+
+	for i, test := range tests {
+		forwards, err := parseManifest(test.manifest)
+		if test.fail != (err != nil) {
+			t.Errorf("test %d: unexpected error result: %v", i, err)
+			continue
+		}
+
+		if !reflect.DeepEqual(test.expected, forwards) {
+			t.Errorf("test %d: unexpected forwards: want %v, got %v", i, test.expected, forwards)
+		}
+	}
+}
+
+func TestLogLimiter(t *testing.T) {
+	var out bytes.Buffer
+
+	logger := log.New()
+	logger.Out = &out
+	logger.Formatter = &log.TextFormatter{DisableTimestamp: true}
+
+	entry := log.NewEntry(logger)
+
+	var l logLimiter
+
+	for i := 0; i < 5; i++ {
+		l.log(time.Minute, entry, log.WarnLevel, "reconnecting to ssh server")
+	}
+
+	if c := strings.Count(out.String(), "reconnecting to ssh server"); c != 1 {
+		t.Errorf("repeated message was expected to be logged once, got %d times: %s", c, out.String())
+	}
+
+	l.log(time.Minute, entry, log.WarnLevel, "error sending keep-alive request to ssh server")
+
+	if !strings.Contains(out.String(), "error sending keep-alive request to ssh server") {
+		t.Errorf("distinct message was expected to be logged: %s", out.String())
+	}
+
+	l.flush()
+
+	if !strings.Contains(out.String(), "reconnecting to ssh server: repeated 4 times in last") {
+		t.Errorf("summary of the suppressed messages was expected to be logged: %s", out.String())
+	}
+
+	if strings.Contains(out.String(), "keep-alive request to ssh server: repeated") {
+		t.Errorf("summary was not expected for messages never suppressed: %s", out.String())
+	}
+
+	out.Reset()
+
+	l.log(time.Minute, entry, log.WarnLevel, "reconnecting to ssh server")
+	l.log(0, entry, log.WarnLevel, "reconnecting to ssh server")
+
+	if c := strings.Count(out.String(), "reconnecting to ssh server"); c != 2 {
+		t.Errorf("messages were expected to be logged after a flush and without a window, got %d: %s", c, out.String())
+	}
+}
+
+func TestHandoffListeners(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mole-handoff")
+	if err != nil {
+		t.Fatalf("error creating temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	socket := &net.UnixAddr{Name: filepath.Join(dir, "handoff.sock"), Net: "unix"}
+
+	lis, err := net.ListenUnix("unix", socket)
+	if err != nil {
+		t.Fatalf("error creating handoff socket: %v", err)
+	}
+	defer lis.Close()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("error creating listener: %v", err)
+	}
+
+	address := l.Addr().String()
+
+	go func() {
+		conn, err := lis.AcceptUnix()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		SendListeners(conn, map[string]net.Listener{address: l})
+	}()
+
+	conn, err := net.DialUnix("unix", nil, socket)
+	if err != nil {
+		t.Fatalf("error connecting to handoff socket: %v", err)
+	}
+	defer conn.Close()
+
+	listeners, err := ReceiveListeners(conn)
+	if err != nil {
+		t.Fatalf("error receiving listeners: %v", err)
+	}
+
+	// the original listener is gone, so only the one received can accept
+	// connections.
+	l.Close()
+
+	tun := &Tunnel{channels: []*SSHChannel{{ChannelType: "local", Source: address}}}
+	tun.InheritListeners(listeners)
+
+	ch := tun.channels[0]
+	if ch.listener == nil {
+		t.Fatalf("channel was expected to inherit the listener on %s", address)
+	}
+	defer ch.listener.Close()
+
+	go func() {
+		c, err := net.Dial("tcp", address)
+		if err == nil {
+			c.Close()
+		}
+	}()
+
+	err = ch.Accept()
+	if err != nil {
+		t.Fatalf("inherited listener was expected to accept connections: %v", err)
+	}
+	ch.conn.Close()
+}
+
+func TestSameAddress(t *testing.T) {
+	tests := []struct {
+		source   string
+		address  string
+		expected bool
+	}{
+		{"127.0.0.1:8080", "127.0.0.1:8080", true},
+		{":8080", "[::]:8080", true},
+		{"localhost:8080", "127.0.0.1:8080", true},
+		{"0.0.0.0:8080", "[::]:8080", true},
+		{"127.0.0.1:8080", "127.0.0.1:8081", false},
+		{"127.0.0.1:0", "127.0.0.1:8080", false},
+		{"192.168.1.1:8080", "127.0.0.1:8080", false},
+	}
+
+	for i, test := range tests {
+		if r := sameAddress(test.source, test.address); r != test.expected {
+			t.Errorf("test %d: unexpected result for %s and %s: want %t, got %t", i, test.source, test.address, test.expected, r)
+		}
+	}
+}
+
+func TestDialLatency(t *testing.T) {
+	c := &tunnelConfig{t, "local", 1, true, NoSshRetries}
+	tun, _, _ := prepareTunnel(c)
+	defer tun.Stop()
+
+	select {
+	case <-tun.Started():
+	case <-time.After(1 * time.Second):
+		t.Fatalf("error waiting for tunnel to be started")
+	}
+
+	latency := tun.DialLatency()
+
+	if latency.Connect <= 0 || latency.Handshake <= 0 || latency.Auth <= 0 {
+		t.Errorf("all connection phases were expected to be measured: %+v", latency)
+	}
+}
+
+func TestKeepAliveData(t *testing.T) {
+	sshServer, err := createSSHServer(t, "", keyPath)
+	if err != nil {
+		t.Fatalf("error while creating ssh server: %s", err)
+	}
+	defer sshServer.Close()
+
+	l, hs := createHttpServer()
+	defer hs.Close()
+
+	srv, _ := NewServer("mole", sshServer.Addr().String(), "", "", "testdata/.ssh/config")
+	srv.Insecure = true
+
+	tun, _ := New("local", srv, []string{"127.0.0.1:0"}, []string{l.Addr().String()}, configPath)
+	tun.ConnectionRetries = NoSshRetries
+	tun.KeepAliveInterval = 50 * time.Millisecond
+	tun.KeepAliveData = true
+
+	before := atomic.LoadUint32(&catBytes)
+
+	go tun.Start()
+	defer tun.Stop()
+
+	select {
+	case <-tun.Ready:
+	case <-time.After(2 * time.Second):
+		t.Fatalf("tunnel was not ready in time")
+	}
+
+	time.Sleep(3 * relistenInterval)
+
+	if sent := atomic.LoadUint32(&catBytes) - before; sent == 0 {
+		t.Errorf("keep alive data was expected to be received by the ssh server")
+	}
+}
+
+func TestKeepAliveInitialDelay(t *testing.T) {
+	sshServer, err := createSSHServer(t, "", keyPath)
+	if err != nil {
+		t.Fatalf("error while creating ssh server: %s", err)
+	}
+	defer sshServer.Close()
+
+	l, hs := createHttpServer()
+	defer hs.Close()
+
+	srv, _ := NewServer("mole", sshServer.Addr().String(), "", "", "testdata/.ssh/config")
+	srv.Insecure = true
+
+	tun, _ := New("local", srv, []string{"127.0.0.1:0"}, []string{l.Addr().String()}, configPath)
+	tun.ConnectionRetries = NoSshRetries
+	tun.KeepAliveInterval = 10 * time.Second
+	tun.KeepAliveInitialDelay = 50 * time.Millisecond
+
+	replied := make(chan bool, 1)
+	tun.KeepAliveReplied = func() {
+		select {
+		case replied <- true:
+		default:
+		}
+	}
+
+	go tun.Start()
+	defer tun.Stop()
+
+	select {
+	case <-tun.Ready:
+	case <-time.After(2 * time.Second):
+		t.Fatalf("tunnel was not ready in time")
+	}
+
+	select {
+	case <-replied:
+	case <-time.After(1 * time.Second):
+		t.Errorf("first keep alive was expected to be sent after the initial delay")
+	}
+}
+
+func TestKeepAliveIdleOnly(t *testing.T) {
+	sshServer, err := createSSHServer(t, "", keyPath)
+	if err != nil {
+		t.Fatalf("error while creating ssh server: %s", err)
+	}
+	defer sshServer.Close()
+
+	l, hs := createHttpServer()
+	defer hs.Close()
+
+	srv, _ := NewServer("mole", sshServer.Addr().String(), "", "", "testdata/.ssh/config")
+	srv.Insecure = true
+
+	tun, _ := New("local", srv, []string{"127.0.0.1:0"}, []string{l.Addr().String()}, configPath)
+	tun.ConnectionRetries = NoSshRetries
+	tun.KeepAliveInterval = 100 * time.Millisecond
+	tun.KeepAliveIdleOnly = true
+
+	var replies int32
+	tun.KeepAliveReplied = func() {
+		atomic.AddInt32(&replies, 1)
+	}
+
+	go tun.Start()
+	defer tun.Stop()
+
+	select {
+	case <-tun.Ready:
+	case <-time.After(2 * time.Second):
+		t.Fatalf("tunnel was not ready in time")
+	}
+
+	// keep alive packets are still sent while the tunnel is idle.
+	time.Sleep(350 * time.Millisecond)
+
+	if atomic.LoadInt32(&replies) == 0 {
+		t.Fatalf("keep alive packets were expected to be sent while idle")
+	}
+
+	client := http.Client{
+		Timeout:   500 * time.Millisecond,
+		Transport: &http.Transport{DisableKeepAlives: true},
+	}
+
+	busy := func(d time.Duration) {
+		for deadline := time.Now().Add(d); time.Now().Before(deadline); {
+			resp, err := client.Get(fmt.Sprintf("http://%s/busy", tun.channels[0].listener.Addr()))
+			if err != nil {
+				t.Fatalf("error requesting through the tunnel: %v", err)
+			}
+			ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+
+			time.Sleep(20 * time.Millisecond)
+		}
+	}
+
+	// a keep alive packet may still be sent until the tunnel is busy for a
+	// whole interval.
+	busy(150 * time.Millisecond)
+	atomic.StoreInt32(&replies, 0)
+	busy(400 * time.Millisecond)
+
+	if r := atomic.LoadInt32(&replies); r != 0 {
+		t.Errorf("no keep alive packets were expected to be sent while data is received: %d sent", r)
+	}
+}
+
+// TestKeepAliveRestart restarts the connection to the ssh server while keep
+// alive packets are sent as often as possible, which is meant to be run with
+// the race detector enabled.
+func TestKeepAliveRestart(t *testing.T) {
+	sshServer, err := createSSHServer(t, "", keyPath)
+	if err != nil {
+		t.Fatalf("error while creating ssh server: %s", err)
+	}
+	defer sshServer.Close()
+
+	srv, _ := NewServer("mole", sshServer.Addr().String(), "", "", "testdata/.ssh/config")
+	srv.Insecure = true
+
+	tun, _ := New("local", srv, []string{"127.0.0.1:0"}, []string{"127.0.0.1:80"}, configPath)
+	tun.ConnectionRetries = 3
+	tun.WaitAndRetry = 10 * time.Millisecond
+	tun.KeepAliveInterval = time.Millisecond
+
+	result := make(chan error, 1)
+	go func() {
+		result <- tun.Start()
+	}()
+	defer tun.Stop()
+
+	select {
+	case <-tun.Ready:
+	case <-time.After(2 * time.Second):
+		t.Fatalf("tunnel was not ready in time")
+	}
+
+	for i := 0; i < 5; i++ {
+		tun.clientMu.RLock()
+		done := tun.keepAliveDone
+		tun.clientMu.RUnlock()
+
+		if err := tun.Restart(); err != nil {
+			t.Fatalf("error restarting the tunnel: %v", err)
+		}
+
+		select {
+		case <-tun.Ready:
+		case err := <-result:
+			t.Fatalf("tunnel was expected to keep running after restart %d: %v", i, err)
+		case <-time.After(2 * time.Second):
+			t.Fatalf("tunnel was not ready in time after restart %d", i)
+		}
+
+		select {
+		case <-done:
+		default:
+			t.Errorf("keep alive loop of the connection closed by restart %d is still running", i)
+		}
+	}
+}
+
+func TestKeepAliveDelay(t *testing.T) {
+	tests := []struct {
+		interval time.Duration
+		delay    time.Duration
+		expected time.Duration
+	}{
+		{10 * time.Second, 0, 10 * time.Second},
+		{10 * time.Second, 2 * time.Second, 2 * time.Second},
+		{10 * time.Second, 30 * time.Second, 30 * time.Second},
+	}
+
+	for _, test := range tests {
+		tun := &Tunnel{KeepAliveInterval: test.interval, KeepAliveInitialDelay: test.delay}
+
+		if delay := tun.keepAliveDelay(); delay != test.expected {
+			t.Errorf("unexpected keep alive delay for interval %s and initial delay %s: want: %s, got: %s", test.interval, test.delay, test.expected, delay)
+		}
+	}
+}
+
+func TestDestinationClose(t *testing.T) {
+	sshServer, err := createSSHServer(t, "", keyPath)
+	if err != nil {
+		t.Fatalf("error while creating ssh server: %s", err)
+	}
+	defer sshServer.Close()
+
+	// the destination closes every connection without sending anything, while
+	// the client sits idle.
+	destination, _ := net.Listen("tcp", "127.0.0.1:0")
+	defer destination.Close()
+
+	go func() {
+		for {
+			conn, err := destination.Accept()
+			if err != nil {
+				return
+			}
+
+			time.Sleep(100 * time.Millisecond)
+			conn.Close()
+		}
+	}()
+
+	srv, _ := NewServer("mole", sshServer.Addr().String(), "", "", "testdata/.ssh/config")
+	srv.Insecure = true
+
+	tun, _ := New("local", srv, []string{"127.0.0.1:0"}, []string{destination.Addr().String()}, configPath)
+	tun.ConnectionRetries = NoSshRetries
+	tun.KeepAliveInterval = 10 * time.Second
+
+	go tun.Start()
+	defer tun.Stop()
+
+	select {
+	case <-tun.Ready:
+	case <-time.After(2 * time.Second):
+		t.Fatalf("tunnel was not ready in time")
+	}
+
+	conn, err := net.Dial("tcp", tun.Channels()[0].Source)
+	if err != nil {
+		t.Fatalf("error connecting to tunnel: %v", err)
+	}
+	defer conn.Close()
+
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+
+	_, err = conn.Read(make([]byte, 1))
+	if err != io.EOF {
+		t.Errorf("client connection was not closed after the destination closed it: want: %v, got: %v", io.EOF, err)
+	}
+}
+
+func TestHalfClose(t *testing.T) {
+	sshServer, err := createSSHServer(t, "", keyPath)
+	if err != nil {
+		t.Fatalf("error while creating ssh server: %s", err)
+	}
+	defer sshServer.Close()
+
+	// the destination only answers once the client is done sending its request.
+	destination, _ := net.Listen("tcp", "127.0.0.1:0")
+	defer destination.Close()
+
+	go func() {
+		for {
+			conn, err := destination.Accept()
+			if err != nil {
+				return
+			}
+
+			go func() {
+				defer conn.Close()
+
+				req, _ := ioutil.ReadAll(conn)
+				conn.Write(append([]byte("bye "), req...))
+			}()
+		}
+	}()
+
+	srv, _ := NewServer("mole", sshServer.Addr().String(), "", "", "testdata/.ssh/config")
+	srv.Insecure = true
+
+	tun, _ := New("local", srv, []string{"127.0.0.1:0"}, []string{destination.Addr().String()}, configPath)
+	tun.ConnectionRetries = NoSshRetries
+	tun.KeepAliveInterval = 10 * time.Second
+	tun.HalfClose = true
+
+	go tun.Start()
+	defer tun.Stop()
+
+	select {
+	case <-tun.Ready:
+	case <-time.After(2 * time.Second):
+		t.Fatalf("tunnel was not ready in time")
+	}
+
+	conn, err := net.Dial("tcp", tun.Channels()[0].Source)
+	if err != nil {
+		t.Fatalf("error connecting to tunnel: %v", err)
+	}
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+	conn.Write([]byte("mole"))
+	conn.(*net.TCPConn).CloseWrite()
+
+	resp, err := ioutil.ReadAll(conn)
+	if err != nil {
+		t.Fatalf("error reading response: %v", err)
+	}
+
+	if string(resp) != "bye mole" {
+		t.Errorf("unexpected response: want: %s, got: %s", "bye mole", resp)
+	}
+}
+
+func TestConnTrace(t *testing.T) {
+	trace := newConnTrace(3)
+
+	// data read without pauses makes up a single burst per direction
+	trace.record("sent", 10)
+	trace.record("received", 5)
+	trace.record("sent", 20)
+	trace.record("received", 0)
+
+	time.Sleep(3 * traceBurstGap)
+
+	trace.record("received", 100)
+
+	// bursts over the limit are only counted
+	time.Sleep(3 * traceBurstGap)
+
+	trace.record("sent", 1)
+	trace.record("received", 1)
+
+	expected := []burst{
+		{direction: "sent", bytes: 30},
+		{direction: "received", bytes: 5},
+		{direction: "received", bytes: 100},
+	}
+
+	if len(trace.bursts) != len(expected) {
+		t.Fatalf("unexpected number of bursts: want: %d, got: %d", len(expected), len(trace.bursts))
+	}
+
+	for i, b := range trace.bursts {
+		if b.direction != expected[i].direction || b.bytes != expected[i].bytes {
+			t.Errorf("unexpected burst %d: want: %s %d bytes, got: %s %d bytes", i, expected[i].direction, expected[i].bytes, b.direction, b.bytes)
+		}
+	}
+
+	if !trace.bursts[2].start.After(trace.bursts[1].end) {
+		t.Errorf("bursts were expected to be apart in time")
+	}
+
+	if trace.dropped != 2 {
+		t.Errorf("unexpected number of dropped bursts: want: 2, got: %d", trace.dropped)
+	}
+}
+
+func TestMigrateConnections(t *testing.T) {
+	sshServer, err := createSSHServer(t, "", keyPath)
+	if err != nil {
+		t.Fatalf("error while creating ssh server: %s", err)
+	}
+
+	echo, _ := net.Listen("tcp", "127.0.0.1:0")
+	defer echo.Close()
+
+	go func() {
+		for {
+			conn, err := echo.Accept()
+			if err != nil {
+				return
+			}
+
+			go func() {
+				io.Copy(conn, conn)
+				conn.Close()
+			}()
+		}
+	}()
+
+	srv, _ := NewServer("mole", sshServer.Addr().String(), "", "", "testdata/.ssh/config")
+	srv.Insecure = true
+
+	tun, _ := New("local", srv, []string{"127.0.0.1:0"}, []string{echo.Addr().String()}, configPath)
+	tun.ConnectionRetries = 10
+	tun.WaitAndRetry = 100 * time.Millisecond
+	tun.KeepAliveInterval = 10 * time.Second
+	tun.MigrationTimeout = 5 * time.Second
+
+	go tun.Start()
+	defer tun.Stop()
+
+	select {
+	case <-tun.Ready:
+	case <-time.After(2 * time.Second):
+		t.Fatalf("tunnel was not ready in time")
+	}
+
+	conn, err := net.Dial("tcp", tun.Channels()[0].Source)
+	if err != nil {
+		t.Fatalf("error connecting to tunnel: %v", err)
+	}
+	defer conn.Close()
+
+	reader := bufio.NewReader(conn)
+
+	echoLine := func(line string) error {
+		conn.SetDeadline(time.Now().Add(3 * time.Second))
+
+		_, err := fmt.Fprintf(conn, "%s\n", line)
+		if err != nil {
+			return err
+		}
+
+		resp, err := reader.ReadString('\n')
+		if err != nil {
+			return err
+		}
+
+		if resp != line+"\n" {
+			return fmt.Errorf("unexpected response: want %q, got %q", line, resp)
+		}
+
+		return nil
+	}
+
+	if err := echoLine("before"); err != nil {
+		t.Fatalf("error forwarding data before reconnection: %v", err)
+	}
+
+	sshServer.Close()
+
+	sshServer, err = createSSHServer(t, sshServer.Addr().String(), keyPath)
+	if err != nil {
+		t.Fatalf("error while recreating ssh server: %s", err)
+	}
+	defer sshServer.Close()
+
+	select {
+	case <-tun.Ready:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("tunnel did not reconnect in time")
+	}
+
+	if err := echoLine("after"); err != nil {
+		t.Errorf("connection was expected to survive the reconnection: %v", err)
+	}
+}
+
+func TestBindDialSource(t *testing.T) {
+	srv := &Server{Name: "example"}
+
+	local, _ := New("local", srv, []string{":8080"}, []string{"172.17.0.10:80"}, "")
+	if err := local.BindDialSource("", "127.0.0.1:0"); err == nil {
+		t.Errorf("dial source address expected to be refused by local tunnels")
+	}
+
+	tun, _ := New("remote", srv, []string{"127.0.0.1:8080"}, []string{"127.0.0.1:80"}, "")
+
+	for _, address := range []string{"127.0.0.1", "localhost:0", ":server", ":70000"} {
+		if err := tun.BindDialSource("", address); err == nil {
+			t.Errorf("invalid dial source address %s expected to be refused", address)
+		}
+	}
+
+	l, _ := net.Listen("tcp", "127.0.0.1:0")
+	defer l.Close()
+
+	ports, err := freeport.GetFreePorts(2)
+	if err != nil {
+		t.Fatalf("error getting free ports: %v", err)
+	}
+
+	client := &net.TCPConn{}
+	clientAddr := &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: ports[1]}
+
+	tests := []struct {
+		address string
+		port    int
+	}{
+		{fmt.Sprintf("127.0.0.1:%d", ports[0]), ports[0]},
+		{":" + ClientPort, ports[1]},
+	}
+
+	for id, test := range tests {
+		if err := tun.BindDialSource(":8080", test.address); err != nil {
+			t.Fatalf("error binding dial source address on test %d: %v", id, err)
+		}
+
+		channel := tun.Channels()[0]
+
+		conn, err := dialLocal(channel, &remoteAddrConn{client, clientAddr}, l.Addr().String(), time.Second)
+		if err != nil {
+			t.Fatalf("error dialing destination on test %d: %v", id, err)
+		}
+
+		accepted, err := l.Accept()
+		if err != nil {
+			t.Fatalf("error accepting connection on test %d: %v", id, err)
+		}
+
+		if port := accepted.RemoteAddr().(*net.TCPAddr).Port; port != test.port {
+			t.Errorf("unexpected source port on test %d: want: %d, got: %d", id, test.port, port)
+		}
+
+		accepted.Close()
+		conn.Close()
+	}
+}
+
+// remoteAddrConn is a connection reporting a fixed remote address, like the
+// connections forwarded by the ssh server do.
+type remoteAddrConn struct {
+	net.Conn
+	addr net.Addr
+}
+
+func (c *remoteAddrConn) RemoteAddr() net.Addr {
+	return c.addr
+}
+
+func TestOriginateTLS(t *testing.T) {
+	sshServer, err := createSSHServer(t, "", keyPath)
+	if err != nil {
+		t.Fatalf("error while creating ssh server: %s", err)
+	}
+	defer sshServer.Close()
+
+	hs := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "tls")
+	}))
+	defer hs.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(hs.Certificate())
+
+	destination := strings.TrimPrefix(hs.URL, "https://")
+
+	srv, _ := NewServer("mole", sshServer.Addr().String(), "", "", "testdata/.ssh/config")
+	srv.Insecure = true
+
+	ports, err := freeport.GetFreePorts(2)
+	if err != nil {
+		t.Fatalf("error getting free ports: %v", err)
+	}
+
+	valid := fmt.Sprintf("127.0.0.1:%d", ports[0])
+	invalid := fmt.Sprintf("127.0.0.1:%d", ports[1])
+
+	tun, _ := New("local", srv, []string{valid, invalid}, []string{destination, destination}, configPath)
+	tun.ConnectionRetries = NoSshRetries
+	tun.KeepAliveInterval = 10 * time.Second
+
+	err = tun.OriginateTLS(valid, &tls.Config{RootCAs: roots})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// the certificate of the test server is not valid for this name
+	err = tun.OriginateTLS(invalid, &tls.Config{RootCAs: roots, ServerName: "mole.invalid"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	go tun.Start()
+	defer tun.Stop()
+
+	select {
+	case <-tun.Ready:
+	case <-time.After(2 * time.Second):
+		t.Fatalf("tunnel was not ready in time")
+	}
+
+	resp, err := http.Get(fmt.Sprintf("http://%s/", valid))
+	if err != nil {
+		t.Fatalf("error sending plaintext request through the tunnel: %v", err)
+	}
+	defer resp.Body.Close()
+
+	body, _ := ioutil.ReadAll(resp.Body)
+	if string(body) != "tls" {
+		t.Errorf("unexpected response from tls destination: %s", body)
+	}
+
+	_, err = http.Get(fmt.Sprintf("http://%s/", invalid))
+	if err == nil {
+		t.Errorf("connection was expected to fail on an invalid destination certificate")
+	}
+
+	err = tun.OriginateTLS("127.0.0.1:1", &tls.Config{})
+	if err == nil {
+		t.Errorf("error expected for unknown channel")
+	}
+}
+
+func TestTerminateTLS(t *testing.T) {
+	sshServer, err := createSSHServer(t, "", keyPath)
+	if err != nil {
+		t.Fatalf("error while creating ssh server: %s", err)
+	}
+	defer sshServer.Close()
+
+	l, hs := createHttpServer()
+	defer hs.Close()
+
+	// borrows the certificate of a tls test server, valid for 127.0.0.1
+	ts := httptest.NewTLSServer(http.NotFoundHandler())
+	ts.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ts.Certificate())
+
+	srv, _ := NewServer("mole", sshServer.Addr().String(), "", "", "testdata/.ssh/config")
+	srv.Insecure = true
+
+	tun, _ := New("local", srv, []string{"127.0.0.1:0"}, []string{l.Addr().String()}, configPath)
+	tun.ConnectionRetries = NoSshRetries
+	tun.KeepAliveInterval = 10 * time.Second
+
+	err = tun.TerminateTLS("", &tls.Config{})
+	if err == nil {
+		t.Errorf("error expected for a tls configuration without certificate")
+	}
+
+	err = tun.TerminateTLS("", &tls.Config{Certificates: ts.TLS.Certificates})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	go tun.Start()
+	defer tun.Stop()
+
+	select {
+	case <-tun.Ready:
+	case <-time.After(2 * time.Second):
+		t.Fatalf("tunnel was not ready in time")
+	}
+
+	source := tun.Channels()[0].Source
+
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots}}}
+
+	resp, err := client.Get(fmt.Sprintf("https://%s/", source))
+	if err != nil {
+		t.Fatalf("error sending tls request through the tunnel: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("unexpected status code from plaintext destination: %d", resp.StatusCode)
+	}
+
+	_, err = http.Get(fmt.Sprintf("http://%s/", source))
+	if err == nil {
+		t.Errorf("plaintext request was expected to be refused by the tls listener")
+	}
+}
+
+func TestChannelState(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("error creating listener: %v", err)
+	}
+	defer l.Close()
+
+	tests := []struct {
+		channel  *SSHChannel
+		expected string
+	}{
+		{&SSHChannel{ChannelType: "local"}, ChannelPending},
+		{&SSHChannel{ChannelType: "local", listener: l}, ChannelListening},
+		{&SSHChannel{ChannelType: "remote"}, ChannelPending},
+		{&SSHChannel{ChannelType: "remote", listener: l}, ChannelEstablished},
+		{&SSHChannel{ChannelType: "tun"}, ChannelPending},
+		{&SSHChannel{ChannelType: "tun", tun: &fakeTun{}}, ChannelEstablished},
+		{&SSHChannel{ChannelType: "stdio"}, ChannelEstablished},
+	}
+
+	for i, test := range tests {
+		if state := test.channel.State(); state != test.expected {
+			t.Errorf("test %d: unexpected state for %s channel: want %s, got %s", i, test.channel.ChannelType, test.expected, state)
+		}
+	}
+}
+
+func TestWaitForRemote(t *testing.T) {
+	sshServer, err := createSSHServer(t, "", keyPath)
+	if err != nil {
+		t.Fatalf("error while creating ssh server: %s", err)
+	}
+	defer sshServer.Close()
+
+	ports, err := freeport.GetFreePorts(2)
+	if err != nil {
+		t.Fatalf("error getting free ports: %v", err)
+	}
+
+	destination := fmt.Sprintf("127.0.0.1:%d", ports[0])
+	unreachable := fmt.Sprintf("127.0.0.1:%d", ports[1])
+
+	srv, _ := NewServer("mole", sshServer.Addr().String(), "", "", "testdata/.ssh/config")
+	srv.Insecure = true
+
+	tun, _ := New("local", srv, []string{"127.0.0.1:0"}, []string{destination}, configPath)
+	tun.ConnectionRetries = NoSshRetries
+	tun.KeepAliveInterval = 10 * time.Second
+	tun.WaitForRemote = 5 * time.Second
+
+	go tun.Start()
+	defer tun.Stop()
+
+	select {
+	case <-tun.Ready:
+		t.Fatalf("tunnel was not expected to be ready before its destination is reachable")
+	case <-time.After(1500 * time.Millisecond):
+	}
+
+	l, err := net.Listen("tcp", destination)
+	if err != nil {
+		t.Fatalf("error listening on destination: %v", err)
+	}
+	defer l.Close()
+
+	select {
+	case <-tun.Ready:
+	case <-time.After(3 * time.Second):
+		t.Fatalf("tunnel was expected to be ready once its destination is reachable")
+	}
+
+	tun, _ = New("local", srv, []string{"127.0.0.1:0"}, []string{unreachable}, configPath)
+	tun.ConnectionRetries = NoSshRetries
+	tun.KeepAliveInterval = 10 * time.Second
+	tun.WaitForRemote = 1 * time.Second
+
+	result := make(chan error, 1)
+	go func() {
+		result <- tun.Start()
+	}()
+
+	select {
+	case err := <-result:
+		if err == nil {
+			t.Errorf("error expected when the destination is still unreachable after the timeout")
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatalf("tunnel was expected to fail once the timeout is over")
+	}
+}
+
+func TestHTTPError(t *testing.T) {
+	sshServer, err := createSSHServer(t, "", keyPath)
+	if err != nil {
+		t.Fatalf("error while creating ssh server: %s", err)
+	}
+	defer sshServer.Close()
+
+	ports, err := freeport.GetFreePorts(3)
+	if err != nil {
+		t.Fatalf("error getting free ports: %v", err)
+	}
+
+	httpSource := fmt.Sprintf("127.0.0.1:%d", ports[0])
+	plainSource := fmt.Sprintf("127.0.0.1:%d", ports[1])
+	unreachable := fmt.Sprintf("127.0.0.1:%d", ports[2])
+
+	srv, _ := NewServer("mole", sshServer.Addr().String(), "", "", "testdata/.ssh/config")
+	srv.Insecure = true
+
+	tun, _ := New("local", srv, []string{httpSource, plainSource}, []string{unreachable, unreachable}, configPath)
+	tun.ConnectionRetries = NoSshRetries
+	tun.KeepAliveInterval = 10 * time.Second
+
+	err = tun.HTTPErrorChannel(httpSource)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	err = tun.HTTPErrorChannel("127.0.0.1:1")
+	if err == nil {
+		t.Errorf("error expected for unknown channel")
+	}
+
+	go tun.Start()
+	defer tun.Stop()
+
+	select {
+	case <-tun.Ready:
+	case <-time.After(2 * time.Second):
+		t.Fatalf("tunnel was not ready in time")
+	}
+
+	resp, err := http.Get(fmt.Sprintf("http://%s/", httpSource))
+	if err != nil {
+		t.Fatalf("error sending request to http channel: %v", err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("unexpected response status: want: %d, got: %d", http.StatusServiceUnavailable, resp.StatusCode)
+	}
+
+	_, err = http.Get(fmt.Sprintf("http://%s/", plainSource))
+	if err == nil {
+		t.Errorf("connection to a channel not marked as http was expected to be closed")
+	}
+}
+
+func TestMaxReconnects(t *testing.T) {
+	sshServer, err := createSSHServer(t, "", keyPath)
+	if err != nil {
+		t.Fatalf("error while creating ssh server: %s", err)
+	}
+	defer sshServer.Close()
+
+	srv, _ := NewServer("mole", sshServer.Addr().String(), "", "", "testdata/.ssh/config")
+	srv.Insecure = true
+
+	tun, _ := New("local", srv, []string{"127.0.0.1:0"}, []string{"127.0.0.1:80"}, configPath)
+	tun.ConnectionRetries = 3
+	tun.WaitAndRetry = 10 * time.Millisecond
+	tun.KeepAliveInterval = 10 * time.Second
+	tun.MaxReconnects = 1
+
+	result := make(chan error, 1)
+	go func() {
+		result <- tun.Start()
+	}()
+
+	select {
+	case <-tun.Ready:
+	case <-time.After(2 * time.Second):
+		t.Fatalf("tunnel was not ready in time")
+	}
+
+	tun.sshClient().Close()
+
+	select {
+	case <-tun.Ready:
+	case err := <-result:
+		t.Fatalf("tunnel was expected to reconnect once: %v", err)
+	case <-time.After(2 * time.Second):
+		t.Fatalf("tunnel was not ready in time after reconnecting")
+	}
+
+	tun.sshClient().Close()
+
+	select {
+	case err := <-result:
+		if err != ErrMaxReconnects {
+			t.Errorf("unexpected error: want: %v, got: %v", ErrMaxReconnects, err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("tunnel was expected to give up after too many reconnections")
+	}
+}
+
+func TestRestart(t *testing.T) {
+	sshServer, err := createSSHServer(t, "", keyPath)
+	if err != nil {
+		t.Fatalf("error while creating ssh server: %s", err)
+	}
+	defer sshServer.Close()
+
+	srv, _ := NewServer("mole", sshServer.Addr().String(), "", "", "testdata/.ssh/config")
+	srv.Insecure = true
+
+	tun, _ := New("local", srv, []string{"127.0.0.1:0"}, []string{"127.0.0.1:80"}, configPath)
+	tun.ConnectionRetries = 3
+	tun.WaitAndRetry = 10 * time.Millisecond
+	tun.KeepAliveInterval = 10 * time.Second
+	tun.MaxReconnects = 1
+
+	result := make(chan error, 1)
+	go func() {
+		result <- tun.Start()
+	}()
+	defer tun.Stop()
+
+	select {
+	case <-tun.Ready:
+	case <-time.After(2 * time.Second):
+		t.Fatalf("tunnel was not ready in time")
+	}
+
+	// restarts are not counted towards MaxReconnects
+	for i := 0; i < 3; i++ {
+		client := tun.sshClient()
+
+		if err := tun.Restart(); err != nil {
+			t.Fatalf("error restarting the tunnel: %v", err)
+		}
+
+		select {
+		case <-tun.Ready:
+		case err := <-result:
+			t.Fatalf("tunnel was expected to keep running after restart %d: %v", i, err)
+		case <-time.After(2 * time.Second):
+			t.Fatalf("tunnel was not ready in time after restart %d", i)
+		}
+
+		if client == tun.sshClient() {
+			t.Errorf("tunnel is still using the connection established before restart %d", i)
+		}
+	}
+}
+
+func TestRestartWhileRetrying(t *testing.T) {
+	l, attempts := createFailingServer()
+
+	srv, _ := NewServer("mole", l.Addr().String(), "", "", "testdata/.ssh/config")
+	srv.Insecure = true
+
+	tun, _ := New("local", srv, []string{"127.0.0.1:0"}, []string{"127.0.0.1:80"}, configPath)
+	tun.ConnectionRetries = 2
+	tun.WaitAndRetry = time.Hour
+
+	var retries []int
+	tun.ShouldRetry = func(attempt int, lastErr error) bool {
+		retries = append(retries, attempt)
+
+		if len(retries) == 1 {
+			go tun.Restart()
+			return true
+		}
+
+		return false
+	}
+
+	result := make(chan error, 1)
+	go func() {
+		result <- tun.dial()
+	}()
+
+	// the restart cuts the wait short and clears the failed attempt, so the
+	// next attempt is counted as the first one.
+	select {
+	case <-result:
+	case <-time.After(2 * time.Second):
+		t.Fatalf("tunnel did not retry right away once restarted")
+	}
+
+	l.Close()
+
+	if a := <-attempts; a != 2 {
+		t.Errorf("unexpected number of connection attempts: expected: 2, value: %d", a)
+	}
+
+	if !reflect.DeepEqual([]int{1, 1}, retries) {
+		t.Errorf("unexpected attempts given to ShouldRetry: %v", retries)
+	}
+}
+
+func TestNotify(t *testing.T) {
+	sshServer, err := createSSHServer(t, "", keyPath)
+	if err != nil {
+		t.Fatalf("error while creating ssh server: %s", err)
+	}
+	defer sshServer.Close()
+
+	l, hs := createHttpServer()
+	defer hs.Close()
+
+	srv, _ := NewServer("mole", sshServer.Addr().String(), "", "", "testdata/.ssh/config")
+	srv.Insecure = true
+
+	tun, _ := New("local", srv, []string{"127.0.0.1:0"}, []string{l.Addr().String()}, configPath)
+	tun.ConnectionRetries = 3
+	tun.WaitAndRetry = 10 * time.Millisecond
+	tun.KeepAliveInterval = 10 * time.Second
+
+	events := make(chan Event, 10)
+	tun.Notify = func(e Event) {
+		events <- e
+	}
+
+	go tun.Start()
+	defer tun.Stop()
+
+	select {
+	case <-tun.Ready:
+	case <-time.After(2 * time.Second):
+		t.Fatalf("tunnel was not ready in time")
+	}
+
+	conn, err := net.Dial("tcp", tun.Channels()[0].listener.Addr().String())
+	if err != nil {
+		t.Fatalf("error connecting to the tunnel: %v", err)
+	}
+
+	request := "GET /ABC HTTP/1.0\r\n\r\n"
+	fmt.Fprint(conn, request)
+	response, _ := ioutil.ReadAll(conn)
+	conn.Close()
+
+	for _, want := range []string{EventConnect, EventChannelOpen, EventChannelClose} {
+		select {
+		case e := <-events:
+			if e.Type != want {
+				t.Fatalf("unexpected event: want: %s, got: %s", want, e.Type)
+			}
+
+			if e.Server != sshServer.Addr().String() {
+				t.Errorf("unexpected server on %s event: %s", e.Type, e.Server)
+			}
+
+			if e.Type == EventChannelClose {
+				if e.BytesSent != int64(len(request)) || e.BytesReceived != int64(len(response)) {
+					t.Errorf("unexpected bytes forwarded: want: %d/%d, got: %d/%d", len(request), len(response), e.BytesSent, e.BytesReceived)
+				}
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("%s event was not sent in time", want)
+		}
+	}
+}
+
+func TestViaChannel(t *testing.T) {
+	sshServer, err := createSSHServer(t, "", keyPath)
+	if err != nil {
+		t.Fatalf("error while creating ssh server: %s", err)
+	}
+	defer sshServer.Close()
+
+	hopServer, err := createSSHServer(t, "", keyPath)
+	if err != nil {
+		t.Fatalf("error while creating ssh server: %s", err)
+	}
+
+	l, hs := createHttpServer()
+	defer hs.Close()
+
+	srv, _ := NewServer("mole", sshServer.Addr().String(), "", "", "testdata/.ssh/config")
+	srv.Insecure = true
+
+	via, _ := NewServer("mole", hopServer.Addr().String(), "", "", "testdata/.ssh/config")
+	via.Insecure = true
+
+	ports, err := freeport.GetFreePorts(2)
+	if err != nil {
+		t.Fatalf("error getting free ports: %v", err)
+	}
+
+	hopped := fmt.Sprintf("127.0.0.1:%d", ports[0])
+	direct := fmt.Sprintf("127.0.0.1:%d", ports[1])
+
+	tun, _ := New("local", srv, []string{hopped, direct}, []string{l.Addr().String(), l.Addr().String()}, configPath)
+	tun.ConnectionRetries = NoSshRetries
+	tun.KeepAliveInterval = 10 * time.Second
+
+	err = tun.ViaChannel(hopped, via)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	err = tun.ViaChannel("127.0.0.1:1", via)
+	if err == nil {
+		t.Errorf("error expected for unknown channel")
+	}
+
+	go tun.Start()
+	defer tun.Stop()
+
+	select {
+	case <-tun.Ready:
+	case <-time.After(2 * time.Second):
+		t.Fatalf("tunnel was not ready in time")
+	}
+
+	err = validateTunnelConnectivity(t, "ABC", tun)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	tun.hopsMu.Lock()
+	hops := len(tun.hops)
+	tun.hopsMu.Unlock()
+
+	if hops != 1 {
+		t.Errorf("a single connection to the additional ssh server was expected: %d", hops)
+	}
+
+	// only the channel going via the additional ssh server depends on it.
+	hopServer.Close()
+	tun.closeHops()
+
+	client := http.Client{Timeout: 500 * time.Millisecond}
+
+	_, err = client.Get(fmt.Sprintf("http://%s/DEF", hopped))
+	if err == nil {
+		t.Errorf("channel was expected to fail without its additional ssh server")
+	}
+
+	resp, err := client.Get(fmt.Sprintf("http://%s/DEF", direct))
+	if err != nil {
+		t.Fatalf("channel was expected to keep working without the additional ssh server: %v", err)
+	}
+	resp.Body.Close()
+}
+
+func TestVerifyHostKey(t *testing.T) {
+	sshServer, err := createSSHServer(t, "", keyPath)
+	if err != nil {
+		t.Fatalf("error while creating ssh server: %s", err)
+	}
+	defer sshServer.Close()
+
+	srv, _ := NewServer("mole", sshServer.Addr().String(), "", "", "testdata/.ssh/config")
+
+	err = generateKnownHosts(sshServer.Addr(), publicKeyPath, knownHostsPath)
+	if err != nil {
+		t.Fatalf("error generating known hosts file for tests: %v", err)
+	}
+
+	err = VerifyHostKey(srv)
+	if err != nil {
+		t.Errorf("host key was expected to be verified: %v", err)
+	}
+
+	// a different key known for the same server
+	pub, _, _ := ed25519.GenerateKey(nil)
+	pk, _ := ssh.NewPublicKey(pub)
+	l := knownhosts.Line([]string{sshServer.Addr().String()}, pk)
+	ioutil.WriteFile(knownHostsPath, []byte(l), 0600)
+
+	err = VerifyHostKey(srv)
+	if err == nil {
+		t.Errorf("error expected when the host key does not match the known one")
+	}
+
+	srv.Insecure = true
+
+	err = VerifyHostKey(srv)
+	if err != nil {
+		t.Errorf("host key was not expected to be verified in insecure mode: %v", err)
+	}
+
+	srv.Insecure = false
+	srv.Address = "127.0.0.1:1"
+
+	err = VerifyHostKey(srv)
+	if err != nil {
+		t.Errorf("unreachable ssh server was not expected to be reported: %v", err)
+	}
+}
+
+func TestHostKey(t *testing.T) {
+	sshServer, err := createSSHServer(t, "", keyPath)
+	if err != nil {
+		t.Fatalf("error while creating ssh server: %s", err)
+	}
+	defer sshServer.Close()
+
+	d, err := ioutil.ReadFile(publicKeyPath)
+	if err != nil {
+		t.Fatalf("error reading the ssh server public key: %v", err)
+	}
+
+	expected, _, _, _, err := ssh.ParseAuthorizedKey(d)
+	if err != nil {
+		t.Fatalf("error parsing the ssh server public key: %v", err)
+	}
+
+	// the host key is retrieved without being verified against any known_hosts
+	// file nor authenticating.
+	srv, err := NewServer("", sshServer.Addr().String(), "", "", "testdata/.ssh/config", WithoutCredentials())
+	if err != nil {
+		t.Fatalf("error creating server without credentials: %v", err)
+	}
+
+	key, err := HostKey(srv)
+	if err != nil {
+		t.Fatalf("error retrieving the host key: %v", err)
+	}
+
+	if ssh.FingerprintSHA256(key) != ssh.FingerprintSHA256(expected) {
+		t.Errorf("unexpected host key: expected: %s, value: %s", ssh.FingerprintSHA256(expected), ssh.FingerprintSHA256(key))
+	}
+
+	srv.Address = "127.0.0.1:1"
+
+	_, err = HostKey(srv)
+	if err == nil {
+		t.Errorf("error expected when the ssh server can't be reached")
+	}
+}
+
+func TestStatsLastPeer(t *testing.T) {
+	sshServer, err := createSSHServer(t, "", keyPath)
+	if err != nil {
+		t.Fatalf("error while creating ssh server: %s", err)
+	}
+	defer sshServer.Close()
+
+	l, hs := createHttpServer()
+	defer hs.Close()
+
+	srv, _ := NewServer("mole", sshServer.Addr().String(), "", "", "testdata/.ssh/config")
+	srv.Insecure = true
+
+	tun, _ := New("remote", srv, []string{"127.0.0.1:0"}, []string{"backend.mole.invalid:" + strconv.Itoa(l.Addr().(*net.TCPAddr).Port)}, configPath)
+	tun.ConnectionRetries = NoSshRetries
+	tun.KeepAliveInterval = 10 * time.Second
+	tun.HostAliases = map[string]string{"backend.mole.invalid": "127.0.0.1"}
+
+	// the test ssh server doesn't forward the connections made to the
+	// listeners it is asked to open, so a local listener stands in for it.
+	source, _ := net.Listen("tcp", "127.0.0.1:0")
+	tun.channels[0].listener = source
+	tun.channels[0].Source = source.Addr().String()
+
+	go tun.Start()
+	defer tun.Stop()
+
+	select {
+	case <-tun.Ready:
+	case <-time.After(2 * time.Second):
+		t.Fatalf("tunnel was not ready in time")
+	}
+
+	client := http.Client{Timeout: 1 * time.Second}
+
+	resp, err := client.Get(fmt.Sprintf("http://%s/peer", source.Addr()))
+	if err != nil {
+		t.Fatalf("error sending request through the tunnel: %v", err)
+	}
+	resp.Body.Close()
+
+	if peer := tun.Stats()[0].LastPeer; peer != l.Addr().String() {
+		t.Errorf("unexpected last peer: want: %s, got: %s", l.Addr(), peer)
+	}
+}
+
+func TestUnixSocketSource(t *testing.T) {
+	sshServer, err := createSSHServer(t, "", keyPath)
+	if err != nil {
+		t.Fatalf("error while creating ssh server: %s", err)
+	}
+	defer sshServer.Close()
+
+	l, hs := createHttpServer()
+	defer hs.Close()
+
+	dir, err := ioutil.TempDir("", "mole-unix")
+	if err != nil {
+		t.Fatalf("error creating temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	socket := filepath.Join(dir, "mole.sock")
+
+	srv, _ := NewServer("mole", sshServer.Addr().String(), "", "", "testdata/.ssh/config")
+	srv.Insecure = true
+
+	tun, _ := New("local", srv, []string{socket}, []string{l.Addr().String()}, configPath)
+	tun.ConnectionRetries = NoSshRetries
+	tun.KeepAliveInterval = 10 * time.Second
+
+	go tun.Start()
+	defer tun.Stop()
+
+	select {
+	case <-tun.Ready:
+	case <-time.After(2 * time.Second):
+		t.Fatalf("tunnel was not ready in time")
+	}
+
+	if source := tun.Channels()[0].Source; source != socket {
+		t.Errorf("unexpected channel source: want: %s, got: %s", socket, source)
+	}
+
+	client := http.Client{
+		Timeout: 1 * time.Second,
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				return net.Dial("unix", socket)
+			},
+		},
+	}
+
+	resp, err := client.Get("http://mole/unix-source")
+	if err != nil {
+		t.Fatalf("error sending request through unix socket channel: %v", err)
+	}
+	defer resp.Body.Close()
+
+	body, _ := ioutil.ReadAll(resp.Body)
+	if string(body) != "unix-source" {
+		t.Errorf("unexpected response: want: %s, got: %s", "unix-source", body)
+	}
+}
+
+func TestUnixSocketDestination(t *testing.T) {
+	sshServer, err := createSSHServer(t, "", keyPath)
+	if err != nil {
+		t.Fatalf("error while creating ssh server: %s", err)
+	}
+	defer sshServer.Close()
+
+	dir, err := ioutil.TempDir("", "mole-unix")
+	if err != nil {
+		t.Fatalf("error creating temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	socket := filepath.Join(dir, "http.sock")
+
+	l, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatalf("error creating unix socket listener: %v", err)
+	}
+
+	hs := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, r.URL.Path[1:])
+	})}
+	go hs.Serve(l)
+	defer hs.Close()
+
+	srv, _ := NewServer("mole", sshServer.Addr().String(), "", "", "testdata/.ssh/config")
+	srv.Insecure = true
+
+	tun, _ := New("local", srv, []string{"127.0.0.1:0"}, []string{socket}, configPath)
+	tun.ConnectionRetries = NoSshRetries
+	tun.KeepAliveInterval = 10 * time.Second
+
+	go tun.Start()
+	defer tun.Stop()
+
+	select {
+	case <-tun.Ready:
+	case <-time.After(2 * time.Second):
+		t.Fatalf("tunnel was not ready in time")
+	}
+
+	client := http.Client{Timeout: 1 * time.Second}
+
+	resp, err := client.Get(fmt.Sprintf("http://%s/unix-destination", tun.Channels()[0].Source))
+	if err != nil {
+		t.Fatalf("error sending request to unix socket destination: %v", err)
+	}
+	defer resp.Body.Close()
+
+	body, _ := ioutil.ReadAll(resp.Body)
+	if string(body) != "unix-destination" {
+		t.Errorf("unexpected response: want: %s, got: %s", "unix-destination", body)
+	}
+}
+
+func TestAddressNetwork(t *testing.T) {
+	tests := []struct {
+		address  string
+		expected string
+	}{
+		{"127.0.0.1:8080", "tcp"},
+		{"example.com:80", "tcp"},
+		{"[::1]:22", "tcp"},
+		{"/var/run/docker.sock", "unix"},
+		{"./mole.sock", "unix"},
+	}
+
+	for _, test := range tests {
+		if network := addressNetwork(test.address); network != test.expected {
+			t.Errorf("unexpected network for %s: want: %s, got: %s", test.address, test.expected, network)
+		}
+	}
+}
+
+func TestRun(t *testing.T) {
+	sshServer, err := createSSHServer(t, "", keyPath)
+	if err != nil {
+		t.Fatalf("error while creating ssh server: %s", err)
+	}
+	defer sshServer.Close()
+
+	l, hs := createHttpServer()
+	defer hs.Close()
+
+	srv, _ := NewServer("mole", sshServer.Addr().String(), "", "", "testdata/.ssh/config")
+	srv.Insecure = true
+
+	sources := make(chan string, 1)
+
+	cfg := Config{
+		Server:            srv,
+		Source:            []string{"127.0.0.1:0"},
+		Destination:       []string{l.Addr().String()},
+		SSHConfig:         configPath,
+		ConnectionRetries: NoSshRetries,
+		KeepAliveInterval: 10 * time.Second,
+		Ready: func(tun *Tunnel) {
+			sources <- tun.Channels()[0].Source
+		},
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	result := make(chan error, 1)
+	go func() { result <- Run(ctx, cfg) }()
+
+	var source string
+
+	select {
+	case source = <-sources:
+	case err := <-result:
+		t.Fatalf("tunnel stopped before it was ready: %v", err)
+	case <-time.After(2 * time.Second):
+		t.Fatalf("tunnel was not ready in time")
+	}
+
+	client := http.Client{Timeout: 1 * time.Second}
+
+	resp, err := client.Get(fmt.Sprintf("http://%s/run", source))
+	if err != nil {
+		t.Fatalf("error sending request through the tunnel: %v", err)
+	}
+	resp.Body.Close()
+
+	cancel()
+
+	select {
+	case err := <-result:
+		if err != context.Canceled {
+			t.Errorf("unexpected error returned once the context is canceled: %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("tunnel was not stopped in time")
+	}
+
+	if conn, err := net.Dial("tcp", source); err == nil {
+		conn.Close()
+		t.Errorf("channel listener was expected to be closed once the tunnel stopped")
+	}
+}
+
+// countingDialer is a Dialer counting the connections it opens.
+type countingDialer struct {
+	dials uint32
+}
+
+func (d *countingDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	atomic.AddUint32(&d.dials, 1)
+
+	var nd net.Dialer
+	return nd.DialContext(ctx, network, address)
+}
+
+func TestServerDialerAndHostKeyCallback(t *testing.T) {
+	sshServer, err := createSSHServer(t, "", keyPath)
+	if err != nil {
+		t.Fatalf("error while creating ssh server: %s", err)
+	}
+	defer sshServer.Close()
+
+	l, hs := createHttpServer()
+	defer hs.Close()
+
+	dialer := &countingDialer{}
+
+	var verified uint32
+
+	srv, _ := NewServer("mole", sshServer.Addr().String(), "", "", "testdata/.ssh/config")
+	srv.Dialer = dialer
+	srv.HostKeyCallback = func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		atomic.AddUint32(&verified, 1)
+		return nil
+	}
+
+	tun, err := NewFromConfig(Config{
+		Server:            srv,
+		Source:            []string{"127.0.0.1:0"},
+		Destination:       []string{l.Addr().String()},
+		SSHConfig:         configPath,
+		ConnectionRetries: NoSshRetries,
+		KeepAliveInterval: 10 * time.Second,
+	})
+	if err != nil {
+		t.Fatalf("error creating tunnel: %v", err)
+	}
+
+	go tun.Start()
+	defer tun.Stop()
+
+	select {
+	case <-tun.Ready:
+	case <-time.After(2 * time.Second):
+		t.Fatalf("tunnel was not ready in time")
+	}
+
+	if n := atomic.LoadUint32(&dialer.dials); n != 1 {
+		t.Errorf("ssh server was expected to be dialed once through the server dialer, got %d", n)
+	}
+
+	if n := atomic.LoadUint32(&verified); n != 1 {
+		t.Errorf("host key was expected to be verified once through the server callback, got %d", n)
+	}
+}
+
+func TestNewFromConfigDefaults(t *testing.T) {
+	srv, _ := NewServer("mole", "127.0.0.1:22", "", "", "testdata/.ssh/config")
+
+	tun, err := NewFromConfig(Config{
+		Server:       srv,
+		Destination:  []string{"127.0.0.1:80"},
+		SSHConfig:    configPath,
+		LogRateLimit: -1,
+	})
+	if err != nil {
+		t.Fatalf("error creating tunnel: %v", err)
+	}
+
+	if tun.Type != "local" {
+		t.Errorf("unexpected tunnel type: want: local, got: %s", tun.Type)
+	}
+
+	if tun.DialTimeout != DefaultDialTimeout {
+		t.Errorf("unexpected dial timeout: want: %s, got: %s", DefaultDialTimeout, tun.DialTimeout)
+	}
+
+	if tun.ConnectionWaitTimeout != DefaultConnectionWaitTimeout {
+		t.Errorf("unexpected connection wait timeout: want: %s, got: %s", DefaultConnectionWaitTimeout, tun.ConnectionWaitTimeout)
+	}
+
+	if tun.LogRateLimit != 0 {
+		t.Errorf("log rate limit was expected to be disabled, got: %s", tun.LogRateLimit)
+	}
+
+	_, err = NewFromConfig(Config{Destination: []string{"127.0.0.1:80"}})
+	if err == nil {
+		t.Errorf("tunnel was not expected to be created without an ssh server")
+	}
+}
+
+func TestStats(t *testing.T) {
+	sshServer, err := createSSHServer(t, "", keyPath)
+	if err != nil {
+		t.Fatalf("error while creating ssh server: %s", err)
+	}
+	defer sshServer.Close()
+
+	l, hs := createHttpServer()
+	defer hs.Close()
+
+	ports, err := freeport.GetFreePorts(3)
+	if err != nil {
+		t.Fatalf("error getting free ports: %v", err)
+	}
+
+	reachable := fmt.Sprintf("127.0.0.1:%d", ports[0])
+	unreachable := fmt.Sprintf("127.0.0.1:%d", ports[1])
+
+	srv, _ := NewServer("mole", sshServer.Addr().String(), "", "", "testdata/.ssh/config")
+	srv.Insecure = true
+
+	tun, _ := New("local", srv, []string{reachable, unreachable}, []string{l.Addr().String(), fmt.Sprintf("127.0.0.1:%d", ports[2])}, configPath)
+	tun.ConnectionRetries = NoSshRetries
+	tun.KeepAliveInterval = 10 * time.Second
+
+	go tun.Start()
+	defer tun.Stop()
+
+	select {
+	case <-tun.Ready:
+	case <-time.After(2 * time.Second):
+		t.Fatalf("tunnel was not ready in time")
+	}
+
+	// every request must go through a new connection to the channel
+	client := http.Client{
+		Timeout:   500 * time.Millisecond,
+		Transport: &http.Transport{DisableKeepAlives: true},
+	}
+
+	for _, source := range []string{reachable, reachable, unreachable} {
+		resp, err := client.Get(fmt.Sprintf("http://%s/stats", source))
+		if err == nil {
+			resp.Body.Close()
+		}
+	}
+
+	expected := []ChannelStats{
+		{Source: reachable, Destination: l.Addr().String(), DialAttempts: 2, DialSuccesses: 2, Generation: 1},
+		{Source: unreachable, Destination: fmt.Sprintf("127.0.0.1:%d", ports[2]), DialAttempts: 1, DialFailures: 1, Generation: 1},
+	}
+
+	// the byte counters depend on the size of the http messages, and the
+	// uptime on when the stats are read, so they are checked apart.
+	dialStats := func() []ChannelStats {
+		stats := tun.Stats()
+		for i := range stats {
+			stats[i].BytesSent, stats[i].BytesReceived = 0, 0
+			stats[i].ConnectionUptime = 0
+		}
+
+		return stats
+	}
+
+	// the failure is counted right before the client connection is closed
+	deadline := time.Now().Add(1 * time.Second)
+	for !reflect.DeepEqual(expected, dialStats()) && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if stats := dialStats(); !reflect.DeepEqual(expected, stats) {
+		t.Errorf("unexpected channel stats: want: %+v, got: %+v", expected, stats)
+	}
+
+	stats := tun.Stats()
+
+	if stats[0].BytesSent == 0 || stats[0].BytesReceived == 0 {
+		t.Errorf("bytes forwarded through the reachable channel were expected to be counted: %+v", stats[0])
+	}
+
+	if stats[1].BytesSent != 0 || stats[1].BytesReceived != 0 {
+		t.Errorf("no bytes were expected to be forwarded through the unreachable channel: %+v", stats[1])
+	}
+}
+
+func TestStatsAcrossReconnects(t *testing.T) {
+	sshServer, err := createSSHServer(t, "", keyPath)
+	if err != nil {
+		t.Fatalf("error while creating ssh server: %s", err)
+	}
+	defer sshServer.Close()
+
+	l, hs := createHttpServer()
+	defer hs.Close()
+
+	srv, _ := NewServer("mole", sshServer.Addr().String(), "", "", "testdata/.ssh/config")
+	srv.Insecure = true
+
+	tun, _ := New("local", srv, []string{"127.0.0.1:0"}, []string{l.Addr().String()}, configPath)
+	tun.ConnectionRetries = 3
+	tun.WaitAndRetry = 10 * time.Millisecond
+	tun.KeepAliveInterval = 10 * time.Second
+
+	if g := tun.Generation(); g != 0 {
+		t.Errorf("unexpected generation before connecting: %d", g)
+	}
+
+	if u := tun.Uptime(); u != 0 {
+		t.Errorf("unexpected uptime before connecting: %s", u)
+	}
+
+	go tun.Start()
+	defer tun.Stop()
+
+	select {
+	case <-tun.Ready:
+	case <-time.After(2 * time.Second):
+		t.Fatalf("tunnel was not ready in time")
+	}
+
+	ready := time.Now()
+
+	client := http.Client{
+		Timeout:   500 * time.Millisecond,
+		Transport: &http.Transport{DisableKeepAlives: true},
+	}
+
+	get := func() {
+		resp, err := client.Get(fmt.Sprintf("http://%s/stats", tun.channels[0].listener.Addr()))
+		if err != nil {
+			t.Fatalf("error requesting through the tunnel: %v", err)
+		}
+		ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+	}
+
+	get()
+
+	before := tun.Stats()[0]
+
+	if err := tun.Restart(); err != nil {
+		t.Fatalf("error restarting the tunnel: %v", err)
+	}
+
+	select {
+	case <-tun.Ready:
+	case <-time.After(2 * time.Second):
+		t.Fatalf("tunnel was not ready in time after restarting")
+	}
+
+	get()
+
+	after := tun.Stats()[0]
+
+	if before.Generation != 1 || after.Generation != 2 {
+		t.Errorf("unexpected generations: before: %d, after: %d", before.Generation, after.Generation)
+	}
+
+	if after.DialSuccesses != 2 {
+		t.Errorf("connections were expected to be counted across reconnections: %+v", after)
+	}
+
+	if after.BytesSent <= before.BytesSent || after.BytesReceived <= before.BytesReceived {
+		t.Errorf("bytes were expected to be counted across reconnections: before: %+v, after: %+v", before, after)
+	}
+
+	// the tunnel connected before it was ready, so only an uptime counted
+	// from the reconnection is shorter than the time since then.
+	if before.ConnectionUptime <= 0 || after.ConnectionUptime <= 0 || after.ConnectionUptime >= time.Since(ready) {
+		t.Errorf("connection uptime was expected to restart along with the connection: before: %s, after: %s", before.ConnectionUptime, after.ConnectionUptime)
+	}
+}
+
+func TestOpenSSHChannels(t *testing.T) {
+	sshServer, err := createSSHServer(t, "", keyPath)
+	if err != nil {
+		t.Fatalf("error while creating ssh server: %s", err)
+	}
+	defer sshServer.Close()
+
+	// the destination holds every connection open until the test is done
+	destination, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("error creating destination listener: %v", err)
+	}
+	defer destination.Close()
+
+	go func() {
+		for {
+			conn, err := destination.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	srv, _ := NewServer("mole", sshServer.Addr().String(), "", "", "testdata/.ssh/config")
+	srv.Insecure = true
+
+	tun, _ := New("local", srv, []string{"127.0.0.1:0"}, []string{destination.Addr().String()}, configPath)
+	tun.ConnectionRetries = NoSshRetries
+	tun.KeepAliveInterval = 10 * time.Second
+
+	go tun.Start()
+	defer tun.Stop()
+
+	select {
+	case <-tun.Ready:
+	case <-time.After(2 * time.Second):
+		t.Fatalf("tunnel was not ready in time")
+	}
+
+	waitOpen := func(expected int64) {
+		deadline := time.Now().Add(1 * time.Second)
+		for tun.OpenSSHChannels() != expected && time.Now().Before(deadline) {
+			time.Sleep(10 * time.Millisecond)
+		}
+
+		if open := tun.OpenSSHChannels(); open != expected {
+			t.Fatalf("unexpected number of open ssh channels: want: %d, got: %d", expected, open)
+		}
+
+		if open := tun.Stats()[0].OpenSSHChannels; open != expected {
+			t.Fatalf("unexpected number of open ssh channels on the channel stats: want: %d, got: %d", expected, open)
+		}
+	}
+
+	var conns []net.Conn
+	for i := 0; i < 2; i++ {
+		conn, err := net.Dial("tcp", tun.Channels()[0].Source)
+		if err != nil {
+			t.Fatalf("error connecting to the tunnel: %v", err)
+		}
+		defer conn.Close()
+
+		conns = append(conns, conn)
+	}
+
+	waitOpen(2)
+
+	conns[0].Close()
+
+	waitOpen(1)
+}
+
+func TestVerify(t *testing.T) {
+	sshServer, err := createSSHServer(t, "", keyPath)
+	if err != nil {
+		t.Fatalf("error while creating ssh server: %s", err)
+	}
+	defer sshServer.Close()
+
+	l, hs := createHttpServer()
+	defer hs.Close()
+
+	ports, err := freeport.GetFreePorts(1)
+	if err != nil {
+		t.Fatalf("error getting free ports: %v", err)
+	}
+
+	unreachable := fmt.Sprintf("127.0.0.1:%d", ports[0])
+
+	srv, _ := NewServer("mole", sshServer.Addr().String(), "", "", "testdata/.ssh/config")
+	srv.Insecure = true
+
+	tests := []struct {
+		destination string
+		fail        bool
+	}{
+		{l.Addr().String(), false},
+		{unreachable, true},
+	}
+
+	for i, test := range tests {
+		tun, _ := New("local", srv, []string{"127.0.0.1:0"}, []string{test.destination}, configPath)
+		tun.ConnectionRetries = NoSshRetries
+		tun.KeepAliveInterval = 10 * time.Second
+
+		result := make(chan error, 1)
+		go func() { result <- tun.Verify() }()
+
+		select {
+		case err = <-result:
+		case <-time.After(3 * time.Second):
+			t.Fatalf("test %d: tunnel verification didn't finish in time", i)
+		}
+
+		if test.fail != (err != nil) {
+			t.Errorf("test %d: unexpected verification result: %v", i, err)
+		}
+
+		// the source address is listened on only during the verification
+		if conn, err := net.Dial("tcp", tun.Channels()[0].Source); err == nil {
+			conn.Close()
+			t.Errorf("test %d: listener expected to be closed after the verification", i)
+		}
+	}
+}
+
+func TestDrain(t *testing.T) {
+	sshServer, err := createSSHServer(t, "", keyPath)
+	if err != nil {
+		t.Fatalf("error while creating ssh server: %s", err)
+	}
+	defer sshServer.Close()
+
+	echo, _ := net.Listen("tcp", "127.0.0.1:0")
+	defer echo.Close()
+
+	go func() {
+		for {
+			conn, err := echo.Accept()
+			if err != nil {
+				return
+			}
+
+			go func() {
+				io.Copy(conn, conn)
+				conn.Close()
+			}()
+		}
+	}()
+
+	srv, _ := NewServer("mole", sshServer.Addr().String(), "", "", "testdata/.ssh/config")
+	srv.Insecure = true
+
+	tun, _ := New("local", srv, []string{"127.0.0.1:0"}, []string{echo.Addr().String()}, configPath)
+	tun.ConnectionRetries = NoSshRetries
+	tun.KeepAliveInterval = 10 * time.Second
+
+	result := make(chan error, 1)
+	go func() { result <- tun.Start() }()
+
+	select {
+	case <-tun.Ready:
+	case <-time.After(2 * time.Second):
+		t.Fatalf("tunnel was not ready in time")
+	}
+
+	source := tun.Channels()[0].Source
+
+	conn, err := net.Dial("tcp", source)
+	if err != nil {
+		t.Fatalf("error connecting to tunnel: %v", err)
+	}
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+	conn.Write([]byte("mole"))
+	io.ReadFull(conn, make([]byte, 4))
+
+	drained := make(chan int64, 1)
+	go func() { drained <- tun.Drain(5 * time.Second) }()
+
+	// no connection is accepted once draining, while the ones being forwarded
+	// keep working until closed by their ends.
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		c, err := net.Dial("tcp", source)
+		if err != nil {
+			break
+		}
+		c.Close()
+
+		if time.Now().After(deadline) {
+			t.Fatalf("connections still accepted after draining")
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	conn.Write([]byte("more"))
+	if _, err := io.ReadFull(conn, make([]byte, 4)); err != nil {
+		t.Errorf("forwarded connection expected to keep working while draining: %v", err)
+	}
+
+	conn.Close()
+
+	select {
+	case open := <-drained:
+		if open != 0 {
+			t.Errorf("unexpected number of connections left open: want: 0, got: %d", open)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatalf("tunnel didn't finish draining once its connections were closed")
+	}
+
+	select {
+	case err := <-result:
+		if err != nil {
+			t.Errorf("unexpected error stopping the drained tunnel: %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("tunnel was not stopped after draining")
+	}
+
+	// connections left open once the timeout expires are counted
+	tun, _ = New("local", srv, []string{"127.0.0.1:0"}, []string{echo.Addr().String()}, configPath)
+	tun.ConnectionRetries = NoSshRetries
+	tun.KeepAliveInterval = 10 * time.Second
+
+	go tun.Start()
+
+	select {
+	case <-tun.Ready:
+	case <-time.After(2 * time.Second):
+		t.Fatalf("tunnel was not ready in time")
+	}
+
+	conn, err = net.Dial("tcp", tun.Channels()[0].Source)
+	if err != nil {
+		t.Fatalf("error connecting to tunnel: %v", err)
+	}
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+	conn.Write([]byte("mole"))
+	io.ReadFull(conn, make([]byte, 4))
+
+	if open := tun.Drain(100 * time.Millisecond); open != 1 {
+		t.Errorf("unexpected number of connections left open: want: 1, got: %d", open)
+	}
+}
+
+// TestRSASignatureAlgorithms documents the authentication of an RSA key
+// against a server refusing ssh-rsa (SHA-1) signatures, like OpenSSH 8.8+.
+func TestRSASignatureAlgorithms(t *testing.T) {
+	conf := &ssh.ServerConfig{
+		PublicKeyCallback: func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			return &ssh.Permissions{}, nil
+		},
+		PublicKeyAuthAlgorithms: []string{ssh.KeyAlgoRSASHA256, ssh.KeyAlgoRSASHA512},
+	}
+
+	b, _ := ioutil.ReadFile(keyPath)
+	p, _ := ssh.ParsePrivateKey(b)
+	conf.AddHostKey(p)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("error while creating listener: %s", err)
+	}
+	defer l.Close()
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+
+			go func() {
+				defer conn.Close()
+
+				sc, chans, reqs, err := ssh.NewServerConn(conn, conf)
+				if err != nil {
+					return
+				}
+				defer sc.Close()
+
+				go ssh.DiscardRequests(reqs)
+				for newChan := range chans {
+					newChan.Reject(ssh.Prohibited, "")
+				}
+			}()
+		}
+	}()
+
+	tests := []struct {
+		algorithms []string
+		fail       bool
+	}{
+		{nil, false},
+		{[]string{ssh.KeyAlgoRSASHA512}, false},
+		{[]string{ssh.KeyAlgoRSA}, true},
+	}
+
+	for i, test := range tests {
+		key, _ := NewPemKey(keyPath, "")
+
+		config, err := sshClientConfig(&Server{User: "mole", Key: key, Insecure: true, RSASignatureAlgorithms: test.algorithms})
+		if err != nil {
+			t.Fatalf("test %d: error creating ssh client config: %v", i, err)
+		}
+
+		client, err := ssh.Dial("tcp", l.Addr().String(), config)
+		if err == nil {
+			client.Close()
+		}
+
+		if test.fail != (err != nil) {
+			t.Errorf("test %d: unexpected authentication result: %v", i, err)
+		}
+	}
+
+	key, _ := NewPemKey(keyPath, "")
+
+	_, err = sshClientConfig(&Server{User: "mole", Key: key, Insecure: true, RSASignatureAlgorithms: []string{"rsa-sha1"}})
+	if err == nil {
+		t.Errorf("error expected for an unknown rsa signature algorithm")
+	}
+}
+
+func TestDisconnectedReconnected(t *testing.T) {
+	sshListener, err := createSSHServer(t, "", keyPath)
+	if err != nil {
+		t.Fatalf("error while creating ssh server: %s", err)
+	}
+	defer sshListener.Close()
+
+	l, _ := createHttpServer()
+
+	srv, _ := NewServer("mole", sshListener.Addr().String(), "", "", "testdata/.ssh/config")
+	srv.Insecure = true
+
+	disconnected := make(chan error, 1)
+	reconnected := make(chan struct{}, 1)
+
+	tun, _ := New("local", srv, []string{"127.0.0.1:0"}, []string{l.Addr().String()}, configPath)
+	tun.ConnectionRetries = 3
+	tun.WaitAndRetry = 100 * time.Millisecond
+	tun.KeepAliveInterval = 10 * time.Second
+	tun.Disconnected = func(err error) { disconnected <- err }
+	tun.Reconnected = func() { reconnected <- struct{}{} }
+
+	go tun.Start()
+	defer tun.Stop()
+
+	select {
+	case <-tun.Ready:
+	case <-time.After(1 * time.Second):
+		t.Fatalf("error waiting for tunnel to be ready")
+	}
+
+	select {
+	case <-reconnected:
+		t.Fatalf("reconnected hook not expected to be called on the first connection")
+	default:
+	}
+
+	sshListener.Close()
+
+	select {
+	case err := <-disconnected:
+		if err == nil {
+			t.Errorf("disconnection error expected")
+		}
+	case <-time.After(1 * time.Second):
+		t.Fatalf("disconnected hook not called")
+	}
+
+	sshListener, err = createSSHServer(t, sshListener.Addr().String(), keyPath)
+	if err != nil {
+		t.Fatalf("error while recreating ssh server: %s", err)
+	}
+	defer sshListener.Close()
+
+	select {
+	case <-reconnected:
+	case <-time.After(2 * time.Second):
+		t.Fatalf("reconnected hook not called")
+	}
+
+	<-tun.Ready
+}
+
+func TestEgressPolicy(t *testing.T) {
+	policy, err := ParseEgressPolicy(strings.NewReader(`
+# databases
+*.db.internal:5432
+10.0.1.*:8000-8999
+[::1]:*
+/var/run/*.sock
+`))
+	if err != nil {
+		t.Fatalf("error parsing egress policy: %v", err)
+	}
+
+	tests := []struct {
+		address string
+		allowed bool
+	}{
+		{"pg.db.internal:5432", true},
+		{"PG.DB.internal:5432", true},
+		{"pg.db.internal:5433", false},
+		{"db.internal:5432", false},
+		{"10.0.1.7:8080", true},
+		{"10.0.1.7:9000", false},
+		{"10.0.2.7:8080", false},
+		{"[::1]:22", true},
+		{"/var/run/docker.sock", true},
+		{"/tmp/docker.sock", false},
+	}
+
+	for _, test := range tests {
+		if allowed := policy.Allows(test.address); allowed != test.allowed {
+			t.Errorf("unexpected egress policy result for %s: want: %t, got: %t", test.address, test.allowed, allowed)
+		}
+	}
+
+	for _, invalid := range []string{"host:port", "host:9-1", "[a-:80"} {
+		if _, err := ParseEgressPolicy(strings.NewReader(invalid)); err == nil {
+			t.Errorf("error expected for invalid egress rule %s", invalid)
+		}
+	}
+
+	srv, _ := NewServer("mole", "127.0.0.1:1", "", "", "testdata/.ssh/config")
+
+	tun, _ := New("local", srv, []string{"127.0.0.1:0"}, []string{"172.17.0.10:5432"}, configPath)
+	tun.EgressPolicy = policy
+
+	if err := tun.Start(); err == nil {
+		t.Errorf("tunnel was not expected to start with a destination that is not allowed")
+	}
+}
+
+func TestPreferSources(t *testing.T) {
+	free, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("error reserving a free address: %v", err)
+	}
+	freeAddr := free.Addr().String()
+	free.Close()
+
+	taken, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("error reserving a taken address: %v", err)
+	}
+	defer taken.Close()
+
+	srv, _ := NewServer("mole", "127.0.0.1:1", "", "", "testdata/.ssh/config")
+
+	source := []string{"127.0.0.1:0", "127.0.0.1:0", "127.0.0.1:0", "127.0.0.1:3360"}
+	destination := []string{"172.17.0.10:80", "172.17.0.10:81", "172.17.0.10:82", "172.17.0.10:83"}
+	tun, _ := New("local", srv, source, destination, configPath)
+
+	tun.PreferSources([]string{freeAddr, taken.Addr().String(), "localhost:4000", "127.0.0.1:4001"})
+
+	expected := []string{freeAddr, "127.0.0.1:0", "127.0.0.1:0", "127.0.0.1:3360"}
+	for i, ch := range tun.channels {
+		if ch.Source != expected[i] {
+			t.Errorf("unexpected source for channel %d: want: %s, got: %s", i, expected[i], ch.Source)
+		}
+	}
+}
+
+func TestMaxChannels(t *testing.T) {
+	srv, _ := NewServer("mole", "127.0.0.1:1", "", "", "testdata/.ssh/config")
+
+	destination := make([]string, DefaultMaxChannels+1)
+	for i := range destination {
+		destination[i] = fmt.Sprintf("172.17.0.10:%d", 8000+i)
+	}
+
+	_, err := NewFromConfig(Config{Server: srv, Destination: destination})
+	if err == nil {
+		t.Errorf("error expected creating a tunnel with more than %d channels", DefaultMaxChannels)
+	}
+
+	_, err = NewFromConfig(Config{Server: srv, Destination: destination, MaxChannels: -1})
+	if err != nil {
+		t.Errorf("unexpected error creating a tunnel with no channel limit: %v", err)
+	}
+
+	tun, _ := New("local", srv, nil, destination[:3], configPath)
+	tun.MaxChannels = 2
+
+	if err := tun.Start(); err == nil {
+		t.Errorf("tunnel was not expected to start with more channels than the maximum")
+	}
+}
+
+func TestServerInterface(t *testing.T) {
+	var loopback string
+
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		t.Fatalf("error listing network interfaces: %v", err)
+	}
+
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagLoopback != 0 && iface.Flags&net.FlagUp != 0 {
+			loopback = iface.Name
+			break
+		}
+	}
+
+	if loopback == "" {
+		t.Skip("no loopback interface found")
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("error listening: %v", err)
+	}
+	defer l.Close()
+
+	srv := &Server{Address: l.Addr().String(), Interface: loopback}
+
+	conn, err := srv.dial(l.Addr().String(), 5*time.Second)
+	if err != nil {
+		t.Fatalf("unexpected error dialing from interface %s: %v", loopback, err)
+	}
+	defer conn.Close()
+
+	if host, _, _ := net.SplitHostPort(conn.LocalAddr().String()); host != "127.0.0.1" {
+		t.Errorf("unexpected local address: want: 127.0.0.1, got: %s", host)
+	}
+
+	srv.Interface = "mole-missing0"
+
+	if _, err := srv.dial(l.Addr().String(), 5*time.Second); err == nil {
+		t.Errorf("error expected dialing from a missing interface")
+	}
+}
+
+func TestSetProtocol(t *testing.T) {
+	srv, _ := NewServer("mole", "127.0.0.1:1", "", "", "testdata/.ssh/config")
+
+	source := []string{"127.0.0.1:8080", "127.0.0.1:5432"}
+	destination := []string{"172.17.0.10:80", "172.17.0.10:5432"}
+	tun, _ := New("local", srv, source, destination, configPath)
+
+	if err := tun.SetProtocol("", "tcp"); err != nil {
+		t.Fatalf("error setting the protocol of all channels: %v", err)
+	}
+
+	if err := tun.SetProtocol("127.0.0.1:8080", "HTTP"); err != nil {
+		t.Fatalf("error setting the protocol of a channel: %v", err)
+	}
+
+	if err := tun.SetProtocol("127.0.0.1:9999", "redis"); err == nil {
+		t.Errorf("error expected setting the protocol of a missing channel")
+	}
+
+	web, tcp := tun.channels[0], tun.channels[1]
+
+	if web.Protocol != "HTTP" || !web.HTTPError {
+		t.Errorf("http channel expected to answer with http errors: protocol: %s, http error: %t", web.Protocol, web.HTTPError)
+	}
+
+	if tcp.Protocol != "tcp" || tcp.HTTPError {
+		t.Errorf("unexpected tcp channel: protocol: %s, http error: %t", tcp.Protocol, tcp.HTTPError)
+	}
+
+	expected := "[source=127.0.0.1:8080, destination=172.17.0.10:80, protocol=HTTP]"
+	if web.String() != expected {
+		t.Errorf("unexpected channel string: want: %s, got: %s", expected, web.String())
+	}
+
+	if stats := tun.Stats(); stats[1].Protocol != "tcp" {
+		t.Errorf("unexpected protocol on channel stats: want: tcp, got: %s", stats[1].Protocol)
+	}
+}
+
+func TestInitialReadTimeout(t *testing.T) {
+	sshServer, err := createSSHServer(t, "", keyPath)
+	if err != nil {
+		t.Fatalf("error while creating ssh server: %s", err)
+	}
+	defer sshServer.Close()
+
+	destination, _ := net.Listen("tcp", "127.0.0.1:0")
+	defer destination.Close()
+
+	go func() {
+		for {
+			conn, err := destination.Accept()
+			if err != nil {
+				return
+			}
+
+			go func() {
+				defer conn.Close()
+
+				req, _ := ioutil.ReadAll(conn)
+				conn.Write(append([]byte("bye "), req...))
+			}()
+		}
+	}()
+
+	srv, _ := NewServer("mole", sshServer.Addr().String(), "", "", "testdata/.ssh/config")
+	srv.Insecure = true
+
+	tun, _ := New("local", srv, []string{"127.0.0.1:0"}, []string{destination.Addr().String()}, configPath)
+	tun.ConnectionRetries = NoSshRetries
+	tun.KeepAliveInterval = 10 * time.Second
+	tun.HalfClose = true
+	tun.InitialReadTimeout = 200 * time.Millisecond
+
+	go tun.Start()
+	defer tun.Stop()
+
+	select {
+	case <-tun.Ready:
+	case <-time.After(2 * time.Second):
+		t.Fatalf("tunnel was not ready in time")
+	}
+
+	source := tun.Channels()[0].Source
+
+	idle, err := net.Dial("tcp", source)
+	if err != nil {
+		t.Fatalf("error connecting to tunnel: %v", err)
+	}
+	defer idle.Close()
+
+	// the idle client must not hold the channel from accepting connections.
+	conn, err := net.Dial("tcp", source)
+	if err != nil {
+		t.Fatalf("error connecting to tunnel: %v", err)
+	}
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+	conn.Write([]byte("mole"))
+	conn.(*net.TCPConn).CloseWrite()
+
+	resp, err := ioutil.ReadAll(conn)
+	if err != nil {
+		t.Fatalf("error reading response: %v", err)
+	}
+
+	if string(resp) != "bye mole" {
+		t.Errorf("unexpected response: want: %s, got: %s", "bye mole", resp)
+	}
+
+	idle.SetDeadline(time.Now().Add(2 * time.Second))
+
+	if _, err := idle.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("idle client connection expected to be dropped, got: %v", err)
+	}
+
+	if attempts := tun.Stats()[0].DialAttempts; attempts != 1 {
+		t.Errorf("destination expected to be dialed for the active client only: want: 1, got: %d", attempts)
+	}
+}
+
+func TestHostKeyError(t *testing.T) {
+	known, _, _ := ed25519.GenerateKey(nil)
+	knownKey, _ := ssh.NewPublicKey(known)
+
+	sent, _, _ := ed25519.GenerateKey(nil)
+	sentKey, _ := ssh.NewPublicKey(sent)
+
+	dir, err := ioutil.TempDir("", "mole-known-hosts")
+	if err != nil {
+		t.Fatalf("error creating temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "known_hosts")
+	ioutil.WriteFile(file, []byte(knownhosts.Line([]string{"bastion.example.com:22"}, knownKey)+"\n"), 0600)
+
+	clb, err := knownHostsCallback(false, file)
+	if err != nil {
+		t.Fatalf("error creating known hosts callback: %v", err)
+	}
+
+	remote := &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 22}
+
+	if err := clb("bastion.example.com:22", remote, knownKey); err != nil {
+		t.Errorf("unexpected error verifying a known host key: %v", err)
+	}
+
+	err = clb("bastion.example.com:22", remote, sentKey)
+
+	var hke *HostKeyError
+	if !errors.As(err, &hke) || hke.Unknown() {
+		t.Fatalf("changed host key error expected, got: %v", err)
+	}
+
+	offending := fmt.Sprintf("%s:1", file)
+	if !strings.Contains(err.Error(), "HAS CHANGED") || !strings.Contains(err.Error(), offending) {
+		t.Errorf("changed host key error expected to point at %s: %v", offending, err)
+	}
+
+	err = clb("other.example.com:22", remote, sentKey)
+	if !errors.As(err, &hke) || !hke.Unknown() {
+		t.Fatalf("unknown host key error expected, got: %v", err)
+	}
+
+	if !strings.Contains(err.Error(), ssh.FingerprintSHA256(sentKey)) {
+		t.Errorf("unknown host key error expected to show the key fingerprint: %v", err)
+	}
+}
+
+func TestReconnectRemoteTunnel(t *testing.T) {
+	sshServer, err := createSSHServer(t, "", keyPath)
+	if err != nil {
+		t.Fatalf("error while creating ssh server: %s", err)
+	}
+
+	srv, _ := NewServer("mole", sshServer.Addr().String(), "", "", "testdata/.ssh/config")
+	srv.Insecure = true
+
+	tun, _ := New("remote", srv, []string{"127.0.0.1:0"}, []string{"127.0.0.1:8080"}, configPath)
+	tun.ConnectionRetries = 3
+	tun.WaitAndRetry = 100 * time.Millisecond
+	tun.KeepAliveInterval = 10 * time.Second
+
+	result := make(chan error, 1)
+	go func() { result <- tun.Start() }()
+	defer tun.Stop()
+
+	select {
+	case <-tun.Ready:
+	case <-time.After(2 * time.Second):
+		t.Fatalf("tunnel was not ready in time")
+	}
+
+	first := tun.channels[0].currentListener()
+	source := tun.Channels()[0].Source
+
+	sshServer.Close()
+
+	sshServer, err = createSSHServer(t, sshServer.Addr().String(), keyPath)
+	if err != nil {
+		t.Fatalf("error while recreating ssh server: %s", err)
+	}
+	defer sshServer.Close()
+
+	select {
+	case <-tun.Ready:
+	case err := <-result:
+		t.Fatalf("tunnel expected to survive the reconnection, got: %v", err)
+	case <-time.After(5 * time.Second):
+		t.Fatalf("tunnel was not ready in time after reconnecting")
+	}
+
+	ch := tun.channels[0]
+
+	if l := ch.currentListener(); l == nil || l == first {
+		t.Errorf("remote channel expected to listen again through the new connection")
+	}
+
+	if ch.Source != source {
+		t.Errorf("remote channel expected to listen on the same address: want: %s, got: %s", source, ch.Source)
+	}
+
+	select {
+	case err := <-result:
+		t.Errorf("tunnel expected to keep running, got: %v", err)
+	case <-time.After(3 * relistenInterval):
+	}
+}
+
+func TestDynamicTunnel(t *testing.T) {
+	sshServer, err := createSSHServer(t, "", keyPath)
+	if err != nil {
+		t.Fatalf("error while creating ssh server: %s", err)
+	}
+	defer sshServer.Close()
+
+	destination, _ := net.Listen("tcp", "127.0.0.1:0")
+	defer destination.Close()
+
+	go func() {
+		for {
+			conn, err := destination.Accept()
+			if err != nil {
+				return
+			}
+
+			go func() {
+				defer conn.Close()
+
+				req, _ := ioutil.ReadAll(conn)
+				conn.Write(append([]byte("bye "), req...))
+			}()
+		}
+	}()
+
+	closed, _ := net.Listen("tcp", "127.0.0.1:0")
+	closed.Close()
+
+	srv, _ := NewServer("mole", sshServer.Addr().String(), "", "", "testdata/.ssh/config")
+	srv.Insecure = true
+
+	tun, err := New("dynamic", srv, nil, nil, configPath)
+	if err != nil {
+		t.Fatalf("error creating dynamic tunnel: %v", err)
+	}
+	tun.ConnectionRetries = NoSshRetries
+	tun.KeepAliveInterval = 10 * time.Second
+	tun.HalfClose = true
+
+	go tun.Start()
+	defer tun.Stop()
+
+	select {
+	case <-tun.Ready:
+	case <-time.After(2 * time.Second):
+		t.Fatalf("tunnel was not ready in time")
+	}
+
+	source := tun.Channels()[0].Source
+
+	_, port, _ := net.SplitHostPort(destination.Addr().String())
+	n, _ := strconv.Atoi(port)
+	portBytes := []byte{byte(n >> 8), byte(n)}
+
+	_, port, _ = net.SplitHostPort(closed.Addr().String())
+	n, _ = strconv.Atoi(port)
+	closedPortBytes := []byte{byte(n >> 8), byte(n)}
+
+	tests := []struct {
+		name      string
+		greeting  []byte
+		auth      []byte
+		request   []byte
+		wantReply byte
+	}{
+		{
+			name:      "ipv4 address",
+			greeting:  []byte{5, 1, 0},
+			request:   append([]byte{5, 1, 0, 1, 127, 0, 0, 1}, portBytes...),
+			wantReply: socksSucceeded,
+		},
+		{
+			name:      "domain name with username and password",
+			greeting:  []byte{5, 1, 2},
+			auth:      []byte{1, 4, 'm', 'o', 'l', 'e', 3, 'p', 'w', 'd'},
+			request:   append([]byte{5, 1, 0, 3, 9, '1', '2', '7', '.', '0', '.', '0', '.', '1'}, portBytes...),
+			wantReply: socksSucceeded,
+		},
+		{
+			name:      "connection refused",
+			greeting:  []byte{5, 1, 0},
+			request:   append([]byte{5, 1, 0, 1, 127, 0, 0, 1}, closedPortBytes...),
+			wantReply: socksConnectionRefused,
+		},
+		{
+			name:      "unsupported command",
+			greeting:  []byte{5, 1, 0},
+			request:   append([]byte{5, 2, 0, 1, 127, 0, 0, 1}, portBytes...),
+			wantReply: socksCommandNotSupported,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			conn, err := net.Dial("tcp", source)
+			if err != nil {
+				t.Fatalf("error connecting to tunnel: %v", err)
+			}
+			defer conn.Close()
+
+			conn.SetDeadline(time.Now().Add(2 * time.Second))
+
+			conn.Write(test.greeting)
+
+			method := make([]byte, 2)
+			if _, err := io.ReadFull(conn, method); err != nil {
+				t.Fatalf("error reading selected method: %v", err)
+			}
+
+			if method[1] != test.greeting[2] {
+				t.Fatalf("unexpected method selected: want: %d, got: %d", test.greeting[2], method[1])
+			}
+
+			if test.auth != nil {
+				conn.Write(test.auth)
+
+				status := make([]byte, 2)
+				if _, err := io.ReadFull(conn, status); err != nil || status[1] != 0 {
+					t.Fatalf("authentication failed: %v %v", status, err)
+				}
+			}
+
+			conn.Write(test.request)
+
+			reply := make([]byte, 10)
+			if _, err := io.ReadFull(conn, reply); err != nil {
+				t.Fatalf("error reading reply: %v", err)
+			}
+
+			if reply[1] != test.wantReply {
+				t.Fatalf("unexpected reply: want: %d, got: %d", test.wantReply, reply[1])
+			}
+
+			if test.wantReply != socksSucceeded {
+				return
+			}
+
+			conn.Write([]byte("mole"))
+			conn.(*net.TCPConn).CloseWrite()
+
+			resp, err := ioutil.ReadAll(conn)
+			if err != nil {
+				t.Fatalf("error reading response: %v", err)
+			}
+
+			if string(resp) != "bye mole" {
+				t.Errorf("unexpected response: want: %s, got: %s", "bye mole", resp)
+			}
+		})
+	}
+
+	if peer := tun.Stats()[0].LastPeer; peer != destination.Addr().String() {
+		t.Errorf("unexpected last peer: want: %s, got: %s", destination.Addr().String(), peer)
+	}
+
+	_, err = New("dynamic", srv, nil, []string{":80"}, configPath)
+	if err == nil {
+		t.Errorf("expected dynamic tunnel with a destination address to fail")
+	}
+}
+
+// createTrackedProxy forwards the connections accepted on a random port to
+// the given address, telling, through the returned channels, when the first
+// one is opened and closed.
+func createTrackedProxy(t *testing.T, address string) (net.Listener, <-chan struct{}, <-chan struct{}) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("error creating proxy: %v", err)
+	}
+
+	opened := make(chan struct{})
+	closed := make(chan struct{})
+
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		close(opened)
+		defer close(closed)
+
+		upstream, err := net.Dial("tcp", address)
+		if err != nil {
+			return
+		}
+		defer upstream.Close()
+
+		done := make(chan struct{}, 2)
+
+		go func() {
+			io.Copy(upstream, conn)
+			done <- struct{}{}
+		}()
+
+		go func() {
+			io.Copy(conn, upstream)
+			done <- struct{}{}
+		}()
+
+		<-done
+	}()
+
+	return l, opened, closed
+}
+
+func TestJumpServers(t *testing.T) {
+	var proxies []net.Listener
+	var opened, closed []<-chan struct{}
+	var jump []*Server
+
+	for i := 0; i < 2; i++ {
+		sshServer, err := createSSHServer(t, "", keyPath)
+		if err != nil {
+			t.Fatalf("error while creating ssh server: %s", err)
+		}
+		defer sshServer.Close()
+
+		proxy, o, c := createTrackedProxy(t, sshServer.Addr().String())
+		defer proxy.Close()
+
+		js, _ := NewServer("mole", proxy.Addr().String(), "", "", "testdata/.ssh/config")
+		js.Insecure = true
+
+		proxies = append(proxies, proxy)
+		opened = append(opened, o)
+		closed = append(closed, c)
+		jump = append(jump, js)
+	}
+
+	sshServer, err := createSSHServer(t, "", keyPath)
+	if err != nil {
+		t.Fatalf("error while creating ssh server: %s", err)
+	}
+	defer sshServer.Close()
+
+	l, hs := createHttpServer()
+	defer hs.Close()
+
+	srv, _ := NewServer("mole", sshServer.Addr().String(), "", "", "testdata/.ssh/config")
+	srv.Insecure = true
+	srv.Jump = jump
+
+	tun, _ := New("local", srv, []string{"127.0.0.1:0"}, []string{l.Addr().String()}, configPath)
+	tun.ConnectionRetries = NoSshRetries
+	tun.KeepAliveInterval = 10 * time.Second
+
+	go tun.Start()
+
+	select {
+	case <-tun.Ready:
+	case <-time.After(2 * time.Second):
+		t.Fatalf("tunnel was not ready in time")
+	}
+
+	err = validateTunnelConnectivity(t, "jump", tun)
+	if err != nil {
+		t.Errorf("%v", err)
+	}
+
+	for i := range proxies {
+		select {
+		case <-opened[i]:
+		default:
+			t.Fatalf("jump host %d was not connected to", i)
+		}
+	}
+
+	tun.Stop()
+
+	for i := range proxies {
+		select {
+		case <-closed[i]:
+		case <-time.After(2 * time.Second):
+			t.Errorf("jump host %d was not disconnected once the tunnel stopped", i)
+		}
+	}
+}
+
+// createSSHAgent serves an ssh agent, holding the test key, on a unix socket,
+// counting the connections it accepts and the ones closed by its clients.
+func createSSHAgent(t *testing.T) (string, *int32, *int32) {
+	dir, err := ioutil.TempDir("", "mole-agent")
+	if err != nil {
+		t.Fatalf("error creating temporary directory: %v", err)
+	}
+
+	sock := filepath.Join(dir, "agent.sock")
+
+	l, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Fatalf("error creating ssh agent socket: %v", err)
+	}
+
+	t.Cleanup(func() {
+		l.Close()
+		os.RemoveAll(dir)
+	})
+
+	b, _ := ioutil.ReadFile(keyPath)
+	key, _ := ssh.ParseRawPrivateKey(b)
+
+	keyring := agent.NewKeyring()
+	keyring.Add(agent.AddedKey{PrivateKey: key})
+
+	var accepted, closed int32
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+
+			atomic.AddInt32(&accepted, 1)
+
+			go func() {
+				agent.ServeAgent(keyring, conn)
+				conn.Close()
+				atomic.AddInt32(&closed, 1)
+			}()
+		}
+	}()
+
+	return sock, &accepted, &closed
+}
+
+func TestSSHAgentAuthentication(t *testing.T) {
+	sshServer, err := createSSHServer(t, "", keyPath)
+	if err != nil {
+		t.Fatalf("error while creating ssh server: %s", err)
+	}
+	defer sshServer.Close()
+
+	l, hs := createHttpServer()
+	defer hs.Close()
+
+	sock, accepted, closed := createSSHAgent(t)
+
+	os.Setenv("SSH_AUTH_SOCK", sock)
+	defer os.Unsetenv("SSH_AUTH_SOCK")
+
+	s, _ := NewServer("mole", "test", "", "none", "testdata/.ssh/config")
+	if s.SSHAgent != "" {
+		t.Errorf("no ssh agent expected when none is given, got %s", s.SSHAgent)
+	}
+
+	s, _ = NewServer("mole", "test", "", "", "testdata/.ssh/config")
+	if s.SSHAgent != sock {
+		t.Errorf("unexpected ssh agent: want: %s, got: %s", sock, s.SSHAgent)
+	}
+
+	// the agent pointed by the environment is not a way around the default
+	// key fallback being disabled.
+	_, err = NewServer("mole", sshServer.Addr().String(), "", "", "", WithoutDefaultKey())
+	if err == nil {
+		t.Errorf("error expected when no key nor ssh agent is given and the default key fallback is disabled")
+	}
+
+	// no key is given, so the server can only be authenticated against with
+	// the key held by the agent.
+	srv, err := NewServer("mole", sshServer.Addr().String(), "", sock, "", WithoutDefaultKey())
+	if err != nil {
+		t.Fatalf("unexpected error creating server: %v", err)
+	}
+	srv.Insecure = true
+
+	servers := []struct {
+		name   string
+		server *Server
+	}{
+		{"NewServer", srv},
+		// servers not created by NewServer get their agent connection the
+		// first time it is needed.
+		{"literal", &Server{Name: "mole", Address: sshServer.Addr().String(), User: "mole", SSHAgent: sock, Insecure: true}},
+	}
+
+	for _, test := range servers {
+		t.Run(test.name, func(t *testing.T) {
+			opened, done := atomic.LoadInt32(accepted), atomic.LoadInt32(closed)
+
+			tun, _ := New("local", test.server, []string{"127.0.0.1:0"}, []string{l.Addr().String()}, configPath)
+			tun.ConnectionRetries = NoSshRetries
+			tun.KeepAliveInterval = 10 * time.Second
+
+			result := make(chan error, 1)
+			go func() { result <- tun.Start() }()
+
+			select {
+			case <-tun.Ready:
+			case <-time.After(2 * time.Second):
+				t.Fatalf("tunnel was not ready in time")
+			}
+
+			err := validateTunnelConnectivity(t, "agent", tun)
+			if err != nil {
+				t.Errorf("%v", err)
+			}
+
+			tun.Stop()
+			<-result
+
+			deadline := time.Now().Add(2 * time.Second)
+			for atomic.LoadInt32(closed)-done != atomic.LoadInt32(accepted)-opened && time.Now().Before(deadline) {
+				time.Sleep(10 * time.Millisecond)
+			}
+
+			if a, c := atomic.LoadInt32(accepted)-opened, atomic.LoadInt32(closed)-done; a == 0 || a != c {
+				t.Errorf("ssh agent connections expected to be closed once the tunnel stopped: opened: %d, closed: %d", a, c)
+			}
+		})
+	}
+}
+
+func createPromptSSHServer(t *testing.T, password func(ssh.ConnMetadata, []byte) (*ssh.Permissions, error), keyboardInteractive func(ssh.ConnMetadata, ssh.KeyboardInteractiveChallenge) (*ssh.Permissions, error)) net.Listener {
+	conf := &ssh.ServerConfig{
+		PasswordCallback:            password,
+		KeyboardInteractiveCallback: keyboardInteractive,
+	}
+
+	b, _ := ioutil.ReadFile(keyPath)
+	p, _ := ssh.ParsePrivateKey(b)
+	conf.AddHostKey(p)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("error while creating listener: %s", err)
+	}
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+
+			go func() {
+				sc, chans, reqs, err := ssh.NewServerConn(conn, conf)
+				if err != nil {
+					conn.Close()
+					return
+				}
+
+				go ssh.DiscardRequests(reqs)
+
+				for nc := range chans {
+					nc.Reject(ssh.Prohibited, "no channels")
+				}
+
+				sc.Close()
+			}()
+		}
+	}()
+
+	return l
+}
+
+func TestPromptAuthentication(t *testing.T) {
+	password := func(conn ssh.ConnMetadata, p []byte) (*ssh.Permissions, error) {
+		if string(p) == "secret" {
+			return &ssh.Permissions{}, nil
+		}
+
+		return nil, fmt.Errorf("wrong password")
+	}
+
+	keyboardInteractive := func(conn ssh.ConnMetadata, challenge ssh.KeyboardInteractiveChallenge) (*ssh.Permissions, error) {
+		answers, err := challenge("", "enter the code sent to your phone", []string{"code: "}, []bool{true})
+		if err != nil {
+			return nil, err
+		}
+
+		if len(answers) == 1 && answers[0] == "123456" {
+			return &ssh.Permissions{}, nil
+		}
+
+		return nil, fmt.Errorf("wrong code")
+	}
+
+	answers := map[string]string{
+		"mole@prompt's password: ": "secret",
+		"code: ":                   "123456",
+	}
+
+	tests := []struct {
+		name                string
+		password            func(ssh.ConnMetadata, []byte) (*ssh.Permissions, error)
+		keyboardInteractive func(ssh.ConnMetadata, ssh.KeyboardInteractiveChallenge) (*ssh.Permissions, error)
+		answers             map[string]string
+		wantErr             bool
+	}{
+		{name: "password", password: password, answers: answers},
+		{name: "keyboard-interactive", keyboardInteractive: keyboardInteractive, answers: answers},
+		{name: "wrong answer", keyboardInteractive: keyboardInteractive, answers: map[string]string{"code: ": "000000"}, wantErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			l := createPromptSSHServer(t, test.password, test.keyboardInteractive)
+			defer l.Close()
+
+			prompt := func(name, instruction string, questions []string, echos []bool) ([]string, error) {
+				a := make([]string, len(questions))
+				for i, q := range questions {
+					a[i] = test.answers[q]
+				}
+
+				return a, nil
+			}
+
+			srv := &Server{Name: "prompt", Address: l.Addr().String(), User: "mole", Insecure: true, Prompt: prompt}
+
+			c, err := sshClientConfig(srv)
+			if err != nil {
+				t.Fatalf("a prompt was expected to be enough to authenticate: %v", err)
+			}
+
+			client, err := dialServer(srv, c, &DialLatency{})
+			if err == nil {
+				client.Close()
+			}
+
+			if test.wantErr != (err != nil) {
+				t.Errorf("unexpected authentication result: want error: %t, got: %v", test.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestStartContext(t *testing.T) {
+	t.Run("connected", func(t *testing.T) {
+		sshServer, err := createSSHServer(t, "", keyPath)
+		if err != nil {
+			t.Fatalf("error while creating ssh server: %s", err)
+		}
+		defer sshServer.Close()
+
+		l, hs := createHttpServer()
+		defer hs.Close()
+
+		srv, _ := NewServer("mole", sshServer.Addr().String(), "", "", "testdata/.ssh/config")
+		srv.Insecure = true
+
+		tun, _ := New("local", srv, []string{"127.0.0.1:0"}, []string{l.Addr().String()}, configPath)
+		tun.ConnectionRetries = NoSshRetries
+		tun.KeepAliveInterval = 10 * time.Second
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		result := make(chan error, 1)
+		go func() { result <- tun.StartContext(ctx) }()
+
+		select {
+		case <-tun.Ready:
+		case err := <-result:
+			t.Fatalf("tunnel stopped before it was ready: %v", err)
+		case <-time.After(2 * time.Second):
+			t.Fatalf("tunnel was not ready in time")
+		}
+
+		source := tun.Channels()[0].Source
+
+		cancel()
+
+		select {
+		case err := <-result:
+			if err != context.Canceled {
+				t.Errorf("unexpected error returned once the context is canceled: %v", err)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("tunnel was not stopped in time")
+		}
+
+		if conn, err := net.Dial("tcp", source); err == nil {
+			conn.Close()
+			t.Errorf("channel listener was expected to be closed once the tunnel stopped")
+		}
+	})
+
+	t.Run("retrying", func(t *testing.T) {
+		l, attempts := createFailingServer()
+
+		srv, _ := NewServer("mole", l.Addr().String(), "", "", "testdata/.ssh/config")
+		srv.Insecure = true
+
+		tun, _ := New("local", srv, []string{"127.0.0.1:0"}, []string{"127.0.0.1:80"}, configPath)
+		tun.ConnectionRetries = 2
+		tun.WaitAndRetry = time.Hour
+
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+
+		result := make(chan error, 1)
+		go func() { result <- tun.StartContext(ctx) }()
+
+		// the wait between connection attempts is cut short once the context
+		// is done.
+		select {
+		case err := <-result:
+			if err != context.DeadlineExceeded {
+				t.Errorf("unexpected error returned once the context is done: %v", err)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("tunnel was not stopped in time")
+		}
+
+		l.Close()
+
+		if a := <-attempts; a != 1 {
+			t.Errorf("unexpected number of connection attempts: expected: 1, value: %d", a)
+		}
+	})
+
+	t.Run("dialing", func(t *testing.T) {
+		sshServer, err := createSSHServer(t, "", keyPath)
+		if err != nil {
+			t.Fatalf("error while creating ssh server: %s", err)
+		}
+		defer sshServer.Close()
+
+		dialer := &blockingDialer{release: make(chan struct{}), closed: make(chan struct{})}
+
+		srv, _ := NewServer("mole", sshServer.Addr().String(), "", "", "testdata/.ssh/config")
+		srv.Insecure = true
+		srv.Dialer = dialer
+
+		tun, _ := New("local", srv, []string{"127.0.0.1:0"}, []string{"127.0.0.1:80"}, configPath)
+		tun.ConnectionRetries = NoSshRetries
+		tun.KeepAliveInterval = 10 * time.Second
+
+		ctx, cancel := context.WithCancel(context.Background())
+
+		result := make(chan error, 1)
+		go func() { result <- tun.StartContext(ctx) }()
+
+		// the connection to the ssh server is only established after the
+		// context is canceled.
+		cancel()
+		close(dialer.release)
+
+		select {
+		case err := <-result:
+			if err != context.Canceled {
+				t.Errorf("unexpected error returned once the context is canceled: %v", err)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("tunnel was not stopped in time")
+		}
+
+		if client := tun.sshClient(); client != nil {
+			t.Errorf("connection established after the context was canceled was not expected to be used")
+		}
+
+		select {
+		case <-dialer.closed:
+		case <-time.After(2 * time.Second):
+			t.Errorf("connection established after the context was canceled was expected to be closed")
+		}
+	})
+}
+
+// blockingDialer is a Dialer holding the connection it opens until released,
+// reporting once it is closed.
+type blockingDialer struct {
+	release chan struct{}
+	closed  chan struct{}
+}
+
+func (d *blockingDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	<-d.release
+
+	var nd net.Dialer
+	conn, err := nd.DialContext(context.Background(), network, address)
+	if err != nil {
+		return nil, err
+	}
+
+	return &notifyingConn{Conn: conn, closed: d.closed}, nil
+}
+
+// notifyingConn closes the given channel once the connection is closed.
+type notifyingConn struct {
+	net.Conn
+	closed chan struct{}
+	once   sync.Once
+}
+
+func (c *notifyingConn) Close() error {
+	c.once.Do(func() { close(c.closed) })
+
+	return c.Conn.Close()
+}
+
+func TestStopWithoutReconnection(t *testing.T) {
+	tests := []struct {
+		tunnelType  string
+		destination string
+	}{
+		{"local", "127.0.0.1:80"},
+		{"remote", "127.0.0.1:8080"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.tunnelType, func(t *testing.T) {
+			sshServer, err := createSSHServer(t, "", keyPath)
+			if err != nil {
+				t.Fatalf("error while creating ssh server: %s", err)
+			}
+
+			srv, _ := NewServer("mole", sshServer.Addr().String(), "", "", "testdata/.ssh/config")
+			srv.Insecure = true
+
+			tun, _ := New(test.tunnelType, srv, []string{"127.0.0.1:0"}, []string{test.destination}, configPath)
+			tun.ConnectionRetries = NoSshRetries
+			tun.KeepAliveInterval = 10 * time.Second
+
+			result := make(chan error, 1)
+			go func() { result <- tun.Start() }()
+
+			select {
+			case <-tun.Ready:
+			case err := <-result:
+				t.Fatalf("tunnel stopped before it was ready: %v", err)
+			case <-time.After(2 * time.Second):
+				t.Fatalf("tunnel was not ready in time")
+			}
+
+			sshServer.Close()
+
+			select {
+			case err := <-result:
+				if err == nil {
+					t.Errorf("tunnel expected to fail once the connection to the ssh server is lost")
+				}
+			case <-time.After(2 * time.Second):
+				tun.Stop()
+				t.Fatalf("tunnel was not stopped once the connection to the ssh server was lost")
+			}
+		})
+	}
+}
+
+func TestStartWithoutReconnection(t *testing.T) {
+	l, _ := createFailingServer()
+	defer l.Close()
+
+	srv, _ := NewServer("mole", l.Addr().String(), "", "", "testdata/.ssh/config")
+	srv.Insecure = true
+
+	tun, _ := New("local", srv, []string{"127.0.0.1:0"}, []string{"127.0.0.1:80"}, configPath)
+	tun.ConnectionRetries = NoSshRetries
+	tun.KeepAliveInterval = 10 * time.Second
+
+	result := make(chan error, 1)
+	go func() { result <- tun.Start() }()
+
+	select {
+	case err := <-result:
+		if err == nil {
+			t.Errorf("tunnel expected to fail when the ssh server can't be reached")
+		}
+	case <-time.After(2 * time.Second):
+		tun.Stop()
+		t.Fatalf("tunnel was not stopped after failing to connect to the ssh server")
+	}
+}
+
+// TestChannelsDuringReconnect reads the channels of a remote tunnel while they
+// listen again through a new connection to the ssh server, which is meant to
+// be run with the race detector enabled.
+func TestChannelsDuringReconnect(t *testing.T) {
+	sshServer, err := createSSHServer(t, "", keyPath)
+	if err != nil {
+		t.Fatalf("error while creating ssh server: %s", err)
+	}
+
+	srv, _ := NewServer("mole", sshServer.Addr().String(), "", "", "testdata/.ssh/config")
+	srv.Insecure = true
+
+	tun, _ := New("remote", srv, []string{"127.0.0.1:0"}, []string{"127.0.0.1:8080"}, configPath)
+	tun.ConnectionRetries = 3
+	tun.WaitAndRetry = 100 * time.Millisecond
+	tun.KeepAliveInterval = 10 * time.Second
+
+	result := make(chan error, 1)
+	go func() { result <- tun.Start() }()
+	defer tun.Stop()
+
+	select {
+	case <-tun.Ready:
+	case <-time.After(2 * time.Second):
+		t.Fatalf("tunnel was not ready in time")
+	}
+
+	stop := make(chan struct{})
+	reading := make(chan struct{})
+
+	go func() {
+		defer close(reading)
+
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+
+			for _, ch := range tun.Channels() {
+				ch.State()
+			}
+
+			tun.Listeners()
+		}
+	}()
+
+	sshServer.Close()
+
+	sshServer, err = createSSHServer(t, sshServer.Addr().String(), keyPath)
+	if err != nil {
+		t.Fatalf("error while recreating ssh server: %s", err)
+	}
+	defer sshServer.Close()
+
+	select {
+	case <-tun.Ready:
+	case err := <-result:
+		t.Fatalf("tunnel expected to survive the reconnection, got: %v", err)
+	case <-time.After(5 * time.Second):
+		t.Fatalf("tunnel was not ready in time after reconnecting")
+	}
+
+	close(stop)
+	<-reading
+
+	if state := tun.Channels()[0].State(); state != ChannelEstablished {
+		t.Errorf("unexpected channel state after reconnecting: %s", state)
+	}
+}
+
+func TestJumpServersOptions(t *testing.T) {
+	prompt := func(name, instruction string, questions []string, echos []bool) ([]string, error) {
+		return nil, nil
+	}
+
+	// no key is configured for this jump host on the ssh config file
+	_, err := JumpServers("127.0.0.1:2222", "mole", "", "testdata/.ssh/config", WithoutDefaultKey())
+	if err == nil {
+		t.Errorf("error expected when no key is given and the default key fallback is disabled")
+	}
+
+	// jump hosts authenticated against interactively don't need a key
+	jumps, err := JumpServers("127.0.0.1:2222", "mole", "", "testdata/.ssh/config", WithoutDefaultKey(), WithPrompt(prompt))
+	if err != nil {
+		t.Fatalf("unexpected error when the jump host can be authenticated against interactively: %v", err)
+	}
+
+	if jumps[0].Key != nil || jumps[0].Prompt == nil {
+		t.Errorf("jump host expected to be authenticated against interactively only: %s", jumps[0])
+	}
+}
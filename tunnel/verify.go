@@ -0,0 +1,192 @@
+package tunnel
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// VerifyHostKey connects to the ssh server just long enough to verify its host
+// key against the known_hosts files, without authenticating, so a host key
+// mismatch can be reported before the tunnel is started (e.g. before a
+// detached instance leaves the terminal behind).
+//
+// Failing to reach the ssh server is only logged, since the tunnel keeps
+// trying to connect to it once started.
+func VerifyHostKey(server *Server) error {
+	if server.Insecure {
+		return nil
+	}
+
+	clb := server.HostKeyCallback
+	if clb == nil {
+		var err error
+
+		clb, err = knownHostsCallback(false, server.KnownHostsFiles...)
+		if err != nil {
+			return err
+		}
+	}
+
+	var verified bool
+	var keyErr error
+
+	config := &ssh.ClientConfig{
+		User: server.User,
+		HostKeyCallback: func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+			keyErr = clb(hostname, remote, key)
+			verified = keyErr == nil
+
+			return keyErr
+		},
+		Timeout: server.Timeout,
+	}
+
+	if server.Strict {
+		config.KeyExchanges = StrictKeyExchanges
+		config.Ciphers = StrictCiphers
+		config.MACs = StrictMACs
+	}
+
+	// no authentication method is offered, so the connection fails right after
+	// the host key is verified, unless the server accepts anyone.
+	client, err := dialServer(server, config, &DialLatency{})
+	if client != nil {
+		client.Close()
+	}
+
+	if keyErr != nil {
+		return keyErr
+	}
+
+	if !verified {
+		log.WithError(err).WithFields(log.Fields{
+			"server": server,
+		}).Warn("could not reach the ssh server to verify its host key")
+
+		return nil
+	}
+
+	log.WithFields(log.Fields{
+		"server": server,
+	}).Debug("ssh server host key verified")
+
+	return nil
+}
+
+// errHostKeyRetrieved aborts the connection to the ssh server once its host
+// key is retrieved by HostKey.
+var errHostKeyRetrieved = errors.New("host key retrieved")
+
+// HostKey connects to the ssh server just long enough to retrieve its host
+// key, which is neither verified nor trusted, so it can be compared against a
+// fingerprint obtained out of band before being added to the known_hosts
+// file.
+func HostKey(server *Server) (ssh.PublicKey, error) {
+	var hostKey ssh.PublicKey
+
+	config := &ssh.ClientConfig{
+		User: server.User,
+		HostKeyCallback: func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+			hostKey = key
+
+			return errHostKeyRetrieved
+		},
+		Timeout: server.Timeout,
+	}
+
+	if server.Strict {
+		config.KeyExchanges = StrictKeyExchanges
+		config.Ciphers = StrictCiphers
+		config.MACs = StrictMACs
+	}
+
+	client, err := dialServer(server, config, &DialLatency{})
+	if client != nil {
+		client.Close()
+	}
+
+	if hostKey == nil {
+		return nil, err
+	}
+
+	return hostKey, nil
+}
+
+// HostKeyError is returned when the ssh server host key is rejected by the
+// known_hosts files, telling an unknown host apart from a host which key
+// changed, like OpenSSH does.
+type HostKeyError struct {
+	// Hostname is the host name the ssh server was dialed by.
+	Hostname string
+	// Key is the host key sent by the ssh server.
+	Key ssh.PublicKey
+	// Files are the known_hosts files the key was looked up on.
+	Files []string
+	// Known are the known_hosts entries of the host which key differs from
+	// the one sent by the ssh server. It is empty for an unknown host.
+	Known []knownhosts.KnownKey
+	// Revoked, if set, is the known_hosts entry revoking the key.
+	Revoked *knownhosts.KnownKey
+
+	err error
+}
+
+// newHostKeyError returns the given error, returned by the verification of a
+// host key against the given known_hosts files, as a HostKeyError when the
+// key was rejected.
+func newHostKeyError(hostname string, key ssh.PublicKey, files []string, err error) error {
+	hke := &HostKeyError{Hostname: hostname, Key: key, Files: files, err: err}
+
+	switch e := err.(type) {
+	case *knownhosts.KeyError:
+		hke.Known = e.Want
+	case *knownhosts.RevokedError:
+		hke.Revoked = &e.Revoked
+	default:
+		return err
+	}
+
+	return hke
+}
+
+// Unknown tells the host is not listed on any of the known_hosts files.
+func (e *HostKeyError) Unknown() bool {
+	return e.Revoked == nil && len(e.Known) == 0
+}
+
+func (e *HostKeyError) Error() string {
+	fingerprint := fmt.Sprintf("%s %s", e.Key.Type(), ssh.FingerprintSHA256(e.Key))
+
+	if e.Revoked != nil {
+		return fmt.Sprintf("host key %s of %s was revoked by %s:%d", fingerprint, e.Hostname, e.Revoked.Filename, e.Revoked.Line)
+	}
+
+	if e.Unknown() {
+		return fmt.Sprintf("host key of %s is unknown: it is not listed on %s. "+
+			"Make sure its fingerprint, %s, matches the one obtained out of band "+
+			"(see the fingerprint command) before adding it to the known_hosts file",
+			e.Hostname, strings.Join(e.Files, ", "), fingerprint)
+	}
+
+	offending := make([]string, len(e.Known))
+	for i, k := range e.Known {
+		offending[i] = fmt.Sprintf("%s:%d", k.Filename, k.Line)
+	}
+
+	return fmt.Sprintf("REMOTE HOST IDENTIFICATION HAS CHANGED: host key of %s doesn't match the one on the known_hosts file. "+
+		"Someone could be eavesdropping on you right now (man-in-the-middle attack)! "+
+		"It is also possible that the host key has just been changed. "+
+		"The fingerprint of the key sent by the host is %s. "+
+		"Offending key on %s: remove it only once the new key is confirmed to be legitimate",
+		e.Hostname, fingerprint, strings.Join(offending, ", "))
+}
+
+func (e *HostKeyError) Unwrap() error {
+	return e.err
+}
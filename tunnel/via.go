@@ -0,0 +1,149 @@
+package tunnel
+
+import (
+	"fmt"
+	"net"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/ssh"
+)
+
+// hop is a connection to an additional ssh server, opened through a specific
+// connection to the tunnel ssh server.
+type hop struct {
+	client *ssh.Client
+	base   *ssh.Client
+}
+
+// ViaChannel makes the channel listening on the given source address reach its
+// destination through an additional ssh server, itself reached through the
+// tunnel ssh server, while the other channels keep dialing their destinations
+// from the tunnel ssh server. An empty source applies the hop to all channels.
+//
+// Channels given the same server share a single connection to it, which is
+// opened on the first connection accepted and again after every reconnection
+// to the tunnel ssh server. Only local tunnels are supported.
+func (t *Tunnel) ViaChannel(source string, server *Server) error {
+	if server == nil {
+		return fmt.Errorf("missing ssh server to go via")
+	}
+
+	if t.Type != "local" {
+		return fmt.Errorf("additional ssh hops are not supported by %s tunnels", t.Type)
+	}
+
+	channels := t.channelList()
+
+	if len(channels) == 0 {
+		return fmt.Errorf("can't add an ssh hop to a tunnel with no channels")
+	}
+
+	if source == "" {
+		for _, ch := range channels {
+			ch.Via = server
+		}
+
+		return nil
+	}
+
+	ch, err := t.findChannel(source)
+	if err != nil {
+		return err
+	}
+
+	ch.Via = server
+
+	return nil
+}
+
+// dialThrough opens a connection to the given destination from the tunnel ssh
+// server, through the given client, or from the additional ssh server the
+// channel goes via, if any.
+func (t *Tunnel) dialThrough(channel *SSHChannel, client *ssh.Client, destination string) (net.Conn, error) {
+	if channel.Via != nil {
+		hc, err := t.hopClient(channel.Via, client)
+		if err != nil {
+			return nil, fmt.Errorf("error connecting to ssh server %s: %v", channel.Via.Address, err)
+		}
+
+		client = hc
+	}
+
+	conn, err := t.dialLimited(client, destination)
+	if err != nil {
+		return nil, err
+	}
+
+	return t.trackSSHChannel(channel, conn), nil
+}
+
+// hopClient returns the connection to the given additional ssh server opened
+// through the given connection to the tunnel ssh server, connecting to it if
+// needed.
+func (t *Tunnel) hopClient(server *Server, base *ssh.Client) (*ssh.Client, error) {
+	t.hopsMu.Lock()
+	defer t.hopsMu.Unlock()
+
+	if h, ok := t.hops[server]; ok {
+		if h.base == base {
+			return h.client, nil
+		}
+
+		// opened through a previous connection to the tunnel ssh server
+		h.client.Close()
+		delete(t.hops, server)
+	}
+
+	config, err := sshClientConfig(server)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := dialTimeout(base, server.Address, t.DialTimeout)
+	if err != nil {
+		return nil, err
+	}
+
+	c, chans, reqs, err := ssh.NewClientConn(conn, server.Address, config)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	client := ssh.NewClient(c, chans, reqs)
+
+	if t.hops == nil {
+		t.hops = make(map[*Server]*hop)
+	}
+	t.hops[server] = &hop{client: client, base: base}
+
+	log.WithFields(log.Fields{
+		"server": server,
+		"via":    t.server,
+	}).Debug("connection to additional ssh server is established")
+
+	// a hop that fails is opened again on the next connection accepted.
+	go func() {
+		client.Wait()
+
+		t.hopsMu.Lock()
+		defer t.hopsMu.Unlock()
+
+		if h, ok := t.hops[server]; ok && h.client == client {
+			delete(t.hops, server)
+		}
+	}()
+
+	return client, nil
+}
+
+// closeHops closes the connections to all additional ssh servers.
+func (t *Tunnel) closeHops() {
+	t.hopsMu.Lock()
+	defer t.hopsMu.Unlock()
+
+	for server, h := range t.hops {
+		h.client.Close()
+		delete(t.hops, server)
+	}
+}
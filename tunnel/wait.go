@@ -0,0 +1,107 @@
+package tunnel
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// waitForRemoteInterval is the time waited between attempts to reach the
+// destination of a channel (see WaitForRemote).
+const waitForRemoteInterval = 1 * time.Second
+
+// waitForDestinations polls the destination of every channel, through the ssh
+// server for local tunnels, until a connection to each one of them succeeds,
+// giving up once the given timeout is over. Dynamic channels have no
+// destination of their own to poll.
+func (t *Tunnel) waitForDestinations(timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+
+	for _, ch := range t.channelList() {
+		if ch.ChannelType == "dynamic" {
+			continue
+		}
+
+		destination := t.aliasedAddress(ch.Destination)
+
+		for {
+			conn, err := t.probeDestination(ch, destination)
+			if err == nil {
+				conn.Close()
+
+				log.WithFields(log.Fields{
+					"channel": ch,
+				}).Debug("channel destination is reachable")
+
+				break
+			}
+
+			if time.Now().Add(waitForRemoteInterval).After(deadline) {
+				return fmt.Errorf("destination %s not reachable after %s: %v", ch.Destination, timeout, err)
+			}
+
+			log.WithError(err).WithFields(log.Fields{
+				"channel": ch,
+			}).Debug("waiting for channel destination to be reachable")
+
+			time.Sleep(waitForRemoteInterval)
+		}
+	}
+
+	return nil
+}
+
+// CheckDestinations tries, once, to open a connection to the destination of
+// every channel the same way the channel does, returning an error listing
+// the destinations that couldn't be reached. Stdio, tun and dynamic channels
+// are not checked.
+func (t *Tunnel) CheckDestinations() error {
+	var unreachable []string
+
+	for _, ch := range t.channelList() {
+		if ch.ChannelType == "stdio" || ch.ChannelType == "tun" || ch.ChannelType == "dynamic" {
+			continue
+		}
+
+		conn, err := t.probeDestination(ch, t.aliasedAddress(ch.Destination))
+		if err != nil {
+			log.WithError(err).WithFields(log.Fields{
+				"channel": ch,
+			}).Error("channel destination is not reachable")
+
+			unreachable = append(unreachable, ch.Destination)
+			continue
+		}
+
+		conn.Close()
+
+		log.WithFields(log.Fields{
+			"channel": ch,
+		}).Info("channel destination is reachable")
+	}
+
+	if len(unreachable) > 0 {
+		return fmt.Errorf("destinations not reachable: %s", strings.Join(unreachable, ", "))
+	}
+
+	return nil
+}
+
+// probeDestination opens a connection to the destination of the given channel
+// the same way the channel does, without going through its prewarmed
+// connections.
+func (t *Tunnel) probeDestination(channel *SSHChannel, destination string) (net.Conn, error) {
+	if t.Type == "remote" {
+		return net.DialTimeout(addressNetwork(destination), destination, t.DialTimeout)
+	}
+
+	client := t.sshClient()
+	if client == nil {
+		return nil, fmt.Errorf("missing connection to the ssh server")
+	}
+
+	return t.dialThrough(channel, client, destination)
+}